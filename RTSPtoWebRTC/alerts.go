@@ -0,0 +1,852 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// AlertRuleOffline fires when a running stream received no packet for
+	// Threshold seconds
+	AlertRuleOffline = "stream_offline"
+	// AlertRuleNoKeyframe fires when a running stream received no video
+	// keyframe for Threshold seconds, the condition RTSPWorker exits on with
+	// ErrorStreamExitNoVideoOnStream
+	AlertRuleNoKeyframe = "no_keyframe"
+	// AlertRuleReconnects fires on more than Threshold reconnects within
+	// Window seconds
+	AlertRuleReconnects = "reconnects"
+	// AlertRuleStorage fires when recordings use more than Threshold percent
+	// of the quota, 0 uses record_warn_percent
+	AlertRuleStorage = "storage"
+
+	AlertStatusActive       = "active"
+	AlertStatusAcknowledged = "acknowledged"
+	AlertStatusResolved     = "resolved"
+
+	// alertSystemActor resolves alerts whose condition cleared
+	alertSystemActor = "system"
+	// EventAlert is the event type added for every fired alert
+	EventAlert = "alert"
+
+	alertsEvaluateEvery = 5 * time.Second
+	alertsPageSize      = 100
+	alertsMaxPageSize   = 1000
+)
+
+var (
+	ErrorAlertNotFound     = errors.New("alert not found")
+	ErrorAlertResolved     = errors.New("alert already resolved")
+	ErrorAlertNoTitle      = errors.New("alert title is required")
+	ErrorAlertRuleNotFound = errors.New("alert rule not found")
+	ErrorAlertRuleBadType  = errors.New("alert rule type must be stream_offline, no_keyframe, reconnects or storage")
+	ErrorAlertRuleBadValue = errors.New("alert rule threshold and window must not be negative")
+)
+
+var alertsBucket = []byte("alerts")
+
+// Alerts global
+var Alerts = newAlerts()
+
+// AlertsST evaluates the rules and keeps the fired alerts in the events
+// database. Alerts fire when a condition becomes true and resolve on their
+// own when it clears; one resolved by hand fires again only after the
+// condition cleared in between.
+type AlertsST struct {
+	mutex      sync.Mutex
+	conditions map[string]bool
+	running    map[string]time.Time
+	reconnects map[string][]alertSampleST
+	// open indexes the ids of unresolved rule alerts by alertKey, so a
+	// clearing condition does not scan every stored alert
+	open map[string][]string
+}
+
+func newAlerts() *AlertsST {
+	return &AlertsST{
+		conditions: make(map[string]bool),
+		running:    make(map[string]time.Time),
+		reconnects: make(map[string][]alertSampleST),
+		open:       make(map[string][]string),
+	}
+}
+
+type alertSampleST struct {
+	at    time.Time
+	count uint64
+}
+
+// AlertRuleST is one configured rule. An empty Stream applies it to every
+// stream; storage rules ignore Stream.
+type AlertRuleST struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Stream    string `json:"stream,omitempty"`
+	Priority  string `json:"priority"`
+	Threshold int    `json:"threshold"`
+	Window    int    `json:"window,omitempty"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// AlertST is one firing of a rule, or an alert created by hand
+type AlertST struct {
+	ID           string     `json:"id"`
+	Rule         string     `json:"rule,omitempty"`
+	Stream       string     `json:"stream,omitempty"`
+	StreamName   string     `json:"stream_name,omitempty"`
+	Title        string     `json:"title"`
+	Description  string     `json:"description"`
+	Priority     string     `json:"priority"`
+	Status       string     `json:"status"`
+	Fired        time.Time  `json:"fired"`
+	Acknowledged *time.Time `json:"acknowledged,omitempty"`
+	AckBy        string     `json:"ack_by,omitempty"`
+	Resolved     *time.Time `json:"resolved,omitempty"`
+	ResolvedBy   string     `json:"resolved_by,omitempty"`
+}
+
+func (element AlertRuleST) Validate() error {
+	switch element.Type {
+	case AlertRuleOffline, AlertRuleNoKeyframe, AlertRuleReconnects, AlertRuleStorage:
+	default:
+		return ErrorAlertRuleBadType
+	}
+	if !validEventPriority(element.Priority) {
+		return ErrorEventBadPriority
+	}
+	if element.Threshold < 0 || element.Window < 0 {
+		return ErrorAlertRuleBadValue
+	}
+	return nil
+}
+
+// ThresholdOrDefault fills in the defaults of each rule type
+func (element AlertRuleST) ThresholdOrDefault() int {
+	if element.Threshold > 0 {
+		return element.Threshold
+	}
+	switch element.Type {
+	case AlertRuleOffline:
+		return 60
+	case AlertRuleNoKeyframe:
+		return 20
+	case AlertRuleReconnects:
+		return 5
+	case AlertRuleStorage:
+		return Config.GetRecordWarnPercent()
+	}
+	return 0
+}
+
+func (element AlertRuleST) WindowOrDefault() time.Duration {
+	if element.Window > 0 {
+		return time.Duration(element.Window) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+func (element *ConfigST) GetAlertRules() []AlertRuleST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return append([]AlertRuleST(nil), element.AlertRules...)
+}
+
+// alertStreamST is what the rules look at for one stream
+type alertStreamST struct {
+	uuid    string
+	name    string
+	running bool
+	stats   HubStatsST
+}
+
+func (element *ConfigST) alertStreams() []alertStreamST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	res := make([]alertStreamST, 0, len(element.Streams))
+	for uuid, stream := range element.Streams {
+		// A suspended stream still should be running, its offline alert
+		// holds until it is retried
+		tmp := alertStreamST{uuid: uuid, name: stream.Name, running: stream.RunLock || stream.retry.Suspended}
+		if stream.hub != nil {
+			tmp.stats = stream.hub.Stats()
+		}
+		res = append(res, tmp)
+	}
+	return res
+}
+
+func serveAlerts() {
+	if err := Alerts.restore(); err != nil {
+		log.Println("Alerts restore error", err)
+	}
+	for {
+		Alerts.evaluate(time.Now())
+		time.Sleep(alertsEvaluateEvery)
+	}
+}
+
+// restore marks the conditions of alerts still open from the last run as
+// holding, so they are not fired twice and resolve once the condition clears
+func (element *AlertsST) restore() error {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return Events.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(alertsBucket).ForEach(func(key, data []byte) error {
+			var alert AlertST
+			if err := json.Unmarshal(data, &alert); err == nil && alert.Rule != "" && alert.Status != AlertStatusResolved {
+				element.conditions[alertKey(alert)] = true
+				element.open[alertKey(alert)] = append(element.open[alertKey(alert)], alert.ID)
+			}
+			return nil
+		})
+	})
+}
+
+// closed drops a resolved alert from the open index
+func (element *AlertsST) closed(alert AlertST) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	key := alertKey(alert)
+	ids := element.open[key]
+	for i, id := range ids {
+		if id == alert.ID {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(element.open, key)
+	} else {
+		element.open[key] = ids
+	}
+}
+
+// evaluate checks every enabled rule once
+func (element *AlertsST) evaluate(now time.Time) {
+	rules := Config.GetAlertRules()
+	streams := Config.alertStreams()
+	reconnects := make(map[string]uint64)
+	Metrics.mutex.Lock()
+	for uuid, tmp := range Metrics.streams {
+		reconnects[uuid] = tmp.Reconnects
+	}
+	Metrics.mutex.Unlock()
+
+	element.mutex.Lock()
+	seen := make(map[string]bool)
+	for _, stream := range streams {
+		seen[stream.uuid] = true
+		if !stream.running {
+			delete(element.running, stream.uuid)
+		} else if _, ok := element.running[stream.uuid]; !ok {
+			element.running[stream.uuid] = now
+		}
+		samples := append(element.reconnects[stream.uuid], alertSampleST{at: now, count: reconnects[stream.uuid]})
+		// Keep an hour of samples, enough for any sensible window
+		for len(samples) > 1 && now.Sub(samples[0].at) > time.Hour {
+			samples = samples[1:]
+		}
+		element.reconnects[stream.uuid] = samples
+	}
+	for uuid := range element.reconnects {
+		if !seen[uuid] {
+			delete(element.reconnects, uuid)
+			delete(element.running, uuid)
+		}
+	}
+	type firingST struct {
+		rule   AlertRuleST
+		stream alertStreamST
+		title  string
+		detail string
+	}
+	var fire []firingST
+	var clear []string
+	active := make(map[string]bool)
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		if rule.Type == AlertRuleStorage {
+			key := rule.ID
+			title, detail, ok := element.checkStorage(rule)
+			active[key] = true
+			if ok && !element.conditions[key] {
+				fire = append(fire, firingST{rule: rule, title: title, detail: detail})
+			} else if !ok && element.conditions[key] {
+				clear = append(clear, key)
+			}
+			element.conditions[key] = ok
+			continue
+		}
+		for _, stream := range streams {
+			if rule.Stream != "" && rule.Stream != stream.uuid {
+				continue
+			}
+			key := rule.ID + "/" + stream.uuid
+			title, detail, ok := element.checkStream(rule, stream, now)
+			active[key] = true
+			if ok && !element.conditions[key] {
+				fire = append(fire, firingST{rule: rule, stream: stream, title: title, detail: detail})
+			} else if !ok && element.conditions[key] {
+				clear = append(clear, key)
+			}
+			element.conditions[key] = ok
+		}
+	}
+	// Rules or streams that went away clear their alerts
+	for key, ok := range element.conditions {
+		if !active[key] {
+			if ok {
+				clear = append(clear, key)
+			}
+			delete(element.conditions, key)
+		}
+	}
+	element.mutex.Unlock()
+
+	for _, firing := range fire {
+		if firing.rule.Name != "" {
+			firing.title = firing.rule.Name
+		}
+		alert, err := element.Add(AlertST{
+			Rule:        firing.rule.ID,
+			Stream:      firing.stream.uuid,
+			StreamName:  firing.stream.name,
+			Title:       firing.title,
+			Description: firing.detail,
+			Priority:    firing.rule.Priority,
+		})
+		if err != nil {
+			log.Println("Alerts add error", err)
+			continue
+		}
+		log.Println("Alert fired", alert.ID, alert.Title, alert.Stream)
+		Events.stream(alert.Stream, EventAlert, alert.Priority, alert.Title, alert.Description)
+	}
+	for _, key := range clear {
+		if err := element.resolveCondition(key, now); err != nil {
+			log.Println("Alerts resolve error", err)
+		}
+	}
+}
+
+// checkStream reports whether a stream rule holds; the caller holds the mutex
+func (element *AlertsST) checkStream(rule AlertRuleST, stream alertStreamST, now time.Time) (string, string, bool) {
+	threshold := rule.ThresholdOrDefault()
+	label := stream.name
+	if label == "" {
+		label = stream.uuid
+	}
+	switch rule.Type {
+	case AlertRuleOffline:
+		started, ok := element.running[stream.uuid]
+		if !ok {
+			return "", "", false
+		}
+		since := stream.stats.LastPacket
+		if since.Before(started) {
+			since = started
+		}
+		if now.Sub(since) <= time.Duration(threshold)*time.Second {
+			return "", "", false
+		}
+		return "Camera offline", fmt.Sprintf("%s received no packets for more than %ds", label, threshold), true
+	case AlertRuleNoKeyframe:
+		started, ok := element.running[stream.uuid]
+		if !ok {
+			return "", "", false
+		}
+		since := stream.stats.LastKeyframe
+		if since.Before(started) {
+			since = started
+		}
+		if now.Sub(since) <= time.Duration(threshold)*time.Second {
+			return "", "", false
+		}
+		return "No video keyframe", fmt.Sprintf("%s received no video keyframe for more than %ds", label, threshold), true
+	case AlertRuleReconnects:
+		samples := element.reconnects[stream.uuid]
+		if len(samples) == 0 {
+			return "", "", false
+		}
+		last := samples[len(samples)-1]
+		base := last
+		window := rule.WindowOrDefault()
+		for _, sample := range samples {
+			if now.Sub(sample.at) <= window {
+				base = sample
+				break
+			}
+		}
+		count := last.count - base.count
+		if count <= uint64(threshold) {
+			return "", "", false
+		}
+		return "Frequent reconnects", fmt.Sprintf("%s reconnected %d times in %s", label, count, window), true
+	}
+	return "", "", false
+}
+
+func (element *AlertsST) checkStorage(rule AlertRuleST) (string, string, bool) {
+	threshold := rule.ThresholdOrDefault()
+	Storage.mutex.RLock()
+	defer Storage.mutex.RUnlock()
+	if Storage.QuotaBytes <= 0 || Storage.UsedPercent < float64(threshold) {
+		return "", "", false
+	}
+	return "Storage above threshold", fmt.Sprintf("Recordings use %.1f%% of the %d MB quota (threshold %d%%)", Storage.UsedPercent, Storage.QuotaBytes/bytesPerMB, threshold), true
+}
+
+func alertKey(alert AlertST) string {
+	if alert.Stream == "" {
+		return alert.Rule
+	}
+	return alert.Rule + "/" + alert.Stream
+}
+
+func (element *AlertsST) Add(alert AlertST) (AlertST, error) {
+	alert.Status = AlertStatusActive
+	alert.Fired = time.Now().UTC()
+	if alert.Priority == "" {
+		alert.Priority = EventPriorityMedium
+	}
+	err := Events.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(alertsBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		alert.ID = strconv.FormatUint(id, 10)
+		data, err := json.Marshal(alert)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(eventKey(id), data)
+	})
+	if err == nil {
+		if alert.Rule != "" {
+			element.mutex.Lock()
+			element.open[alertKey(alert)] = append(element.open[alertKey(alert)], alert.ID)
+			element.mutex.Unlock()
+		}
+		Push.Publish(PushMessageST{Type: PushAlert, Stream: alert.Stream, Time: alert.Fired, Data: alert})
+		Webhooks.Notify(WebhookAlertFired, alert.Stream, alert)
+	}
+	return alert, err
+}
+
+func (element *AlertsST) Get(id string) (AlertST, error) {
+	var alert AlertST
+	key, ok := eventKeyFromID(id)
+	if !ok {
+		return alert, ErrorAlertNotFound
+	}
+	err := Events.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(alertsBucket).Get(key)
+		if data == nil {
+			return ErrorAlertNotFound
+		}
+		return json.Unmarshal(data, &alert)
+	})
+	return alert, err
+}
+
+// List returns a page of alerts newest first and the total number of matches
+func (element *AlertsST) List(match func(AlertST) bool, limit, offset int) ([]AlertST, int, error) {
+	res := make([]AlertST, 0, limit)
+	total := 0
+	err := Events.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(alertsBucket).Cursor()
+		for key, data := cursor.Last(); key != nil; key, data = cursor.Prev() {
+			var alert AlertST
+			if err := json.Unmarshal(data, &alert); err != nil || !match(alert) {
+				continue
+			}
+			if total >= offset && len(res) < limit {
+				res = append(res, alert)
+			}
+			total++
+		}
+		return nil
+	})
+	return res, total, err
+}
+
+// update applies fn to the stored alerts of ids it selects
+func (element *AlertsST) update(ids []string, fn func(*AlertST) bool) ([]AlertST, error) {
+	var res []AlertST
+	err := Events.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(alertsBucket)
+		for _, id := range ids {
+			key, ok := eventKeyFromID(id)
+			if !ok {
+				continue
+			}
+			data := bucket.Get(key)
+			if data == nil {
+				continue
+			}
+			var alert AlertST
+			if err := json.Unmarshal(data, &alert); err != nil || !fn(&alert) {
+				continue
+			}
+			data, err := json.Marshal(alert)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(key, data); err != nil {
+				return err
+			}
+			res = append(res, alert)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// resolveCondition resolves the open alerts of a rule and stream
+func (element *AlertsST) resolveCondition(key string, now time.Time) error {
+	element.mutex.Lock()
+	ids := element.open[key]
+	delete(element.open, key)
+	element.mutex.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	resolved, err := element.update(ids, func(alert *AlertST) bool {
+		if alert.Status == AlertStatusResolved {
+			return false
+		}
+		alert.Status = AlertStatusResolved
+		resolved := now.UTC()
+		alert.Resolved = &resolved
+		alert.ResolvedBy = alertSystemActor
+		return true
+	})
+	for _, alert := range resolved {
+		log.Println("Alert resolved", alert.ID, alert.Title, alert.Stream)
+		Push.Publish(PushMessageST{Type: PushAlertUpdate, Stream: alert.Stream, Data: alert})
+		Webhooks.Notify(WebhookAlertResolved, alert.Stream, alert)
+	}
+	return err
+}
+
+// setStatus acknowledges or resolves one alert on behalf of a user
+func (element *AlertsST) setStatus(id, status, actor string) (AlertST, error) {
+	key, ok := eventKeyFromID(id)
+	if !ok {
+		return AlertST{}, ErrorAlertNotFound
+	}
+	var alert AlertST
+	err := Events.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(alertsBucket)
+		data := bucket.Get(key)
+		if data == nil {
+			return ErrorAlertNotFound
+		}
+		if err := json.Unmarshal(data, &alert); err != nil {
+			return err
+		}
+		if alert.Status == AlertStatusResolved {
+			return ErrorAlertResolved
+		}
+		now := time.Now().UTC()
+		alert.Status = status
+		if status == AlertStatusAcknowledged {
+			alert.Acknowledged, alert.AckBy = &now, actor
+		} else {
+			alert.Resolved, alert.ResolvedBy = &now, actor
+		}
+		data, err := json.Marshal(alert)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	if err == nil {
+		Push.Publish(PushMessageST{Type: PushAlertUpdate, Stream: alert.Stream, Data: alert})
+		if status == AlertStatusResolved {
+			if alert.Rule != "" {
+				element.closed(alert)
+			}
+			Webhooks.Notify(WebhookAlertResolved, alert.Stream, alert)
+		}
+	}
+	return alert, err
+}
+
+// prune deletes the alerts resolved before maxAge, open ones are kept
+// however old they are
+func (element *AlertsST) prune(maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	err := Events.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(alertsBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(key, data []byte) error {
+			var alert AlertST
+			if err := json.Unmarshal(data, &alert); err == nil && alert.Resolved != nil && alert.Resolved.Before(cutoff) {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Deleting while iterating would skip keys
+		for _, key := range expired {
+			if err = bucket.Delete(key); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func alertError(c *gin.Context, err error) {
+	switch err {
+	case ErrorAlertNotFound, ErrorAlertRuleNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case ErrorAlertResolved:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case ErrorAlertNoTitle, ErrorAlertRuleBadType, ErrorAlertRuleBadValue, ErrorEventBadPriority:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Println("Alerts error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Alerts database error"})
+	}
+}
+
+// alertVisible follows eventVisible, system alerts are for operators
+func alertVisible(user UserST, alert AlertST) bool {
+	return eventVisible(user, EventST{Stream: alert.Stream})
+}
+
+// HTTPAPIServerAlerts filters by status, stream and priority and pages
+// newest first with limit and offset
+func HTTPAPIServerAlerts(c *gin.Context) {
+	user := currentUser(c)
+	status, stream, priority := c.Query("status"), c.Query("stream"), c.Query("priority")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(alertsPageSize)))
+	if err != nil || limit <= 0 || limit > alertsMaxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(alertsMaxPageSize)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+		return
+	}
+	alerts, total, err := Alerts.List(func(alert AlertST) bool {
+		// "open" selects active and acknowledged alerts
+		if status == "open" && alert.Status == AlertStatusResolved {
+			return false
+		} else if status != "" && status != "open" && alert.Status != status {
+			return false
+		}
+		return (stream == "" || alert.Stream == stream) &&
+			(priority == "" || alert.Priority == priority) &&
+			alertVisible(user, alert)
+	}, limit, offset)
+	if err != nil {
+		alertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+		"alerts": alerts,
+	})
+}
+
+func HTTPAPIServerAlert(c *gin.Context) {
+	alert, err := Alerts.Get(c.Param("id"))
+	if err == nil && !alertVisible(currentUser(c), alert) {
+		err = ErrorAlertNotFound
+	}
+	if err != nil {
+		alertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, alert)
+}
+
+// HTTPAPIAddAlert raises an alert by hand, as the CreateAlertModal does
+func HTTPAPIAddAlert(c *gin.Context) {
+	var request struct {
+		Stream      string `json:"stream"`
+		StreamName  string `json:"stream_name"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Priority    string `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if request.Title == "" {
+		alertError(c, ErrorAlertNoTitle)
+		return
+	}
+	if request.Priority != "" && !validEventPriority(request.Priority) {
+		alertError(c, ErrorEventBadPriority)
+		return
+	}
+	if request.Stream != "" && !canStream(c, request.Stream, RoleOperator) {
+		return
+	}
+	if request.Stream != "" {
+		Config.mutex.RLock()
+		stream, ok := Config.Streams[request.Stream]
+		Config.mutex.RUnlock()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+			return
+		}
+		request.StreamName = stream.Name
+	}
+	alert, err := Alerts.Add(AlertST{
+		Stream:      request.Stream,
+		StreamName:  request.StreamName,
+		Title:       request.Title,
+		Description: request.Description,
+		Priority:    request.Priority,
+	})
+	if err != nil {
+		alertError(c, err)
+		return
+	}
+	log.Println("User", c.GetString(authUserKey), "raised alert", alert.ID, alert.Title)
+	auditRequest(c, AuditAlertAdd, alert.ID, alert.Title, nil)
+	c.JSON(http.StatusCreated, alert)
+}
+
+func httpAPIAlertStatus(c *gin.Context, status, action string) {
+	alert, err := Alerts.Get(c.Param("id"))
+	if err == nil && !alertVisible(currentUser(c), alert) {
+		err = ErrorAlertNotFound
+	}
+	if err == nil {
+		alert, err = Alerts.setStatus(alert.ID, status, c.GetString(authUserKey))
+	}
+	if err != nil {
+		alertError(c, err)
+		return
+	}
+	log.Println("User", c.GetString(authUserKey), "set alert", alert.ID, "to", status)
+	auditRequest(c, action, alert.ID, alert.Title, nil)
+	c.JSON(http.StatusOK, alert)
+}
+
+func HTTPAPIAcknowledgeAlert(c *gin.Context) {
+	httpAPIAlertStatus(c, AlertStatusAcknowledged, AuditAlertAcknowledge)
+}
+
+func HTTPAPIResolveAlert(c *gin.Context) {
+	httpAPIAlertStatus(c, AlertStatusResolved, AuditAlertResolve)
+}
+
+func HTTPAPIServerAlertRules(c *gin.Context) {
+	rules := Config.GetAlertRules()
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ID < rules[j].ID
+	})
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// alertRuleRequest binds and validates a rule body, answering the request
+// itself on error
+func alertRuleRequest(c *gin.Context) (AlertRuleST, bool) {
+	var rule AlertRuleST
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return rule, false
+	}
+	if err := rule.Validate(); err != nil {
+		alertError(c, err)
+		return rule, false
+	}
+	return rule, true
+}
+
+func HTTPAPIAddAlertRule(c *gin.Context) {
+	rule, ok := alertRuleRequest(c)
+	if !ok {
+		return
+	}
+	rule.ID = pseudoUUID()
+	var audit AuditPendingST
+	defer audit.Flush()
+	Config.mutex.Lock()
+	defer Config.mutex.Unlock()
+	Config.AlertRules = append(Config.AlertRules, rule)
+	if err := saveConfig(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save config"})
+		return
+	}
+	audit.Set(c, AuditAlertRuleAdd, rule.ID, "", auditDiff(nil, rule))
+	c.JSON(http.StatusCreated, rule)
+}
+
+func HTTPAPIUpdateAlertRule(c *gin.Context) {
+	rule, ok := alertRuleRequest(c)
+	if !ok {
+		return
+	}
+	rule.ID = c.Param("id")
+	var audit AuditPendingST
+	defer audit.Flush()
+	Config.mutex.Lock()
+	defer Config.mutex.Unlock()
+	for i, before := range Config.AlertRules {
+		if before.ID != rule.ID {
+			continue
+		}
+		Config.AlertRules[i] = rule
+		if err := saveConfig(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save config"})
+			return
+		}
+		audit.Set(c, AuditAlertRuleUpdate, rule.ID, "", auditDiff(before, rule))
+		c.JSON(http.StatusOK, rule)
+		return
+	}
+	alertError(c, ErrorAlertRuleNotFound)
+}
+
+func HTTPAPIDeleteAlertRule(c *gin.Context) {
+	id := c.Param("id")
+	var audit AuditPendingST
+	defer audit.Flush()
+	Config.mutex.Lock()
+	defer Config.mutex.Unlock()
+	for i, before := range Config.AlertRules {
+		if before.ID != id {
+			continue
+		}
+		Config.AlertRules = append(Config.AlertRules[:i:i], Config.AlertRules[i+1:]...)
+		if err := saveConfig(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save config"})
+			return
+		}
+		audit.Set(c, AuditAlertRuleDelete, id, "", auditDiff(before, nil))
+		c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted successfully"})
+		return
+	}
+	alertError(c, ErrorAlertRuleNotFound)
+}
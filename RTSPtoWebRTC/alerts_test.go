@@ -0,0 +1,170 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testAlerts lists the stored alerts of a state, all of them for ""
+func testAlerts(t *testing.T, alerts *AlertsST, status string) []AlertST {
+	t.Helper()
+	list, _, err := alerts.List(func(alert AlertST) bool { return status == "" || alert.Status == status }, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func testRunning(cfg *ConfigST, uuid string, running bool) {
+	cfg.mutex.Lock()
+	defer cfg.mutex.Unlock()
+	stream := cfg.Streams[uuid]
+	stream.RunLock = running
+	cfg.Streams[uuid] = stream
+}
+
+func TestAlertsLifecycle(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {Name: "Cam", RunLock: true}, "other": {}})
+	cfg.AlertRules = []AlertRuleST{{ID: "offline", Type: AlertRuleOffline, Stream: "cam", Priority: EventPriorityHigh, Threshold: 5, Enabled: true}}
+	testEvents(t)
+	alerts := newAlerts()
+	now := time.Now()
+
+	alerts.evaluate(now)
+	if n := len(testAlerts(t, alerts, "")); n != 0 {
+		t.Fatalf("%d alerts before the threshold", n)
+	}
+	alerts.evaluate(now.Add(10 * time.Second))
+	active := testAlerts(t, alerts, AlertStatusActive)
+	if len(active) != 1 || active[0].Rule != "offline" || active[0].Stream != "cam" || active[0].Priority != EventPriorityHigh {
+		t.Fatalf("fired %+v", active)
+	}
+	if events, _, _ := Events.Query(EventFilterST{Type: EventAlert}, 10, 0); len(events) != 1 {
+		t.Errorf("%d alert events, want 1", len(events))
+	}
+
+	// The condition still holding does not fire again
+	alerts.evaluate(now.Add(20 * time.Second))
+	alerts.evaluate(now.Add(30 * time.Second))
+	if n := len(testAlerts(t, alerts, "")); n != 1 {
+		t.Fatalf("%d alerts while the condition holds, want 1", n)
+	}
+
+	testRunning(cfg, "cam", false)
+	alerts.evaluate(now.Add(40 * time.Second))
+	resolved := testAlerts(t, alerts, AlertStatusResolved)
+	if len(resolved) != 1 || resolved[0].ID != active[0].ID || resolved[0].ResolvedBy != alertSystemActor || resolved[0].Resolved == nil {
+		t.Fatalf("resolved %+v", resolved)
+	}
+	if len(alerts.open) != 0 {
+		t.Errorf("open index %v after resolving", alerts.open)
+	}
+
+	testRunning(cfg, "cam", true)
+	alerts.evaluate(now.Add(50 * time.Second))
+	alerts.evaluate(now.Add(60 * time.Second))
+	active = testAlerts(t, alerts, AlertStatusActive)
+	if len(active) != 1 || active[0].ID == resolved[0].ID {
+		t.Fatalf("fired again %+v", active)
+	}
+	if ids := alerts.open["offline/cam"]; len(ids) != 1 || ids[0] != active[0].ID {
+		t.Errorf("open index %v, want [%s]", ids, active[0].ID)
+	}
+}
+
+// An alert resolved by hand stays resolved while the condition holds and
+// fires again once it cleared in between
+func TestAlertsResolvedByHand(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {RunLock: true}})
+	cfg.AlertRules = []AlertRuleST{{ID: "offline", Type: AlertRuleOffline, Threshold: 5, Enabled: true}}
+	testEvents(t)
+	alerts := newAlerts()
+	now := time.Now()
+	alerts.evaluate(now)
+	alerts.evaluate(now.Add(10 * time.Second))
+	active := testAlerts(t, alerts, AlertStatusActive)
+	if len(active) != 1 {
+		t.Fatalf("%d alerts fired", len(active))
+	}
+	if _, err := alerts.setStatus(active[0].ID, AlertStatusResolved, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts.open) != 0 {
+		t.Errorf("open index %v after resolving by hand", alerts.open)
+	}
+	alerts.evaluate(now.Add(20 * time.Second))
+	if n := len(testAlerts(t, alerts, AlertStatusActive)); n != 0 {
+		t.Fatalf("%d alerts fired while the condition held", n)
+	}
+
+	testRunning(cfg, "cam", false)
+	alerts.evaluate(now.Add(30 * time.Second))
+	if alert, _ := alerts.Get(active[0].ID); alert.ResolvedBy != "admin" {
+		t.Errorf("resolved by %q after the condition cleared", alert.ResolvedBy)
+	}
+	testRunning(cfg, "cam", true)
+	alerts.evaluate(now.Add(40 * time.Second))
+	alerts.evaluate(now.Add(50 * time.Second))
+	if n := len(testAlerts(t, alerts, AlertStatusActive)); n != 1 {
+		t.Errorf("%d alerts after the condition returned, want 1", n)
+	}
+}
+
+// Open alerts of an earlier run resolve from the index once their
+// condition clears
+func TestAlertsRestore(t *testing.T) {
+	testConfig(t, map[string]StreamST{"cam": {}})
+	testEvents(t)
+	before := newAlerts()
+	fired, err := before.Add(AlertST{Rule: "offline", Stream: "cam", Title: "Camera offline"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = before.Add(AlertST{Title: "By hand"}); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := newAlerts()
+	if err = alerts.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if !alerts.conditions["offline/cam"] || len(alerts.open) != 1 || len(alerts.open["offline/cam"]) != 1 {
+		t.Fatalf("restored conditions %v open %v", alerts.conditions, alerts.open)
+	}
+	// The rule is gone, so its condition clears on the next evaluation
+	alerts.evaluate(time.Now())
+	if alert, _ := alerts.Get(fired.ID); alert.Status != AlertStatusResolved {
+		t.Errorf("restored alert %s", alert.Status)
+	}
+	if n := len(testAlerts(t, alerts, AlertStatusActive)); n != 1 {
+		t.Errorf("%d active alerts, want the one added by hand", n)
+	}
+}
+
+func TestAlertsPrune(t *testing.T) {
+	testConfig(t, nil)
+	testEvents(t)
+	alerts := newAlerts()
+	var ids []string
+	for _, title := range []string{"old", "recent", "open"} {
+		alert, err := alerts.Add(AlertST{Rule: "rule", Stream: title, Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, alert.ID)
+	}
+	alerts.resolveCondition("rule/old", time.Now().Add(-2*time.Hour))
+	alerts.resolveCondition("rule/recent", time.Now())
+	removed, err := alerts.prune(time.Hour)
+	if err != nil || removed != 1 {
+		t.Fatalf("pruned %d %v, want 1", removed, err)
+	}
+	if _, err = alerts.Get(ids[0]); err != ErrorAlertNotFound {
+		t.Errorf("old resolved alert: %v", err)
+	}
+	for _, id := range ids[1:] {
+		if _, err = alerts.Get(id); err != nil {
+			t.Errorf("alert %s: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AuditStreamAdd        = "stream.add"
+	AuditStreamUpdate     = "stream.update"
+	AuditStreamDelete     = "stream.delete"
+	AuditStreamRecord     = "stream.record"
+	AuditStreamRetry      = "stream.retry"
+	AuditViewStart        = "stream.view.start"
+	AuditViewStop         = "stream.view.stop"
+	AuditPlayback         = "stream.playback"
+	AuditExportAdd        = "export.add"
+	AuditExportDelete     = "export.delete"
+	AuditEventUpdate      = "event.update"
+	AuditEventDelete      = "event.delete"
+	AuditAlertAdd         = "alert.add"
+	AuditAlertAcknowledge = "alert.acknowledge"
+	AuditAlertResolve     = "alert.resolve"
+	AuditAlertRuleAdd     = "alert_rule.add"
+	AuditAlertRuleUpdate  = "alert_rule.update"
+	AuditAlertRuleDelete  = "alert_rule.delete"
+	AuditTicketAdd        = "ticket.add"
+	AuditTicketUpdate     = "ticket.update"
+	AuditTicketDelete     = "ticket.delete"
+	AuditTicketAttach     = "ticket.attach"
+	AuditUserAdd          = "user.add"
+	AuditUserUpdate       = "user.update"
+	AuditUserDelete       = "user.delete"
+	AuditLogin            = "auth.login"
+	AuditLoginFailed      = "auth.login_failed"
+	AuditLogout           = "auth.logout"
+	AuditConfigReload     = "config.reload"
+	AuditPassword         = "auth.password"
+
+	// auditSystemActor is the actor of changes the server makes by itself
+	auditSystemActor = "system"
+
+	defaultAuditPath = "audit.jsonl"
+	auditPageSize    = 100
+	auditMaxPageSize = 1000
+	// auditLineMax bounds one entry when reading the log back
+	auditLineMax = 1 << 20
+)
+
+// Audit global
+var Audit = &AuditST{}
+
+// AuditST appends entries to a JSON lines file that is never rewritten.
+// Every entry carries the hash of the one before it, so removing or
+// editing a line breaks the chain.
+type AuditST struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	seq   uint64
+	last  string
+}
+
+// AuditEntryST is one audited action
+type AuditEntryST struct {
+	ID      uint64          `json:"id"`
+	Time    time.Time       `json:"time"`
+	Actor   string          `json:"actor"`
+	IP      string          `json:"ip,omitempty"`
+	Action  string          `json:"action"`
+	Target  string          `json:"target"`
+	Detail  string          `json:"detail,omitempty"`
+	Changes []AuditChangeST `json:"changes,omitempty"`
+	Prev    string          `json:"prev"`
+	Hash    string          `json:"hash"`
+}
+
+// AuditChangeST is one changed field, nested fields use dotted names
+type AuditChangeST struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+func (element *ConfigST) GetAuditPath() string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if element.Server.AuditPath == "" {
+		return defaultAuditPath
+	}
+	return element.Server.AuditPath
+}
+
+// loadAudit opens the audit log for appending and continues its sequence
+// and hash chain. It runs before the HTTP server.
+func loadAudit() {
+	Audit.mutex.Lock()
+	defer Audit.mutex.Unlock()
+	Audit.path = Config.GetAuditPath()
+	err := auditScan(Audit.path, func(entry AuditEntryST) {
+		Audit.seq = entry.ID
+		Audit.last = entry.Hash
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalln("Audit log", Audit.path, err)
+	}
+	Audit.file, err = os.OpenFile(Audit.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatalln("Audit log", Audit.path, err)
+	}
+}
+
+func auditScan(path string, fn func(AuditEntryST)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), auditLineMax)
+	for scanner.Scan() {
+		var entry AuditEntryST
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Println("Audit log skipping bad line", err)
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+func (element AuditEntryST) digest() string {
+	element.Hash = ""
+	data, _ := json.Marshal(element)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Add appends an entry. Failures are logged, an audit problem never fails
+// the request being audited.
+func (element *AuditST) Add(actor, ip, action, target, detail string, changes []AuditChangeST) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.file == nil {
+		return
+	}
+	element.seq++
+	entry := AuditEntryST{
+		ID:      element.seq,
+		Time:    time.Now().UTC(),
+		Actor:   actor,
+		IP:      ip,
+		Action:  action,
+		Target:  target,
+		Detail:  detail,
+		Changes: changes,
+		Prev:    element.last,
+	}
+	entry.Hash = entry.digest()
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = element.file.Write(append(data, '\n'))
+	}
+	if err == nil {
+		err = element.file.Sync()
+	}
+	if err != nil {
+		log.Println("Audit log write error", err, action, target)
+		return
+	}
+	element.last = entry.Hash
+}
+
+// auditRequest adds an entry for the user behind c
+func auditRequest(c *gin.Context, action, target, detail string, changes []AuditChangeST) {
+	Audit.Add(c.GetString(authUserKey), c.ClientIP(), action, target, detail, changes)
+}
+
+// AuditPendingST holds an entry built while Config.mutex is held. Handlers
+// defer Flush before taking the lock, so the append and its fsync run after
+// the unlock and never stall the streams.
+type AuditPendingST struct {
+	c       *gin.Context
+	action  string
+	target  string
+	detail  string
+	changes []AuditChangeST
+}
+
+func (element *AuditPendingST) Set(c *gin.Context, action, target, detail string, changes []AuditChangeST) {
+	*element = AuditPendingST{c: c, action: action, target: target, detail: detail, changes: changes}
+}
+
+// Flush adds the entry if one was set
+func (element *AuditPendingST) Flush() {
+	if element.c != nil {
+		auditRequest(element.c, element.action, element.target, element.detail, element.changes)
+	}
+}
+
+// auditDiff lists the fields that differ between two values of the same
+// JSON shape; nil stands for a missing value on add or delete. Fields in
+// ignore are runtime state, not configuration.
+func auditDiff(before, after interface{}, ignore ...string) []AuditChangeST {
+	var changes []AuditChangeST
+	auditDiffValue("", auditFlatten(before), auditFlatten(after), &changes)
+	skip := make(map[string]bool)
+	for _, field := range ignore {
+		skip[field] = true
+	}
+	res := changes[:0]
+	for _, change := range changes {
+		if !skip[change.Field] {
+			res = append(res, change)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Field < res[j].Field
+	})
+	return res
+}
+
+func auditFlatten(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var res interface{}
+	json.Unmarshal(data, &res)
+	return res
+}
+
+func auditDiffValue(field string, before, after interface{}, changes *[]AuditChangeST) {
+	beforeMap, beforeOK := before.(map[string]interface{})
+	afterMap, afterOK := after.(map[string]interface{})
+	if (beforeOK || before == nil) && (afterOK || after == nil) && (beforeOK || afterOK) {
+		keys := make(map[string]bool)
+		for key := range beforeMap {
+			keys[key] = true
+		}
+		for key := range afterMap {
+			keys[key] = true
+		}
+		for key := range keys {
+			name := key
+			if field != "" {
+				name = field + "." + key
+			}
+			auditDiffValue(name, beforeMap[key], afterMap[key], changes)
+		}
+		return
+	}
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, AuditChangeST{Field: field, Before: before, After: after})
+	}
+}
+
+// HTTPAPIServerAudit filters the log by actor, action, target and a
+// from/to time range (RFC3339 or unix seconds) and pages it newest first
+// with limit and offset.
+func HTTPAPIServerAudit(c *gin.Context) {
+	from, err := parsePlaybackTime(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := parsePlaybackTime(c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(auditPageSize)))
+	if err != nil || limit <= 0 || limit > auditMaxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(auditMaxPageSize)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+		return
+	}
+	actor, action, target := c.Query("actor"), c.Query("action"), c.Query("target")
+
+	var entries []AuditEntryST
+	err = auditScan(Audit.path, func(entry AuditEntryST) {
+		if (actor != "" && entry.Actor != actor) ||
+			(action != "" && entry.Action != action) ||
+			(target != "" && entry.Target != target) ||
+			(!from.IsZero() && entry.Time.Before(from)) ||
+			(!to.IsZero() && entry.Time.After(to)) {
+			return
+		}
+		entries = append(entries, entry)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Audit log read error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read audit log"})
+		return
+	}
+	total := len(entries)
+	page := make([]AuditEntryST, 0, limit)
+	for i := total - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, entries[i])
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"entries": page,
+	})
+}
+
+// HTTPAPIServerAuditVerify walks the hash chain and reports the first
+// entry that does not match
+func HTTPAPIServerAuditVerify(c *gin.Context) {
+	checked, broken, err := auditVerify(Audit.path)
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read audit log"})
+		return
+	}
+	if broken != nil {
+		c.JSON(http.StatusOK, gin.H{"valid": false, "checked": checked, "broken_id": broken.ID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"valid": true, "checked": checked})
+}
+
+// auditVerify walks the hash chain and returns the first entry that does
+// not match its own hash or the hash of the entry before it
+func auditVerify(path string) (checked uint64, broken *AuditEntryST, err error) {
+	var prev string
+	err = auditScan(path, func(entry AuditEntryST) {
+		if broken != nil {
+			return
+		}
+		if entry.Prev != prev || entry.digest() != entry.Hash {
+			broken = &entry
+			return
+		}
+		prev = entry.Hash
+		checked++
+	})
+	return checked, broken, err
+}
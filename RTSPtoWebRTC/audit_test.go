@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testAudit opens a scratch audit log for the duration of a test
+func testAudit(t *testing.T, cfg *ConfigST) string {
+	t.Helper()
+	cfg.Server.AuditPath = filepath.Join(t.TempDir(), "audit.jsonl")
+	loadAudit()
+	t.Cleanup(testAuditClose)
+	return cfg.Server.AuditPath
+}
+
+func testAuditClose() {
+	Audit.mutex.Lock()
+	defer Audit.mutex.Unlock()
+	if Audit.file != nil {
+		Audit.file.Close()
+	}
+	Audit.file, Audit.path, Audit.seq, Audit.last = nil, "", 0, ""
+}
+
+func TestAuditChain(t *testing.T) {
+	path := testAudit(t, testConfig(t, nil))
+	Audit.Add("alice", "10.0.0.1", AuditLogin, "alice", "", nil)
+	Audit.Add("alice", "10.0.0.1", AuditStreamUpdate, "cam", "", []AuditChangeST{{Field: "url", Before: "rtsp://a", After: "rtsp://b"}})
+	// A restart continues the sequence and the chain
+	testAuditClose()
+	loadAudit()
+	Audit.Add("alice", "10.0.0.1", AuditLogout, "alice", "", nil)
+
+	var ids []uint64
+	if err := auditScan(path, func(entry AuditEntryST) { ids = append(ids, entry.ID) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Errorf("entry ids %v, want 1 2 3", ids)
+	}
+	checked, broken, err := auditVerify(path)
+	if err != nil || broken != nil || checked != 3 {
+		t.Errorf("verify: checked %d, broken %+v, err %v", checked, broken, err)
+	}
+}
+
+func TestAuditDetectsTamper(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines [][]byte) [][]byte
+		broken uint64
+	}{
+		{"edited field", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`"actor":"bob"`), []byte(`"actor":"eve"`), 1)
+			return lines
+		}, 2},
+		{"edited and rehashed", func(lines [][]byte) [][]byte {
+			var entry AuditEntryST
+			json.Unmarshal(lines[1], &entry)
+			entry.Actor = "eve"
+			entry.Hash = entry.digest()
+			lines[1], _ = json.Marshal(entry)
+			return lines
+		}, 3},
+		{"removed line", func(lines [][]byte) [][]byte {
+			return append(lines[:1:1], lines[2:]...)
+		}, 3},
+		{"swapped lines", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 3},
+		{"garbled line", func(lines [][]byte) [][]byte {
+			lines[1] = lines[1][:len(lines[1])/2]
+			return lines
+		}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := testAudit(t, testConfig(t, nil))
+			for _, actor := range []string{"alice", "bob", "carol"} {
+				Audit.Add(actor, "", AuditLogin, actor, "", nil)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := test.tamper(bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")))
+			if err = os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, broken, err := auditVerify(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if broken == nil {
+				t.Fatal("tampered log verified")
+			}
+			if broken.ID != test.broken {
+				t.Errorf("broken at %d, want %d", broken.ID, test.broken)
+			}
+		})
+	}
+}
+
+// Appending and syncing the audit log must not block the streams, the
+// handlers add their entry once Config.mutex is released
+func TestAuditOutsideConfigLock(t *testing.T) {
+	router, tokens := testRBAC(t)
+	path := testAudit(t, Config)
+	Audit.mutex.Lock()
+	done := make(chan int)
+	go func() {
+		done <- testRequest(router, http.MethodDelete, "/api/stream/cam2", tokens["admin"]).Code
+	}()
+	removed := waitFor(t, 2*time.Second, func() bool {
+		if !Config.mutex.TryRLock() {
+			return false
+		}
+		defer Config.mutex.RUnlock()
+		_, ok := Config.Streams["cam2"]
+		return !ok
+	})
+	Audit.mutex.Unlock()
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("delete status %d", code)
+	}
+	if !removed {
+		t.Fatal("Config.mutex held while waiting for the audit log")
+	}
+	var actions []string
+	auditScan(path, func(entry AuditEntryST) { actions = append(actions, entry.Action+" "+entry.Actor+" "+entry.Target) })
+	if len(actions) != 1 || actions[0] != AuditStreamDelete+" admin cam2" {
+		t.Errorf("audited %v", actions)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultUsersPath = "users.json"
+	defaultAdminUser = "admin"
+
+	authAccessTTL  = time.Hour
+	authRefreshTTL = 7 * 24 * time.Hour
+	// mediaTokenTTL is how long a media token outlives the footage it was
+	// issued for, players buffer ahead and pause
+	mediaTokenTTL = 10 * time.Minute
+	// authUserKey and authAccountKey are the gin context keys holding the
+	// authenticated username and its UserST
+	authUserKey    = "user"
+	authAccountKey = "account"
+)
+
+var (
+	ErrorAuthBadCredentials = errors.New("invalid username or password")
+	ErrorAuthBadToken       = errors.New("invalid or expired token")
+	ErrorAuthWeakPassword   = errors.New("password must be at least 8 characters")
+)
+
+// authDummyHash is compared against when the user does not exist so a
+// failed login takes as long for unknown and known users
+var authDummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Users global
+var Users = &UsersST{}
+
+// Sessions global
+var Sessions = &SessionsST{
+	access:  make(map[string]*SessionST),
+	refresh: make(map[string]*SessionST),
+	media:   make(map[string]*MediaTokenST),
+}
+
+// UsersST is the user store, persisted as JSON next to config.json
+type UsersST struct {
+	mutex sync.RWMutex
+	path  string
+	Users map[string]UserST `json:"users"`
+}
+
+// UserST is one account, only the bcrypt hash of the password is stored.
+// Streams are the stream ids the user may see, "*" grants every stream;
+// admins see every stream regardless.
+type UserST struct {
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Role         string    `json:"role"`
+	Streams      []string  `json:"streams"`
+	Disabled     bool      `json:"disabled"`
+	PasswordHash string    `json:"password_hash"`
+	Created      time.Time `json:"created"`
+}
+
+// SessionsST keeps the issued tokens in memory, a restart logs everyone out
+type SessionsST struct {
+	mutex   sync.Mutex
+	access  map[string]*SessionST
+	refresh map[string]*SessionST
+	media   map[string]*MediaTokenST
+}
+
+// SessionST is one login. Access and refresh token are opaque random
+// strings; refreshing replaces both.
+type SessionST struct {
+	Username       string
+	AccessToken    string
+	RefreshToken   string
+	AccessExpires  time.Time
+	RefreshExpires time.Time
+}
+
+// MediaTokenST is handed out in playlist URLs instead of the session
+// token. It only opens the media of one stream and expires with it.
+type MediaTokenST struct {
+	Username string
+	Stream   string
+	Expires  time.Time
+}
+
+func (element *ConfigST) GetUsersPath() string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if element.Server.UsersPath == "" {
+		return defaultUsersPath
+	}
+	return element.Server.UsersPath
+}
+
+// loadUsers reads the user store. On first start it creates an admin
+// account with a random password that is logged once.
+func loadUsers() {
+	Users.mutex.Lock()
+	defer Users.mutex.Unlock()
+	Users.path = Config.GetUsersPath()
+	Users.Users = make(map[string]UserST)
+	data, err := os.ReadFile(Users.path)
+	if err == nil {
+		if err = json.Unmarshal(data, Users); err != nil {
+			log.Fatalln("Users file", Users.path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalln("Users file", Users.path, err)
+	}
+	for username, user := range Users.Users {
+		// Accounts from before roles existed had full access
+		if user.Role == "" {
+			user.Role = RoleAdmin
+			Users.Users[username] = user
+		}
+	}
+	if len(Users.Users) > 0 {
+		return
+	}
+	password := randomToken(9)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalln("Users create admin", err)
+	}
+	Users.Users[defaultAdminUser] = UserST{Role: RoleAdmin, PasswordHash: string(hash), Created: time.Now()}
+	if err = Users.save(); err != nil {
+		log.Fatalln("Users file", Users.path, err)
+	}
+	log.Println("Created user", defaultAdminUser, "with password", password, "- change it with POST /api/auth/password")
+}
+
+// save writes the user store, the caller holds the mutex
+func (element *UsersST) save() error {
+	data, err := json.MarshalIndent(element, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(element.path, data, 0600)
+}
+
+// check verifies a password against the stored bcrypt hash, disabled
+// accounts never pass
+func (element *UsersST) check(username, password string) bool {
+	element.mutex.RLock()
+	user, ok := element.Users[username]
+	element.mutex.RUnlock()
+	hash := authDummyHash
+	if ok {
+		hash = []byte(user.PasswordHash)
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	return ok && err == nil && !user.Disabled
+}
+
+func (element *UsersST) exists(username string) bool {
+	_, ok := element.get(username)
+	return ok
+}
+
+// get returns an enabled account
+func (element *UsersST) get(username string) (UserST, bool) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	user, ok := element.Users[username]
+	return user, ok && !user.Disabled
+}
+
+func (element *UsersST) setPassword(username, password string) error {
+	if len(password) < 8 {
+		return ErrorAuthWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	user, ok := element.Users[username]
+	if !ok {
+		return ErrorAuthBadCredentials
+	}
+	user.PasswordHash = string(hash)
+	element.Users[username] = user
+	return element.save()
+}
+
+func randomToken(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln("Error generating token:", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (element *SessionsST) create(username string) SessionST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.expire()
+	now := time.Now()
+	session := &SessionST{
+		Username:       username,
+		AccessToken:    randomToken(32),
+		RefreshToken:   randomToken(32),
+		AccessExpires:  now.Add(authAccessTTL),
+		RefreshExpires: now.Add(authRefreshTTL),
+	}
+	element.access[session.AccessToken] = session
+	element.refresh[session.RefreshToken] = session
+	return *session
+}
+
+// validate returns the username owning a live access token
+func (element *SessionsST) validate(token string) (string, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	session, ok := element.access[token]
+	if !ok || time.Now().After(session.AccessExpires) {
+		return "", false
+	}
+	return session.Username, true
+}
+
+// rotate trades a refresh token for a new session and revokes the old one
+func (element *SessionsST) rotate(refresh string) (SessionST, bool) {
+	element.mutex.Lock()
+	session, ok := element.refresh[refresh]
+	if ok {
+		element.revokeLocked(session)
+	}
+	element.mutex.Unlock()
+	if !ok || time.Now().After(session.RefreshExpires) || !Users.exists(session.Username) {
+		return SessionST{}, false
+	}
+	return element.create(session.Username), true
+}
+
+// revoke ends the session of an access token
+func (element *SessionsST) revoke(token string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if session, ok := element.access[token]; ok {
+		element.revokeLocked(session)
+	}
+}
+
+// revokeUser ends every session and media token of a user, used after a
+// password change
+func (element *SessionsST) revokeUser(username string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	for _, session := range element.refresh {
+		if session.Username == username {
+			element.revokeLocked(session)
+		}
+	}
+	for token, media := range element.media {
+		if media.Username == username {
+			delete(element.media, token)
+		}
+	}
+}
+
+// createMedia issues a media token for the given stream
+func (element *SessionsST) createMedia(username, stream string, ttl time.Duration) string {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.expire()
+	token := randomToken(32)
+	element.media[token] = &MediaTokenST{Username: username, Stream: stream, Expires: time.Now().Add(ttl)}
+	return token
+}
+
+// validateMedia returns the username owning a live media token of stream
+func (element *SessionsST) validateMedia(token, stream string) (string, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	media, ok := element.media[token]
+	if !ok || media.Stream != stream || time.Now().After(media.Expires) {
+		return "", false
+	}
+	return media.Username, true
+}
+
+func (element *SessionsST) revokeLocked(session *SessionST) {
+	delete(element.access, session.AccessToken)
+	delete(element.refresh, session.RefreshToken)
+}
+
+// expire drops sessions whose refresh token ran out and expired media
+// tokens, the caller holds the mutex
+func (element *SessionsST) expire() {
+	now := time.Now()
+	for _, session := range element.refresh {
+		if now.After(session.RefreshExpires) {
+			element.revokeLocked(session)
+		}
+	}
+	for token, media := range element.media {
+		if now.After(media.Expires) {
+			delete(element.media, token)
+		}
+	}
+}
+
+// requestToken takes the bearer token from the Authorization header, or
+// from the token query parameter for URLs a browser loads by itself
+// (HLS playlists, snapshots, downloads). The request log redacts it.
+func requestToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return c.Query("token")
+}
+
+// redactToken hides the token query parameter of a logged request URI. An
+// unparsable query is dropped, it could hold a token.
+func redactToken(uri string) string {
+	path, rawQuery, found := strings.Cut(uri, "?")
+	if !found {
+		return uri
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return path + "?[redacted]"
+	}
+	if !query.Has("token") {
+		return uri
+	}
+	query.Set("token", "[redacted]")
+	return path + "?" + query.Encode()
+}
+
+// AuthMiddleware rejects requests without a valid access token
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, ok := Sessions.validate(requestToken(c))
+		authenticate(c, username, ok)
+	}
+}
+
+// MediaAuthMiddleware also accepts a media token of the requested stream,
+// used for the segments listed in a playlist
+func MediaAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := requestToken(c)
+		username, ok := Sessions.validate(token)
+		if !ok {
+			username, ok = Sessions.validateMedia(token, c.Param("uuid"))
+		}
+		authenticate(c, username, ok)
+	}
+}
+
+// authenticate continues as username if the token was valid and the user
+// still exists
+func authenticate(c *gin.Context, username string, ok bool) {
+	var user UserST
+	if ok {
+		user, ok = Users.get(username)
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrorAuthBadToken.Error()})
+		return
+	}
+	c.Set(authUserKey, username)
+	c.Set(authAccountKey, user)
+	c.Next()
+}
+
+func sessionResponse(session SessionST) gin.H {
+	return gin.H{
+		"username":        session.Username,
+		"token":           session.AccessToken,
+		"expires":         session.AccessExpires,
+		"refresh_token":   session.RefreshToken,
+		"refresh_expires": session.RefreshExpires,
+	}
+}
+
+func HTTPAPIAuthLogin(c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !Users.check(request.Username, request.Password) {
+		log.Println("Failed login for user", request.Username, "from", c.ClientIP())
+		Audit.Add(request.Username, c.ClientIP(), AuditLoginFailed, request.Username, "", nil)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": ErrorAuthBadCredentials.Error()})
+		return
+	}
+	log.Println("User", request.Username, "logged in from", c.ClientIP())
+	Audit.Add(request.Username, c.ClientIP(), AuditLogin, request.Username, "", nil)
+	c.JSON(http.StatusOK, sessionResponse(Sessions.create(request.Username)))
+}
+
+func HTTPAPIAuthRefresh(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	session, ok := Sessions.rotate(request.RefreshToken)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": ErrorAuthBadToken.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sessionResponse(session))
+}
+
+func HTTPAPIAuthLogout(c *gin.Context) {
+	Sessions.revoke(requestToken(c))
+	auditRequest(c, AuditLogout, c.GetString(authUserKey), "", nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+func HTTPAPIAuthMe(c *gin.Context) {
+	user := currentUser(c)
+	c.JSON(http.StatusOK, gin.H{
+		"username": c.GetString(authUserKey),
+		"name":     user.Name,
+		"role":     user.Role,
+		"streams":  user.Streams,
+	})
+}
+
+// HTTPAPIAuthPassword changes the password of the logged in user and ends
+// all of their sessions, including the current one
+func HTTPAPIAuthPassword(c *gin.Context) {
+	var request struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	username := c.GetString(authUserKey)
+	if !Users.check(username, request.OldPassword) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": ErrorAuthBadCredentials.Error()})
+		return
+	}
+	if err := Users.setPassword(username, request.NewPassword); err == ErrorAuthWeakPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Println("Failed to save users file:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save password"})
+		return
+	}
+	Sessions.revokeUser(username)
+	log.Println("User", username, "changed password")
+	auditRequest(c, AuditPassword, username, "", nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed, log in again"})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testUsers replaces the user store for the duration of a test
+func testUsers(t testing.TB, users map[string]UserST) {
+	t.Helper()
+	Users.mutex.Lock()
+	old := Users.Users
+	Users.Users = users
+	Users.mutex.Unlock()
+	t.Cleanup(func() {
+		Users.mutex.Lock()
+		Users.Users = old
+		Users.mutex.Unlock()
+	})
+}
+
+func TestRedactToken(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/api/streams", "/api/streams"},
+		{"/api/streams?kind=live", "/api/streams?kind=live"},
+		{"/push?token=secret", "/push?token=%5Bredacted%5D"},
+		{"/api/playback/cam/segment/1_2.ts?start=1&token=secret", "/api/playback/cam/segment/1_2.ts?start=1&token=%5Bredacted%5D"},
+		{"/push?token=secret&token=other", "/push?token=%5Bredacted%5D"},
+		{"/push?token=sec%ret", "/push?[redacted]"},
+	}
+	for _, test := range tests {
+		if got := redactToken(test.uri); got != test.want {
+			t.Errorf("redactToken(%q) = %q, want %q", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestHTTPLogRedactsToken(t *testing.T) {
+	line := httpLogFormatter(gin.LogFormatterParams{
+		TimeStamp:  time.Now(),
+		StatusCode: http.StatusOK,
+		Method:     http.MethodGet,
+		Path:       "/api/stream/cam/snapshot?token=secret",
+	})
+	if strings.Contains(line, "secret") {
+		t.Errorf("token logged: %s", line)
+	}
+	if !strings.Contains(line, "/api/stream/cam/snapshot") {
+		t.Errorf("path missing: %s", line)
+	}
+}
+
+func TestMediaToken(t *testing.T) {
+	token := Sessions.createMedia("alice", "cam", time.Minute)
+	if username, ok := Sessions.validateMedia(token, "cam"); !ok || username != "alice" {
+		t.Fatalf("media token rejected for its stream: %q %v", username, ok)
+	}
+	if _, ok := Sessions.validateMedia(token, "other"); ok {
+		t.Error("media token accepted for another stream")
+	}
+	if _, ok := Sessions.validate(token); ok {
+		t.Error("media token accepted as a session token")
+	}
+	expired := Sessions.createMedia("alice", "cam", -time.Second)
+	if _, ok := Sessions.validateMedia(expired, "cam"); ok {
+		t.Error("expired media token accepted")
+	}
+	Sessions.revokeUser("alice")
+	if _, ok := Sessions.validateMedia(token, "cam"); ok {
+		t.Error("media token survived revoking its user")
+	}
+}
+
+func TestMediaAuthMiddleware(t *testing.T) {
+	testUsers(t, map[string]UserST{"alice": {Role: RoleViewer, Streams: []string{"cam", "other"}}})
+	router := gin.New()
+	router.GET("/media/:uuid", MediaAuthMiddleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(authUserKey))
+	})
+	media := Sessions.createMedia("alice", "cam", time.Minute)
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/media/cam?token=" + media, http.StatusOK},
+		{"/media/other?token=" + media, http.StatusUnauthorized},
+		{"/media/cam?token=wrong", http.StatusUnauthorized},
+		{"/media/cam", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if w.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.path, w.Code, test.want)
+		}
+	}
+}
+
+// The playlist must hand out a media token of the stream, never the
+// session token it was requested with
+func TestPlaybackPlaylistUsesMediaToken(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {}})
+	cfg.Server.RecordPath = t.TempDir()
+	dir := recordDir(cfg.Server.RecordPath, "cam")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1000_2000.ts"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const session = "session-token"
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/playback/cam?token="+session, nil)
+	c.Params = gin.Params{{Key: "uuid", Value: "cam"}}
+	c.Set(authUserKey, "alice")
+	HTTPAPIServerPlayback(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, session) {
+		t.Fatal("session token copied into the playlist")
+	}
+	var segment string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "/api/playback/cam/segment/1000_2000.ts?") {
+			segment = line
+		}
+	}
+	if segment == "" {
+		t.Fatalf("segment missing from playlist:\n%s", body)
+	}
+	link, err := url.Parse(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username, ok := Sessions.validateMedia(link.Query().Get("token"), "cam"); !ok || username != "alice" {
+		t.Errorf("segment token not a media token of cam: %q %v", username, ok)
+	}
+}
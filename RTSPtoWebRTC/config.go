@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"flag"
@@ -18,12 +19,16 @@ import (
 // Config global
 var Config = loadConfig()
 
+// workerStopTimeout bounds the wait for a cancelled worker, the RTSP dial
+// and read timeouts are shorter
+const workerStopTimeout = 10 * time.Second
+
 // ConfigST struct
 type ConfigST struct {
-	mutex     sync.RWMutex
-	Server    ServerST            `json:"server"`
-	Streams   map[string]StreamST `json:"streams"`
-	LastError error               `json:"-"`
+	mutex      sync.RWMutex
+	Server     ServerST            `json:"server"`
+	Streams    map[string]StreamST `json:"streams"`
+	AlertRules []AlertRuleST       `json:"alert_rules"`
 }
 
 // ServerST struct
@@ -34,43 +39,110 @@ type ServerST struct {
 	ICECredential string   `json:"ice_credential"`
 	WebRTCPortMin uint16   `json:"webrtc_port_min"`
 	WebRTCPortMax uint16   `json:"webrtc_port_max"`
+	RecordPath    string   `json:"record_path"`
+	// RecordQuotaMB caps the total size of all recordings, 0 disables it
+	RecordQuotaMB     int64 `json:"record_quota_mb"`
+	RecordWarnPercent int   `json:"record_warn_percent"`
+	// ExportPath keeps exported clips apart from the retention managed recordings
+	ExportPath string `json:"export_path"`
+	// ExportMaxAgeHours deletes finished exports, 0 keeps them 7 days
+	ExportMaxAgeHours int          `json:"export_max_age_hours"`
+	SlowViewer        SlowViewerST `json:"slow_viewer"`
+	UsersPath         string       `json:"users_path"`
+	AuditPath         string       `json:"audit_path"`
+	EventsPath        string       `json:"events_path"`
+	// EventsMaxAgeDays prunes older events, 0 keeps 30 days
+	EventsMaxAgeDays int `json:"events_max_age_days"`
+	// FFmpegPath decodes snapshots, empty looks ffmpeg up in PATH
+	FFmpegPath string      `json:"ffmpeg_path"`
+	Webhooks   []WebhookST `json:"webhooks"`
+	Reconnect  ReconnectST `json:"reconnect"`
+	Timeouts   TimeoutsST  `json:"timeouts"`
+	// RTMPPort accepts encoder publishes to ingest streams, empty disables it
+	RTMPPort string `json:"rtmp_port"`
 }
 
 // StreamST struct
 type StreamST struct {
-	Name         string            `json:"name"`
-	URL          string            `json:"url"`
-	Status       bool              `json:"status"`
-	OnDemand     bool              `json:"on_demand"`
-	DisableAudio bool              `json:"disable_audio"`
-	Debug        bool              `json:"debug"`
-	RunLock      bool              `json:"-"`
-	Codecs       []av.CodecData    `json:"-"`
-	Cl           map[string]viewer `json:"-"`
+	Name         string   `json:"name"`
+	URL          string   `json:"url"`
+	Status       bool     `json:"status"`
+	OnDemand     bool     `json:"on_demand"`
+	DisableAudio bool     `json:"disable_audio"`
+	Debug        bool     `json:"debug"`
+	Record       RecordST `json:"record"`
+	// Substream is the stream id of a lower bitrate profile of this camera
+	Substream  string        `json:"substream,omitempty"`
+	SlowViewer *SlowViewerST `json:"slow_viewer,omitempty"`
+	Reconnect  *ReconnectST  `json:"reconnect,omitempty"`
+	Timeouts   *TimeoutsST   `json:"timeouts,omitempty"`
+	// Transport is tcp, udp, multicast or http, empty is tcp
+	Transport string `json:"transport,omitempty"`
+	// Ingest rtmp streams have no URL, an encoder publishes them with PublishKey
+	Ingest     string         `json:"ingest,omitempty"`
+	PublishKey string         `json:"publish_key,omitempty"`
+	RunLock    bool           `json:"-"`
+	Codecs     []av.CodecData `json:"-"`
+	hub        *HubST
+	worker     *workerST
+	retry      RetryST
+}
+
+// workerST is one run of RTSPWorkerLoop. Cancelling ctx stops it, done is
+// closed once it has exited.
+type workerST struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// retry cuts a reconnect wait short
+	retry chan struct{}
+}
+
+func newWorker() *workerST {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workerST{ctx: ctx, cancel: cancel, done: make(chan struct{}), retry: make(chan struct{}, 1)}
 }
 
-type viewer struct {
-	c chan av.Packet
+// wake makes a worker waiting to reconnect try at once
+func (element *workerST) wake() {
+	select {
+	case element.retry <- struct{}{}:
+	default:
+	}
 }
 
 func (element *ConfigST) RunIFNotRun(uuid string) {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
 	if tmp, ok := element.Streams[uuid]; ok {
+		if tmp.retry.Suspended {
+			log.Println("Stream", uuid, "is suspended, not starting until retried")
+			return
+		}
+		if tmp.Ingest != "" {
+			log.Println("Stream", uuid, "waits for an", tmp.Ingest, "publisher")
+			return
+		}
 		if tmp.OnDemand && !tmp.RunLock {
 			tmp.RunLock = true
 			tmp.Status = false // Start as false, will be set to true when codecs are ready
 			tmp.Codecs = nil   // Clear old codecs to ensure fresh discovery
+			tmp.hub.Reset()
+			tmp.worker = newWorker()
 			element.Streams[uuid] = tmp
 			log.Println("Starting on-demand stream", uuid)
-			go RTSPWorkerLoop(uuid, tmp.URL, tmp.OnDemand, tmp.DisableAudio, tmp.Debug)
+			Push.streamStatus(uuid, false, true)
+			go RTSPWorkerLoop(tmp.worker, uuid, tmp.URL, tmp.OnDemand, tmp.DisableAudio, tmp.Debug)
 		} else if !tmp.OnDemand && !tmp.RunLock {
 			tmp.RunLock = true
 			tmp.Status = false // Start as false, will be set to true when codecs are ready
 			tmp.Codecs = nil   // Clear old codecs to ensure fresh discovery
+			tmp.hub.Reset()
+			tmp.worker = newWorker()
 			element.Streams[uuid] = tmp
 			log.Println("Starting non-on-demand stream", uuid)
-			go RTSPWorkerLoop(uuid, tmp.URL, tmp.OnDemand, tmp.DisableAudio, tmp.Debug)
+			Push.streamStatus(uuid, false, true)
+			go RTSPWorkerLoop(tmp.worker, uuid, tmp.URL, tmp.OnDemand, tmp.DisableAudio, tmp.Debug)
 		} else {
 			log.Println("Stream", uuid, "already running or conditions not met. RunLock:", tmp.RunLock, "OnDemand:", tmp.OnDemand)
 		}
@@ -79,95 +151,240 @@ func (element *ConfigST) RunIFNotRun(uuid string) {
 	}
 }
 
-func (element *ConfigST) RunUnlock(uuid string) {
+// RunUnlock is called by an exiting worker. A worker that was stopped and
+// replaced leaves the state of its successor alone.
+func (element *ConfigST) RunUnlock(uuid string, worker *workerST) {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
 	if tmp, ok := element.Streams[uuid]; ok {
+		if tmp.worker != worker {
+			log.Println("Stopped worker of stream", uuid, "exited")
+			return
+		}
+		tmp.worker = nil
 		tmp.RunLock = false
 		tmp.Status = false
 		tmp.Codecs = nil // Clear codecs when stream stops
+		tmp.hub.Reset()
 		element.Streams[uuid] = tmp
 		log.Println("Stopped stream", uuid, "and cleared codecs")
+		Push.streamStatus(uuid, false, false)
 	} else {
 		log.Println("Stream", uuid, "not found for unlocking")
 	}
 }
 
+// stopWorker cancels the worker of a stream and marks it stopped at once,
+// the caller holds the mutex. The returned worker, if any, is still
+// exiting until its done channel is closed.
+func (element *ConfigST) stopWorker(uuid string) *workerST {
+	tmp, ok := element.Streams[uuid]
+	if !ok || tmp.worker == nil {
+		return nil
+	}
+	worker := tmp.worker
+	worker.cancel()
+	tmp.worker = nil
+	tmp.RunLock = false
+	tmp.Status = false
+	tmp.Codecs = nil
+	element.Streams[uuid] = tmp
+	log.Println("Stopping worker of stream", uuid)
+	Push.streamStatus(uuid, false, false)
+	return worker
+}
+
+// removeStream stops the worker of a stream, disconnects its viewers and
+// forgets it, the caller holds the mutex
+func (element *ConfigST) removeStream(uuid string) {
+	tmp, ok := element.Streams[uuid]
+	if !ok {
+		return
+	}
+	element.stopWorker(uuid)
+	if tmp.hub != nil {
+		tmp.hub.Close(SubscriberStreamRemoved)
+	}
+	delete(element.Streams, uuid)
+	// A substream that is gone would fail the next load of config.json
+	for id, stream := range element.Streams {
+		if stream.Substream == uuid {
+			stream.Substream = ""
+			element.Streams[id] = stream
+			log.Println("Stream", id, "lost its substream", uuid)
+		}
+	}
+	Recorders.Stop(uuid)
+	Metrics.remove(uuid)
+}
+
+// restartWorker waits for a stopped worker to exit and starts a new one,
+// unless the stream is on demand and was idle
+func (element *ConfigST) restartWorker(uuid string, old *workerST) {
+	// New settings deserve a fresh start, also for a suspended stream
+	element.resume(uuid)
+	if old != nil {
+		select {
+		case <-old.done:
+		case <-time.After(workerStopTimeout):
+			log.Println("Worker of stream", uuid, "did not stop in time, starting anyway")
+		}
+	}
+	element.mutex.RLock()
+	tmp, ok := element.Streams[uuid]
+	element.mutex.RUnlock()
+	if ok && (old != nil || !tmp.OnDemand) {
+		element.RunIFNotRun(uuid)
+	}
+}
+
+// HasViewer reports whether an on-demand stream is watched or recorded.
+// Snapshots subscribe too but do not keep the stream running.
 func (element *ConfigST) HasViewer(uuid string) bool {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
-	if tmp, ok := element.Streams[uuid]; ok && len(tmp.Cl) > 0 {
-		log.Println("Stream", uuid, "has", len(tmp.Cl), "viewers")
-		return true
+	element.mutex.RLock()
+	tmp, ok := element.Streams[uuid]
+	element.mutex.RUnlock()
+	if ok {
+		if count := tmp.hub.CountKind(SubscriberViewer); count > 0 {
+			log.Println("Stream", uuid, "has", count, "viewers")
+			return true
+		}
+		if tmp.hub.CountKind(SubscriberRecorder) > 0 {
+			log.Println("Stream", uuid, "is recording")
+			return true
+		}
 	}
 	log.Println("Stream", uuid, "has no viewers")
 	return false
 }
 
 func (element *ConfigST) GetICEServers() []string {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
 	return element.Server.ICEServers
 }
 
 func (element *ConfigST) GetICEUsername() string {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
 	return element.Server.ICEUsername
 }
 
 func (element *ConfigST) GetICECredential() string {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
 	return element.Server.ICECredential
 }
 
 func (element *ConfigST) GetWebRTCPortMin() uint16 {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
 	return element.Server.WebRTCPortMin
 }
 
 func (element *ConfigST) GetWebRTCPortMax() uint16 {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
 	return element.Server.WebRTCPortMax
 }
 
 func loadConfig() *ConfigST {
-	var tmp ConfigST
-	data, err := os.ReadFile("config.json")
+	data, err := os.ReadFile(configPath)
 	if err == nil {
-		err = json.Unmarshal(data, &tmp)
+		tmp, err := parseConfig(data)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		for i, v := range tmp.Streams {
-			if v.Name == "" {
-				v.Name = i // Fallback to URL if name is not set
-			}
-			v.Cl = make(map[string]viewer)
+			v.hub = newHub(i)
 			tmp.Streams[i] = v
 		}
+		configWatch.loaded(data)
 		log.Printf("Loaded config from config.json: Server=%+v, Streams=%d", tmp.Server, len(tmp.Streams))
-	} else {
-		log.Println("config.json not found, using default configuration")
-		addr := flag.String("listen", "8083", "HTTP host:port")
-		udpMin := flag.Int("udp_min", 0, "WebRTC UDP port min")
-		udpMax := flag.Int("udp_max", 0, "WebRTC UDP port max")
-		iceServer := flag.String("ice_server", "", "ICE Server")
-		flag.Parse()
-
-		tmp.Server.HTTPPort = *addr
-		tmp.Server.WebRTCPortMin = uint16(*udpMin)
-		tmp.Server.WebRTCPortMax = uint16(*udpMax)
-		if len(*iceServer) > 0 {
-			tmp.Server.ICEServers = []string{*iceServer}
-		}
+		return tmp
+	}
+	var tmp ConfigST
+	log.Println("config.json not found, using default configuration")
+	addr := flag.String("listen", "8083", "HTTP host:port")
+	udpMin := flag.Int("udp_min", 0, "WebRTC UDP port min")
+	udpMax := flag.Int("udp_max", 0, "WebRTC UDP port max")
+	iceServer := flag.String("ice_server", "", "ICE Server")
+	flag.Parse()
+
+	tmp.Server.HTTPPort = *addr
+	tmp.Server.WebRTCPortMin = uint16(*udpMin)
+	tmp.Server.WebRTCPortMax = uint16(*udpMax)
+	if len(*iceServer) > 0 {
+		tmp.Server.ICEServers = []string{*iceServer}
+	}
+
+	tmp.Streams = make(map[string]StreamST)
+	return &tmp
+}
 
+// parseConfig decodes and validates config.json. Streams come without a
+// hub, the caller adds or keeps one.
+func parseConfig(data []byte) (*ConfigST, error) {
+	var tmp ConfigST
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return nil, err
+	}
+	if err := tmp.Server.SlowViewer.Validate(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Server.Reconnect.Validate(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Server.Timeouts.Validate(); err != nil {
+		return nil, err
+	}
+	if tmp.Streams == nil {
 		tmp.Streams = make(map[string]StreamST)
 	}
-	return &tmp
+	for i, v := range tmp.Streams {
+		if v.Name == "" {
+			v.Name = i // Fallback to URL if name is not set
+		}
+		if v.SlowViewer != nil {
+			if err := v.SlowViewer.Validate(); err != nil {
+				return nil, fmt.Errorf("stream %s: %w", i, err)
+			}
+		}
+		if v.Reconnect != nil {
+			if err := v.Reconnect.Validate(); err != nil {
+				return nil, fmt.Errorf("stream %s: %w", i, err)
+			}
+		}
+		if v.Timeouts != nil {
+			if err := v.Timeouts.Validate(); err != nil {
+				return nil, fmt.Errorf("stream %s: %w", i, err)
+			}
+		}
+		if err := validateTransport(v.Transport, v.URL); err != nil {
+			return nil, fmt.Errorf("stream %s: %w", i, err)
+		}
+		if err := validateIngest(v); err != nil {
+			return nil, fmt.Errorf("stream %s: %w", i, err)
+		}
+		tmp.Streams[i] = v
+	}
+	for i, v := range tmp.Streams {
+		if err := validateSubstream(i, v.Substream, tmp.Streams); err != nil {
+			return nil, fmt.Errorf("stream %s: %w", i, err)
+		}
+	}
+	if err := validateWebhooks(tmp.Server.Webhooks); err != nil {
+		return nil, err
+	}
+	for i, rule := range tmp.AlertRules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("alert rule %s: %w", rule.ID, err)
+		}
+		if rule.ID == "" {
+			tmp.AlertRules[i].ID = pseudoUUID()
+		}
+	}
+	return &tmp, nil
 }
 
 // InitializeAllStreams starts all streams to discover their codecs
@@ -186,7 +403,22 @@ func (element *ConfigST) InitializeAllStreams() {
 	}
 }
 
-func (element *ConfigST) cast(uuid string, pck av.Packet) {
+// hub returns the packet hub of a stream, workers keep it for their lifetime
+func (element *ConfigST) hub(uuid string) *HubST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if tmp, ok := element.Streams[uuid]; ok {
+		return tmp.hub
+	}
+	return nil
+}
+
+// cast hands a packet to the stream hub. Config.mutex is only taken for the
+// first packet after a (re)start to flag the stream as online.
+func (element *ConfigST) cast(uuid string, hub *HubST, pck av.Packet) {
+	if !hub.cast(pck) {
+		return
+	}
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
 	if tmp, ok := element.Streams[uuid]; ok {
@@ -194,13 +426,7 @@ func (element *ConfigST) cast(uuid string, pck av.Packet) {
 			tmp.Status = true
 			element.Streams[uuid] = tmp
 			log.Println("Set status to true for stream", uuid, "due to packet casting")
-		}
-		for _, v := range tmp.Cl {
-			if len(v.c) < cap(v.c) {
-				v.c <- pck
-			} else {
-				log.Println("Client channel full for stream", uuid, "dropping packet")
-			}
+			Push.streamStatus(uuid, true, tmp.RunLock)
 		}
 	} else {
 		log.Println("Stream", uuid, "not found for casting packet")
@@ -208,8 +434,8 @@ func (element *ConfigST) cast(uuid string, pck av.Packet) {
 }
 
 func (element *ConfigST) ext(suuid string) bool {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
 	_, ok := element.Streams[suuid]
 	if ok {
 		log.Println("Stream", suuid, "exists")
@@ -224,9 +450,11 @@ func (element *ConfigST) coAd(suuid string, codecs []av.CodecData) {
 	defer element.mutex.Unlock()
 	if tmp, ok := element.Streams[suuid]; ok {
 		tmp.Codecs = codecs
+		tmp.hub.SetCodecs(codecs)
 		if !tmp.Status {
 			tmp.Status = true
 			log.Println("Set status to true for stream", suuid, "due to codec update")
+			Push.streamStatus(suuid, true, tmp.RunLock)
 		}
 		element.Streams[suuid] = tmp
 		log.Println("Added codecs for stream", suuid, codecs)
@@ -235,7 +463,7 @@ func (element *ConfigST) coAd(suuid string, codecs []av.CodecData) {
 	}
 }
 
-func (element *ConfigST) coGe(suuid string) []av.CodecData {
+func (element *ConfigST) coGe(suuid string) (codecs []av.CodecData) {
 	// Check if stream is running, if not and it's on-demand, try to start it
 	element.mutex.RLock()
 	tmp, ok := element.Streams[suuid]
@@ -245,6 +473,10 @@ func (element *ConfigST) coGe(suuid string) []av.CodecData {
 		log.Println("Stream", suuid, "not found for getting codecs")
 		return nil
 	}
+	started := time.Now()
+	defer func() {
+		Metrics.codecDiscovery(suuid, time.Since(started), codecs != nil)
+	}()
 
 	// If stream is not running and is on-demand, start it
 	if !tmp.RunLock && tmp.OnDemand {
@@ -252,9 +484,10 @@ func (element *ConfigST) coGe(suuid string) []av.CodecData {
 		element.RunIFNotRun(suuid)
 	}
 
-	// Wait for codecs with extended timeout for restarted streams
-	maxRetries := 200 // Extended from 100 to 200 (10 seconds)
-	for i := 0; i < maxRetries; i++ {
+	// Wait for codecs, restarted streams can take a while to reconnect
+	wait := element.timeouts(suuid).CodecWait
+	deadline := started.Add(wait)
+	for i := 0; time.Now().Before(deadline); i++ {
 		element.mutex.RLock()
 		tmp, ok := element.Streams[suuid]
 		element.mutex.RUnlock()
@@ -283,34 +516,40 @@ func (element *ConfigST) coGe(suuid string) []av.CodecData {
 
 		// Log progress every 2 seconds (40 iterations)
 		if i%40 == 0 && i > 0 {
-			log.Printf("Still waiting for codecs for stream %s (attempt %d/%d, RunLock: %v, Status: %v)",
-				suuid, i, maxRetries, tmp.RunLock, tmp.Status)
+			log.Printf("Still waiting for codecs for stream %s (%s of %s, RunLock: %v, Status: %v)",
+				suuid, time.Since(started).Round(time.Second), wait, tmp.RunLock, tmp.Status)
 		}
 
 		time.Sleep(50 * time.Millisecond)
 	}
-	log.Println("Failed to get codecs for stream", suuid, "after", maxRetries, "retries")
+	log.Println("Failed to get codecs for stream", suuid, "within", wait)
 	return nil
 }
 
-func (element *ConfigST) clAd(suuid string) (string, chan av.Packet) {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
-	if tmp, ok := element.Streams[suuid]; ok {
-		cuuid := pseudoUUID()
-		ch := make(chan av.Packet, 100)
-		tmp.Cl[cuuid] = viewer{c: ch}
-		element.Streams[suuid] = tmp
-		log.Println("Added client", cuuid, "to stream", suuid)
-		return cuuid, ch
+// clAd subscribes to a stream. Only viewers follow the configured slow
+// viewer policy, recorders and snapshots always skip to the next keyframe.
+func (element *ConfigST) clAd(suuid, kind string) *SubscriberST {
+	policy := SlowViewerST{Policy: SlowViewerKeyframe}
+	if kind == SubscriberViewer {
+		policy = element.slowViewer(suuid)
+	}
+	element.mutex.RLock()
+	tmp, ok := element.Streams[suuid]
+	element.mutex.RUnlock()
+	if ok {
+		sub := tmp.hub.Subscribe(kind, policy)
+		if viewers, changed := tmp.hub.viewersChanged(); changed {
+			Push.viewers(suuid, viewers)
+		}
+		return sub
 	}
 	log.Println("Stream", suuid, "not found for adding client")
-	return "", nil
+	return nil
 }
 
 func (element *ConfigST) list() (string, []string) {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
 	var res []string
 	var first string
 	for k := range element.Streams {
@@ -324,14 +563,18 @@ func (element *ConfigST) list() (string, []string) {
 }
 
 func (element *ConfigST) clDe(suuid, cuuid string) {
-	element.mutex.Lock()
-	defer element.mutex.Unlock()
-	if tmp, ok := element.Streams[suuid]; ok {
-		delete(tmp.Cl, cuuid)
-		element.Streams[suuid] = tmp
-		log.Println("Removed client", cuuid, "from stream", suuid, "- remaining viewers:", len(tmp.Cl))
+	element.mutex.RLock()
+	tmp, ok := element.Streams[suuid]
+	element.mutex.RUnlock()
+	if ok {
+		tmp.hub.Unsubscribe(cuuid)
+		remaining, changed := tmp.hub.viewersChanged()
+		log.Println("Removed client", cuuid, "from stream", suuid, "- remaining viewers:", remaining)
+		if changed {
+			Push.viewers(suuid, remaining)
+		}
 
-		if len(tmp.Cl) == 0 && tmp.OnDemand {
+		if remaining == 0 && tmp.OnDemand {
 			log.Println("No more viewers for on-demand stream", suuid, "- will stop when worker loop detects this")
 			// Don't manually stop here, let the worker loop handle it naturally
 		}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	EventStreamConnect         = "stream.connect"
+	EventStreamDisconnect      = "stream.disconnect"
+	EventStreamCodec           = "stream.codec"
+	EventStreamSuspended       = "stream.suspended"
+	EventStreamPublishRejected = "stream.publish_rejected"
+	EventViewerJoin            = "viewer.join"
+	EventViewerLeave           = "viewer.leave"
+	EventStorageWarning        = "storage.warning"
+	EventStorageRecovered      = "storage.recovered"
+
+	EventPriorityLow    = "low"
+	EventPriorityMedium = "medium"
+	EventPriorityHigh   = "high"
+
+	// EventSourceServer events are added by the server itself, EventSourceUser
+	// ones through the API and EventSourceStorage ones by the retention pass
+	EventSourceServer  = "server"
+	EventSourceUser    = "user"
+	EventSourceStorage = "storage"
+
+	defaultEventsPath       = "events.db"
+	defaultEventsMaxAgeDays = 30
+	eventsPageSize          = 100
+	eventsMaxPageSize       = 1000
+	eventsPruneEvery        = time.Hour
+)
+
+var (
+	ErrorEventNotFound    = errors.New("event not found")
+	ErrorEventBadPriority = errors.New("priority must be low, medium or high")
+	ErrorEventNoName      = errors.New("event name is required")
+)
+
+var eventsBucket = []byte("events")
+
+// Events global
+var Events = &EventsST{}
+
+// EventsST stores events in a bolt database keyed by a big endian sequence,
+// so a cursor walks them in insertion order
+type EventsST struct {
+	db *bolt.DB
+}
+
+// EventST is one event shown on the EventLogs page
+type EventST struct {
+	ID          string    `json:"id"`
+	Stream      string    `json:"stream,omitempty"`
+	Type        string    `json:"type"`
+	Name        string    `json:"name"`
+	Priority    string    `json:"priority"`
+	Time        time.Time `json:"time"`
+	Description string    `json:"description"`
+	MediaURL    string    `json:"media_url,omitempty"`
+	Source      string    `json:"source"`
+	Actor       string    `json:"actor,omitempty"`
+}
+
+// EventFilterST selects events, zero fields match everything
+type EventFilterST struct {
+	Stream   string
+	Type     string
+	Priority string
+	From     time.Time
+	To       time.Time
+	// User limits the result to the streams the user is granted
+	User *UserST
+}
+
+func (element *ConfigST) GetEventsPath() string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if element.Server.EventsPath == "" {
+		return defaultEventsPath
+	}
+	return element.Server.EventsPath
+}
+
+func (element *ConfigST) GetEventsMaxAge() time.Duration {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	days := element.Server.EventsMaxAgeDays
+	if days <= 0 {
+		days = defaultEventsMaxAgeDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func loadEvents() {
+	path := Config.GetEventsPath()
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		log.Fatalln("Events database", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(eventsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(alertsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(ticketsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(exportsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(webhookDeliveriesBucket)
+		return err
+	})
+	if err != nil {
+		log.Fatalln("Events database", path, err)
+	}
+	Events.db = db
+}
+
+func eventKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func eventKeyFromID(id string) ([]byte, bool) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return eventKey(n), true
+}
+
+func validEventPriority(priority string) bool {
+	switch priority {
+	case EventPriorityLow, EventPriorityMedium, EventPriorityHigh:
+		return true
+	}
+	return false
+}
+
+func (element EventFilterST) match(event EventST) bool {
+	if element.Stream != "" && event.Stream != element.Stream {
+		return false
+	}
+	if element.Type != "" && event.Type != element.Type {
+		return false
+	}
+	if element.Priority != "" && event.Priority != element.Priority {
+		return false
+	}
+	if !element.From.IsZero() && event.Time.Before(element.From) {
+		return false
+	}
+	if !element.To.IsZero() && event.Time.After(element.To) {
+		return false
+	}
+	if element.User != nil && !eventVisible(*element.User, event) {
+		return false
+	}
+	return true
+}
+
+// eventVisible hides events of streams the user is not granted, events not
+// tied to a stream are for operators and admins
+func eventVisible(user UserST, event EventST) bool {
+	if event.Stream == "" {
+		return user.HasRole(RoleOperator)
+	}
+	return user.CanStream(event.Stream)
+}
+
+// Add stores an event and returns it with its id and time set
+func (element *EventsST) Add(event EventST) (EventST, error) {
+	if element.db == nil {
+		return event, nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Priority == "" {
+		event.Priority = EventPriorityLow
+	}
+	err := element.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		event.ID = strconv.FormatUint(id, 10)
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(eventKey(id), data)
+	})
+	if err == nil {
+		Push.Publish(PushMessageST{Type: PushEvent, Stream: event.Stream, Time: event.Time, Data: event})
+	}
+	return event, err
+}
+
+// stream adds a server event of a stream, failures are only logged
+func (element *EventsST) stream(uuid, kind, priority, name, description string) {
+	_, err := element.Add(EventST{
+		Stream:      uuid,
+		Type:        kind,
+		Name:        name,
+		Priority:    priority,
+		Description: description,
+		Source:      EventSourceServer,
+	})
+	if err != nil {
+		log.Println("Events add error", err, kind, uuid)
+	}
+}
+
+func (element *EventsST) Get(id string) (EventST, error) {
+	var event EventST
+	key, ok := eventKeyFromID(id)
+	if !ok {
+		return event, ErrorEventNotFound
+	}
+	err := element.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(eventsBucket).Get(key)
+		if data == nil {
+			return ErrorEventNotFound
+		}
+		return json.Unmarshal(data, &event)
+	})
+	return event, err
+}
+
+// Query returns a page of matching events newest first and the total
+// number of matches
+func (element *EventsST) Query(filter EventFilterST, limit, offset int) ([]EventST, int, error) {
+	res := make([]EventST, 0, limit)
+	total := 0
+	err := element.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(eventsBucket).Cursor()
+		for key, data := cursor.Last(); key != nil; key, data = cursor.Prev() {
+			var event EventST
+			if err := json.Unmarshal(data, &event); err != nil {
+				continue
+			}
+			// Events are stored in time order, nothing older can match
+			if !filter.From.IsZero() && event.Time.Before(filter.From) {
+				break
+			}
+			if !filter.match(event) {
+				continue
+			}
+			if total >= offset && len(res) < limit {
+				res = append(res, event)
+			}
+			total++
+		}
+		return nil
+	})
+	return res, total, err
+}
+
+// Update applies fn to a stored event, id, source and time are kept
+func (element *EventsST) Update(id string, fn func(*EventST) error) (EventST, error) {
+	var event EventST
+	key, ok := eventKeyFromID(id)
+	if !ok {
+		return event, ErrorEventNotFound
+	}
+	err := element.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		data := bucket.Get(key)
+		if data == nil {
+			return ErrorEventNotFound
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			return err
+		}
+		stored := event
+		if err := fn(&event); err != nil {
+			return err
+		}
+		event.ID, event.Source, event.Time = stored.ID, stored.Source, stored.Time
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	return event, err
+}
+
+func (element *EventsST) Delete(id string) error {
+	key, ok := eventKeyFromID(id)
+	if !ok {
+		return ErrorEventNotFound
+	}
+	return element.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		if bucket.Get(key) == nil {
+			return ErrorEventNotFound
+		}
+		return bucket.Delete(key)
+	})
+}
+
+// prune deletes events older than the configured age
+func (element *EventsST) prune(maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	err := element.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(eventsBucket).Cursor()
+		for key, data := cursor.First(); key != nil; key, data = cursor.First() {
+			var event EventST
+			if err := json.Unmarshal(data, &event); err == nil && !event.Time.Before(cutoff) {
+				break
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func serveEventsRetention() {
+	for {
+		removed, err := Events.prune(Config.GetEventsMaxAge())
+		if err != nil {
+			log.Println("Events retention error", err)
+		} else if removed > 0 {
+			log.Println("Events retention removed", removed, "events")
+		}
+		// Resolved alerts are kept as long as the events they belong to
+		removed, err = Alerts.prune(Config.GetEventsMaxAge())
+		if err != nil {
+			log.Println("Alerts retention error", err)
+		} else if removed > 0 {
+			log.Println("Alerts retention removed", removed, "resolved alerts")
+		}
+		time.Sleep(eventsPruneEvery)
+	}
+}
+
+// EventRequestST is the body of event create and update requests
+type EventRequestST struct {
+	Stream      string `json:"stream"`
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Priority    string `json:"priority"`
+	Description string `json:"description"`
+	MediaURL    string `json:"media_url"`
+}
+
+func (element EventRequestST) Validate() error {
+	if element.Name == "" {
+		return ErrorEventNoName
+	}
+	if element.Priority != "" && !validEventPriority(element.Priority) {
+		return ErrorEventBadPriority
+	}
+	return nil
+}
+
+func eventError(c *gin.Context, err error) {
+	switch err {
+	case ErrorEventNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case ErrorEventBadPriority, ErrorEventNoName:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Println("Events database error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Events database error"})
+	}
+}
+
+// HTTPAPIServerEvents filters by stream, type, priority and a from/to time
+// range and pages newest first with limit and offset
+func HTTPAPIServerEvents(c *gin.Context) {
+	user := currentUser(c)
+	filter := EventFilterST{
+		Stream:   c.Query("stream"),
+		Type:     c.Query("type"),
+		Priority: c.Query("priority"),
+		User:     &user,
+	}
+	var err error
+	if filter.From, err = parsePlaybackTime(c.Query("from")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.To, err = parsePlaybackTime(c.Query("to")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(eventsPageSize)))
+	if err != nil || limit <= 0 || limit > eventsMaxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(eventsMaxPageSize)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+		return
+	}
+	events, total, err := Events.Query(filter, limit, offset)
+	if err != nil {
+		eventError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+		"events": events,
+	})
+}
+
+// eventAccess loads an event the user may see and answers the request
+// itself when it may not
+func eventAccess(c *gin.Context, role string) (EventST, bool) {
+	event, err := Events.Get(c.Param("id"))
+	if err != nil {
+		eventError(c, err)
+		return event, false
+	}
+	user := currentUser(c)
+	if !eventVisible(user, event) {
+		eventError(c, ErrorEventNotFound)
+		return event, false
+	}
+	if !user.HasRole(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": ErrorUserForbidden.Error()})
+		return event, false
+	}
+	return event, true
+}
+
+func HTTPAPIServerEvent(c *gin.Context) {
+	if event, ok := eventAccess(c, RoleViewer); ok {
+		c.JSON(http.StatusOK, event)
+	}
+}
+
+func HTTPAPIAddEvent(c *gin.Context) {
+	var request EventRequestST
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := request.Validate(); err != nil {
+		eventError(c, err)
+		return
+	}
+	if request.Stream != "" && !canStream(c, request.Stream, RoleOperator) {
+		return
+	}
+	event, err := Events.Add(EventST{
+		Stream:      request.Stream,
+		Type:        request.Type,
+		Name:        request.Name,
+		Priority:    request.Priority,
+		Description: request.Description,
+		MediaURL:    request.MediaURL,
+		Source:      EventSourceUser,
+		Actor:       c.GetString(authUserKey),
+	})
+	if err != nil {
+		eventError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, event)
+}
+
+func HTTPAPIUpdateEvent(c *gin.Context) {
+	before, ok := eventAccess(c, RoleOperator)
+	if !ok {
+		return
+	}
+	var request EventRequestST
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := request.Validate(); err != nil {
+		eventError(c, err)
+		return
+	}
+	if request.Stream != before.Stream && request.Stream != "" && !canStream(c, request.Stream, RoleOperator) {
+		return
+	}
+	event, err := Events.Update(before.ID, func(event *EventST) error {
+		event.Stream = request.Stream
+		event.Type = request.Type
+		event.Name = request.Name
+		if request.Priority != "" {
+			event.Priority = request.Priority
+		}
+		event.Description = request.Description
+		event.MediaURL = request.MediaURL
+		return nil
+	})
+	if err != nil {
+		eventError(c, err)
+		return
+	}
+	auditRequest(c, AuditEventUpdate, event.ID, "", auditDiff(before, event))
+	c.JSON(http.StatusOK, event)
+}
+
+func HTTPAPIDeleteEvent(c *gin.Context) {
+	event, ok := eventAccess(c, RoleOperator)
+	if !ok {
+		return
+	}
+	if err := Events.Delete(event.ID); err != nil {
+		eventError(c, err)
+		return
+	}
+	auditRequest(c, AuditEventDelete, event.ID, "", auditDiff(event, nil))
+	c.JSON(http.StatusOK, gin.H{"message": "Event deleted successfully"})
+}
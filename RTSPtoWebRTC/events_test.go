@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testRequestJSON is testRequest with a JSON body
+func testRequestJSON(router *gin.Engine, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// testAddEvents stores one event per minute starting at from
+func testAddEvents(t *testing.T, from time.Time, events ...EventST) {
+	t.Helper()
+	for i, event := range events {
+		event.Time = from.Add(time.Duration(i) * time.Minute)
+		if _, err := Events.Add(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testEventNames(events []EventST) string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		names = append(names, event.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestEventsQuery(t *testing.T) {
+	testConfig(t, nil)
+	testEvents(t)
+	from := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	testAddEvents(t, from,
+		EventST{Stream: "cam1", Type: EventStreamConnect, Name: "a"},
+		EventST{Stream: "cam2", Type: EventStreamConnect, Name: "b", Priority: EventPriorityHigh},
+		EventST{Stream: "cam1", Type: EventStreamDisconnect, Name: "c", Priority: EventPriorityMedium},
+		EventST{Type: EventStorageWarning, Name: "d", Priority: EventPriorityHigh},
+		EventST{Stream: "cam1", Type: EventStreamConnect, Name: "e"},
+	)
+	viewer := UserST{Role: RoleViewer, Streams: []string{"cam1"}}
+	tests := []struct {
+		name   string
+		filter EventFilterST
+		want   string
+	}{
+		{"everything newest first", EventFilterST{}, "e,d,c,b,a"},
+		{"stream", EventFilterST{Stream: "cam1"}, "e,c,a"},
+		{"type", EventFilterST{Type: EventStreamConnect}, "e,b,a"},
+		{"priority", EventFilterST{Priority: EventPriorityHigh}, "d,b"},
+		{"from", EventFilterST{From: from.Add(3 * time.Minute)}, "e,d"},
+		{"to", EventFilterST{To: from.Add(time.Minute)}, "b,a"},
+		{"range", EventFilterST{From: from.Add(time.Minute), To: from.Add(3 * time.Minute)}, "d,c,b"},
+		{"granted streams", EventFilterST{User: &viewer}, "e,c,a"},
+		{"combined", EventFilterST{Stream: "cam1", Type: EventStreamConnect, User: &viewer}, "e,a"},
+	}
+	for _, test := range tests {
+		events, total, err := Events.Query(test.filter, 10, 0)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if got := testEventNames(events); got != test.want || total != len(events) {
+			t.Errorf("%s: %s total %d, want %s", test.name, got, total, test.want)
+		}
+	}
+
+	events, total, err := Events.Query(EventFilterST{}, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testEventNames(events); got != "d,c" || total != 5 {
+		t.Errorf("second page: %s total %d, want d,c total 5", got, total)
+	}
+	if events, total, _ := Events.Query(EventFilterST{}, 2, 5); len(events) != 0 || total != 5 {
+		t.Errorf("page past the end: %d events total %d", len(events), total)
+	}
+}
+
+func TestEventsDefaultsAndPrune(t *testing.T) {
+	testConfig(t, nil)
+	testEvents(t)
+	now := time.Now().UTC()
+	testAddEvents(t, now.Add(-48*time.Hour), EventST{Name: "old"}, EventST{Name: "older"})
+	event, err := Events.Add(EventST{Name: "recent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ID == "" || event.Priority != EventPriorityLow || event.Time.Before(now) {
+		t.Errorf("defaults not applied: %+v", event)
+	}
+
+	removed, err := Events.prune(24 * time.Hour)
+	if err != nil || removed != 2 {
+		t.Fatalf("pruned %d, %v, want 2", removed, err)
+	}
+	events, _, _ := Events.Query(EventFilterST{}, 10, 0)
+	if got := testEventNames(events); got != "recent" {
+		t.Errorf("left %s after prune", got)
+	}
+	if _, err := Events.Get(event.ID); err != nil {
+		t.Errorf("recent event gone: %v", err)
+	}
+}
+
+func TestEventVisible(t *testing.T) {
+	tests := []struct {
+		name  string
+		user  UserST
+		event EventST
+		want  bool
+	}{
+		{"granted stream", UserST{Role: RoleViewer, Streams: []string{"cam1"}}, EventST{Stream: "cam1"}, true},
+		{"other stream", UserST{Role: RoleViewer, Streams: []string{"cam1"}}, EventST{Stream: "cam2"}, false},
+		{"all streams", UserST{Role: RoleViewer, Streams: []string{StreamGrantAll}}, EventST{Stream: "cam2"}, true},
+		{"server event for a viewer", UserST{Role: RoleViewer, Streams: []string{StreamGrantAll}}, EventST{}, false},
+		{"server event for an operator", UserST{Role: RoleOperator, Streams: []string{"cam1"}}, EventST{}, true},
+		{"admin", UserST{Role: RoleAdmin}, EventST{Stream: "cam2"}, true},
+	}
+	for _, test := range tests {
+		if got := eventVisible(test.user, test.event); got != test.want {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEventsAPI(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testEvents(t)
+
+	w := testRequestJSON(router, http.MethodPost, "/api/events", tokens["operator"], EventRequestST{
+		Stream: "cam1", Type: "motion", Name: "Motion", Priority: EventPriorityMedium,
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	var event EventST
+	if err := json.Unmarshal(w.Body.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Source != EventSourceUser || event.Actor != "operator" || event.ID == "" {
+		t.Errorf("created %+v", event)
+	}
+
+	rejected := []struct {
+		name    string
+		token   string
+		request EventRequestST
+		want    int
+	}{
+		{"viewer", tokens["viewer"], EventRequestST{Stream: "cam1", Name: "x"}, http.StatusForbidden},
+		{"ungranted stream", tokens["operator"], EventRequestST{Stream: "cam2", Name: "x"}, http.StatusForbidden},
+		{"no name", tokens["operator"], EventRequestST{Stream: "cam1"}, http.StatusBadRequest},
+		{"bad priority", tokens["operator"], EventRequestST{Stream: "cam1", Name: "x", Priority: "urgent"}, http.StatusBadRequest},
+	}
+	for _, test := range rejected {
+		if w := testRequestJSON(router, http.MethodPost, "/api/events", test.token, test.request); w.Code != test.want {
+			t.Errorf("create %s: %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+
+	path := "/api/events/" + event.ID
+	if w := testRequest(router, http.MethodGet, path, tokens["viewer"]); w.Code != http.StatusOK {
+		t.Errorf("granted viewer reading: %d", w.Code)
+	}
+	if w := testRequestJSON(router, http.MethodPut, path, tokens["viewer"], EventRequestST{Stream: "cam1", Name: "x"}); w.Code != http.StatusForbidden {
+		t.Errorf("viewer updating: %d", w.Code)
+	}
+	w = testRequestJSON(router, http.MethodPut, path, tokens["operator"], EventRequestST{Stream: "cam1", Type: "motion", Name: "Person"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body.String())
+	}
+	updated, _ := Events.Get(event.ID)
+	if updated.Name != "Person" || updated.Priority != EventPriorityMedium || !updated.Time.Equal(event.Time) || updated.Source != EventSourceUser {
+		t.Errorf("updated %+v", updated)
+	}
+	if w := testRequestJSON(router, http.MethodPut, path, tokens["operator"], EventRequestST{Stream: "cam2", Name: "x"}); w.Code != http.StatusForbidden {
+		t.Errorf("moving to an ungranted stream: %d", w.Code)
+	}
+
+	Events.stream("cam2", EventStreamConnect, EventPriorityLow, "Connected", "")
+	w = testRequest(router, http.MethodGet, "/api/events", tokens["viewer"])
+	var page struct {
+		Total  int       `json:"total"`
+		Events []EventST `json:"events"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || testEventNames(page.Events) != "Person" {
+		t.Errorf("viewer listed %d: %s", page.Total, testEventNames(page.Events))
+	}
+	for _, query := range []string{"limit=0", "limit=5000", "offset=-1", "from=yesterday"} {
+		if w := testRequest(router, http.MethodGet, "/api/events?"+query, tokens["admin"]); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", query, w.Code)
+		}
+	}
+
+	if w := testRequest(router, http.MethodDelete, path, tokens["viewer"]); w.Code != http.StatusForbidden {
+		t.Errorf("viewer deleting: %d", w.Code)
+	}
+	if w := testRequest(router, http.MethodDelete, path, tokens["operator"]); w.Code != http.StatusOK {
+		t.Errorf("delete: %d", w.Code)
+	}
+	for _, id := range []string{event.ID, "abc"} {
+		if w := testRequest(router, http.MethodGet, "/api/events/"+id, tokens["admin"]); w.Code != http.StatusNotFound {
+			t.Errorf("get %s: %d", id, w.Code)
+		}
+	}
+}
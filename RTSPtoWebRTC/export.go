@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	ExportStatusQueued  = "queued"
+	ExportStatusRunning = "running"
+	ExportStatusDone    = "done"
+	ExportStatusFailed  = "failed"
+
+	defaultExportPath        = "exports"
+	defaultExportMaxAgeHours = 7 * 24
+	exportMaxDuration        = 24 * time.Hour
+	exportPruneEvery         = time.Hour
+)
+
+var (
+	ErrorExportNotFound    = errors.New("export not found")
+	ErrorExportBadRange    = errors.New("export needs start and end with end after start")
+	ErrorExportTooLong     = errors.New("export range must not exceed 24h")
+	ErrorExportNoTracks    = errors.New("export no tracks supported by mp4")
+	ErrorExportNoPackets   = errors.New("export no recorded packets in range")
+	ErrorExportNotFinished = errors.New("export not finished")
+	ErrorExportInterrupted = errors.New("export interrupted by a restart")
+)
+
+var exportsBucket = []byte("exports")
+
+// Exports global
+var Exports = &ExportsST{jobs: make(map[string]*ExportST)}
+
+// ExportsST keeps the clip export jobs in memory and a copy of each in the
+// events database, so finished clips stay listed across restarts
+type ExportsST struct {
+	mutex sync.RWMutex
+	jobs  map[string]*ExportST
+}
+
+// ExportST is a clip cut from the recordings of one stream
+type ExportST struct {
+	ID       string    `json:"id"`
+	Stream   string    `json:"stream"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+	URL      string    `json:"url,omitempty"`
+	path     string
+}
+
+func (element *ConfigST) GetExportPath() string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if element.Server.ExportPath == "" {
+		return defaultExportPath
+	}
+	return element.Server.ExportPath
+}
+
+func (element *ConfigST) GetExportMaxAge() time.Duration {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	hours := element.Server.ExportMaxAgeHours
+	if hours <= 0 {
+		hours = defaultExportMaxAgeHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// exportPath is where the clip of a job is written
+func exportPath(id string) string {
+	return filepath.Join(Config.GetExportPath(), id+".mp4")
+}
+
+// loadExports restores the jobs stored by earlier runs. Jobs that were
+// still queued or running lost their worker and are marked failed.
+func loadExports() {
+	if err := Exports.load(); err != nil {
+		log.Fatalln("Exports database", err)
+	}
+}
+
+func (element *ExportsST) load() error {
+	var interrupted []*ExportST
+	err := Events.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(exportsBucket).ForEach(func(key, data []byte) error {
+			job := &ExportST{}
+			if err := json.Unmarshal(data, job); err != nil {
+				log.Println("Skipping unreadable export", string(key), err)
+				return nil
+			}
+			job.path = exportPath(job.ID)
+			if job.Status == ExportStatusQueued || job.Status == ExportStatusRunning {
+				interrupted = append(interrupted, job)
+			}
+			element.mutex.Lock()
+			element.jobs[job.ID] = job
+			element.mutex.Unlock()
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, job := range interrupted {
+		os.Remove(job.path + recordPartSuffix)
+		element.setStatus(job.ID, ExportStatusFailed, ErrorExportInterrupted)
+	}
+	return nil
+}
+
+// store writes job to the events database, the caller holds the mutex
+func (element *ExportsST) store(job *ExportST) {
+	if Events.db == nil {
+		return
+	}
+	data, err := json.Marshal(job)
+	if err == nil {
+		err = Events.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(exportsBucket).Put([]byte(job.ID), data)
+		})
+	}
+	if err != nil {
+		log.Println("Failed to store export", job.ID, err)
+	}
+}
+
+func (element *ExportsST) add(stream string, start, end time.Time) ExportST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	job := &ExportST{
+		ID:      pseudoUUID(),
+		Stream:  stream,
+		Start:   start,
+		End:     end,
+		Status:  ExportStatusQueued,
+		Created: time.Now(),
+	}
+	job.path = exportPath(job.ID)
+	element.jobs[job.ID] = job
+	element.store(job)
+	return *job
+}
+
+func (element *ExportsST) get(id string) (ExportST, bool) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if job, ok := element.jobs[id]; ok {
+		return *job, true
+	}
+	return ExportST{}, false
+}
+
+// list returns the jobs of the streams user may see, newest first
+func (element *ExportsST) list(user UserST) []ExportST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	res := make([]ExportST, 0, len(element.jobs))
+	for _, job := range element.jobs {
+		if user.CanStream(job.Stream) {
+			res = append(res, *job)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.After(res[j].Created)
+	})
+	return res
+}
+
+func (element *ExportsST) setStatus(id, status string, err error) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	job, ok := element.jobs[id]
+	if !ok {
+		return
+	}
+	job.Status = status
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if status == ExportStatusDone || status == ExportStatusFailed {
+		job.Finished = time.Now()
+	}
+	if status == ExportStatusDone {
+		job.URL = "/api/exports/" + id + "/download"
+		if info, err := os.Stat(job.path); err == nil {
+			job.Size = info.Size()
+		}
+	}
+	element.store(job)
+}
+
+func (element *ExportsST) remove(id string) (ExportST, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	job, ok := element.jobs[id]
+	if !ok {
+		return ExportST{}, false
+	}
+	delete(element.jobs, id)
+	if Events.db != nil {
+		err := Events.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(exportsBucket).Delete([]byte(id))
+		})
+		if err != nil {
+			log.Println("Failed to delete export", id, err)
+		}
+	}
+	return *job, true
+}
+
+// prune deletes the jobs and clips that finished before maxAge. Queued and
+// running jobs are kept however old they are.
+func (element *ExportsST) prune(maxAge time.Duration) int {
+	cutoff := time.Now().Add(-maxAge)
+	var expired []string
+	element.mutex.RLock()
+	for id, job := range element.jobs {
+		if !job.Finished.IsZero() && job.Finished.Before(cutoff) {
+			expired = append(expired, id)
+		}
+	}
+	element.mutex.RUnlock()
+	removed := 0
+	for _, id := range expired {
+		job, ok := element.remove(id)
+		if !ok {
+			continue
+		}
+		if err := os.Remove(job.path); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove export file:", err)
+		}
+		removed++
+	}
+	return removed
+}
+
+func serveExportsRetention() {
+	for {
+		if removed := Exports.prune(Config.GetExportMaxAge()); removed > 0 {
+			log.Println("Exports retention removed", removed, "exports")
+		}
+		time.Sleep(exportPruneEvery)
+	}
+}
+
+func ExportWorker(job ExportST) {
+	Exports.setStatus(job.ID, ExportStatusRunning, nil)
+	log.Println("Export", job.ID, "started for stream", job.Stream, job.Start, job.End)
+	if err := exportClip(job); err != nil {
+		log.Println("Export", job.ID, "failed", err)
+		Exports.setStatus(job.ID, ExportStatusFailed, err)
+		return
+	}
+	log.Println("Export", job.ID, "finished", job.path)
+	if _, ok := Exports.get(job.ID); !ok {
+		// Deleted while running
+		os.Remove(job.path)
+		return
+	}
+	Exports.setStatus(job.ID, ExportStatusDone, nil)
+}
+
+// exportClip remuxes the recorded packets between job.Start and job.End
+// into one MP4. The clip begins at the keyframe preceding job.Start so it
+// decodes without transcoding.
+func exportClip(job ExportST) error {
+	segments, err := recordSegmentsInRange(job.Stream, job.Start, job.End)
+	if err != nil || len(segments) == 0 {
+		return ErrorExportNoPackets
+	}
+	if err = os.MkdirAll(filepath.Dir(job.path), 0755); err != nil {
+		return err
+	}
+	part := job.path + recordPartSuffix
+	file, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part)
+	muxer := mp4.NewMuxer(file)
+
+	var codecs []av.CodecData
+	var tracks map[int8]int8
+	var clipStart time.Time
+	last := make(map[int8]time.Duration)
+	written := 0
+	for _, segment := range segments {
+		demuxer, segmentFile, err := openRecordSegment(segment)
+		if err != nil {
+			log.Println("Export open segment error", segment.Path, err)
+			continue
+		}
+		streams, err := demuxer.Streams()
+		if err != nil {
+			segmentFile.Close()
+			log.Println("Export read segment error", segment.Path, err)
+			continue
+		}
+		if codecs == nil {
+			tracks = make(map[int8]int8)
+			for i, codec := range streams {
+				if !recordSupports(RecordFormatMP4, codec.Type()) {
+					continue
+				}
+				tracks[int8(i)] = int8(len(codecs))
+				codecs = append(codecs, codec)
+			}
+			if len(codecs) == 0 {
+				segmentFile.Close()
+				file.Close()
+				return ErrorExportNoTracks
+			}
+			if err = muxer.WriteHeader(codecs); err != nil {
+				segmentFile.Close()
+				file.Close()
+				return err
+			}
+		}
+		offset := recordKeyframeBefore(segment, job.Start.Sub(segment.Start))
+		first := time.Duration(-1)
+		for {
+			pkt, err := demuxer.ReadPacket()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Println("Export read packet error", segment.Path, err)
+				break
+			}
+			if first < 0 {
+				first = pkt.Time
+			}
+			relative := pkt.Time - first
+			at := segment.Start.Add(relative)
+			if relative < offset || at.After(job.End) {
+				continue
+			}
+			idx, ok := tracks[pkt.Idx]
+			if !ok || int(pkt.Idx) >= len(streams) || streams[pkt.Idx].Type() != codecs[idx].Type() {
+				continue
+			}
+			if clipStart.IsZero() {
+				if hasVideo(codecs) && !(pkt.IsKeyFrame && codecs[idx].Type().IsVideo()) {
+					continue
+				}
+				clipStart = at
+			}
+			pkt.Idx = idx
+			pkt.Time = at.Sub(clipStart)
+			if pkt.Time < last[idx] {
+				pkt.Time = last[idx]
+			}
+			last[idx] = pkt.Time
+			if err = muxer.WritePacket(pkt); err != nil {
+				segmentFile.Close()
+				file.Close()
+				return err
+			}
+			written++
+		}
+		segmentFile.Close()
+	}
+	if written == 0 {
+		file.Close()
+		return ErrorExportNoPackets
+	}
+	if err = muxer.WriteTrailer(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, job.path)
+}
+
+// HTTPAPIAddExport takes {"stream", "start", "end"} with RFC3339 or unix
+// second times and queues the export in the background.
+func HTTPAPIAddExport(c *gin.Context) {
+	var request struct {
+		Stream string `json:"stream"`
+		Start  string `json:"start"`
+		End    string `json:"end"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		log.Println("Invalid request body:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	start, err := parsePlaybackTime(request.Start)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	end, err := parsePlaybackTime(request.End)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if start.IsZero() || end.IsZero() || !end.After(start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrorExportBadRange.Error()})
+		return
+	}
+	if end.Sub(start) > exportMaxDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrorExportTooLong.Error()})
+		return
+	}
+	if !Config.ext(request.Stream) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	if !canStream(c, request.Stream, RoleOperator) {
+		return
+	}
+	job := Exports.add(request.Stream, start, end)
+	auditRequest(c, AuditExportAdd, request.Stream, "export "+job.ID+" "+start.UTC().Format(time.RFC3339)+" - "+end.UTC().Format(time.RFC3339), nil)
+	go ExportWorker(job)
+	c.JSON(http.StatusAccepted, job)
+}
+
+func HTTPAPIServerExports(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"exports": Exports.list(currentUser(c))})
+}
+
+func HTTPAPIServerExport(c *gin.Context) {
+	job, ok := Exports.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrorExportNotFound.Error()})
+		return
+	}
+	if !canStream(c, job.Stream, RoleOperator) {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+func HTTPAPIServerExportDownload(c *gin.Context) {
+	job, ok := Exports.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrorExportNotFound.Error()})
+		return
+	}
+	if !canStream(c, job.Stream, RoleOperator) {
+		return
+	}
+	if job.Status != ExportStatusDone {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrorExportNotFinished.Error()})
+		return
+	}
+	c.FileAttachment(job.path, job.filename())
+}
+
+// filename names the downloaded clip after its stream and start time
+func (element ExportST) filename() string {
+	return generateStreamID(element.Stream) + "_" + element.Start.UTC().Format("20060102T150405Z") + ".mp4"
+}
+
+func HTTPAPIDeleteExport(c *gin.Context) {
+	job, ok := Exports.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrorExportNotFound.Error()})
+		return
+	}
+	if !canStream(c, job.Stream, RoleOperator) {
+		return
+	}
+	if job, ok = Exports.remove(job.ID); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrorExportNotFound.Error()})
+		return
+	}
+	if err := os.Remove(job.path); err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to remove export file:", err)
+	}
+	auditRequest(c, AuditExportDelete, job.Stream, "export "+job.ID, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Export deleted successfully"})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testExports swaps in an empty job list writing clips to a scratch
+// directory, the events database holds the stored copies
+func testExports(t *testing.T) {
+	t.Helper()
+	Config.Server.ExportPath = t.TempDir()
+	testEvents(t)
+	old := Exports
+	Exports = &ExportsST{jobs: make(map[string]*ExportST)}
+	t.Cleanup(func() {
+		Exports = old
+	})
+}
+
+// testExportDone adds a finished job of stream with a clip on disk
+func testExportDone(t *testing.T, stream string) ExportST {
+	t.Helper()
+	job := Exports.add(stream, time.Now().Add(-time.Minute), time.Now())
+	if err := os.WriteFile(job.path, []byte("clip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	Exports.setStatus(job.ID, ExportStatusDone, nil)
+	job, _ = Exports.get(job.ID)
+	return job
+}
+
+func TestExportsSurviveRestart(t *testing.T) {
+	testConfig(t, map[string]StreamST{"cam": {}})
+	testExports(t)
+	done := testExportDone(t, "cam")
+	running := Exports.add("cam", time.Now().Add(-time.Minute), time.Now())
+	Exports.setStatus(running.ID, ExportStatusRunning, nil)
+	if err := os.WriteFile(running.path+recordPartSuffix, []byte("cl"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Exports = &ExportsST{jobs: make(map[string]*ExportST)}
+	loadExports()
+	job, ok := Exports.get(done.ID)
+	if !ok || job.Status != ExportStatusDone || job.Size != 4 || job.path != done.path || job.URL == "" {
+		t.Errorf("finished export after restart %+v", job)
+	}
+	job, ok = Exports.get(running.ID)
+	if !ok || job.Status != ExportStatusFailed || job.Error != ErrorExportInterrupted.Error() || job.Finished.IsZero() {
+		t.Errorf("running export after restart %+v", job)
+	}
+	if _, err := os.Stat(running.path + recordPartSuffix); !os.IsNotExist(err) {
+		t.Error("partial clip of the interrupted export left behind")
+	}
+}
+
+func TestExportsPrune(t *testing.T) {
+	testConfig(t, map[string]StreamST{"cam": {}})
+	testExports(t)
+	expired := testExportDone(t, "cam")
+	recent := testExportDone(t, "cam")
+	queued := Exports.add("cam", time.Now().Add(-time.Minute), time.Now())
+	Exports.mutex.Lock()
+	Exports.jobs[expired.ID].Finished = time.Now().Add(-2 * time.Hour)
+	// Only finished jobs expire, a job stuck in the queue is left alone
+	Exports.jobs[queued.ID].Created = time.Now().Add(-2 * time.Hour)
+	Exports.mutex.Unlock()
+
+	if removed := Exports.prune(time.Hour); removed != 1 {
+		t.Errorf("pruned %d exports, want 1", removed)
+	}
+	if _, ok := Exports.get(expired.ID); ok {
+		t.Error("expired export still listed")
+	}
+	if _, err := os.Stat(expired.path); !os.IsNotExist(err) {
+		t.Error("clip of the expired export left behind")
+	}
+	for _, id := range []string{recent.ID, queued.ID} {
+		if _, ok := Exports.get(id); !ok {
+			t.Errorf("export %s pruned", id)
+		}
+	}
+
+	// Pruned jobs do not come back from the database
+	Exports = &ExportsST{jobs: make(map[string]*ExportST)}
+	loadExports()
+	if _, ok := Exports.get(expired.ID); ok {
+		t.Error("expired export restored")
+	}
+	if n := len(Exports.list(UserST{Role: RoleAdmin})); n != 2 {
+		t.Errorf("%d exports restored, want 2", n)
+	}
+	if filepath.Dir(recent.path) != Config.GetExportPath() {
+		t.Errorf("clip written to %s", recent.path)
+	}
+}
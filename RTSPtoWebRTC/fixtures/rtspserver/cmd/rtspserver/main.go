@@ -0,0 +1,50 @@
+// Command rtspserver runs the fixture RTSP server of package rtspserver
+// for trying the stream transports without a camera:
+//
+//	go run ./fixtures/rtspserver/cmd/rtspserver -rtsp :8554 -http :8080
+//
+// With -user and -password set, RTSP requests need digest authentication
+// and the HTTP tunnel basic authentication.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/deepch/RTSPtoWebRTC/fixtures/rtspserver"
+)
+
+var (
+	rtspAddr  = flag.String("rtsp", ":8554", "RTSP listen address")
+	httpAddr  = flag.String("http", ":8080", "RTSP over HTTP tunnel listen address, empty disables")
+	group     = flag.String("multicast", "239.255.42.42:5004", "multicast group and RTP port")
+	fps       = flag.Int("fps", 25, "frames per second")
+	gop       = flag.Int("gop", 25, "frames per keyframe")
+	frameSize = flag.Int("frame", 1000, "bytes per frame")
+	user      = flag.String("user", "", "username, empty disables authentication")
+	password  = flag.String("password", "", "password")
+)
+
+func main() {
+	flag.Parse()
+	server := rtspserver.New(rtspserver.OptionsST{
+		Multicast: *group,
+		FPS:       *fps,
+		GOP:       *gop,
+		FrameSize: *frameSize,
+		User:      *user,
+		Password:  *password,
+	})
+	addr, err := server.ListenRTSP(*rtspAddr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("RTSP on", addr, "multicast", *group)
+	if *httpAddr != "" {
+		if addr, err = server.ListenHTTP(*httpAddr); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("RTSP over HTTP on", addr)
+	}
+	select {}
+}
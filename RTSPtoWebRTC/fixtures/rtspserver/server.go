@@ -0,0 +1,704 @@
+// Package rtspserver is a local RTSP server for trying the stream
+// transports without a camera. It serves a synthetic H.264 stream, the
+// frames carry filler instead of pictures, over RTP interleaved in the
+// RTSP connection, RTP over UDP, UDP multicast and RTSP over HTTP
+// tunneling. The tests start it in-process, cmd/rtspserver runs it on its
+// own:
+//
+//	go run ./fixtures/rtspserver/cmd/rtspserver -rtsp :8554 -http :8080
+//
+// and add streams such as
+//
+//	"tcp":       {"url": "rtsp://127.0.0.1:8554/fixture"}
+//	"udp":       {"url": "rtsp://127.0.0.1:8554/fixture", "transport": "udp"}
+//	"multicast": {"url": "rtsp://127.0.0.1:8554/fixture", "transport": "multicast"}
+//	"http":      {"url": "rtsp://127.0.0.1:8080/fixture", "transport": "http"}
+//
+// With a user set, RTSP requests need digest authentication and the HTTP
+// tunnel basic authentication.
+package rtspserver
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	realm = "fixture"
+	// maxPayload keeps RTP packets below a typical MTU, larger NAL units
+	// are sent as FU-A fragments
+	maxPayload = 1200
+)
+
+// OptionsST configure the stream and authentication, zero fields take the
+// defaults
+type OptionsST struct {
+	// Multicast is the group and RTP port, 239.255.42.42:5004 by default
+	Multicast string
+	// FPS is frames per second, 25 by default
+	FPS int
+	// GOP is frames per keyframe, 25 by default
+	GOP int
+	// FrameSize is bytes per frame, 1000 by default
+	FrameSize int
+	// User enables authentication
+	User     string
+	Password string
+}
+
+// ServerST serves the fixture stream on the listeners opened with
+// ListenRTSP and ListenHTTP until Close
+type ServerST struct {
+	options OptionsST
+	stop    chan struct{}
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	sessions  int
+	closed    bool
+	multicast sync.Once
+}
+
+func New(options OptionsST) *ServerST {
+	if options.Multicast == "" {
+		options.Multicast = "239.255.42.42:5004"
+	}
+	if options.FPS <= 0 {
+		options.FPS = 25
+	}
+	if options.GOP <= 0 {
+		options.GOP = 25
+	}
+	if options.FrameSize <= 0 {
+		options.FrameSize = 1000
+	}
+	return &ServerST{
+		options: options,
+		stop:    make(chan struct{}),
+		conns:   make(map[net.Conn]bool),
+	}
+}
+
+// ListenRTSP serves RTSP on addr and returns the address it listens on
+func (element *ServerST) ListenRTSP(addr string) (net.Addr, error) {
+	listener, err := element.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	go element.accept(listener, func(conn net.Conn) {
+		remote := conn.RemoteAddr().(*net.TCPAddr).IP
+		element.newSession(conn, remote).serve(bufio.NewReader(conn))
+	})
+	return listener.Addr(), nil
+}
+
+// ListenHTTP serves RTSP over HTTP tunnels on addr and returns the address
+// it listens on. The GET and POST connections of a tunnel are paired by
+// their session cookie, responses go out on the GET connection and
+// requests arrive base64 encoded on the POST one.
+func (element *ServerST) ListenHTTP(addr string) (net.Addr, error) {
+	listener, err := element.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	var mutex sync.Mutex
+	waiting := make(map[string]*tunnelST)
+	go element.accept(listener, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		cookie := req.Header.Get("x-sessioncookie")
+		if cookie == "" || !element.tunnelAuthorized(req) {
+			io.WriteString(conn, "HTTP/1.0 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\""+realm+"\"\r\n\r\n")
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			io.WriteString(conn, "HTTP/1.0 200 OK\r\nContent-Type: application/x-rtsp-tunnelled\r\nCache-Control: no-cache\r\nPragma: no-cache\r\n\r\n")
+			tunnel := &tunnelST{get: conn, done: make(chan struct{})}
+			mutex.Lock()
+			waiting[cookie] = tunnel
+			mutex.Unlock()
+			// The POST connection serves the session on this one
+			select {
+			case <-tunnel.done:
+			case <-element.stop:
+			}
+		case http.MethodPost:
+			mutex.Lock()
+			tunnel, ok := waiting[cookie]
+			delete(waiting, cookie)
+			mutex.Unlock()
+			if !ok {
+				return
+			}
+			defer close(tunnel.done)
+			log.Println("HTTP tunnel", cookie, "from", conn.RemoteAddr())
+			requests, decoded := io.Pipe()
+			go decodeTunnel(reader, decoded)
+			element.newSession(tunnel.get, nil).serve(bufio.NewReader(requests))
+		}
+	})
+	return listener.Addr(), nil
+}
+
+// Sessions returns the number of RTSP sessions being served
+func (element *ServerST) Sessions() int {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return element.sessions
+}
+
+// Close stops the listeners, the connections and the multicast sender
+func (element *ServerST) Close() {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.closed {
+		return
+	}
+	element.closed = true
+	close(element.stop)
+	for _, listener := range element.listeners {
+		listener.Close()
+	}
+	for conn := range element.conns {
+		conn.Close()
+	}
+}
+
+func (element *ServerST) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.closed {
+		listener.Close()
+		return nil, net.ErrClosed
+	}
+	element.listeners = append(element.listeners, listener)
+	return listener, nil
+}
+
+// accept hands every connection to handle and closes it afterwards
+func (element *ServerST) accept(listener net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		element.mutex.Lock()
+		if element.closed {
+			element.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		element.conns[conn] = true
+		element.mutex.Unlock()
+		go func() {
+			defer func() {
+				element.mutex.Lock()
+				delete(element.conns, conn)
+				element.mutex.Unlock()
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// tunnelST is a GET connection waiting for its POST
+type tunnelST struct {
+	get  net.Conn
+	done chan struct{}
+}
+
+func (element *ServerST) tunnelAuthorized(req *http.Request) bool {
+	if element.options.User == "" {
+		return true
+	}
+	name, pass, ok := req.BasicAuth()
+	return ok && name == element.options.User && pass == element.options.Password
+}
+
+// decodeTunnel decodes the POST body in groups of four characters, every
+// request is padded on its own so the body is no single base64 string
+func decodeTunnel(reader *bufio.Reader, out *io.PipeWriter) {
+	quad := make([]byte, 4)
+	buf := make([]byte, 3)
+	for {
+		if _, err := io.ReadFull(reader, quad); err != nil {
+			out.CloseWithError(err)
+			return
+		}
+		n, err := base64.StdEncoding.Decode(buf, quad)
+		if err != nil {
+			out.CloseWithError(err)
+			return
+		}
+		if _, err = out.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// sessionST is one RTSP connection, plain or tunneled
+type sessionST struct {
+	server *ServerST
+	mutex  sync.Mutex
+	out    io.Writer
+	remote net.IP
+	id     string
+	nonce  string
+	tracks []trackST
+	stop   chan struct{}
+}
+
+// trackST is where the RTP of the video track goes after SETUP
+type trackST struct {
+	channel int
+	udp     *net.UDPConn
+}
+
+func (element *ServerST) newSession(out io.Writer, remote net.IP) *sessionST {
+	return &sessionST{
+		server: element,
+		out:    out,
+		remote: remote,
+		id:     strconv.FormatUint(rand.Uint64(), 16),
+		nonce:  strconv.FormatUint(rand.Uint64(), 16),
+	}
+}
+
+func (element *sessionST) serve(reader *bufio.Reader) {
+	element.server.mutex.Lock()
+	element.server.sessions++
+	element.server.mutex.Unlock()
+	defer element.teardown()
+	for {
+		method, uri, headers, err := readRequest(reader)
+		if err != nil {
+			return
+		}
+		if !element.authorized(method, headers) {
+			element.reply(headers["cseq"], "401 Unauthorized", map[string]string{"WWW-Authenticate": fmt.Sprintf(`Digest realm="%s", nonce="%s"`, realm, element.nonce)}, nil)
+			continue
+		}
+		switch method {
+		case "OPTIONS", "GET_PARAMETER":
+			element.reply(headers["cseq"], "200 OK", map[string]string{"Public": "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}, nil)
+		case "DESCRIBE":
+			base := strings.TrimSuffix(uri, "/") + "/"
+			element.reply(headers["cseq"], "200 OK", map[string]string{"Content-Base": base, "Content-Type": "application/sdp"}, []byte(sdp()))
+		case "SETUP":
+			transport, err := element.setup(headers["transport"])
+			if err != nil {
+				element.reply(headers["cseq"], "461 Unsupported Transport", nil, nil)
+				continue
+			}
+			element.reply(headers["cseq"], "200 OK", map[string]string{"Transport": transport, "Session": element.id + ";timeout=60"}, nil)
+		case "PLAY":
+			element.reply(headers["cseq"], "200 OK", map[string]string{"Session": element.id}, nil)
+			element.play()
+		case "TEARDOWN":
+			element.reply(headers["cseq"], "200 OK", nil, nil)
+			return
+		default:
+			element.reply(headers["cseq"], "501 Not Implemented", nil, nil)
+		}
+	}
+}
+
+func (element *sessionST) authorized(method string, headers map[string]string) bool {
+	options := element.server.options
+	if options.User == "" {
+		return true
+	}
+	auth := headers["authorization"]
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false
+	}
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "Digest "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	ha1 := fmt.Sprintf("%x", md5.Sum([]byte(options.User+":"+realm+":"+options.Password)))
+	ha2 := fmt.Sprintf("%x", md5.Sum([]byte(method+":"+params["uri"])))
+	want := fmt.Sprintf("%x", md5.Sum([]byte(ha1+":"+element.nonce+":"+ha2)))
+	return params["username"] == options.User && params["nonce"] == element.nonce && params["response"] == want
+}
+
+// setup picks the transport the client asked for and answers with the
+// matching Transport header
+func (element *sessionST) setup(transport string) (string, error) {
+	params := make(map[string]string)
+	for _, part := range strings.Split(transport, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		} else {
+			params[kv[0]] = ""
+		}
+	}
+	if value, ok := params["interleaved"]; ok {
+		channel, err := strconv.Atoi(strings.SplitN(value, "-", 2)[0])
+		if err != nil {
+			return "", err
+		}
+		element.tracks = append(element.tracks, trackST{channel: channel})
+		return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1), nil
+	}
+	if _, ok := params["multicast"]; ok {
+		addr, err := net.ResolveUDPAddr("udp", element.server.options.Multicast)
+		if err != nil {
+			return "", err
+		}
+		element.server.startMulticast(addr)
+		return fmt.Sprintf("RTP/AVP;multicast;destination=%s;port=%d-%d;ttl=1", addr.IP, addr.Port, addr.Port+1), nil
+	}
+	if value, ok := params["client_port"]; ok && element.remote != nil {
+		port, err := strconv.Atoi(strings.SplitN(value, "-", 2)[0])
+		if err != nil {
+			return "", err
+		}
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: element.remote, Port: port})
+		if err != nil {
+			return "", err
+		}
+		local := conn.LocalAddr().(*net.UDPAddr).Port
+		element.tracks = append(element.tracks, trackST{udp: conn})
+		return fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", port, port+1, local, local+1), nil
+	}
+	return "", fmt.Errorf("unsupported transport %q", transport)
+}
+
+// play sends the stream to the tracks of the session, multicast tracks
+// share the group sender started in setup
+func (element *sessionST) play() {
+	if element.stop != nil || len(element.tracks) == 0 {
+		return
+	}
+	element.stop = make(chan struct{})
+	tracks := element.tracks
+	go element.server.stream(element.stop, func(packet []byte) error {
+		for _, track := range tracks {
+			if track.udp != nil {
+				if _, err := track.udp.Write(packet); err != nil {
+					return err
+				}
+				continue
+			}
+			frame := make([]byte, 4+len(packet))
+			frame[0] = '$'
+			frame[1] = byte(track.channel)
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+			copy(frame[4:], packet)
+			if err := element.write(frame); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (element *sessionST) teardown() {
+	element.server.mutex.Lock()
+	element.server.sessions--
+	element.server.mutex.Unlock()
+	if element.stop != nil {
+		close(element.stop)
+	}
+	for _, track := range element.tracks {
+		if track.udp != nil {
+			track.udp.Close()
+		}
+	}
+}
+
+func (element *sessionST) write(data []byte) error {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	_, err := element.out.Write(data)
+	return err
+}
+
+func (element *sessionST) reply(cseq, status string, headers map[string]string, body []byte) {
+	var builder strings.Builder
+	builder.WriteString("RTSP/1.0 " + status + "\r\nCSeq: " + cseq + "\r\n")
+	for k, v := range headers {
+		builder.WriteString(k + ": " + v + "\r\n")
+	}
+	if body != nil {
+		builder.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+	builder.WriteString("\r\n")
+	builder.Write(body)
+	element.write([]byte(builder.String()))
+}
+
+// readRequest reads one request, header names are lower cased. Interleaved
+// data from the client, RTCP receiver reports, is skipped.
+func readRequest(reader *bufio.Reader) (method, uri string, headers map[string]string, err error) {
+	for {
+		peek, err := reader.Peek(1)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if peek[0] != '$' {
+			break
+		}
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(reader, header); err != nil {
+			return "", "", nil, err
+		}
+		if _, err = reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+			return "", "", nil, err
+		}
+	}
+	headers = make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if method == "" {
+				continue
+			}
+			break
+		}
+		if method == "" {
+			parts := strings.Fields(line)
+			if len(parts) != 3 {
+				return "", "", nil, fmt.Errorf("bad request line %q", line)
+			}
+			method, uri = parts[0], parts[1]
+			continue
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			headers[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	if length, _ := strconv.Atoi(headers["content-length"]); length > 0 {
+		_, err = reader.Discard(length)
+	}
+	return method, uri, headers, err
+}
+
+// startMulticast sends the stream to the group until the server closes,
+// like a camera with multicast enabled
+func (element *ServerST) startMulticast(addr *net.UDPAddr) {
+	element.multicast.Do(func() {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			log.Println("Multicast", err)
+			return
+		}
+		log.Println("Sending multicast to", addr)
+		go func() {
+			defer conn.Close()
+			element.stream(element.stop, func(packet []byte) error {
+				_, err := conn.Write(packet)
+				return err
+			})
+		}()
+	})
+}
+
+func sdp() string {
+	return "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=fixture\r\n" +
+		"t=0 0\r\n" +
+		"a=control:*\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1;profile-level-id=42c01e;sprop-parameter-sets=" +
+		base64.StdEncoding.EncodeToString(sps()) + "," + base64.StdEncoding.EncodeToString(pps()) + "\r\n" +
+		"a=control:track1\r\n"
+}
+
+// stream packetizes frames at the configured rate until stop is closed or
+// send fails. Keyframes are preceded by SPS and PPS.
+func (element *ServerST) stream(stop chan struct{}, send func([]byte) error) {
+	options := element.options
+	ticker := time.NewTicker(time.Second / time.Duration(options.FPS))
+	defer ticker.Stop()
+	seq := uint16(rand.Uint32())
+	ssrc := rand.Uint32()
+	timestamp := rand.Uint32()
+	for frame := 0; ; frame++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		nalus := [][]byte{nalu(0x41, options.FrameSize)}
+		if frame%options.GOP == 0 {
+			nalus = [][]byte{sps(), pps(), nalu(0x65, options.FrameSize)}
+		}
+		for i, unit := range nalus {
+			for _, payload := range fragment(unit) {
+				packet := make([]byte, 12+len(payload))
+				packet[0] = 0x80
+				packet[1] = 96
+				if i == len(nalus)-1 && (len(unit) <= maxPayload || payload[1]&0x40 != 0) {
+					packet[1] |= 0x80
+				}
+				binary.BigEndian.PutUint16(packet[2:], seq)
+				binary.BigEndian.PutUint32(packet[4:], timestamp)
+				binary.BigEndian.PutUint32(packet[8:], ssrc)
+				copy(packet[12:], payload)
+				seq++
+				if err := send(packet); err != nil {
+					return
+				}
+			}
+		}
+		timestamp += uint32(90000 / options.FPS)
+	}
+}
+
+// fragment splits a NAL unit into FU-A payloads when it does not fit one
+// packet
+func fragment(unit []byte) [][]byte {
+	if len(unit) <= maxPayload {
+		return [][]byte{unit}
+	}
+	var res [][]byte
+	indicator := unit[0]&0xe0 | 28
+	for data, first := unit[1:], true; len(data) > 0; first = false {
+		n := len(data)
+		if n > maxPayload-2 {
+			n = maxPayload - 2
+		}
+		header := unit[0] & 0x1f
+		if first {
+			header |= 0x80
+		}
+		if n == len(data) {
+			header |= 0x40
+		}
+		res = append(res, append([]byte{indicator, header}, data[:n]...))
+		data = data[n:]
+	}
+	return res
+}
+
+// nalu is a slice of the given header filled up to size, the filler has no
+// zero bytes so it never looks like a start code
+func nalu(header byte, size int) []byte {
+	res := make([]byte, size)
+	res[0] = header
+	for i := 1; i < size; i++ {
+		res[i] = 0xaa
+	}
+	return res
+}
+
+// sps describes 320x240 baseline video
+func sps() []byte {
+	var w bitWriter
+	w.bits(0x67, 8)
+	w.bits(66, 8) // profile_idc baseline
+	w.bits(0xc0, 8)
+	w.bits(30, 8) // level_idc 3.0
+	w.ue(0)       // seq_parameter_set_id
+	w.ue(0)       // log2_max_frame_num_minus4
+	w.ue(2)       // pic_order_cnt_type
+	w.ue(1)       // max_num_ref_frames
+	w.bits(0, 1)  // gaps_in_frame_num_value_allowed_flag
+	w.ue(19)      // pic_width_in_mbs_minus1
+	w.ue(14)      // pic_height_in_map_units_minus1
+	w.bits(1, 1)  // frame_mbs_only_flag
+	w.bits(1, 1)  // direct_8x8_inference_flag
+	w.bits(0, 1)  // frame_cropping_flag
+	w.bits(0, 1)  // vui_parameters_present_flag
+	return w.trailing()
+}
+
+func pps() []byte {
+	var w bitWriter
+	w.bits(0x68, 8)
+	w.ue(0)      // pic_parameter_set_id
+	w.ue(0)      // seq_parameter_set_id
+	w.bits(0, 1) // entropy_coding_mode_flag
+	w.bits(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)      // num_slice_groups_minus1
+	w.ue(0)      // num_ref_idx_l0_default_active_minus1
+	w.ue(0)      // num_ref_idx_l1_default_active_minus1
+	w.bits(0, 1) // weighted_pred_flag
+	w.bits(0, 2) // weighted_bipred_idc
+	w.se(0)      // pic_init_qp_minus26
+	w.se(0)      // pic_init_qs_minus26
+	w.se(0)      // chroma_qp_index_offset
+	w.bits(1, 1) // deblocking_filter_control_present_flag
+	w.bits(0, 1) // constrained_intra_pred_flag
+	w.bits(0, 1) // redundant_pic_cnt_present_flag
+	return w.trailing()
+}
+
+// bitWriter writes the Exp-Golomb coded fields of parameter sets
+type bitWriter struct {
+	buf []byte
+	n   uint
+}
+
+func (element *bitWriter) bits(value uint32, count uint) {
+	for i := count; i > 0; i-- {
+		if element.n%8 == 0 {
+			element.buf = append(element.buf, 0)
+		}
+		if value>>(i-1)&1 == 1 {
+			element.buf[len(element.buf)-1] |= 0x80 >> (element.n % 8)
+		}
+		element.n++
+	}
+}
+
+func (element *bitWriter) ue(value uint32) {
+	value++
+	length := uint(0)
+	for v := value; v > 1; v >>= 1 {
+		length++
+	}
+	element.bits(0, length)
+	element.bits(value, length+1)
+}
+
+func (element *bitWriter) se(value int32) {
+	if value > 0 {
+		element.ue(uint32(2*value - 1))
+	} else {
+		element.ue(uint32(-2 * value))
+	}
+}
+
+// trailing adds the rbsp stop bit and byte alignment
+func (element *bitWriter) trailing() []byte {
+	element.bits(1, 1)
+	for element.n%8 != 0 {
+		element.bits(0, 1)
+	}
+	return element.buf
+}
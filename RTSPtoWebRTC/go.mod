@@ -5,6 +5,8 @@ go 1.18
 require (
 	github.com/deepch/vdk v0.0.20
 	github.com/gin-gonic/gin v1.9.0
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.7.0
 )
 
 require (
@@ -43,7 +45,6 @@ require (
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/ugorji/go/codec v1.2.11 // indirect
 	golang.org/x/arch v0.3.0 // indirect
-	golang.org/x/crypto v0.7.0 // indirect
 	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
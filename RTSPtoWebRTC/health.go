@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// healthErrorWindow is how long a worker error lowers the health score
+	healthErrorWindow = 10 * time.Minute
+	// healthKeyframeMax is the keyframe interval above which a viewer
+	// joining waits noticeably for the first picture
+	healthKeyframeMax = 10 * time.Second
+	// healthQuietAfter is how long without packets a connected source is
+	// no longer counted as up
+	healthQuietAfter = 2 * hubRateWindow
+)
+
+// StreamHealthST is the state of the source connection of one stream,
+// combining the counters of its hub and worker
+type StreamHealthST struct {
+	// Score rates the stream from 0, offline, to 100 for the dashboard
+	Score            int        `json:"score"`
+	LastError        string     `json:"last_error,omitempty"`
+	LastErrorTime    *time.Time `json:"last_error_time,omitempty"`
+	LastConnect      *time.Time `json:"last_connect,omitempty"`
+	Uptime           float64    `json:"uptime_seconds"`
+	Reconnects       uint64     `json:"reconnects"`
+	PacketRate       float64    `json:"packet_rate"`
+	Bitrate          float64    `json:"bitrate"`
+	KeyframeInterval float64    `json:"keyframe_interval_seconds"`
+	// Failures are consecutive, after ReconnectST.SuspendAfter of them the
+	// stream is Suspended until retried
+	Failures  int        `json:"failures"`
+	Suspended bool       `json:"suspended"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+}
+
+// StreamInfoST is a stream as listed by the API, with its health
+type StreamInfoST struct {
+	StreamST
+	Health StreamHealthST `json:"health"`
+}
+
+// streamHealth reports the health of stream, the caller holds Config.mutex
+func streamHealth(uuid string, stream StreamST) StreamHealthST {
+	now := time.Now()
+	worker := Metrics.worker(uuid)
+	res := StreamHealthST{
+		LastError:  worker.LastError,
+		Reconnects: worker.Reconnects,
+		Failures:   stream.retry.Failures,
+		Suspended:  stream.retry.Suspended,
+	}
+	if stream.retry.NextRetry.After(now) {
+		res.NextRetry = &stream.retry.NextRetry
+	}
+	if !worker.LastErrorTime.IsZero() {
+		res.LastErrorTime = &worker.LastErrorTime
+	}
+	var stats HubStatsST
+	if stream.hub != nil {
+		stats = stream.hub.Stats()
+	}
+	if !stats.LastConnect.IsZero() {
+		res.LastConnect = &stats.LastConnect
+	}
+	if !stream.Status {
+		return res
+	}
+	// Uptime and rates only count while the current connection delivers,
+	// the rates of a source that went quiet are stale until the next packet
+	flowing := !stats.Connected.IsZero() && !stats.LastPacket.Before(stats.Connected) && now.Sub(stats.LastPacket) < healthQuietAfter
+	if flowing {
+		res.Uptime = now.Sub(stats.Connected).Round(time.Second).Seconds()
+		res.PacketRate = stats.PacketRate
+		res.Bitrate = stats.Bitrate
+	}
+	res.KeyframeInterval = stats.KeyframeInterval.Seconds()
+
+	res.Score = 100
+	if !flowing || res.PacketRate == 0 && res.Uptime >= hubRateWindow.Seconds() {
+		res.Score -= 50
+	}
+	if !worker.LastErrorTime.IsZero() && now.Sub(worker.LastErrorTime) < healthErrorWindow {
+		res.Score -= 25
+	}
+	if stats.KeyframeInterval > healthKeyframeMax {
+		res.Score -= 25
+	}
+	return res
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A worker reconnecting within one run never resets the hub, every dial
+// must still start a new connection
+func TestHubConnectedEveryDial(t *testing.T) {
+	hub := testHub(t)
+	hub.connected()
+	first := hub.Stats().Connected
+	if first.IsZero() || hub.Stats().LastConnect != first {
+		t.Fatalf("dial not stamped: %+v", hub.Stats())
+	}
+	hub.cast(testPacket(true, 0))
+
+	hub.disconnected()
+	if stats := hub.Stats(); !stats.Connected.IsZero() || stats.LastConnect != first {
+		t.Errorf("after an error Connected %v, LastConnect %v", stats.Connected, stats.LastConnect)
+	}
+	if sub := hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(sub.C) != 0 {
+		t.Errorf("prefilled %d packets of the dropped connection", len(sub.C))
+	}
+
+	time.Sleep(time.Millisecond)
+	hub.connected()
+	if stats := hub.Stats(); !stats.Connected.After(first) || stats.LastConnect != stats.Connected {
+		t.Errorf("reconnect not stamped: %+v", stats)
+	}
+	if !hub.cast(testPacket(true, 0)) {
+		t.Error("first packet after a reconnect not reported")
+	}
+}
+
+func TestStreamHealthUptime(t *testing.T) {
+	now := time.Now()
+	connected := now.Add(-time.Minute)
+	tests := []struct {
+		name   string
+		status bool
+		stats  HubStatsST
+		uptime float64
+		score  int
+	}{
+		{"flowing", true, HubStatsST{Connected: connected, LastConnect: connected, LastPacket: now, PacketRate: 25}, 60, 100},
+		{"quiet", true, HubStatsST{Connected: connected, LastConnect: connected, LastPacket: now.Add(-healthQuietAfter - time.Second), PacketRate: 25}, 0, 50},
+		{"no packet since reconnect", true, HubStatsST{Connected: now.Add(-time.Second), LastConnect: now.Add(-time.Second), LastPacket: connected}, 0, 50},
+		{"disconnected", true, HubStatsST{LastConnect: connected, LastPacket: now}, 0, 50},
+		{"stopped", false, HubStatsST{LastConnect: connected, LastPacket: connected}, 0, 0},
+	}
+	for _, test := range tests {
+		hub := newHub(test.name)
+		hub.stats = test.stats
+		res := streamHealth(test.name, StreamST{Status: test.status, hub: hub})
+		if res.Uptime != test.uptime || res.Score != test.score {
+			t.Errorf("%s: uptime %v score %d, want %v and %d", test.name, res.Uptime, res.Score, test.uptime, test.score)
+		}
+		if res.LastConnect == nil || !res.LastConnect.Equal(test.stats.LastConnect) {
+			t.Errorf("%s: last connect %v, want %v", test.name, res.LastConnect, test.stats.LastConnect)
+		}
+	}
+}
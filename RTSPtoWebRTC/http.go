@@ -25,6 +25,7 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, ngrok-skip-browser-warning")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", ViewerIDHeader)
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -33,38 +34,118 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
+// httpLogFormatter is the gin default log line without colors and with the
+// token query parameter redacted
+func httpLogFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		redactToken(param.Path),
+		param.ErrorMessage,
+	)
+}
+
 type JCodec struct {
 	Type string
 }
 
 func serveHTTP() {
 	gin.SetMode(gin.ReleaseMode)
-	router := gin.Default()
-	router.Use(CORSMiddleware())
+	router := newRouter()
+	err := router.Run(Config.Server.HTTPPort)
+	if err != nil {
+		log.Fatalln("Start HTTP Server error", err)
+	}
+}
+
+// newRouter registers every route with its access checks
+func newRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(httpLogFormatter), gin.Recovery(), CORSMiddleware())
 
 	if _, err := os.Stat("./web"); !os.IsNotExist(err) {
 		router.LoadHTMLGlob("web/templates/*")
 		router.GET("/", HTTPAPIServerIndex)
 		router.GET("/stream/player/:uuid", HTTPAPIServerStreamPlayer)
 	}
-	router.GET("/api/streams", func(c *gin.Context) {
-		Config.mutex.Lock()
-		defer Config.mutex.Unlock()
-		c.JSON(http.StatusOK, gin.H{"streams": Config.Streams})
-	})
-	router.GET("/stream/info/:uuid", HTTPAPIServerStreamInfo)
-	router.POST("/stream/receiver/:uuid", HTTPAPIServerStreamWebRTC)
-	router.GET("/stream/codec/:uuid", HTTPAPIServerStreamCodec)
-	router.POST("/stream", HTTPAPIServerStreamWebRTC2)
-	router.POST("/api/streams", HTTPAPIAddStream)
-	router.PUT("/api/stream/:uuid", HTTPAPIUpdateStream)
-	router.DELETE("/api/stream/:uuid", HTTPAPIDeleteStream)
+	router.POST("/api/auth/login", HTTPAPIAuthLogin)
+	router.POST("/api/auth/refresh", HTTPAPIAuthRefresh)
+	// Players fetch playlist segments with the media token of the playlist
+	router.GET("/api/playback/:uuid/segment/:name", MediaAuthMiddleware(), StreamAccess(RoleViewer), HTTPAPIServerPlaybackSegment)
+
+	// Everything below needs a token from /api/auth/login
+	private := router.Group("/", AuthMiddleware())
+	private.POST("/api/auth/logout", HTTPAPIAuthLogout)
+	private.GET("/api/auth/me", HTTPAPIAuthMe)
+	private.POST("/api/auth/password", HTTPAPIAuthPassword)
+	private.GET("/api/streams", HTTPAPIServerStreams)
+	private.GET("/stream/info/:uuid", StreamAccess(RoleViewer), HTTPAPIServerStreamInfo)
+	private.POST("/stream/receiver/:uuid", StreamAccess(RoleViewer), HTTPAPIServerStreamWebRTC)
+	private.GET("/stream/codec/:uuid", StreamAccess(RoleViewer), HTTPAPIServerStreamCodec)
+	private.POST("/stream", HTTPAPIServerStreamWebRTC2)
+	private.GET("/api/playback/:uuid", StreamAccess(RoleViewer), HTTPAPIServerPlayback)
+	private.GET("/api/playback/:uuid/ranges", StreamAccess(RoleViewer), HTTPAPIServerPlaybackRanges)
+	private.POST("/api/playback/:uuid/webrtc", StreamAccess(RoleViewer), HTTPAPIServerPlaybackWebRTC)
+	private.GET("/api/playback/:uuid/webrtc/:session", StreamAccess(RoleViewer), HTTPAPIServerPlaybackSession)
+	private.POST("/api/playback/:uuid/webrtc/:session", StreamAccess(RoleViewer), HTTPAPIControlPlaybackSession)
+	private.DELETE("/api/playback/:uuid/webrtc/:session", StreamAccess(RoleViewer), HTTPAPIStopPlaybackSession)
+	private.POST("/api/streams", RequireRole(RoleAdmin), HTTPAPIAddStream)
+	private.PUT("/api/stream/:uuid", StreamAccess(RoleOperator), HTTPAPIUpdateStream)
+	private.DELETE("/api/stream/:uuid", RequireRole(RoleAdmin), HTTPAPIDeleteStream)
+	private.POST("/api/stream/:uuid/retry", StreamAccess(RoleOperator), HTTPAPIServerStreamRetry)
+	private.GET("/api/stream/:uuid/record", StreamAccess(RoleViewer), HTTPAPIServerStreamRecord)
+	private.PUT("/api/stream/:uuid/record", StreamAccess(RoleOperator), HTTPAPIUpdateStreamRecord)
+	private.GET("/api/stream/:uuid/snapshot.jpg", StreamAccess(RoleViewer), HTTPAPIServerStreamSnapshot)
+	private.GET("/api/stream/:uuid/viewers", StreamAccess(RoleOperator), HTTPAPIServerStreamViewers)
+	private.GET("/api/storage", RequireRole(RoleOperator), HTTPAPIServerStorage)
+	private.GET("/metrics", RequireRole(RoleAdmin), HTTPAPIServerMetrics)
+	private.POST("/api/exports", RequireRole(RoleOperator), HTTPAPIAddExport)
+	private.GET("/api/exports", RequireRole(RoleOperator), HTTPAPIServerExports)
+	private.GET("/api/exports/:id", RequireRole(RoleOperator), HTTPAPIServerExport)
+	private.GET("/api/exports/:id/download", RequireRole(RoleOperator), HTTPAPIServerExportDownload)
+	private.DELETE("/api/exports/:id", RequireRole(RoleOperator), HTTPAPIDeleteExport)
+	private.GET("/api/events", HTTPAPIServerEvents)
+	private.POST("/api/events", RequireRole(RoleOperator), HTTPAPIAddEvent)
+	private.GET("/api/events/:id", HTTPAPIServerEvent)
+	private.PUT("/api/events/:id", HTTPAPIUpdateEvent)
+	private.DELETE("/api/events/:id", HTTPAPIDeleteEvent)
+	private.GET("/api/alerts", HTTPAPIServerAlerts)
+	private.POST("/api/alerts", RequireRole(RoleOperator), HTTPAPIAddAlert)
+	private.GET("/api/alerts/:id", HTTPAPIServerAlert)
+	private.POST("/api/alerts/:id/acknowledge", RequireRole(RoleOperator), HTTPAPIAcknowledgeAlert)
+	private.POST("/api/alerts/:id/resolve", RequireRole(RoleOperator), HTTPAPIResolveAlert)
+	private.GET("/api/push", HTTPAPIServerPush)
+	private.GET("/api/tickets", HTTPAPIServerTickets)
+	private.POST("/api/tickets", RequireRole(RoleOperator), HTTPAPIAddTicket)
+	private.GET("/api/tickets/:id", HTTPAPIServerTicket)
+	private.PUT("/api/tickets/:id", HTTPAPIUpdateTicket)
+	private.DELETE("/api/tickets/:id", HTTPAPIDeleteTicket)
+	private.POST("/api/tickets/:id/attachments", HTTPAPIAddTicketAttachment)
+	private.GET("/api/tickets/:id/attachments/:n", HTTPAPIServerTicketAttachment)
+	private.POST("/api/config/reload", RequireRole(RoleAdmin), HTTPAPIReloadConfig)
+	private.GET("/api/webhooks", RequireRole(RoleAdmin), HTTPAPIServerWebhooks)
+	private.GET("/api/webhooks/deliveries", RequireRole(RoleAdmin), HTTPAPIServerWebhookDeliveries)
+	private.POST("/api/webhooks/:name/test", RequireRole(RoleAdmin), HTTPAPITestWebhook)
+	private.GET("/api/alert-rules", RequireRole(RoleAdmin), HTTPAPIServerAlertRules)
+	private.POST("/api/alert-rules", RequireRole(RoleAdmin), HTTPAPIAddAlertRule)
+	private.PUT("/api/alert-rules/:id", RequireRole(RoleAdmin), HTTPAPIUpdateAlertRule)
+	private.DELETE("/api/alert-rules/:id", RequireRole(RoleAdmin), HTTPAPIDeleteAlertRule)
+	private.GET("/api/audit", RequireRole(RoleAdmin), HTTPAPIServerAudit)
+	private.GET("/api/audit/verify", RequireRole(RoleAdmin), HTTPAPIServerAuditVerify)
+	private.GET("/api/users", RequireRole(RoleAdmin), HTTPAPIServerUsers)
+	private.POST("/api/users", RequireRole(RoleAdmin), HTTPAPIAddUser)
+	private.GET("/api/users/:username", RequireRole(RoleAdmin), HTTPAPIServerUser)
+	private.PUT("/api/users/:username", RequireRole(RoleAdmin), HTTPAPIUpdateUser)
+	private.DELETE("/api/users/:username", RequireRole(RoleAdmin), HTTPAPIDeleteUser)
 
 	router.StaticFS("/static", http.Dir("web/static"))
-	err := router.Run(Config.Server.HTTPPort)
-	if err != nil {
-		log.Fatalln("Start HTTP Server error", err)
-	}
+	return router
 }
 
 func HTTPAPIServerIndex(c *gin.Context) {
@@ -92,17 +173,36 @@ func HTTPAPIServerStreamPlayer(c *gin.Context) {
 	})
 }
 
+// HTTPAPIServerStreams lists the streams the user is granted
+func HTTPAPIServerStreams(c *gin.Context) {
+	user := currentUser(c)
+	Config.mutex.RLock()
+	defer Config.mutex.RUnlock()
+	streams := make(map[string]StreamInfoST)
+	for uuid, stream := range Config.Streams {
+		if user.CanStream(uuid) {
+			// Publish keys are for admins like the webhook secrets
+			if !user.HasRole(RoleAdmin) {
+				stream.PublishKey = ""
+			}
+			streams[uuid] = StreamInfoST{StreamST: stream, Health: streamHealth(uuid, stream)}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"streams": streams})
+}
+
 func HTTPAPIServerStreamInfo(c *gin.Context) {
 	uuid := c.Param("uuid")
 	log.Println("Fetching stream info for", uuid)
-	Config.mutex.Lock()
-	defer Config.mutex.Unlock()
+	Config.mutex.RLock()
+	defer Config.mutex.RUnlock()
 	if stream, ok := Config.Streams[uuid]; ok {
 		c.JSON(http.StatusOK, gin.H{
 			"uuid":     uuid,
 			"url":      stream.URL,
 			"onDemand": stream.OnDemand,
 			"status":   stream.Status,
+			"health":   streamHealth(uuid, stream),
 		})
 	} else {
 		log.Println("Stream not found for info request", uuid)
@@ -160,6 +260,10 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 			c.String(http.StatusInternalServerError, "Internal Server Error")
 		}
 	}()
+	negotiated := false
+	defer func() {
+		Metrics.webrtcSession(MetricsSessionLive, negotiated)
+	}()
 
 	suuid := c.Param("uuid")
 	log.Println("WebRTC request for stream", suuid)
@@ -215,29 +319,52 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 		}
 	}
 
+	negotiated = true
+	// Subscribed before answering so the client learns its viewer id,
+	// push messages for this viewer carry it
+	sub := Config.clAd(suuid, SubscriberViewer)
+	if sub == nil {
+		muxerWebRTC.Close()
+		c.String(http.StatusNotFound, "Stream Not Found")
+		return
+	}
 	log.Println("Sending SDP answer for stream", suuid, answer)
 	c.Writer.Header().Set("Content-Type", "text/plain")
+	c.Writer.Header().Set(ViewerIDHeader, sub.ID)
 	_, err = c.Writer.Write([]byte(answer))
 	if err != nil {
 		log.Println("Write error for stream", suuid, err)
+		Config.clDe(suuid, sub.ID)
+		muxerWebRTC.Close()
 		return
 	}
 
+	actor, ip := c.GetString(authUserKey), c.ClientIP()
 	go func() {
-		cid, ch := Config.clAd(suuid)
-		defer Config.clDe(suuid, cid)
+		defer Config.clDe(suuid, sub.ID)
+		Audit.Add(actor, ip, AuditViewStart, suuid, "client "+sub.ID, nil)
+		Events.stream(suuid, EventViewerJoin, EventPriorityLow, "Viewer joined", actor+" started watching from "+ip)
+		defer func(started time.Time) {
+			watched := time.Since(started).Round(time.Second).String()
+			Audit.Add(actor, ip, AuditViewStop, suuid, "client "+sub.ID+" watched "+watched, nil)
+			Events.stream(suuid, EventViewerLeave, EventPriorityLow, "Viewer left", actor+" stopped watching after "+watched)
+		}(time.Now())
 		defer muxerWebRTC.Close()
-		log.Println("Starting WebRTC stream for", suuid, "with client ID", cid)
+		log.Println("Starting WebRTC stream for", suuid, "with client ID", sub.ID)
 		var videoStart bool
-		noVideo := time.NewTimer(10 * time.Second)
+		noVideoTimeout := Config.timeouts(suuid).NoVideo
+		noVideo := time.NewTimer(noVideoTimeout)
 		for {
 			select {
 			case <-noVideo.C:
-				log.Println("No video received for stream", suuid, "within 10 seconds")
+				log.Println("No video received for stream", suuid, "within", noVideoTimeout)
+				return
+			case <-sub.Done:
+				viewerDisconnected(suuid, sub)
 				return
-			case pck := <-ch:
+			case pck := <-sub.C:
 				if pck.IsKeyFrame || AudioOnly {
-					noVideo.Reset(10 * time.Second)
+					noVideo.Reset(noVideoTimeout)
 					videoStart = true
 					log.Println("Received key frame or audio packet for stream", suuid)
 				}
@@ -257,6 +384,8 @@ func HTTPAPIServerStreamWebRTC(c *gin.Context) {
 type Response struct {
 	Tracks []string `json:"tracks"`
 	Sdp64  string   `json:"sdp64"`
+	// Viewer identifies the session in viewer.substream push messages
+	Viewer string `json:"viewer"`
 }
 
 type ResponseError struct {
@@ -321,6 +450,10 @@ func HTTPAPIServerStreamWebRTC2(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, ResponseError{Error: "Internal Server Error"})
 		}
 	}()
+	negotiated := false
+	defer func() {
+		Metrics.webrtcSession(MetricsSessionLive, negotiated)
+	}()
 
 	url := c.PostForm("url")
 	normalizedURL := normalizeRTSPURL(url)
@@ -328,16 +461,22 @@ func HTTPAPIServerStreamWebRTC2(c *gin.Context) {
 
 	// Check if stream already exists with normalized URL
 	if existingID, found := findExistingStreamByURL(normalizedURL); found {
+		if !canStream(c, existingID, RoleViewer) {
+			return
+		}
 		log.Printf("Found existing stream with ID %s for URL %s", existingID, url)
 		url = existingID // Use existing stream ID
 	} else {
 		// Only add new stream if it doesn't exist
+		if !canStream(c, normalizedURL, RoleAdmin) {
+			return
+		}
 		Config.mutex.Lock()
 		Config.Streams[normalizedURL] = StreamST{
 			URL:      url, // Keep original URL for connection
 			Name:     url,
 			OnDemand: true,
-			Cl:       make(map[string]viewer),
+			hub:      newHub(normalizedURL),
 		}
 		Config.mutex.Unlock()
 		log.Printf("Added new stream to config: %s", normalizedURL)
@@ -349,7 +488,12 @@ func HTTPAPIServerStreamWebRTC2(c *gin.Context) {
 	codecs := Config.coGe(url)
 	if codecs == nil {
 		log.Println("Stream Codec Not Found for", url)
-		c.JSON(500, ResponseError{Error: Config.LastError.Error()})
+		// Report why this stream failed, not whichever stream failed last
+		msg := "stream codec not found"
+		if last := Metrics.worker(url).LastError; last != "" {
+			msg = last
+		}
+		c.JSON(500, ResponseError{Error: msg})
 		return
 	}
 	log.Println("Codecs retrieved for stream", url)
@@ -374,6 +518,7 @@ func HTTPAPIServerStreamWebRTC2(c *gin.Context) {
 		return
 	}
 
+	negotiated = true
 	response := Response{
 		Sdp64: answer,
 	}
@@ -393,26 +538,45 @@ func HTTPAPIServerStreamWebRTC2(c *gin.Context) {
 		}
 	}
 
+	sub := Config.clAd(url, SubscriberViewer)
+	if sub == nil {
+		muxerWebRTC.Close()
+		c.JSON(http.StatusNotFound, ResponseError{Error: "Stream not found"})
+		return
+	}
+	response.Viewer = sub.ID
+
 	log.Println("Sending WebRTC2 response for stream", url, response)
 	c.JSON(200, response)
 
 	AudioOnly := len(codecs) == 1 && codecs[0].Type().IsAudio()
 
+	actor, ip := c.GetString(authUserKey), c.ClientIP()
 	go func() {
-		cid, ch := Config.clAd(url)
-		defer Config.clDe(url, cid)
+		defer Config.clDe(url, sub.ID)
+		Audit.Add(actor, ip, AuditViewStart, url, "client "+sub.ID, nil)
+		Events.stream(url, EventViewerJoin, EventPriorityLow, "Viewer joined", actor+" started watching from "+ip)
+		defer func(started time.Time) {
+			watched := time.Since(started).Round(time.Second).String()
+			Audit.Add(actor, ip, AuditViewStop, url, "client "+sub.ID+" watched "+watched, nil)
+			Events.stream(url, EventViewerLeave, EventPriorityLow, "Viewer left", actor+" stopped watching after "+watched)
+		}(time.Now())
 		defer muxerWebRTC.Close()
-		log.Println("Starting WebRTC2 stream for", url, "with client ID", cid)
+		log.Println("Starting WebRTC2 stream for", url, "with client ID", sub.ID)
 		var videoStart bool
-		noVideo := time.NewTimer(10 * time.Second)
+		noVideoTimeout := Config.timeouts(url).NoVideo
+		noVideo := time.NewTimer(noVideoTimeout)
 		for {
 			select {
 			case <-noVideo.C:
-				log.Println("No video received for stream", url, "within 10 seconds")
+				log.Println("No video received for stream", url, "within", noVideoTimeout)
+				return
+			case <-sub.Done:
+				viewerDisconnected(url, sub)
 				return
-			case pck := <-ch:
+			case pck := <-sub.C:
 				if pck.IsKeyFrame || AudioOnly {
-					noVideo.Reset(10 * time.Second)
+					noVideo.Reset(noVideoTimeout)
 					videoStart = true
 					log.Println("Received key frame or audio packet for stream", url)
 				}
@@ -438,11 +602,16 @@ func HTTPAPIAddStream(c *gin.Context) {
 	}()
 
 	var newStream struct {
-		Name         string `json:"name"`
-		URL          string `json:"url"`
-		OnDemand     bool   `json:"on_demand"`
-		DisableAudio bool   `json:"disable_audio"`
-		Debug        bool   `json:"debug"`
+		Name         string      `json:"name"`
+		URL          string      `json:"url"`
+		OnDemand     bool        `json:"on_demand"`
+		DisableAudio bool        `json:"disable_audio"`
+		Debug        bool        `json:"debug"`
+		Timeouts     *TimeoutsST `json:"timeouts"`
+		Transport    string      `json:"transport"`
+		Ingest       string      `json:"ingest"`
+		PublishKey   string      `json:"publish_key"`
+		Substream    string      `json:"substream"`
 	}
 	log.Println("Received POST /api/streams request")
 	if err := c.ShouldBindJSON(&newStream); err != nil {
@@ -450,14 +619,35 @@ func HTTPAPIAddStream(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
-	log.Println("Parsed stream data:", newStream)
+	if newStream.Ingest != "" && newStream.PublishKey == "" {
+		newStream.PublishKey = randomToken(publishKeyBytes)
+	}
+	timeouts, err := streamTimeouts(newStream.Timeouts, nil)
+	if err == nil {
+		err = validateTransport(newStream.Transport, newStream.URL)
+	}
+	if err == nil {
+		err = validateIngest(StreamST{Ingest: newStream.Ingest, PublishKey: newStream.PublishKey, Transport: newStream.Transport})
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Println("Parsed stream data:", newStream.Name, newStream.URL, newStream.Ingest)
 
+	var audit AuditPendingST
+	defer audit.Flush()
 	Config.mutex.Lock()
 	defer Config.mutex.Unlock()
 
-	// Check if stream URL already exists
+	if err := validateSubstream("", newStream.Substream, Config.Streams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if stream URL already exists, ingest streams have none
 	for _, stream := range Config.Streams {
-		if stream.URL == newStream.URL {
+		if newStream.URL != "" && stream.URL == newStream.URL {
 			log.Println("Stream with URL already exists:", newStream.URL)
 			c.JSON(http.StatusConflict, gin.H{"error": "Stream with this URL already exists"})
 			return
@@ -481,8 +671,13 @@ func HTTPAPIAddStream(c *gin.Context) {
 		OnDemand:     newStream.OnDemand,
 		DisableAudio: newStream.DisableAudio,
 		Debug:        newStream.Debug,
+		Timeouts:     timeouts,
+		Transport:    newStream.Transport,
+		Ingest:       newStream.Ingest,
+		PublishKey:   newStream.PublishKey,
+		Substream:    newStream.Substream,
 		Status:       false,
-		Cl:           make(map[string]viewer),
+		hub:          newHub(streamID),
 	}
 	log.Println("Added stream to config with ID:", streamID)
 
@@ -492,6 +687,7 @@ func HTTPAPIAddStream(c *gin.Context) {
 		return
 	}
 	log.Println("Saved config successfully for stream:", streamID)
+	audit.Set(c, AuditStreamAdd, streamID, "", auditDiff(nil, Config.Streams[streamID], "status", "publish_key"))
 
 	// Initialize stream to fetch codecs and status
 	go func() {
@@ -501,12 +697,17 @@ func HTTPAPIAddStream(c *gin.Context) {
 	}()
 	log.Println("Initialized stream:", streamID)
 
-	c.JSON(http.StatusOK, gin.H{
+	res := gin.H{
 		"id":     streamID,
 		"name":   newStream.Name,
 		"url":    newStream.URL,
 		"status": Config.Streams[streamID].Status,
-	})
+	}
+	if newStream.Ingest != "" {
+		res["ingest"] = newStream.Ingest
+		res["publish_key"] = newStream.PublishKey
+	}
+	c.JSON(http.StatusOK, res)
 }
 
 func generateStreamID(name string) string {
@@ -525,11 +726,17 @@ func generateStreamID(name string) string {
 func HTTPAPIUpdateStream(c *gin.Context) {
 	uuid := c.Param("uuid")
 	var updatedStream struct {
-		Name         string `json:"name"`
-		URL          string `json:"url"`
-		OnDemand     bool   `json:"on_demand"`
-		DisableAudio bool   `json:"disable_audio"`
-		Debug        bool   `json:"debug"`
+		Name         string      `json:"name"`
+		URL          string      `json:"url"`
+		OnDemand     bool        `json:"on_demand"`
+		DisableAudio bool        `json:"disable_audio"`
+		Debug        bool        `json:"debug"`
+		Timeouts     *TimeoutsST `json:"timeouts"`
+		Transport    *string     `json:"transport"`
+		// PublishKey replaces the key of an ingest stream, empty generates one
+		PublishKey *string `json:"publish_key"`
+		// Substream is kept when left out, empty removes it
+		Substream *string `json:"substream"`
 	}
 	if err := c.ShouldBindJSON(&updatedStream); err != nil {
 		log.Println("Invalid request body:", err)
@@ -537,29 +744,82 @@ func HTTPAPIUpdateStream(c *gin.Context) {
 		return
 	}
 
+	admin := currentUser(c).HasRole(RoleAdmin)
+	if updatedStream.PublishKey != nil && !admin {
+		c.JSON(http.StatusForbidden, gin.H{"error": ErrorUserForbidden.Error()})
+		return
+	}
+
+	var audit AuditPendingST
+	defer audit.Flush()
 	Config.mutex.Lock()
 	defer Config.mutex.Unlock()
 
 	if stream, exists := Config.Streams[uuid]; exists {
+		timeouts, err := streamTimeouts(updatedStream.Timeouts, stream.Timeouts)
+		transport := stream.Transport
+		if updatedStream.Transport != nil {
+			transport = *updatedStream.Transport
+		}
+		publishKey := stream.PublishKey
+		if updatedStream.PublishKey != nil && stream.Ingest != "" {
+			publishKey = *updatedStream.PublishKey
+			if publishKey == "" {
+				publishKey = randomToken(publishKeyBytes)
+			}
+		}
+		if err == nil {
+			err = validateTransport(transport, updatedStream.URL)
+		}
+		if err == nil {
+			err = validateIngest(StreamST{Ingest: stream.Ingest, PublishKey: publishKey, Transport: transport})
+		}
+		substream := stream.Substream
+		if updatedStream.Substream != nil {
+			substream = *updatedStream.Substream
+		}
+		if err == nil {
+			err = validateSubstream(uuid, substream, Config.Streams)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		// Check if new URL conflicts with any other stream
 		for streamID, existingStream := range Config.Streams {
-			if streamID != uuid && existingStream.URL == updatedStream.URL {
+			if streamID != uuid && updatedStream.URL != "" && existingStream.URL == updatedStream.URL {
 				c.JSON(http.StatusConflict, gin.H{"error": "Stream with this URL already exists"})
 				return
 			}
 		}
 
-		// Update the stream in place
+		// Update the stream in place, the hub and its viewers are kept
 		Config.Streams[uuid] = StreamST{
 			URL:          updatedStream.URL,
 			Name:         updatedStream.Name,
 			OnDemand:     updatedStream.OnDemand,
 			DisableAudio: updatedStream.DisableAudio,
 			Debug:        updatedStream.Debug,
+			Record:       stream.Record,
+			Substream:    substream,
+			SlowViewer:   stream.SlowViewer,
+			Reconnect:    stream.Reconnect,
+			Timeouts:     timeouts,
+			Transport:    transport,
+			Ingest:       stream.Ingest,
+			PublishKey:   publishKey,
 			Status:       stream.Status,
 			RunLock:      stream.RunLock,
 			Codecs:       stream.Codecs,
-			Cl:           stream.Cl,
+			hub:          stream.hub,
+			worker:       stream.worker,
+			retry:        stream.retry,
+		}
+		// A new URL or source option needs a new connection. Viewers stay
+		// subscribed and continue with the first keyframe it delivers.
+		if workerOptions(stream) != workerOptions(Config.Streams[uuid]) {
+			go Config.restartWorker(uuid, Config.stopWorker(uuid))
+			log.Println("Reconnecting stream", uuid, "with the updated settings")
 		}
 
 		if err := saveConfig(); err != nil {
@@ -568,13 +828,25 @@ func HTTPAPIUpdateStream(c *gin.Context) {
 			return
 		}
 
+		detail := ""
+		if publishKey != stream.PublishKey {
+			detail = "publish key replaced"
+		}
+		audit.Set(c, AuditStreamUpdate, uuid, detail, auditDiff(stream, Config.Streams[uuid], "status", "publish_key"))
 		log.Println("Updated stream:", uuid)
-		c.JSON(http.StatusOK, gin.H{
+		res := gin.H{
 			"id":     uuid,
 			"name":   updatedStream.Name,
 			"url":    updatedStream.URL,
-			"status": stream.Status,
-		})
+			"status": Config.Streams[uuid].Status,
+		}
+		if stream.Ingest != "" {
+			res["ingest"] = stream.Ingest
+			if admin {
+				res["publish_key"] = publishKey
+			}
+		}
+		c.JSON(http.StatusOK, res)
 	} else {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
 	}
@@ -582,16 +854,19 @@ func HTTPAPIUpdateStream(c *gin.Context) {
 
 func HTTPAPIDeleteStream(c *gin.Context) {
 	uuid := c.Param("uuid")
+	var audit AuditPendingST
+	defer audit.Flush()
 	Config.mutex.Lock()
 	defer Config.mutex.Unlock()
 
-	if _, exists := Config.Streams[uuid]; exists {
-		delete(Config.Streams, uuid)
+	if stream, exists := Config.Streams[uuid]; exists {
+		Config.removeStream(uuid)
 		if err := saveConfig(); err != nil {
 			log.Println("Failed to save config:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save config"})
 			return
 		}
+		audit.Set(c, AuditStreamDelete, uuid, "", auditDiff(stream, nil, "status", "publish_key"))
 		log.Println("Deleted stream:", uuid)
 		c.JSON(http.StatusOK, gin.H{"message": "Stream deleted successfully"})
 	} else {
@@ -599,6 +874,21 @@ func HTTPAPIDeleteStream(c *gin.Context) {
 	}
 }
 
+// streamTimeouts validates the timeouts of a stream request. Leaving them
+// out keeps current, an empty object removes the override.
+func streamTimeouts(req, current *TimeoutsST) (*TimeoutsST, error) {
+	if req == nil {
+		return current, nil
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if *req == (TimeoutsST{}) {
+		return nil, nil
+	}
+	return req, nil
+}
+
 func saveConfig() error {
 	defer func() {
 		if r := recover(); r != nil {
@@ -612,11 +902,12 @@ func saveConfig() error {
 		return err
 	}
 	log.Println("Writing config to config.json")
-	err = os.WriteFile("config.json", data, 0644)
+	err = os.WriteFile(configPath, data, 0644)
 	if err != nil {
 		log.Println("Failed to write config file:", err)
 		return err
 	}
+	configWatch.saved(data)
 	log.Println("Config file written successfully")
 	return nil
 }
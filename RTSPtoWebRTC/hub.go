@@ -0,0 +1,345 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+const (
+	viewerQueueSize = 100
+	// gopCacheMaxPackets bounds the cached GOP, longer GOPs are not cached
+	gopCacheMaxPackets = 600
+	// hubRateWindow is the period packet rate and bitrate are averaged over
+	hubRateWindow = 5 * time.Second
+)
+
+// HubST fans the packets of one stream out to its subscribers. Every stream
+// has its own hub and lock, so packet distribution never touches
+// Config.mutex and cameras do not contend with each other or the API.
+type HubST struct {
+	mutex       sync.Mutex
+	uuid        string
+	subscribers map[string]*SubscriberST
+	codecs      []av.CodecData
+	gop         []av.Packet
+	keyframe    KeyframeST
+	hasKeyframe bool
+	live        bool
+	stats       HubStatsST
+	// intervalFrom is the previous keyframe of the current connection
+	intervalFrom time.Time
+	// rateFrom starts the current rate window of ratePackets and rateBytes
+	rateFrom    time.Time
+	ratePackets uint64
+	rateBytes   uint64
+	// announced is the viewer count last pushed to the clients of /api/push
+	announced int
+}
+
+// HubStatsST counts what passed through a hub since the process started
+type HubStatsST struct {
+	Packets          uint64
+	Bytes            uint64
+	Keyframes        uint64
+	Dropped          uint64
+	LastPacket       time.Time
+	LastKeyframe     time.Time
+	KeyframeInterval time.Duration
+	// Connected is when the current connection was made, zero while the
+	// worker is disconnected. LastConnect keeps it after a disconnect.
+	Connected   time.Time
+	LastConnect time.Time
+	// PacketRate and Bitrate cover the last full hubRateWindow
+	PacketRate float64
+	Bitrate    float64
+}
+
+const (
+	SubscriberViewer   = "viewer"
+	SubscriberRecorder = "recorder"
+	SubscriberSnapshot = "snapshot"
+
+	// SubscriberStreamRemoved is the Reason of subscribers of a deleted stream
+	SubscriberStreamRemoved = "stream removed"
+)
+
+// SubscriberST is the handle a viewer or recorder reads packets from
+type SubscriberST struct {
+	ID      string
+	Kind    string
+	C       chan av.Packet
+	Done    chan bool // closed when the hub disconnects the subscriber
+	Reason  string    // why Done was closed, set before closing
+	created time.Time
+	policy  SlowViewerST
+	sent    uint64
+	dropped uint64
+	// skipping drops everything until the next keyframe after an overflow
+	skipping bool
+	// Substream is where a viewer dropped with SlowViewerSubstream should
+	// reconnect, set with Reason
+	Substream string
+}
+
+func newHub(uuid string) *HubST {
+	return &HubST{
+		uuid:        uuid,
+		subscribers: make(map[string]*SubscriberST),
+	}
+}
+
+// Subscribe registers a new subscriber pre-filled with the cached GOP so
+// playback starts without waiting for the next keyframe
+func (element *HubST) Subscribe(kind string, policy SlowViewerST) *SubscriberST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	sub := &SubscriberST{
+		ID:      pseudoUUID(),
+		Kind:    kind,
+		C:       make(chan av.Packet, viewerQueueSize+len(element.gop)),
+		Done:    make(chan bool),
+		created: time.Now(),
+		policy:  policy,
+	}
+	for _, pck := range element.gop {
+		sub.C <- pck
+	}
+	element.subscribers[sub.ID] = sub
+	log.Println("Added", kind, sub.ID, "to stream", element.uuid, "with", len(element.gop), "cached packets")
+	return sub
+}
+
+// Unsubscribe removes a subscriber and returns how many are left
+func (element *HubST) Unsubscribe(id string) int {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	delete(element.subscribers, id)
+	return len(element.subscribers)
+}
+
+// Close disconnects every subscriber with reason, used when the stream is
+// removed. Subscribers that are still reading see Done closed.
+func (element *HubST) Close(reason string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	for id, sub := range element.subscribers {
+		sub.Reason = reason
+		close(sub.Done)
+		delete(element.subscribers, id)
+		log.Println("Disconnected", sub.Kind, id, "from stream", element.uuid, "reason", reason)
+	}
+}
+
+func (element *HubST) Count() int {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return len(element.subscribers)
+}
+
+// CountKind counts the subscribers of one kind
+func (element *HubST) CountKind(kind string) int {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	res := 0
+	for _, sub := range element.subscribers {
+		if sub.Kind == kind {
+			res++
+		}
+	}
+	return res
+}
+
+// viewersChanged counts the viewers and reports whether the count differs
+// from the one announced before, recording it as announced. A slow viewer
+// dropped by deliver is counted when its handler calls clDe.
+func (element *HubST) viewersChanged() (int, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	res := 0
+	for _, sub := range element.subscribers {
+		if sub.Kind == SubscriberViewer {
+			res++
+		}
+	}
+	if res == element.announced {
+		return res, false
+	}
+	element.announced = res
+	return res, true
+}
+
+// SetCodecs is called on codec discovery; cached packets may not decode
+// with the new codecs so they are dropped
+func (element *HubST) SetCodecs(codecs []av.CodecData) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.codecs = codecs
+	element.gop = nil
+}
+
+// Reset forgets the running source when its worker starts or stops
+func (element *HubST) Reset() {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.codecs = nil
+	element.gop = nil
+	element.stats.Connected = time.Time{}
+	element.restart()
+}
+
+// connected is called by a worker for every successful dial, including
+// reconnects within one run
+func (element *HubST) connected() {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	now := time.Now()
+	element.stats.Connected = now
+	element.stats.LastConnect = now
+	element.restart()
+}
+
+// disconnected is called by a worker when its connection ends. The cached
+// GOP would not continue the timestamps of the next connection.
+func (element *HubST) disconnected() {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.stats.Connected = time.Time{}
+	element.gop = nil
+	element.restart()
+}
+
+// restart forgets the measurements of the previous connection, the caller
+// holds the mutex
+func (element *HubST) restart() {
+	element.live = false
+	// An interval across a reconnect would be meaningless
+	element.intervalFrom = time.Time{}
+	element.rateFrom = time.Time{}
+	element.stats.PacketRate = 0
+	element.stats.Bitrate = 0
+}
+
+// Keyframe returns the most recent video keyframe with its codec
+func (element *HubST) Keyframe() (KeyframeST, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return element.keyframe, element.hasKeyframe
+}
+
+// cast delivers pck to every subscriber. It returns true for the first
+// packet after a Reset or a new connection so the caller can flag the
+// stream as online.
+func (element *HubST) cast(pck av.Packet) bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	first := !element.live
+	element.live = true
+	now := time.Now()
+	if first {
+		element.rateFrom = now
+		element.ratePackets, element.rateBytes = 0, 0
+	}
+	if elapsed := now.Sub(element.rateFrom); elapsed >= hubRateWindow {
+		element.stats.PacketRate = float64(element.ratePackets) / elapsed.Seconds()
+		element.stats.Bitrate = float64(element.rateBytes*8) / elapsed.Seconds()
+		element.rateFrom = now
+		element.ratePackets, element.rateBytes = 0, 0
+	}
+	element.ratePackets++
+	element.rateBytes += uint64(len(pck.Data))
+	element.stats.LastPacket = now
+	element.stats.Packets++
+	element.stats.Bytes += uint64(len(pck.Data))
+	if pck.IsKeyFrame && int(pck.Idx) < len(element.codecs) && element.codecs[pck.Idx].Type().IsVideo() {
+		element.keyframe = KeyframeST{Packet: pck, Codec: element.codecs[pck.Idx], Received: now}
+		element.hasKeyframe = true
+		element.stats.Keyframes++
+		if !element.intervalFrom.IsZero() {
+			element.stats.KeyframeInterval = now.Sub(element.intervalFrom)
+		}
+		element.intervalFrom = now
+		element.stats.LastKeyframe = now
+	}
+	// Keep the current GOP so new viewers can start decoding at once
+	if pck.IsKeyFrame {
+		element.gop = append(make([]av.Packet, 0, 64), pck)
+	} else if len(element.gop) > 0 && len(element.gop) < gopCacheMaxPackets {
+		element.gop = append(element.gop, pck)
+	} else {
+		element.gop = nil
+	}
+	video := hasVideo(element.codecs)
+	for _, sub := range element.subscribers {
+		element.deliver(sub, pck, video)
+	}
+	return first
+}
+
+// deliver queues pck for sub and applies its slow viewer policy when the
+// queue is full. Dropping a single video packet corrupts every frame up to
+// the next keyframe, so after an overflow the subscriber skips to it.
+func (element *HubST) deliver(sub *SubscriberST, pck av.Packet, video bool) {
+	if sub.skipping {
+		if !pck.IsKeyFrame {
+			sub.dropped++
+			element.stats.Dropped++
+			return
+		}
+		sub.skipping = false
+	}
+	if len(sub.C) < cap(sub.C) {
+		sub.C <- pck
+		sub.sent++
+		return
+	}
+	sub.dropped++
+	element.stats.Dropped++
+	sub.skipping = video
+	log.Println("Client", sub.ID, "channel full for stream", element.uuid, "dropped", sub.dropped, "packets, policy", sub.policy.Policy)
+	if sub.policy.Policy == SlowViewerKeyframe || sub.dropped < uint64(sub.policy.MaxDropsOrDefault()) {
+		return
+	}
+	switch sub.policy.Policy {
+	case SlowViewerSubstream:
+		if sub.policy.Substream != "" {
+			sub.Reason = SlowViewerSubstream
+			sub.Substream = sub.policy.Substream
+			break
+		}
+		fallthrough
+	default:
+		sub.Reason = SlowViewerDisconnect
+	}
+	delete(element.subscribers, sub.ID)
+	close(sub.Done)
+	log.Println("Disconnected slow client", sub.ID, "from stream", element.uuid, "reason", sub.Reason)
+}
+
+func (element *HubST) Stats() HubStatsST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return element.stats
+}
+
+// Viewers returns the delivery counters of every subscriber
+func (element *HubST) Viewers() []ViewerStatsST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	res := make([]ViewerStatsST, 0, len(element.subscribers))
+	for _, sub := range element.subscribers {
+		res = append(res, ViewerStatsST{
+			ID:       sub.ID,
+			Kind:     sub.Kind,
+			Created:  sub.created,
+			Policy:   sub.policy.Policy,
+			Sent:     sub.sent,
+			Dropped:  sub.dropped,
+			Queued:   len(sub.C),
+			Skipping: sub.skipping,
+		})
+	}
+	return res
+}
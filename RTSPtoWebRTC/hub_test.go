@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+const (
+	benchHubStreams = 32
+	benchHubViewers = 8
+)
+
+func testHub(t testing.TB) *HubST {
+	hub := newHub("test")
+	hub.SetCodecs([]av.CodecData{testH264Codec(t)})
+	return hub
+}
+
+func TestHubSubscribePrefillsGOP(t *testing.T) {
+	hub := testHub(t)
+	hub.cast(testPacket(false, 0))
+	if sub := hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(sub.C) != 0 {
+		t.Fatalf("prefilled %d packets before the first keyframe", len(sub.C))
+	}
+	hub.cast(testPacket(true, 40*time.Millisecond))
+	hub.cast(testPacket(false, 80*time.Millisecond))
+	hub.cast(testPacket(false, 120*time.Millisecond))
+
+	sub := hub.Subscribe(SubscriberViewer, SlowViewerST{})
+	if len(sub.C) != 3 {
+		t.Fatalf("prefilled %d packets, want the 3 of the current GOP", len(sub.C))
+	}
+	if first := <-sub.C; !first.IsKeyFrame || first.Time != 40*time.Millisecond {
+		t.Errorf("prefill starts with %+v, want the keyframe", first)
+	}
+
+	// A new keyframe starts a new GOP
+	hub.cast(testPacket(true, 160*time.Millisecond))
+	if sub = hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(sub.C) != 1 {
+		t.Errorf("prefilled %d packets after a new keyframe, want 1", len(sub.C))
+	}
+}
+
+func TestHubSubscribeSkipsLongGOP(t *testing.T) {
+	hub := testHub(t)
+	hub.cast(testPacket(true, 0))
+	for i := 1; i <= gopCacheMaxPackets; i++ {
+		hub.cast(testPacket(false, time.Duration(i)*time.Millisecond))
+	}
+	if sub := hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(sub.C) != 0 {
+		t.Errorf("prefilled %d packets of a GOP over the cache limit", len(sub.C))
+	}
+	// Caching resumes with the next keyframe
+	hub.cast(testPacket(true, time.Second))
+	hub.cast(testPacket(false, time.Second+40*time.Millisecond))
+	if sub := hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(sub.C) != 2 {
+		t.Errorf("prefilled %d packets after the long GOP, want 2", len(sub.C))
+	}
+}
+
+// The cached GOP does not outlive the connection or the codecs it was
+// received with
+func TestHubGOPDropped(t *testing.T) {
+	tests := []struct {
+		name string
+		drop func(hub *HubST)
+	}{
+		{"disconnected", func(hub *HubST) { hub.disconnected() }},
+		{"new codecs", func(hub *HubST) { hub.SetCodecs([]av.CodecData{testH264Codec(t)}) }},
+	}
+	for _, test := range tests {
+		hub := testHub(t)
+		hub.connected()
+		hub.cast(testPacket(true, 0))
+		hub.cast(testPacket(false, 40*time.Millisecond))
+		test.drop(hub)
+		if sub := hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(sub.C) != 0 {
+			t.Errorf("%s: prefilled %d stale packets", test.name, len(sub.C))
+		}
+		// Delta frames alone do not start a new cache
+		hub.cast(testPacket(false, 80*time.Millisecond))
+		if sub := hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(sub.C) != 0 {
+			t.Errorf("%s: prefilled %d packets without a keyframe", test.name, len(sub.C))
+		}
+		hub.cast(testPacket(true, 120*time.Millisecond))
+		if sub := hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(sub.C) != 1 {
+			t.Errorf("%s: prefilled %d packets after the next keyframe, want 1", test.name, len(sub.C))
+		}
+	}
+}
+
+// A viewer joining mid GOP through clAd reads the cached GOP from its
+// keyframe and then the live packets in order, without waiting for the
+// next keyframe
+func TestClAdStartsAtKeyframe(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {Ingest: IngestRTMP}})
+	cfg.coAd("cam", []av.CodecData{testH264Codec(t)})
+	hub := cfg.hub("cam")
+	early := cfg.clAd("cam", SubscriberViewer)
+	for i := 0; i < 3; i++ {
+		cfg.cast("cam", hub, testPacket(i == 0, time.Duration(i)*40*time.Millisecond))
+	}
+
+	late := cfg.clAd("cam", SubscriberViewer)
+	cfg.cast("cam", hub, testPacket(false, 120*time.Millisecond))
+	if len(early.C) != 4 {
+		t.Errorf("viewer already watching got %d packets, want 4 without repeats", len(early.C))
+	}
+	if len(late.C) != 4 {
+		t.Fatalf("late viewer got %d packets, want 4", len(late.C))
+	}
+	for i := 0; i < 4; i++ {
+		pck := <-late.C
+		if want := time.Duration(i) * 40 * time.Millisecond; pck.Time != want || pck.IsKeyFrame != (i == 0) {
+			t.Errorf("packet %d at %v keyframe %v, want %v", i, pck.Time, pck.IsKeyFrame, want)
+		}
+	}
+}
+
+func TestHubReset(t *testing.T) {
+	hub := testHub(t)
+	if !hub.cast(testPacket(true, 0)) {
+		t.Error("first packet not reported")
+	}
+	if hub.cast(testPacket(false, time.Millisecond)) {
+		t.Error("second packet reported as first")
+	}
+	sub := hub.Subscribe(SubscriberViewer, SlowViewerST{})
+	hub.Reset()
+	if hub.Count() != 1 {
+		t.Error("Reset dropped the subscriber, viewers stay across reconnects")
+	}
+	if late := hub.Subscribe(SubscriberViewer, SlowViewerST{}); len(late.C) != 0 {
+		t.Errorf("prefilled %d packets of the previous connection", len(late.C))
+	}
+	if !hub.cast(testPacket(true, 0)) {
+		t.Error("first packet after Reset not reported")
+	}
+	if len(sub.C) != 3 {
+		t.Errorf("subscriber got %d packets, want 3", len(sub.C))
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := testHub(t)
+	subs := []*SubscriberST{
+		hub.Subscribe(SubscriberViewer, SlowViewerST{}),
+		hub.Subscribe(SubscriberRecorder, SlowViewerST{}),
+	}
+	hub.Close(SubscriberStreamRemoved)
+	for _, sub := range subs {
+		select {
+		case <-sub.Done:
+		default:
+			t.Fatalf("%s not disconnected", sub.Kind)
+		}
+		if sub.Reason != SubscriberStreamRemoved {
+			t.Errorf("%s reason %q", sub.Kind, sub.Reason)
+		}
+	}
+	if hub.Count() != 0 {
+		t.Errorf("%d subscribers left", hub.Count())
+	}
+	// Casting to a closed hub must not touch the closed subscribers
+	hub.cast(testPacket(true, 0))
+}
+
+// testBlockedViewer subscribes a viewer that never reads and fills its queue
+func testBlockedViewer(t *testing.T, hub *HubST, policy SlowViewerST) *SubscriberST {
+	t.Helper()
+	sub := hub.Subscribe(SubscriberViewer, policy)
+	hub.cast(testPacket(true, 0))
+	for i := 1; len(sub.C) < cap(sub.C); i++ {
+		hub.cast(testPacket(false, time.Duration(i)*time.Millisecond))
+	}
+	return sub
+}
+
+func testDisconnected(sub *SubscriberST) bool {
+	select {
+	case <-sub.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubSlowViewerKeyframe(t *testing.T) {
+	hub := testHub(t)
+	sub := testBlockedViewer(t, hub, SlowViewerST{Policy: SlowViewerKeyframe, MaxDrops: 1})
+	for i := 0; i < 10; i++ {
+		hub.cast(testPacket(false, time.Second))
+	}
+	// Still full, the keyframe is dropped too and skipping goes on
+	hub.cast(testPacket(true, time.Second))
+	if testDisconnected(sub) {
+		t.Fatal("keyframe policy disconnected the viewer")
+	}
+	if sub.dropped != 11 {
+		t.Errorf("dropped %d packets, want 11", sub.dropped)
+	}
+	for len(sub.C) > 0 {
+		<-sub.C
+	}
+	hub.cast(testPacket(false, 2*time.Second))
+	if len(sub.C) != 0 {
+		t.Fatal("delta frame delivered while skipping to a keyframe")
+	}
+	hub.cast(testPacket(true, 3*time.Second))
+	hub.cast(testPacket(false, 3*time.Second))
+	if len(sub.C) != 2 {
+		t.Fatalf("%d packets queued after the keyframe, want 2", len(sub.C))
+	}
+	if pck := <-sub.C; !pck.IsKeyFrame {
+		t.Error("delivery resumed without a keyframe")
+	}
+	if hub.Stats().Dropped != sub.dropped {
+		t.Errorf("hub counted %d drops, viewer %d", hub.Stats().Dropped, sub.dropped)
+	}
+}
+
+func TestHubSlowViewerDisconnect(t *testing.T) {
+	hub := testHub(t)
+	reading := hub.Subscribe(SubscriberViewer, SlowViewerST{Policy: SlowViewerDisconnect, MaxDrops: 5})
+	sub := testBlockedViewer(t, hub, SlowViewerST{Policy: SlowViewerDisconnect, MaxDrops: 5})
+	for len(reading.C) > 0 {
+		<-reading.C
+	}
+	for i := 0; i < 10; i++ {
+		hub.cast(testPacket(false, time.Second))
+	}
+	if testDisconnected(sub) {
+		t.Fatal("disconnected before the next keyframe could not be queued")
+	}
+	hub.cast(testPacket(true, time.Second))
+	if !testDisconnected(sub) {
+		t.Fatal("blocked viewer still connected after max drops")
+	}
+	if sub.Reason != SlowViewerDisconnect {
+		t.Errorf("reason %q", sub.Reason)
+	}
+	if hub.Count() != 1 || testDisconnected(reading) {
+		t.Error("the reading viewer was disconnected too")
+	}
+}
+
+func TestHubSlowViewerSubstream(t *testing.T) {
+	tests := []struct {
+		substream string
+		reason    string
+	}{
+		{"cam1_sub", SlowViewerSubstream},
+		{"", SlowViewerDisconnect},
+	}
+	for _, test := range tests {
+		hub := testHub(t)
+		sub := testBlockedViewer(t, hub, SlowViewerST{Policy: SlowViewerSubstream, MaxDrops: 1, Substream: test.substream})
+		hub.cast(testPacket(true, time.Second))
+		if !testDisconnected(sub) {
+			t.Fatalf("substream %q: still connected", test.substream)
+		}
+		if sub.Reason != test.reason || sub.Substream != test.substream {
+			t.Errorf("substream %q: reason %q substream %q, want %q", test.substream, sub.Reason, sub.Substream, test.reason)
+		}
+	}
+}
+
+// Only the viewer sent to the substream is told about it on the push channel
+func TestViewerDisconnectedSubstream(t *testing.T) {
+	id, client := Push.subscribe(UserST{Role: RoleAdmin})
+	defer Push.unsubscribe(id)
+	viewerDisconnected("cam1", &SubscriberST{ID: "v1", Reason: SlowViewerDisconnect})
+	viewerDisconnected("cam1", &SubscriberST{ID: "v2", Reason: SlowViewerSubstream, Substream: "cam1_sub"})
+	select {
+	case msg := <-client.C:
+		data, _ := msg.Data.(PushSubstreamST)
+		if msg.Type != PushViewerSubstream || msg.Stream != "cam1" || data != (PushSubstreamST{Viewer: "v2", Substream: "cam1_sub"}) {
+			t.Errorf("message %+v", msg)
+		}
+	default:
+		t.Fatal("no viewer.substream message")
+	}
+	if len(client.C) != 0 {
+		t.Errorf("%d more messages", len(client.C))
+	}
+}
+
+func TestValidateSubstream(t *testing.T) {
+	streams := map[string]StreamST{"cam1": {}, "cam1_sub": {}}
+	tests := []struct {
+		uuid      string
+		substream string
+		err       error
+	}{
+		{"cam1", "", nil},
+		{"cam1", "cam1_sub", nil},
+		{"cam1", "cam1", ErrorSubstreamUnknown},
+		{"cam1", "cam2", ErrorSubstreamUnknown},
+		// A stream being added is not in the map yet
+		{"", "cam1_sub", nil},
+	}
+	for _, test := range tests {
+		if err := validateSubstream(test.uuid, test.substream, streams); err != test.err {
+			t.Errorf("%s -> %q: %v, want %v", test.uuid, test.substream, err, test.err)
+		}
+	}
+	if _, err := parseConfig([]byte(`{"streams": {"cam1": {"url": "rtsp://cam", "substream": "cam2"}}}`)); !errors.Is(err, ErrorSubstreamUnknown) {
+		t.Errorf("unknown substream in config: %v", err)
+	}
+	if _, err := parseConfig([]byte(`{"streams": {"cam1": {"url": "rtsp://cam", "substream": "cam1_sub"}, "cam1_sub": {"url": "rtsp://cam/sub"}}}`)); err != nil {
+		t.Errorf("valid substream in config: %v", err)
+	}
+}
+
+func TestRemoveStreamClearsSubstream(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam1": {Substream: "cam1_sub"}, "cam1_sub": {}})
+	cfg.mutex.Lock()
+	cfg.removeStream("cam1_sub")
+	cfg.mutex.Unlock()
+	if cam, _ := testStream(cfg, "cam1"); cam.Substream != "" {
+		t.Errorf("substream %q left on cam1", cam.Substream)
+	}
+}
+
+// Without video there is no keyframe to wait for, delivery resumes as soon
+// as the queue has room
+func TestHubSlowViewerAudioOnly(t *testing.T) {
+	hub := newHub("audio")
+	sub := testBlockedViewer(t, hub, SlowViewerST{Policy: SlowViewerKeyframe})
+	hub.cast(testPacket(false, time.Second))
+	<-sub.C
+	hub.cast(testPacket(false, 2*time.Second))
+	if sub.skipping || len(sub.C) != cap(sub.C) {
+		t.Errorf("audio packet not delivered after an overflow, skipping %v", sub.skipping)
+	}
+}
+
+// Recording keeps an on-demand stream running, a snapshot does not
+func TestHasViewerCountsRecorders(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {OnDemand: true}})
+	hub := cfg.Streams["cam"].hub
+	hub.Subscribe(SubscriberSnapshot, SlowViewerST{})
+	if cfg.HasViewer("cam") {
+		t.Error("snapshot counts as a viewer")
+	}
+	recorder := hub.Subscribe(SubscriberRecorder, SlowViewerST{})
+	if !cfg.HasViewer("cam") {
+		t.Error("recorder not counted")
+	}
+	hub.Unsubscribe(recorder.ID)
+	hub.Subscribe(SubscriberViewer, SlowViewerST{})
+	if !cfg.HasViewer("cam") {
+		t.Error("viewer not counted")
+	}
+}
+
+// benchHubs sets up streams with draining viewers. stop ends the viewers.
+func benchHubs(b *testing.B) ([]*HubST, func()) {
+	codecs := []av.CodecData{testH264Codec(b)}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	hubs := make([]*HubST, benchHubStreams)
+	for i := range hubs {
+		hubs[i] = newHub(fmt.Sprintf("stream%d", i))
+		hubs[i].SetCodecs(codecs)
+		for j := 0; j < benchHubViewers; j++ {
+			sub := hubs[i].Subscribe(SubscriberViewer, SlowViewerST{Policy: SlowViewerKeyframe})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-sub.C:
+					case <-sub.Done:
+						return
+					case <-stop:
+						return
+					}
+				}
+			}()
+		}
+	}
+	return hubs, func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+// BenchmarkHubCast casts from one goroutine per camera, every stream with
+// its own hub. Compare with BenchmarkHubCastGlobalLock, the distribution
+// before hubs, where every packet of every stream took Config.mutex.
+func BenchmarkHubCast(b *testing.B) {
+	hubs, stop := benchHubs(b)
+	defer stop()
+	var next int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		hub := hubs[int(atomic.AddInt64(&next, 1))%len(hubs)]
+		for i := 0; pb.Next(); i++ {
+			hub.cast(testPacket(i%50 == 0, time.Duration(i)*time.Millisecond))
+		}
+	})
+}
+
+func BenchmarkHubCastGlobalLock(b *testing.B) {
+	hubs, stop := benchHubs(b)
+	defer stop()
+	var global sync.Mutex
+	var next int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		hub := hubs[int(atomic.AddInt64(&next, 1))%len(hubs)]
+		for i := 0; pb.Next(); i++ {
+			global.Lock()
+			hub.cast(testPacket(i%50 == 0, time.Duration(i)*time.Millisecond))
+			global.Unlock()
+		}
+	})
+}
@@ -8,15 +8,32 @@ import (
 )
 
 func main() {
+	loadUsers()
+	loadAudit()
+	loadEvents()
+	loadExports()
 	go serveHTTP()
 	go serveStreams()
+	go serveRTMP()
+	go serveRecorders()
+	go serveRetention()
+	go serveEventsRetention()
+	go serveExportsRetention()
+	go serveAlerts()
+	go serveConfigWatch()
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		sig := <-sigs
-		log.Println(sig)
-		done <- true
+		for sig := range sigs {
+			log.Println(sig)
+			if sig == syscall.SIGHUP {
+				reloadConfigBySystem("SIGHUP")
+				continue
+			}
+			done <- true
+			return
+		}
 	}()
 	log.Println("Server Start Awaiting Signal")
 	<-done
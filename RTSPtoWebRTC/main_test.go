@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/gin-gonic/gin"
+)
+
+// testSPS and testPPS describe 320x240 baseline H.264, as sent by the
+// fixture server
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x05, 0x07, 0xe4}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// TestMain runs the tests in a scratch directory, so config.json, the
+// users file and recordings written by the code under test never touch
+// the checkout
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "rtsptowebrtc-test")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		log.Fatalln(err)
+	}
+	gin.SetMode(gin.TestMode)
+	if os.Getenv("TEST_LOG") == "" {
+		log.SetOutput(io.Discard)
+		gin.DefaultWriter = io.Discard
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testConfig replaces Config for the duration of a test. Every stream gets
+// its own hub like on load.
+func testConfig(t testing.TB, streams map[string]StreamST) *ConfigST {
+	t.Helper()
+	tmp := &ConfigST{Streams: make(map[string]StreamST)}
+	for uuid, stream := range streams {
+		stream.hub = newHub(uuid)
+		tmp.Streams[uuid] = stream
+	}
+	old := Config
+	Config = tmp
+	t.Cleanup(func() {
+		Config = old
+	})
+	return tmp
+}
+
+// testStream reads a stream under the lock, workers may be updating it
+func testStream(cfg *ConfigST, uuid string) (StreamST, bool) {
+	cfg.mutex.RLock()
+	defer cfg.mutex.RUnlock()
+	stream, ok := cfg.Streams[uuid]
+	return stream, ok
+}
+
+func testH264Codec(t testing.TB) h264parser.CodecData {
+	t.Helper()
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(testSPS, testPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+// testPacket is a length prefixed H.264 slice at the given timestamp
+func testPacket(keyframe bool, at time.Duration) av.Packet {
+	header := byte(0x41)
+	if keyframe {
+		header = 0x65
+	}
+	return av.Packet{IsKeyFrame: keyframe, Time: at, Data: []byte{0, 0, 0, 4, header, 0xaa, 0xaa, 0xaa}}
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t testing.TB, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
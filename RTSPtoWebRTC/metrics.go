@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	metricsPrefix      = "rtsptowebrtc_"
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	MetricsSessionLive     = "live"
+	MetricsSessionPlayback = "playback"
+)
+
+// codecDiscoveryBuckets are the upper bounds in seconds of the coGe histogram
+var codecDiscoveryBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics global
+var Metrics = &MetricsST{
+	streams:  make(map[string]*StreamMetricsST),
+	started:  make(map[string]uint64),
+	failed:   make(map[string]uint64),
+	codecBkt: codecDiscoveryBuckets,
+}
+
+// MetricsST keeps the counters that are not updated per packet. Per packet
+// counters live in HubST so the packet path takes no extra lock.
+type MetricsST struct {
+	mutex    sync.Mutex
+	streams  map[string]*StreamMetricsST
+	started  map[string]uint64
+	failed   map[string]uint64
+	codecBkt []float64
+}
+
+// StreamMetricsST are the worker and codec counters of one stream
+type StreamMetricsST struct {
+	Reconnects    uint64
+	LastError     string
+	LastErrorTime time.Time
+	CodecBuckets  []uint64
+	CodecSum      float64
+	CodecCount    uint64
+	CodecTimeouts uint64
+}
+
+func (element *MetricsST) stream(uuid string) *StreamMetricsST {
+	tmp, ok := element.streams[uuid]
+	if !ok {
+		tmp = &StreamMetricsST{CodecBuckets: make([]uint64, len(element.codecBkt))}
+		element.streams[uuid] = tmp
+	}
+	return tmp
+}
+
+func (element *MetricsST) reconnect(uuid string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.stream(uuid).Reconnects++
+}
+
+func (element *MetricsST) workerError(uuid string, err error) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	tmp := element.stream(uuid)
+	tmp.LastError = err.Error()
+	tmp.LastErrorTime = time.Now()
+}
+
+// worker returns a copy of the worker counters of a stream
+func (element *MetricsST) worker(uuid string) StreamMetricsST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	tmp, ok := element.streams[uuid]
+	if !ok {
+		return StreamMetricsST{}
+	}
+	res := *tmp
+	res.CodecBuckets = append([]uint64(nil), tmp.CodecBuckets...)
+	return res
+}
+
+// codecDiscovery observes how long coGe waited; a wait that gave up is
+// counted as a timeout and not added to the histogram
+func (element *MetricsST) codecDiscovery(uuid string, wait time.Duration, ok bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	tmp := element.stream(uuid)
+	if !ok {
+		tmp.CodecTimeouts++
+		return
+	}
+	seconds := wait.Seconds()
+	for i, bound := range element.codecBkt {
+		if seconds <= bound {
+			tmp.CodecBuckets[i]++
+		}
+	}
+	tmp.CodecSum += seconds
+	tmp.CodecCount++
+}
+
+// webrtcSession counts a WebRTC session of kind live or playback that was
+// negotiated (ok) or refused
+func (element *MetricsST) webrtcSession(kind string, ok bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if ok {
+		element.started[kind]++
+	} else {
+		element.failed[kind]++
+	}
+}
+
+func (element *MetricsST) remove(uuid string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	delete(element.streams, uuid)
+}
+
+type metricsStreamST struct {
+	uuid      string
+	up        bool
+	suspended bool
+	hub       *HubST
+}
+
+// metricsStreams lists the configured streams sorted by id, deleted streams
+// disappear from the output with them
+func (element *ConfigST) metricsStreams() []metricsStreamST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	res := make([]metricsStreamST, 0, len(element.Streams))
+	for uuid, tmp := range element.Streams {
+		res = append(res, metricsStreamST{uuid: uuid, up: tmp.Status, suspended: tmp.retry.Suspended, hub: tmp.hub})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].uuid < res[j].uuid
+	})
+	return res
+}
+
+// metricsWriter writes the Prometheus text exposition format
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (element *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(element, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+// sample writes one value, labels are name/value pairs
+func (element *metricsWriter) sample(name string, value float64, labels ...string) {
+	element.WriteString(metricsPrefix + name)
+	if len(labels) > 0 {
+		element.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				element.WriteByte(',')
+			}
+			element.WriteString(labels[i] + "=\"" + metricsEscape(labels[i+1]) + "\"")
+		}
+		element.WriteByte('}')
+	}
+	element.WriteString(" " + strconv.FormatFloat(value, 'f', -1, 64) + "\n")
+}
+
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsEscape(value string) string {
+	return metricsEscaper.Replace(value)
+}
+
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func HTTPAPIServerMetrics(c *gin.Context) {
+	type streamSampleST struct {
+		uuid      string
+		up        bool
+		suspended bool
+		hub       HubStatsST
+		viewers   int
+		worker    StreamMetricsST
+	}
+	var samples []streamSampleST
+	for _, tmp := range Config.metricsStreams() {
+		sample := streamSampleST{uuid: tmp.uuid, up: tmp.up, suspended: tmp.suspended}
+		if tmp.hub != nil {
+			sample.hub = tmp.hub.Stats()
+			for _, sub := range tmp.hub.Viewers() {
+				if sub.Kind == SubscriberViewer {
+					sample.viewers++
+				}
+			}
+		}
+		samples = append(samples, sample)
+	}
+	Metrics.mutex.Lock()
+	for i := range samples {
+		if worker, ok := Metrics.streams[samples[i].uuid]; ok {
+			samples[i].worker = *worker
+			samples[i].worker.CodecBuckets = append([]uint64(nil), worker.CodecBuckets...)
+		}
+	}
+	started := make(map[string]uint64)
+	failed := make(map[string]uint64)
+	for _, kind := range []string{MetricsSessionLive, MetricsSessionPlayback} {
+		started[kind] = Metrics.started[kind]
+		failed[kind] = Metrics.failed[kind]
+	}
+	Metrics.mutex.Unlock()
+
+	var w metricsWriter
+	w.family("stream_up", "gauge", "Whether the stream is receiving packets.")
+	for _, s := range samples {
+		w.sample("stream_up", boolMetric(s.up), "stream", s.uuid)
+	}
+	w.family("stream_packets_received_total", "counter", "Packets received from the source.")
+	for _, s := range samples {
+		w.sample("stream_packets_received_total", float64(s.hub.Packets), "stream", s.uuid)
+	}
+	w.family("stream_bytes_received_total", "counter", "Payload bytes received from the source.")
+	for _, s := range samples {
+		w.sample("stream_bytes_received_total", float64(s.hub.Bytes), "stream", s.uuid)
+	}
+	w.family("stream_keyframes_received_total", "counter", "Video keyframes received from the source.")
+	for _, s := range samples {
+		w.sample("stream_keyframes_received_total", float64(s.hub.Keyframes), "stream", s.uuid)
+	}
+	w.family("stream_keyframe_interval_seconds", "gauge", "Time between the last two video keyframes.")
+	for _, s := range samples {
+		w.sample("stream_keyframe_interval_seconds", s.hub.KeyframeInterval.Seconds(), "stream", s.uuid)
+	}
+	w.family("stream_reconnects_total", "counter", "Source reconnect attempts by the stream worker.")
+	for _, s := range samples {
+		w.sample("stream_reconnects_total", float64(s.worker.Reconnects), "stream", s.uuid)
+	}
+	w.family("stream_last_error_timestamp_seconds", "gauge", "Unix time of the last stream worker error.")
+	for _, s := range samples {
+		if !s.worker.LastErrorTime.IsZero() {
+			w.sample("stream_last_error_timestamp_seconds", float64(s.worker.LastErrorTime.Unix()), "stream", s.uuid)
+		}
+	}
+	w.family("stream_last_error_info", "gauge", "Last stream worker error, the value is always 1.")
+	for _, s := range samples {
+		if s.worker.LastError != "" {
+			w.sample("stream_last_error_info", 1, "stream", s.uuid, "error", s.worker.LastError)
+		}
+	}
+	w.family("stream_suspended", "gauge", "Whether the stream gave up reconnecting until retried.")
+	for _, s := range samples {
+		w.sample("stream_suspended", boolMetric(s.suspended), "stream", s.uuid)
+	}
+	w.family("stream_viewers", "gauge", "Connected live viewers.")
+	for _, s := range samples {
+		w.sample("stream_viewers", float64(s.viewers), "stream", s.uuid)
+	}
+	w.family("stream_dropped_packets_total", "counter", "Packets dropped for subscribers that could not keep up.")
+	for _, s := range samples {
+		w.sample("stream_dropped_packets_total", float64(s.hub.Dropped), "stream", s.uuid)
+	}
+	w.family("stream_codec_discovery_seconds", "histogram", "Time a request waited for the stream codecs.")
+	for _, s := range samples {
+		for i, bound := range codecDiscoveryBuckets {
+			var count uint64
+			if i < len(s.worker.CodecBuckets) {
+				count = s.worker.CodecBuckets[i]
+			}
+			w.sample("stream_codec_discovery_seconds_bucket", float64(count), "stream", s.uuid, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		w.sample("stream_codec_discovery_seconds_bucket", float64(s.worker.CodecCount), "stream", s.uuid, "le", "+Inf")
+		w.sample("stream_codec_discovery_seconds_sum", s.worker.CodecSum, "stream", s.uuid)
+		w.sample("stream_codec_discovery_seconds_count", float64(s.worker.CodecCount), "stream", s.uuid)
+	}
+	w.family("stream_codec_discovery_timeouts_total", "counter", "Requests that gave up waiting for the stream codecs.")
+	for _, s := range samples {
+		w.sample("stream_codec_discovery_timeouts_total", float64(s.worker.CodecTimeouts), "stream", s.uuid)
+	}
+	w.family("webrtc_sessions_started_total", "counter", "WebRTC sessions negotiated.")
+	for _, kind := range []string{MetricsSessionLive, MetricsSessionPlayback} {
+		w.sample("webrtc_sessions_started_total", float64(started[kind]), "kind", kind)
+	}
+	w.family("webrtc_sessions_failed_total", "counter", "WebRTC session requests that failed before negotiation.")
+	for _, kind := range []string{MetricsSessionLive, MetricsSessionPlayback} {
+		w.sample("webrtc_sessions_failed_total", float64(failed[kind]), "kind", kind)
+	}
+	c.Data(http.StatusOK, metricsContentType, w.Bytes())
+}
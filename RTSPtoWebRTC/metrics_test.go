@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// testMetrics replaces the metrics global for the duration of a test
+func testMetrics(t *testing.T) {
+	t.Helper()
+	old := Metrics
+	Metrics = &MetricsST{
+		streams:  make(map[string]*StreamMetricsST),
+		started:  make(map[string]uint64),
+		failed:   make(map[string]uint64),
+		codecBkt: codecDiscoveryBuckets,
+	}
+	t.Cleanup(func() {
+		Metrics = old
+	})
+}
+
+func TestMetricsOutput(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testMetrics(t)
+	Config.coAd("cam1", []av.CodecData{testH264Codec(t)})
+	hub := Config.hub("cam1")
+	Config.clAd("cam1", SubscriberViewer)
+	Config.clAd("cam1", SubscriberRecorder)
+	testBlockedViewer(t, hub, SlowViewerST{Policy: SlowViewerKeyframe})
+	hub.cast(testPacket(false, time.Second))
+	stats := hub.Stats()
+
+	Metrics.reconnect("cam1")
+	Metrics.reconnect("cam1")
+	Metrics.workerError("cam1", errors.New(`dial "rtsp://cam1" failed`))
+	Metrics.codecDiscovery("cam1", 200*time.Millisecond, true)
+	Metrics.codecDiscovery("cam1", 3*time.Second, true)
+	Metrics.codecDiscovery("cam1", 0, false)
+	Metrics.webrtcSession(MetricsSessionLive, true)
+	Metrics.webrtcSession(MetricsSessionLive, true)
+	Metrics.webrtcSession(MetricsSessionPlayback, false)
+
+	w := testRequest(router, http.MethodGet, "/metrics", tokens["admin"])
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != metricsContentType {
+		t.Fatalf("%d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	want := []string{
+		`rtsptowebrtc_stream_up{stream="cam1"} 1`,
+		`rtsptowebrtc_stream_up{stream="cam2"} 0`,
+		`rtsptowebrtc_stream_packets_received_total{stream="cam1"} ` + strconv.FormatUint(stats.Packets, 10),
+		`rtsptowebrtc_stream_bytes_received_total{stream="cam1"} ` + strconv.FormatUint(stats.Bytes, 10),
+		`rtsptowebrtc_stream_packets_received_total{stream="cam2"} 0`,
+		`rtsptowebrtc_stream_reconnects_total{stream="cam1"} 2`,
+		`rtsptowebrtc_stream_last_error_info{stream="cam1",error="dial \"rtsp://cam1\" failed"} 1`,
+		`rtsptowebrtc_stream_viewers{stream="cam1"} 2`,
+		`rtsptowebrtc_stream_dropped_packets_total{stream="cam1"} ` + strconv.FormatUint(stats.Dropped, 10),
+		`rtsptowebrtc_stream_codec_discovery_seconds_bucket{stream="cam1",le="0.1"} 0`,
+		`rtsptowebrtc_stream_codec_discovery_seconds_bucket{stream="cam1",le="0.25"} 1`,
+		`rtsptowebrtc_stream_codec_discovery_seconds_bucket{stream="cam1",le="5"} 2`,
+		`rtsptowebrtc_stream_codec_discovery_seconds_bucket{stream="cam1",le="+Inf"} 2`,
+		`rtsptowebrtc_stream_codec_discovery_seconds_sum{stream="cam1"} 3.2`,
+		`rtsptowebrtc_stream_codec_discovery_seconds_count{stream="cam1"} 2`,
+		`rtsptowebrtc_stream_codec_discovery_timeouts_total{stream="cam1"} 1`,
+		`rtsptowebrtc_webrtc_sessions_started_total{kind="live"} 2`,
+		`rtsptowebrtc_webrtc_sessions_started_total{kind="playback"} 0`,
+		`rtsptowebrtc_webrtc_sessions_failed_total{kind="playback"} 1`,
+		`# TYPE rtsptowebrtc_stream_codec_discovery_seconds histogram`,
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if stats.Dropped == 0 {
+		t.Error("blocked viewer dropped nothing")
+	}
+	if strings.Contains(body, `rtsptowebrtc_stream_last_error_info{stream="cam2"`) {
+		t.Error("error reported for a stream without one")
+	}
+}
+
+// A deleted stream leaves no series and no worker counters behind
+func TestMetricsRemove(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testMetrics(t)
+	Metrics.reconnect("cam2")
+	Metrics.workerError("cam2", errors.New("timeout"))
+	Config.mutex.Lock()
+	Config.removeStream("cam2")
+	Config.mutex.Unlock()
+
+	if worker := Metrics.worker("cam2"); worker.Reconnects != 0 || worker.LastError != "" {
+		t.Errorf("counters kept: %+v", worker)
+	}
+	body := testRequest(router, http.MethodGet, "/metrics", tokens["admin"]).Body.String()
+	if strings.Contains(body, `stream="cam2"`) {
+		t.Error("removed stream still exported")
+	}
+	if !strings.Contains(body, `rtsptowebrtc_stream_up{stream="cam1"} 0`+"\n") {
+		t.Error("remaining stream missing")
+	}
+}
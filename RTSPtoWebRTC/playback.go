@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av/avutil"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/gin-gonic/gin"
+)
+
+// playbackGapTolerance is the largest hole between two segments that is
+// still drawn as continuous coverage on the timeline
+const playbackGapTolerance = 2 * time.Second
+
+var (
+	ErrorPlaybackBadTime  = errors.New("playback time must be RFC3339 or unix seconds")
+	ErrorPlaybackBadRange = errors.New("playback end must be after start")
+)
+
+// PlaybackRangeST is a span of time on the playback timeline
+type PlaybackRangeST struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// parsePlaybackTime accepts RFC3339 or unix seconds, an empty value is zero
+func parsePlaybackTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	tm, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, ErrorPlaybackBadTime
+	}
+	return tm, nil
+}
+
+func parsePlaybackRange(c *gin.Context) (time.Time, time.Time, error) {
+	start, err := parsePlaybackTime(c.Query("start"))
+	if err != nil {
+		return start, start, err
+	}
+	end, err := parsePlaybackTime(c.Query("end"))
+	if err != nil {
+		return start, end, err
+	}
+	if !end.IsZero() && !end.After(start) {
+		return start, end, ErrorPlaybackBadRange
+	}
+	return start, end, nil
+}
+
+// playbackCoverage merges segments into recorded ranges and the gaps between them
+func playbackCoverage(segments []RecordSegmentST) ([]PlaybackRangeST, []PlaybackRangeST) {
+	ranges, gaps := []PlaybackRangeST{}, []PlaybackRangeST{}
+	for _, segment := range segments {
+		if n := len(ranges); n > 0 && !segment.Start.After(ranges[n-1].End.Add(playbackGapTolerance)) {
+			if segment.End().After(ranges[n-1].End) {
+				ranges[n-1].End = segment.End()
+			}
+			continue
+		}
+		if n := len(ranges); n > 0 {
+			gaps = append(gaps, PlaybackRangeST{Start: ranges[n-1].End, End: segment.Start})
+		}
+		ranges = append(ranges, PlaybackRangeST{Start: segment.Start, End: segment.End()})
+	}
+	return ranges, gaps
+}
+
+// HTTPAPIServerPlayback returns a VOD HLS playlist of the recorded segments
+// overlapping ?start=&end=. Every segment restarts its timestamps, so each
+// one after the first is flagged as a discontinuity.
+func HTTPAPIServerPlayback(c *gin.Context) {
+	uuid := c.Param("uuid")
+	start, end, err := parsePlaybackRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	segments, err := recordSegmentsInRange(uuid, start, end)
+	if err != nil || len(segments) == 0 {
+		log.Println("No recordings found for playback of stream", uuid, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "No recordings found"})
+		return
+	}
+	target := 1.0
+	var total time.Duration
+	for _, segment := range segments {
+		target = math.Max(target, math.Ceil(segment.Duration.Seconds()))
+		total += segment.Duration
+	}
+	// Players fetch segments without our headers. They get a media token of
+	// this stream, the session token never appears in the playlist.
+	ttl := total + mediaTokenTTL
+	if ttl > authRefreshTTL {
+		ttl = authRefreshTTL
+	}
+	query := "?token=" + url.QueryEscape(Sessions.createMedia(c.GetString(authUserKey), uuid, ttl))
+	auditRequest(c, AuditPlayback, uuid, "hls "+segments[0].Start.UTC().Format(time.RFC3339)+" - "+segments[len(segments)-1].End().UTC().Format(time.RFC3339), nil)
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n")
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	for i, segment := range segments {
+		if i > 0 {
+			playlist.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&playlist, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.Start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n", segment.Duration.Seconds())
+		fmt.Fprintf(&playlist, "/api/playback/%s/segment/%s%s\n", url.PathEscape(uuid), filepath.Base(segment.Path), query)
+	}
+	playlist.WriteString("#EXT-X-ENDLIST\n")
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist.String()))
+}
+
+// HTTPAPIServerPlaybackSegment serves one recorded segment as MPEG-TS,
+// remuxing MP4 segments on the fly.
+func HTTPAPIServerPlaybackSegment(c *gin.Context) {
+	uuid := c.Param("uuid")
+	name := filepath.Base(c.Param("name"))
+	segments, err := listRecordSegments(recordDir(Config.GetRecordPath(), uuid))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No recordings found"})
+		return
+	}
+	for _, segment := range segments {
+		if filepath.Base(segment.Path) != name {
+			continue
+		}
+		if segment.Format == RecordFormatTS {
+			c.Header("Content-Type", "video/mp2t")
+			c.File(segment.Path)
+			return
+		}
+		demuxer, file, err := openRecordSegment(segment)
+		if err != nil {
+			log.Println("Playback open segment error", segment.Path, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open segment"})
+			return
+		}
+		defer file.Close()
+		c.Header("Content-Type", "video/mp2t")
+		c.Status(http.StatusOK)
+		if err = avutil.CopyFile(ts.NewMuxer(c.Writer), demuxer); err != nil {
+			log.Println("Playback remux error", segment.Path, err)
+		}
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+}
+
+// HTTPAPIServerPlaybackRanges lists recorded coverage and gaps for the timeline
+func HTTPAPIServerPlaybackRanges(c *gin.Context) {
+	uuid := c.Param("uuid")
+	start, end, err := parsePlaybackRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	segments, err := recordSegmentsInRange(uuid, start, end)
+	if err != nil {
+		segments = nil
+	}
+	ranges, gaps := playbackCoverage(segments)
+	c.JSON(http.StatusOK, gin.H{
+		"uuid":   uuid,
+		"ranges": ranges,
+		"gaps":   gaps,
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// testRecordSegment records frames 40ms apart starting at start into dir
+// and returns the finished segment
+func testRecordSegment(t *testing.T, dir, format string, start time.Time, frames int) RecordSegmentST {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	segment, err := newRecordSegment(dir, format, []av.CodecData{testH264Codec(t)}, 0, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		if err = segment.WritePacket(testPacket(i%25 == 0, time.Duration(i)*40*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segment.Close()
+	segments, err := listRecordSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range segments {
+		if res.Start.Equal(start.Truncate(time.Millisecond)) {
+			return res
+		}
+	}
+	t.Fatalf("segment at %v not recorded", start)
+	return RecordSegmentST{}
+}
+
+// testPlaybackSegments records two adjacent 2s segments of cam1 and a third
+// an hour later, the second one as MP4
+func testPlaybackSegments(t *testing.T) []RecordSegmentST {
+	t.Helper()
+	Config.Server.RecordPath = t.TempDir()
+	dir := recordDir(Config.Server.RecordPath, "cam1")
+	start := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	return []RecordSegmentST{
+		testRecordSegment(t, dir, RecordFormatTS, start, 51),
+		testRecordSegment(t, dir, RecordFormatMP4, start.Add(2*time.Second), 51),
+		testRecordSegment(t, dir, RecordFormatTS, start.Add(time.Hour), 51),
+	}
+}
+
+func testUnix(tm time.Time) string {
+	return strconv.FormatInt(tm.Unix(), 10)
+}
+
+func TestPlaybackPlaylist(t *testing.T) {
+	router, tokens := testRBAC(t)
+	segments := testPlaybackSegments(t)
+	query := "?start=" + testUnix(segments[0].Start.Add(-time.Minute)) + "&end=" + testUnix(segments[1].End().Add(time.Minute))
+	w := testRequest(router, http.MethodGet, "/api/playback/cam1"+query, tokens["viewer"])
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf("playlist %d %s", w.Code, w.Body.String())
+	}
+	playlist := w.Body.String()
+	for _, line := range []string{
+		"#EXT-X-PLAYLIST-TYPE:VOD",
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-PROGRAM-DATE-TIME:" + segments[0].Start.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"#EXT-X-PROGRAM-DATE-TIME:" + segments[1].Start.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"#EXTINF:2.000,",
+		"#EXT-X-ENDLIST",
+	} {
+		if !strings.Contains(playlist, line+"\n") {
+			t.Errorf("playlist lacks %s:\n%s", line, playlist)
+		}
+	}
+	if n := strings.Count(playlist, "#EXT-X-DISCONTINUITY"); n != 1 {
+		t.Errorf("%d discontinuities, want 1", n)
+	}
+	if strings.Contains(playlist, filepath.Base(segments[2].Path)) {
+		t.Error("segment outside the range listed")
+	}
+	if strings.Contains(playlist, tokens["viewer"]) {
+		t.Error("session token in the playlist")
+	}
+
+	var uris []string
+	for _, line := range strings.Split(playlist, "\n") {
+		if strings.HasPrefix(line, "/") {
+			uris = append(uris, line)
+		}
+	}
+	if len(uris) != 2 {
+		t.Fatalf("segment uris %q", uris)
+	}
+	for i, uri := range uris {
+		if !strings.HasPrefix(uri, "/api/playback/cam1/segment/"+filepath.Base(segments[i].Path)+"?token=") {
+			t.Errorf("segment uri %s", uri)
+		}
+		// Players fetch segments with the media token alone, MP4 is remuxed
+		w := testRequest(router, http.MethodGet, uri, "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "video/mp2t" || w.Body.Len() == 0 || w.Body.Bytes()[0] != 0x47 {
+			t.Errorf("segment %d: %d %s %d bytes", i, w.Code, w.Header().Get("Content-Type"), w.Body.Len())
+		}
+	}
+}
+
+func TestPlaybackErrors(t *testing.T) {
+	router, tokens := testRBAC(t)
+	segments := testPlaybackSegments(t)
+	start := testUnix(segments[0].Start)
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		code  int
+	}{
+		{"end before start", "/api/playback/cam1?start=" + start + "&end=" + testUnix(segments[0].Start.Add(-time.Hour)), "viewer", http.StatusBadRequest},
+		{"bad time", "/api/playback/cam1?start=yesterday", "viewer", http.StatusBadRequest},
+		{"nothing recorded", "/api/playback/cam1?start=" + testUnix(time.Now().Add(time.Hour)), "viewer", http.StatusNotFound},
+		{"no grant", "/api/playback/cam2?start=" + start, "viewer", http.StatusForbidden},
+		{"no token", "/api/playback/cam1?start=" + start, "", http.StatusUnauthorized},
+		{"unknown segment", "/api/playback/cam1/segment/1000_2000.ts", "viewer", http.StatusNotFound},
+		{"ranges bad time", "/api/playback/cam1/ranges?end=later", "viewer", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if w := testRequest(router, http.MethodGet, test.path, tokens[test.token]); w.Code != test.code {
+			t.Errorf("%s: %d, want %d", test.name, w.Code, test.code)
+		}
+	}
+}
+
+// A media token opens the segments of its stream until it expires and
+// nothing else
+func TestPlaybackMediaToken(t *testing.T) {
+	router, tokens := testRBAC(t)
+	segments := testPlaybackSegments(t)
+	name := filepath.Base(segments[0].Path)
+	token := Sessions.createMedia("viewer", "cam1", time.Minute)
+	query := "?token=" + url.QueryEscape(token)
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{"segment of its stream", "/api/playback/cam1/segment/" + name + query, http.StatusOK},
+		{"segment of another stream", "/api/playback/cam2/segment/" + name + query, http.StatusUnauthorized},
+		{"playlist", "/api/playback/cam1" + query, http.StatusUnauthorized},
+		{"api", "/api/streams" + query, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		if w := testRequest(router, http.MethodGet, test.path, ""); w.Code != test.code {
+			t.Errorf("%s: %d, want %d", test.name, w.Code, test.code)
+		}
+	}
+	// The session token works on the segment route as well
+	if w := testRequest(router, http.MethodGet, "/api/playback/cam1/segment/"+name, tokens["viewer"]); w.Code != http.StatusOK {
+		t.Errorf("session token: %d", w.Code)
+	}
+
+	Sessions.mutex.Lock()
+	Sessions.media[token].Expires = time.Now().Add(-time.Second)
+	Sessions.mutex.Unlock()
+	if w := testRequest(router, http.MethodGet, "/api/playback/cam1/segment/"+name+query, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: %d", w.Code)
+	}
+
+	// A token of a stream the user lost is refused by the stream check
+	other := Sessions.createMedia("viewer", "cam2", time.Minute)
+	if w := testRequest(router, http.MethodGet, "/api/playback/cam2/segment/"+name+"?token="+other, ""); w.Code != http.StatusForbidden {
+		t.Errorf("token of a stream without grant: %d", w.Code)
+	}
+}
+
+func TestPlaybackRanges(t *testing.T) {
+	router, tokens := testRBAC(t)
+	segments := testPlaybackSegments(t)
+	w := testRequest(router, http.MethodGet, "/api/playback/cam1/ranges", tokens["viewer"])
+	if w.Code != http.StatusOK {
+		t.Fatalf("ranges %d", w.Code)
+	}
+	want := fmt.Sprintf(`"ranges":[{"start":%q,"end":%q},{"start":%q,"end":%q}]`,
+		segments[0].Start.Format(time.RFC3339Nano), segments[1].End().Format(time.RFC3339Nano),
+		segments[2].Start.Format(time.RFC3339Nano), segments[2].End().Format(time.RFC3339Nano))
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("ranges %s, want %s", w.Body.String(), want)
+	}
+}
+
+func TestPlaybackCoverage(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	segment := func(start, duration time.Duration) RecordSegmentST {
+		return RecordSegmentST{Start: at.Add(start), Duration: duration}
+	}
+	span := func(start, end time.Duration) PlaybackRangeST {
+		return PlaybackRangeST{Start: at.Add(start), End: at.Add(end)}
+	}
+	tests := []struct {
+		name     string
+		segments []RecordSegmentST
+		ranges   []PlaybackRangeST
+		gaps     []PlaybackRangeST
+	}{
+		{"none", nil, []PlaybackRangeST{}, []PlaybackRangeST{}},
+		{"adjacent", []RecordSegmentST{segment(0, time.Minute), segment(time.Minute, time.Minute)},
+			[]PlaybackRangeST{span(0, 2*time.Minute)}, []PlaybackRangeST{}},
+		{"within tolerance", []RecordSegmentST{segment(0, time.Minute), segment(time.Minute+playbackGapTolerance, time.Minute)},
+			[]PlaybackRangeST{span(0, 2*time.Minute+playbackGapTolerance)}, []PlaybackRangeST{}},
+		{"gap", []RecordSegmentST{segment(0, time.Minute), segment(2*time.Minute, time.Minute)},
+			[]PlaybackRangeST{span(0, time.Minute), span(2*time.Minute, 3*time.Minute)}, []PlaybackRangeST{span(time.Minute, 2*time.Minute)}},
+		{"contained", []RecordSegmentST{segment(0, 2*time.Minute), segment(time.Minute, 30*time.Second)},
+			[]PlaybackRangeST{span(0, 2*time.Minute)}, []PlaybackRangeST{}},
+	}
+	for _, test := range tests {
+		ranges, gaps := playbackCoverage(test.segments)
+		if !reflect.DeepEqual(ranges, test.ranges) || !reflect.DeepEqual(gaps, test.gaps) {
+			t.Errorf("%s: ranges %v gaps %v, want %v %v", test.name, ranges, gaps, test.ranges, test.gaps)
+		}
+	}
+}
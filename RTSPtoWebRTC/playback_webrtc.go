@@ -0,0 +1,510 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	webrtc "github.com/deepch/vdk/format/webrtcv3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PlaybackActionPlay  = "play"
+	PlaybackActionPause = "pause"
+	PlaybackActionSeek  = "seek"
+	PlaybackActionRate  = "rate"
+
+	// playbackSessionIdle closes a paused or finished session nobody controls
+	playbackSessionIdle     = 60 * time.Second
+	playbackDefaultDuration = 40 * time.Millisecond
+	playbackMaxRate         = 16
+)
+
+var (
+	ErrorPlaybackSessionNotFound = errors.New("playback session not found")
+	ErrorPlaybackSessionBusy     = errors.New("playback session not accepting commands")
+	ErrorPlaybackBadAction       = errors.New("playback action must be play, pause, seek or rate")
+	ErrorPlaybackBadRate         = errors.New("playback rate must be between 0 and 16")
+	ErrorPlaybackStopped         = errors.New("playback session stopped")
+	ErrorPlaybackEnded           = errors.New("playback reached end of recordings")
+	errorPlaybackSeek            = errors.New("playback seek requested")
+)
+
+// PlaybackSessions global
+var PlaybackSessions = &PlaybackSessionsST{sessions: make(map[string]*PlaybackSessionST)}
+
+// PlaybackSessionsST tracks running WebRTC playback sessions
+type PlaybackSessionsST struct {
+	mutex    sync.Mutex
+	sessions map[string]*PlaybackSessionST
+}
+
+// PlaybackControlST is a command for a running playback session
+type PlaybackControlST struct {
+	Action string  `json:"action"`
+	Time   string  `json:"time"`
+	Rate   float64 `json:"rate"`
+	seek   time.Time
+}
+
+// PlaybackSessionST replays recorded segments through a WebRTC muxer
+type PlaybackSessionST struct {
+	mutex    sync.Mutex
+	ID       string    `json:"id"`
+	UUID     string    `json:"uuid"`
+	Position time.Time `json:"position"`
+	End      time.Time `json:"end"`
+	Paused   bool      `json:"paused"`
+	Rate     float64   `json:"rate"`
+	Ended    bool      `json:"ended"`
+	codecs   []av.CodecData
+	control  chan PlaybackControlST
+	stop     chan bool
+}
+
+func (element *PlaybackSessionsST) add(uuid string, start, end time.Time, codecs []av.CodecData) *PlaybackSessionST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	session := &PlaybackSessionST{
+		ID:       pseudoUUID(),
+		UUID:     uuid,
+		Position: start,
+		End:      end,
+		Rate:     1,
+		codecs:   codecs,
+		control:  make(chan PlaybackControlST),
+		stop:     make(chan bool),
+	}
+	element.sessions[session.ID] = session
+	log.Println("Added playback session", session.ID, "for stream", uuid)
+	return session
+}
+
+func (element *PlaybackSessionsST) get(uuid, id string) (*PlaybackSessionST, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	session, ok := element.sessions[id]
+	if !ok || session.UUID != uuid {
+		return nil, false
+	}
+	return session, true
+}
+
+func (element *PlaybackSessionsST) remove(id string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if session, ok := element.sessions[id]; ok {
+		close(session.stop)
+		delete(element.sessions, id)
+		log.Println("Removed playback session", id)
+	}
+}
+
+// Status returns a copy of the session state for the API
+func (element *PlaybackSessionST) Status() gin.H {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return gin.H{
+		"id":       element.ID,
+		"uuid":     element.UUID,
+		"position": element.Position,
+		"end":      element.End,
+		"paused":   element.Paused,
+		"rate":     element.Rate,
+		"ended":    element.Ended,
+	}
+}
+
+// Send hands a command to the session goroutine
+func (element *PlaybackSessionST) Send(cmd PlaybackControlST) error {
+	select {
+	case element.control <- cmd:
+		return nil
+	case <-element.stop:
+		return ErrorPlaybackSessionNotFound
+	case <-time.After(2 * time.Second):
+		return ErrorPlaybackSessionBusy
+	}
+}
+
+// apply updates the session state, it returns errorPlaybackSeek when the
+// current segment has to be abandoned
+func (element *PlaybackSessionST) apply(cmd PlaybackControlST) error {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	switch cmd.Action {
+	case PlaybackActionPlay:
+		element.Paused = false
+	case PlaybackActionPause:
+		element.Paused = true
+	case PlaybackActionRate:
+		element.Rate = cmd.Rate
+	case PlaybackActionSeek:
+		element.Position = cmd.seek
+		element.Ended = false
+		return errorPlaybackSeek
+	}
+	return nil
+}
+
+func (element *PlaybackSessionST) state() (bool, float64) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return element.Paused, element.Rate
+}
+
+// wait blocks until due while the session is playing, applying commands
+// as they arrive. It returns when the packet is due or playback must leave
+// the current segment.
+func (element *PlaybackSessionST) wait(clock *playbackClock, position time.Time) error {
+	for {
+		paused, rate := element.state()
+		var timeout <-chan time.Time
+		if paused {
+			timeout = time.After(playbackSessionIdle)
+		} else {
+			delay := clock.due(position, rate)
+			if delay <= 0 {
+				return nil
+			}
+			timeout = time.After(delay)
+		}
+		select {
+		case <-element.stop:
+			return ErrorPlaybackStopped
+		case <-timeout:
+			if paused {
+				return ErrorPlaybackStopped
+			}
+			return nil
+		case cmd := <-element.control:
+			if err := element.apply(cmd); err != nil {
+				return err
+			}
+			// Restart pacing from here after pause or a rate change
+			clock.reset(position)
+		}
+	}
+}
+
+// playbackClock maps recorded wall clock time onto real time
+type playbackClock struct {
+	real     time.Time
+	media    time.Time
+	previous time.Time
+}
+
+func (element *playbackClock) reset(position time.Time) {
+	element.real = time.Now()
+	element.media = position
+}
+
+func (element *playbackClock) due(position time.Time, rate float64) time.Duration {
+	// Jump over gaps between segments and backwards seeks
+	if element.real.IsZero() || element.previous.Sub(position) > playbackGapTolerance || position.Sub(element.previous) > playbackGapTolerance {
+		element.reset(position)
+		element.previous = position
+	}
+	if position.After(element.previous) {
+		element.previous = position
+	}
+	offset := time.Duration(float64(position.Sub(element.media)) / rate)
+	return time.Until(element.real.Add(offset))
+}
+
+func (element *PlaybackSessionST) run(muxer *webrtc.Muxer) {
+	defer PlaybackSessions.remove(element.ID)
+	defer muxer.Close()
+	for {
+		element.mutex.Lock()
+		position := element.Position
+		element.mutex.Unlock()
+		err := element.play(muxer, position)
+		switch err {
+		case errorPlaybackSeek:
+			continue
+		case ErrorPlaybackEnded:
+			log.Println("Playback session", element.ID, "reached end, waiting for seek")
+			element.mutex.Lock()
+			element.Ended = true
+			element.mutex.Unlock()
+			if err = element.idle(); err != nil {
+				return
+			}
+		default:
+			log.Println("Playback session", element.ID, err)
+			return
+		}
+	}
+}
+
+// idle waits for a seek after playback ended
+func (element *PlaybackSessionST) idle() error {
+	timeout := time.NewTimer(playbackSessionIdle)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-element.stop:
+			return ErrorPlaybackStopped
+		case <-timeout.C:
+			return ErrorPlaybackStopped
+		case cmd := <-element.control:
+			if err := element.apply(cmd); err == errorPlaybackSeek {
+				return nil
+			}
+		}
+	}
+}
+
+// play sends every recorded packet from position on, starting each
+// segment at the keyframe preceding the requested time
+func (element *PlaybackSessionST) play(muxer *webrtc.Muxer, position time.Time) error {
+	segments, err := recordSegmentsInRange(element.UUID, position, element.End)
+	if err != nil || len(segments) == 0 {
+		return ErrorPlaybackEnded
+	}
+	clock := &playbackClock{}
+	durations := make(map[int8]time.Duration)
+	previous := make(map[int8]time.Duration)
+	for _, segment := range segments {
+		offset := position.Sub(segment.Start)
+		if offset < 0 {
+			offset = 0
+		}
+		offset = recordKeyframeBefore(segment, offset)
+		demuxer, file, err := openRecordSegment(segment)
+		if err != nil {
+			log.Println("Playback open segment error", segment.Path, err)
+			continue
+		}
+		streams, err := demuxer.Streams()
+		if err != nil {
+			file.Close()
+			log.Println("Playback read segment error", segment.Path, err)
+			continue
+		}
+		first := time.Duration(-1)
+		for {
+			pkt, err := demuxer.ReadPacket()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Println("Playback read packet error", segment.Path, err)
+				break
+			}
+			if first < 0 {
+				first = pkt.Time
+			}
+			relative := pkt.Time - first
+			if relative < offset {
+				continue
+			}
+			// Skip tracks that do not line up with the negotiated header
+			if int(pkt.Idx) >= len(streams) || int(pkt.Idx) >= len(element.codecs) || streams[pkt.Idx].Type() != element.codecs[pkt.Idx].Type() {
+				continue
+			}
+			at := segment.Start.Add(relative)
+			if !element.End.IsZero() && at.After(element.End) {
+				file.Close()
+				return ErrorPlaybackEnded
+			}
+			if err = element.wait(clock, at); err != nil {
+				file.Close()
+				return err
+			}
+			_, rate := element.state()
+			if rate != 1 && streams[pkt.Idx].Type().IsAudio() {
+				continue
+			}
+			if pkt.Duration <= 0 {
+				if last, ok := previous[pkt.Idx]; ok && pkt.Time > last {
+					durations[pkt.Idx] = pkt.Time - last
+				}
+				pkt.Duration = durations[pkt.Idx]
+				if pkt.Duration <= 0 {
+					pkt.Duration = playbackDefaultDuration
+				}
+			}
+			previous[pkt.Idx] = pkt.Time
+			pkt.Duration = time.Duration(float64(pkt.Duration) / rate)
+			if err = muxer.WritePacket(pkt); err != nil {
+				file.Close()
+				return err
+			}
+			element.mutex.Lock()
+			element.Position = at
+			element.mutex.Unlock()
+		}
+		file.Close()
+		position = segment.End()
+		previous = make(map[int8]time.Duration)
+	}
+	return ErrorPlaybackEnded
+}
+
+// recordKeyframeBefore returns the offset of the last video keyframe at or
+// before offset within the segment
+func recordKeyframeBefore(segment RecordSegmentST, offset time.Duration) time.Duration {
+	if offset <= 0 {
+		return 0
+	}
+	demuxer, file, err := openRecordSegment(segment)
+	if err != nil {
+		return offset
+	}
+	defer file.Close()
+	streams, err := demuxer.Streams()
+	if err != nil || !hasVideo(streams) {
+		return offset
+	}
+	var keyframe time.Duration
+	first := time.Duration(-1)
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err != nil {
+			return keyframe
+		}
+		if first < 0 {
+			first = pkt.Time
+		}
+		relative := pkt.Time - first
+		if relative > offset {
+			return keyframe
+		}
+		if pkt.IsKeyFrame && int(pkt.Idx) < len(streams) && streams[pkt.Idx].Type().IsVideo() {
+			keyframe = relative
+		}
+	}
+}
+
+// HTTPAPIServerPlaybackWebRTC starts a WebRTC playback session of recorded
+// footage. It takes the base64 SDP offer in the "data" form field like
+// /stream/receiver and answers with the session id used for control.
+func HTTPAPIServerPlaybackWebRTC(c *gin.Context) {
+	negotiated := false
+	defer func() {
+		Metrics.webrtcSession(MetricsSessionPlayback, negotiated)
+	}()
+	uuid := c.Param("uuid")
+	start, end, err := parsePlaybackRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	segments, err := recordSegmentsInRange(uuid, start, end)
+	if err != nil || len(segments) == 0 {
+		log.Println("No recordings found for WebRTC playback of stream", uuid, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "No recordings found"})
+		return
+	}
+	if start.IsZero() || start.Before(segments[0].Start) {
+		start = segments[0].Start
+	}
+	demuxer, file, err := openRecordSegment(segments[0])
+	if err != nil {
+		log.Println("Playback open segment error", segments[0].Path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open recording"})
+		return
+	}
+	codecs, err := demuxer.Streams()
+	file.Close()
+	if err != nil {
+		log.Println("Playback read segment error", segments[0].Path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read recording"})
+		return
+	}
+
+	muxerWebRTC := webrtc.NewMuxer(webrtc.Options{
+		ICEServers:    Config.GetICEServers(),
+		ICEUsername:   Config.GetICEUsername(),
+		ICECredential: Config.GetICECredential(),
+		PortMin:       Config.GetWebRTCPortMin(),
+		PortMax:       Config.GetWebRTCPortMax(),
+	})
+	answer, err := muxerWebRTC.WriteHeader(codecs, c.PostForm("data"))
+	if err != nil {
+		log.Println("Playback WriteHeader error for stream", uuid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	negotiated = true
+
+	var tracks []string
+	for _, codec := range codecs {
+		if codec.Type() == av.H264 {
+			tracks = append(tracks, "video")
+		} else if codec.Type() == av.PCM_ALAW || codec.Type() == av.PCM_MULAW || codec.Type() == av.OPUS {
+			tracks = append(tracks, "audio")
+		}
+	}
+	session := PlaybackSessions.add(uuid, start, end, codecs)
+	auditRequest(c, AuditPlayback, uuid, "webrtc session "+session.ID+" from "+start.UTC().Format(time.RFC3339), nil)
+	c.JSON(http.StatusOK, gin.H{
+		"session": session.ID,
+		"sdp64":   answer,
+		"tracks":  tracks,
+	})
+	go session.run(muxerWebRTC)
+}
+
+func HTTPAPIServerPlaybackSession(c *gin.Context) {
+	session, ok := PlaybackSessions.get(c.Param("uuid"), c.Param("session"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrorPlaybackSessionNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session.Status())
+}
+
+// HTTPAPIControlPlaybackSession takes {"action": "play|pause|seek|rate"}
+// with "time" for seek and "rate" for rate
+func HTTPAPIControlPlaybackSession(c *gin.Context) {
+	session, ok := PlaybackSessions.get(c.Param("uuid"), c.Param("session"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrorPlaybackSessionNotFound.Error()})
+		return
+	}
+	var cmd PlaybackControlST
+	if err := c.ShouldBindJSON(&cmd); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	switch cmd.Action {
+	case PlaybackActionPlay, PlaybackActionPause:
+	case PlaybackActionRate:
+		if cmd.Rate <= 0 || cmd.Rate > playbackMaxRate {
+			c.JSON(http.StatusBadRequest, gin.H{"error": ErrorPlaybackBadRate.Error()})
+			return
+		}
+	case PlaybackActionSeek:
+		seek, err := parsePlaybackTime(cmd.Time)
+		if err != nil || seek.IsZero() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": ErrorPlaybackBadTime.Error()})
+			return
+		}
+		cmd.seek = seek
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrorPlaybackBadAction.Error()})
+		return
+	}
+	if err := session.Send(cmd); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session.Status())
+}
+
+func HTTPAPIStopPlaybackSession(c *gin.Context) {
+	session, ok := PlaybackSessions.get(c.Param("uuid"), c.Param("session"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrorPlaybackSessionNotFound.Error()})
+		return
+	}
+	PlaybackSessions.remove(session.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Playback session stopped"})
+}
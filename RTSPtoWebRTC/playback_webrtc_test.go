@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testPlaybackSession() *PlaybackSessionST {
+	return &PlaybackSessionST{Rate: 1, control: make(chan PlaybackControlST), stop: make(chan bool)}
+}
+
+// testPace waits for frames 40ms apart and returns how long that took
+func testPace(t *testing.T, session *PlaybackSessionST, frames int) time.Duration {
+	t.Helper()
+	var clock playbackClock
+	at := time.Unix(1700000000, 0)
+	started := time.Now()
+	for i := 0; i < frames; i++ {
+		if err := session.wait(&clock, at.Add(time.Duration(i)*40*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return time.Since(started)
+}
+
+// One second of recording, 26 frames 40ms apart, plays in a second divided
+// by the rate
+func TestPlaybackPacingRate(t *testing.T) {
+	tests := []struct {
+		rate     float64
+		min, max time.Duration
+	}{
+		{1, 950 * time.Millisecond, 1500 * time.Millisecond},
+		{4, 240 * time.Millisecond, 600 * time.Millisecond},
+		{16, 55 * time.Millisecond, 400 * time.Millisecond},
+	}
+	for _, test := range tests {
+		session := testPlaybackSession()
+		session.Rate = test.rate
+		if took := testPace(t, session, 26); took < test.min || took > test.max {
+			t.Errorf("rate %v: took %v, want %v to %v", test.rate, took, test.min, test.max)
+		}
+	}
+}
+
+// A rate change takes effect from the current frame on
+func TestPlaybackPacingRateChange(t *testing.T) {
+	session := testPlaybackSession()
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		session.Send(PlaybackControlST{Action: PlaybackActionRate, Rate: 4})
+	}()
+	// Half a second at normal speed, the other half four times as fast
+	if took := testPace(t, session, 26); took < 600*time.Millisecond || took > 950*time.Millisecond {
+		t.Errorf("took %v, want about 625ms", took)
+	}
+}
+
+func TestPlaybackPacingPause(t *testing.T) {
+	session := testPlaybackSession()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		session.Send(PlaybackControlST{Action: PlaybackActionPause})
+		time.Sleep(400 * time.Millisecond)
+		session.Send(PlaybackControlST{Action: PlaybackActionPlay})
+	}()
+	if took := testPace(t, session, 26); took < 1350*time.Millisecond || took > 2*time.Second {
+		t.Errorf("took %v, want about 1.4s", took)
+	}
+}
+
+// Gaps between segments and backward seeks are not waited for
+func TestPlaybackClockJumps(t *testing.T) {
+	var clock playbackClock
+	at := time.Unix(1700000000, 0)
+	if delay := clock.due(at, 1); delay > 0 {
+		t.Errorf("first frame due in %v", delay)
+	}
+	if delay := clock.due(at.Add(time.Second), 1); delay < 900*time.Millisecond {
+		t.Errorf("frame a second later due in %v", delay)
+	}
+	if delay := clock.due(at.Add(time.Hour), 1); delay > 0 {
+		t.Errorf("frame after a gap due in %v", delay)
+	}
+	if delay := clock.due(at, 1); delay > 0 {
+		t.Errorf("frame before the previous one due in %v", delay)
+	}
+	if delay := clock.due(at.Add(time.Second), 2); delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Errorf("frame a second later at rate 2 due in %v", delay)
+	}
+}
+
+func TestPlaybackWaitStopped(t *testing.T) {
+	session := testPlaybackSession()
+	var clock playbackClock
+	at := time.Unix(1700000000, 0)
+	session.wait(&clock, at)
+	close(session.stop)
+	if err := session.wait(&clock, at.Add(time.Second)); err != ErrorPlaybackStopped {
+		t.Errorf("stopped session: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PushStreamStatus  = "stream.status"
+	PushStreamViewers = "stream.viewers"
+	PushAlert         = "alert"
+	PushAlertUpdate   = "alert.update"
+	PushEvent         = "event"
+	// PushViewerSubstream tells one slow viewer to watch the substream
+	PushViewerSubstream = "viewer.substream"
+
+	// pushBuffer messages are queued per client, a client that falls further
+	// behind loses messages instead of holding up the publisher
+	pushBuffer = 64
+	// pushHeartbeat keeps proxies from closing an idle connection and is when
+	// the session of the client is checked again
+	pushHeartbeat = 25 * time.Second
+)
+
+// Push global
+var Push = &PushST{clients: make(map[int]*pushClientST)}
+
+// PushST fans state changes out to the clients of /api/push. Publishing
+// never blocks, so it is safe under Config.mutex and from worker loops.
+type PushST struct {
+	mutex   sync.Mutex
+	next    int
+	clients map[int]*pushClientST
+}
+
+type pushClientST struct {
+	user    UserST
+	C       chan PushMessageST
+	dropped int
+}
+
+// PushMessageST is sent as the data of a server-sent event named Type
+type PushMessageST struct {
+	Type   string      `json:"type"`
+	Stream string      `json:"stream,omitempty"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+// PushStreamStatusST is the data of stream.status messages
+type PushStreamStatusST struct {
+	Status  bool `json:"status"`
+	Running bool `json:"running"`
+}
+
+// PushViewersST is the data of stream.viewers messages
+type PushViewersST struct {
+	Viewers int `json:"viewers"`
+}
+
+// PushSubstreamST is the data of viewer.substream messages. Viewer is the
+// id the WebRTC request returned, only that client reconnects.
+type PushSubstreamST struct {
+	Viewer    string `json:"viewer"`
+	Substream string `json:"substream"`
+}
+
+func (element *PushST) subscribe(user UserST) (int, *pushClientST) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.next++
+	client := &pushClientST{user: user, C: make(chan PushMessageST, pushBuffer)}
+	element.clients[element.next] = client
+	return element.next, client
+}
+
+func (element *PushST) unsubscribe(id int) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	delete(element.clients, id)
+}
+
+// Publish queues msg for every client allowed to see its stream; messages
+// without a stream follow eventVisible and go to operators
+func (element *PushST) Publish(msg PushMessageST) {
+	if msg.Time.IsZero() {
+		msg.Time = time.Now().UTC()
+	}
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	for id, client := range element.clients {
+		if !eventVisible(client.user, EventST{Stream: msg.Stream}) {
+			continue
+		}
+		select {
+		case client.C <- msg:
+		default:
+			if client.dropped == 0 {
+				log.Println("Push client", id, "is not keeping up, dropping messages")
+			}
+			client.dropped++
+		}
+	}
+}
+
+func (element *PushST) streamStatus(uuid string, status, running bool) {
+	element.Publish(PushMessageST{Type: PushStreamStatus, Stream: uuid, Data: PushStreamStatusST{Status: status, Running: running}})
+}
+
+func (element *PushST) viewers(uuid string, count int) {
+	element.Publish(PushMessageST{Type: PushStreamViewers, Stream: uuid, Data: PushViewersST{Viewers: count}})
+}
+
+func (element *PushST) substream(uuid, viewer, substream string) {
+	element.Publish(PushMessageST{Type: PushViewerSubstream, Stream: uuid, Data: PushSubstreamST{Viewer: viewer, Substream: substream}})
+}
+
+// pushState lists the current status and viewers of the streams user may
+// see, sent first so a client needs no extra request
+func pushState(user UserST) []PushMessageST {
+	Config.mutex.RLock()
+	defer Config.mutex.RUnlock()
+	now := time.Now().UTC()
+	var res []PushMessageST
+	for uuid, stream := range Config.Streams {
+		if !user.CanStream(uuid) {
+			continue
+		}
+		res = append(res, PushMessageST{Type: PushStreamStatus, Stream: uuid, Time: now, Data: PushStreamStatusST{Status: stream.Status, Running: stream.RunLock}})
+		if stream.hub != nil {
+			res = append(res, PushMessageST{Type: PushStreamViewers, Stream: uuid, Time: now, Data: PushViewersST{Viewers: stream.hub.CountKind(SubscriberViewer)}})
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Stream < res[j].Stream
+	})
+	return res
+}
+
+// HTTPAPIServerPush streams state changes as server-sent events. Browsers
+// cannot set headers on an EventSource, so the token is usually passed as
+// ?token=. The stream ends when the session does.
+func HTTPAPIServerPush(c *gin.Context) {
+	token := requestToken(c)
+	user := currentUser(c)
+	id, client := Push.subscribe(user)
+	defer Push.unsubscribe(id)
+	log.Println("User", c.GetString(authUserKey), "subscribed to push channel", id)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	for _, msg := range pushState(user) {
+		c.SSEvent(msg.Type, msg)
+	}
+	c.Writer.Flush()
+	heartbeat := time.NewTicker(pushHeartbeat)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			if _, ok := Sessions.validate(token); !ok {
+				log.Println("Push channel", id, "session ended")
+				return false
+			}
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case msg := <-client.C:
+			c.SSEvent(msg.Type, msg)
+			return true
+		}
+	})
+	log.Println("Push channel", id, "closed")
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+// testPushViewers returns the viewer counts pushed since the last call
+func testPushViewers(client *pushClientST) []int {
+	var res []int
+	for {
+		select {
+		case msg := <-client.C:
+			if msg.Type == PushStreamViewers {
+				res = append(res, msg.Data.(PushViewersST).Viewers)
+			}
+		default:
+			return res
+		}
+	}
+}
+
+// Only viewers are counted, and only a changed count is pushed
+func TestPushViewerCount(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {}})
+	id, client := Push.subscribe(UserST{Role: RoleAdmin})
+	defer Push.unsubscribe(id)
+
+	viewer := cfg.clAd("cam", SubscriberViewer)
+	if got := testPushViewers(client); len(got) != 1 || got[0] != 1 {
+		t.Errorf("viewer joined: pushed %v, want [1]", got)
+	}
+	recorder := cfg.clAd("cam", SubscriberRecorder)
+	snapshot := cfg.clAd("cam", SubscriberSnapshot)
+	cfg.clDe("cam", snapshot.ID)
+	cfg.clDe("cam", recorder.ID)
+	if got := testPushViewers(client); len(got) != 0 {
+		t.Errorf("recorder and snapshot: pushed %v", got)
+	}
+	for _, msg := range pushState(UserST{Role: RoleAdmin}) {
+		if msg.Type == PushStreamViewers && msg.Data.(PushViewersST).Viewers != 1 {
+			t.Errorf("state counts %d viewers", msg.Data.(PushViewersST).Viewers)
+		}
+	}
+
+	cfg.clDe("cam", viewer.ID)
+	// A handler leaving twice does not announce the same count again
+	cfg.clDe("cam", viewer.ID)
+	if got := testPushViewers(client); len(got) != 1 || got[0] != 0 {
+		t.Errorf("viewer left: pushed %v, want [0]", got)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultReconnectInitial = 1
+	defaultReconnectMax     = 60
+)
+
+var (
+	ErrorReconnectNegative = errors.New("reconnect settings must not be negative")
+	ErrorReconnectJitter   = errors.New("reconnect jitter must be between 0 and 1")
+	ErrorReconnectMax      = errors.New("reconnect max_seconds must not be below initial_seconds")
+)
+
+// ReconnectST configures how a stream worker retries a failing source. The
+// wait doubles with every consecutive failure up to MaxSeconds, and after
+// SuspendAfter failures the stream is suspended until retried by hand.
+type ReconnectST struct {
+	// InitialSeconds is the wait after the first failure, 0 is one second
+	InitialSeconds int `json:"initial_seconds"`
+	// MaxSeconds caps the wait, 0 is one minute
+	MaxSeconds int `json:"max_seconds"`
+	// Jitter varies every wait by up to this fraction so cameras behind one
+	// switch do not retry in lockstep
+	Jitter float64 `json:"jitter"`
+	// SuspendAfter consecutive failures suspend the stream, 0 never does
+	SuspendAfter int `json:"suspend_after"`
+}
+
+func (element ReconnectST) Validate() error {
+	if element.InitialSeconds < 0 || element.MaxSeconds < 0 || element.SuspendAfter < 0 {
+		return ErrorReconnectNegative
+	}
+	if element.Jitter < 0 || element.Jitter > 1 {
+		return ErrorReconnectJitter
+	}
+	if element.MaxSeconds > 0 && element.MaxSeconds < element.InitialSeconds {
+		return ErrorReconnectMax
+	}
+	return nil
+}
+
+// delay is the wait after the given number of consecutive failures
+func (element ReconnectST) delay(failures int) time.Duration {
+	initial := time.Duration(element.InitialSeconds) * time.Second
+	if initial <= 0 {
+		initial = defaultReconnectInitial * time.Second
+	}
+	max := time.Duration(element.MaxSeconds) * time.Second
+	if max <= 0 {
+		max = defaultReconnectMax * time.Second
+	}
+	if max < initial {
+		max = initial
+	}
+	res := max
+	if failures < 1 {
+		failures = 1
+	}
+	// Past 2^30 the multiplication overflows, the cap applies long before
+	if failures <= 30 {
+		if backoff := initial * time.Duration(math.Pow(2, float64(failures-1))); backoff < max {
+			res = backoff
+		}
+	}
+	if element.Jitter > 0 {
+		res += time.Duration(float64(res) * element.Jitter * (rand.Float64()*2 - 1))
+	}
+	return res
+}
+
+// reconnect resolves the policy of a stream, falling back to the server default
+func (element *ConfigST) reconnect(uuid string) ReconnectST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if tmp, ok := element.Streams[uuid]; ok && tmp.Reconnect != nil {
+		return *tmp.Reconnect
+	}
+	return element.Server.Reconnect
+}
+
+// RetryST is the reconnect state of a stream worker. It belongs to the
+// stream and is guarded by Config.mutex, metrics and health only report it.
+type RetryST struct {
+	// Failures counts connection attempts since the last successful connect
+	Failures  int
+	Suspended bool
+	// NextRetry is when a backing off worker connects again
+	NextRetry time.Time
+}
+
+// workerFailed counts a failed connection attempt and returns the number
+// of consecutive failures
+func (element *ConfigST) workerFailed(uuid string) int {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	tmp, ok := element.Streams[uuid]
+	if !ok {
+		return 0
+	}
+	tmp.retry.Failures++
+	element.Streams[uuid] = tmp
+	return tmp.retry.Failures
+}
+
+// workerConnected resets the backoff, called by a worker for every
+// successful connect
+func (element *ConfigST) workerConnected(uuid string) {
+	element.setRetry(uuid, RetryST{})
+}
+
+func (element *ConfigST) backoff(uuid string, next time.Time) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if tmp, ok := element.Streams[uuid]; ok {
+		tmp.retry.NextRetry = next
+		element.Streams[uuid] = tmp
+	}
+}
+
+func (element *ConfigST) suspend(uuid string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if tmp, ok := element.Streams[uuid]; ok {
+		tmp.retry.Suspended = true
+		tmp.retry.NextRetry = time.Time{}
+		element.Streams[uuid] = tmp
+	}
+}
+
+// resume forgets the failures of a stream and reports whether it was
+// suspended
+func (element *ConfigST) resume(uuid string) bool {
+	return element.setRetry(uuid, RetryST{}).Suspended
+}
+
+// setRetry replaces the reconnect state of a stream and returns the old one
+func (element *ConfigST) setRetry(uuid string, retry RetryST) RetryST {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	tmp, ok := element.Streams[uuid]
+	if !ok {
+		return RetryST{}
+	}
+	old := tmp.retry
+	tmp.retry = retry
+	element.Streams[uuid] = tmp
+	return old
+}
+
+// HTTPAPIServerStreamRetry clears the backoff of a stream and connects now,
+// starting it again when it was suspended
+func HTTPAPIServerStreamRetry(c *gin.Context) {
+	uuid := c.Param("uuid")
+	Config.mutex.RLock()
+	tmp, ok := Config.Streams[uuid]
+	Config.mutex.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	suspended := Config.resume(uuid)
+	if tmp.worker != nil {
+		tmp.worker.wake()
+	} else {
+		Config.RunIFNotRun(uuid)
+	}
+	detail := ""
+	if suspended {
+		detail = "was suspended"
+	}
+	auditRequest(c, AuditStreamRetry, uuid, detail, nil)
+	log.Println("Retrying stream", uuid, "on request, suspended:", suspended)
+	c.JSON(http.StatusOK, gin.H{"id": uuid, "was_suspended": suspended})
+}
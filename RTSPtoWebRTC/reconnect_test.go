@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWorkerFailuresResetOnConnect(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {}})
+	cfg.workerFailed("cam")
+	cfg.backoff("cam", time.Now().Add(time.Minute))
+	cfg.workerConnected("cam")
+	if cam, _ := testStream(cfg, "cam"); cam.retry.Failures != 0 || !cam.retry.NextRetry.IsZero() {
+		t.Errorf("after a connect %+v", cam.retry)
+	}
+	if failures := cfg.workerFailed("cam"); failures != 1 {
+		t.Errorf("fail, connect, fail counted %d failures, want 1", failures)
+	}
+	if failures := cfg.workerFailed("unknown"); failures != 0 {
+		t.Errorf("unknown stream counted %d failures", failures)
+	}
+}
+
+// testRefusedURL points at a local port nothing listens on
+func testRefusedURL(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return "rtsp://" + addr + "/refused"
+}
+
+func TestWorkerLoopSuspends(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {
+		URL:       testRefusedURL(t),
+		Reconnect: &ReconnectST{SuspendAfter: 2},
+	}})
+	cfg.RunIFNotRun("cam")
+	cam, _ := testStream(cfg, "cam")
+	worker := cam.worker
+	if worker == nil {
+		t.Fatal("worker not started")
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return testHealth(cfg, "cam").Failures == 1 }) {
+		t.Fatalf("first failure not counted: %+v", testHealth(cfg, "cam"))
+	}
+	if health := testHealth(cfg, "cam"); health.NextRetry == nil || health.Suspended {
+		t.Errorf("backing off stream reported %+v", health)
+	}
+	worker.wake()
+	select {
+	case <-worker.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not give up")
+	}
+	health := testHealth(cfg, "cam")
+	if !health.Suspended || health.Failures != 2 || health.NextRetry != nil {
+		t.Errorf("suspended stream reported %+v", health)
+	}
+	cfg.RunIFNotRun("cam")
+	if cam, _ = testStream(cfg, "cam"); cam.worker != nil {
+		t.Fatal("suspended stream started without a retry")
+	}
+	if !cfg.resume("cam") {
+		t.Error("resume did not report the suspension")
+	}
+	if health := testHealth(cfg, "cam"); health.Suspended || health.Failures != 0 {
+		t.Errorf("resumed stream reported %+v", health)
+	}
+}
+
+func testHealth(cfg *ConfigST, uuid string) StreamHealthST {
+	cfg.mutex.RLock()
+	defer cfg.mutex.RUnlock()
+	return streamHealth(uuid, cfg.Streams[uuid])
+}
+
+// Suspending stops the worker, the stream still should be running so its
+// offline alert holds until it is retried
+func TestAlertsKeepSuspendedStreamRunning(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {Name: "Cam", RunLock: true}})
+	cfg.AlertRules = []AlertRuleST{{ID: "offline", Type: AlertRuleOffline, Threshold: 5, Enabled: true}}
+	testEvents(t)
+	alerts := newAlerts()
+	active := func() int {
+		list, _, err := alerts.List(func(alert AlertST) bool { return alert.Status != AlertStatusResolved }, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(list)
+	}
+	now := time.Now()
+	alerts.evaluate(now)
+	alerts.evaluate(now.Add(10 * time.Second))
+	if active() != 1 {
+		t.Fatal("offline alert did not fire")
+	}
+
+	cfg.workerFailed("cam")
+	cfg.suspend("cam")
+	cfg.RunUnlock("cam", nil)
+	alerts.evaluate(now.Add(20 * time.Second))
+	if active() != 1 {
+		t.Fatal("offline alert resolved by the suspension")
+	}
+
+	// A stream stopped for good does not need to be running
+	cfg.resume("cam")
+	alerts.evaluate(now.Add(30 * time.Second))
+	if active() != 0 {
+		t.Error("offline alert of a stopped stream not resolved")
+	}
+}
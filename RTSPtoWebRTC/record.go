@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RecordFormatTS  = "ts"
+	RecordFormatMP4 = "mp4"
+
+	defaultRecordPath            = "recordings"
+	defaultRecordSegmentDuration = 60
+	recordIdleTimeout            = 10 * time.Second
+	recordPartSuffix             = ".part"
+	// recordClockSkew bounds how far before now a segment derived from the
+	// packet timestamps may start, anything older is another timeline
+	recordClockSkew = time.Minute
+)
+
+var (
+	ErrorRecordStreamNotFound = errors.New("record stream not found")
+	ErrorRecordNoCodecs       = errors.New("record no codecs on stream")
+	ErrorRecordNoTracks       = errors.New("record no supported tracks on stream")
+	ErrorRecordNoPackets      = errors.New("record no packets on stream")
+	ErrorRecordDisconnected   = errors.New("record disconnected from stream")
+	ErrorRecordBadFormat      = errors.New("record format must be ts or mp4")
+	ErrorRecordBadDuration    = errors.New("record segment duration must not be negative")
+	ErrorRecordBadMaxAge      = errors.New("record max age must not be negative")
+)
+
+// RecordST struct
+type RecordST struct {
+	Enabled         bool   `json:"enabled"`
+	Format          string `json:"format"`
+	SegmentDuration int    `json:"segment_duration"`
+	// MaxAgeHours deletes segments older than this, 0 keeps them until the quota is hit
+	MaxAgeHours int `json:"max_age_hours"`
+}
+
+// Validate checks user supplied recording settings
+func (element RecordST) Validate() error {
+	if element.Format != "" && element.Format != RecordFormatTS && element.Format != RecordFormatMP4 {
+		return ErrorRecordBadFormat
+	}
+	if element.SegmentDuration < 0 {
+		return ErrorRecordBadDuration
+	}
+	if element.MaxAgeHours < 0 {
+		return ErrorRecordBadMaxAge
+	}
+	return nil
+}
+
+// FormatOrDefault returns the container used for new segments
+func (element RecordST) FormatOrDefault() string {
+	if element.Format == "" {
+		return RecordFormatTS
+	}
+	return element.Format
+}
+
+// SegmentDurationOrDefault returns the target length of a segment
+func (element RecordST) SegmentDurationOrDefault() time.Duration {
+	if element.SegmentDuration <= 0 {
+		return defaultRecordSegmentDuration * time.Second
+	}
+	return time.Duration(element.SegmentDuration) * time.Second
+}
+
+// Recorders global
+var Recorders = &RecordersST{workers: make(map[string]chan bool)}
+
+// RecordersST keeps one recording worker per stream
+type RecordersST struct {
+	mutex   sync.Mutex
+	workers map[string]chan bool
+}
+
+func (element *RecordersST) Start(uuid string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if _, ok := element.workers[uuid]; ok {
+		log.Println("Recorder already running for stream", uuid)
+		return
+	}
+	stop := make(chan bool)
+	element.workers[uuid] = stop
+	log.Println("Starting recorder for stream", uuid)
+	go RecordWorkerLoop(uuid, stop)
+}
+
+func (element *RecordersST) Stop(uuid string) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if stop, ok := element.workers[uuid]; ok {
+		close(stop)
+		delete(element.workers, uuid)
+		log.Println("Stopped recorder for stream", uuid)
+	}
+}
+
+// forget removes the entry of an exiting recorder. A Restart may already
+// have replaced it, the new recorder's entry has another stop channel.
+func (element *RecordersST) forget(uuid string, stop chan bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.workers[uuid] == stop {
+		delete(element.workers, uuid)
+		log.Println("Forgot recorder of removed stream", uuid)
+	}
+}
+
+func (element *RecordersST) Restart(uuid string) {
+	element.Stop(uuid)
+	element.Start(uuid)
+}
+
+func (element *RecordersST) Active(uuid string) bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	_, ok := element.workers[uuid]
+	return ok
+}
+
+func (element *ConfigST) GetRecordPath() string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if element.Server.RecordPath == "" {
+		return defaultRecordPath
+	}
+	return element.Server.RecordPath
+}
+
+func (element *ConfigST) GetRecord(uuid string) (RecordST, bool) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	tmp, ok := element.Streams[uuid]
+	return tmp.Record, ok
+}
+
+// recordDir returns the directory holding the segments of a stream. Stream
+// ids created through /stream can be raw RTSP URLs, so they are escaped.
+func recordDir(root, uuid string) string {
+	name := url.PathEscape(uuid)
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name
+	}
+	return filepath.Join(root, name)
+}
+
+func serveRecorders() {
+	Config.mutex.RLock()
+	var enabled []string
+	for k, v := range Config.Streams {
+		if v.Record.Enabled {
+			enabled = append(enabled, k)
+		}
+	}
+	Config.mutex.RUnlock()
+	for _, k := range enabled {
+		Recorders.Start(k)
+	}
+}
+
+func RecordWorkerLoop(name string, stop chan bool) {
+	for {
+		err := RecordWorker(name, stop)
+		if err == nil {
+			return
+		}
+		log.Println("Recorder", name, err)
+		if err == ErrorRecordStreamNotFound {
+			Recorders.forget(name, stop)
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// RecordWorker subscribes to a stream like a viewer and writes its packets
+// into segments that each begin with a keyframe. It returns nil when stopped.
+func RecordWorker(name string, stop chan bool) error {
+	settings, ok := Config.GetRecord(name)
+	if !ok {
+		return ErrorRecordStreamNotFound
+	}
+	Config.RunIFNotRun(name)
+	if Config.coGe(name) == nil {
+		return ErrorRecordNoCodecs
+	}
+	sub := Config.clAd(name, SubscriberRecorder)
+	if sub == nil {
+		return ErrorRecordStreamNotFound
+	}
+	defer Config.clDe(name, sub.ID)
+	hub := Config.hub(name)
+	root := recordDir(Config.GetRecordPath(), name)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	var segment *recordSegment
+	defer func() {
+		if segment != nil {
+			segment.Close()
+		}
+	}()
+	idle := time.NewTimer(recordIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-sub.Done:
+			return fmt.Errorf("%w: %s", ErrorRecordDisconnected, sub.Reason)
+		case <-idle.C:
+			return ErrorRecordNoPackets
+		case pck := <-sub.C:
+			idle.Reset(recordIdleTimeout)
+			if segment != nil && segment.NeedRotate(pck, settings.SegmentDurationOrDefault()) {
+				segment.Close()
+				segment = nil
+			}
+			if segment == nil {
+				codecs := Config.coGe(name)
+				if codecs == nil {
+					return ErrorRecordNoCodecs
+				}
+				if !pck.IsKeyFrame && hasVideo(codecs) {
+					continue
+				}
+				var err error
+				segment, err = newRecordSegment(root, settings.FormatOrDefault(), codecs, pck.Time, segmentStart(hub, pck, time.Now()))
+				if err != nil {
+					return err
+				}
+			}
+			if err := segment.WritePacket(pck); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func hasVideo(codecs []av.CodecData) bool {
+	for _, codec := range codecs {
+		if codec.Type().IsVideo() {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSegment is a single file being written by a recorder
+type recordSegment struct {
+	file   *os.File
+	buffer *bufio.Writer
+	muxer  av.Muxer
+	path   string
+	format string
+	start  time.Time
+	first  time.Duration
+	last   time.Duration
+	tracks map[int8]int8
+}
+
+// segmentStart is when the camera sent pck on the wall clock, taken from the
+// time the hub received its latest keyframe. Without a keyframe of the same
+// timeline to compare with it falls back to now.
+func segmentStart(hub *HubST, pck av.Packet, now time.Time) time.Time {
+	if hub == nil {
+		return now
+	}
+	keyframe, ok := hub.Keyframe()
+	if !ok {
+		return now
+	}
+	start := keyframe.Received.Add(pck.Time - keyframe.Packet.Time)
+	if start.After(now) || now.Sub(start) > recordClockSkew {
+		return now
+	}
+	return start
+}
+
+func newRecordSegment(root, format string, codecs []av.CodecData, first time.Duration, start time.Time) (*recordSegment, error) {
+	element := &recordSegment{
+		format: format,
+		start:  start,
+		first:  first,
+		last:   first,
+		tracks: make(map[int8]int8),
+	}
+	var streams []av.CodecData
+	for i, codec := range codecs {
+		if !recordSupports(format, codec.Type()) {
+			log.Println("Codec not supported for recording, ignore this track", codec.Type())
+			continue
+		}
+		element.tracks[int8(i)] = int8(len(streams))
+		streams = append(streams, codec)
+	}
+	if len(streams) == 0 {
+		return nil, ErrorRecordNoTracks
+	}
+	element.path = filepath.Join(root, fmt.Sprintf("%d.%s%s", element.start.UnixMilli(), format, recordPartSuffix))
+	file, err := os.Create(element.path)
+	if err != nil {
+		return nil, err
+	}
+	element.file = file
+	switch format {
+	case RecordFormatMP4:
+		element.muxer = mp4.NewMuxer(file)
+	default:
+		element.buffer = bufio.NewWriter(file)
+		element.muxer = ts.NewMuxer(element.buffer)
+	}
+	if err = element.muxer.WriteHeader(streams); err != nil {
+		file.Close()
+		os.Remove(element.path)
+		return nil, err
+	}
+	log.Println("Recording new segment", element.path)
+	return element, nil
+}
+
+func recordSupports(format string, codec av.CodecType) bool {
+	switch format {
+	case RecordFormatMP4:
+		return codec == av.H264 || codec == av.H265 || codec == av.AAC
+	default:
+		return codec == av.H264 || codec == av.AAC
+	}
+}
+
+// NeedRotate reports whether pck must go to a new segment, either because
+// the target duration is reached or the source restarted its timeline.
+func (element *recordSegment) NeedRotate(pck av.Packet, duration time.Duration) bool {
+	if pck.Time < element.last-time.Second {
+		return true
+	}
+	return pck.IsKeyFrame && pck.Time-element.first >= duration
+}
+
+func (element *recordSegment) WritePacket(pck av.Packet) error {
+	idx, ok := element.tracks[pck.Idx]
+	if !ok {
+		return nil
+	}
+	if pck.Time > element.last {
+		element.last = pck.Time
+	}
+	pck.Idx = idx
+	pck.Time -= element.first
+	if pck.Time < 0 {
+		pck.Time = 0
+	}
+	return element.muxer.WritePacket(pck)
+}
+
+// Close finalizes the segment and renames it to <start ms>_<duration ms>.<format>
+func (element *recordSegment) Close() {
+	err := element.muxer.WriteTrailer()
+	if err == nil && element.buffer != nil {
+		err = element.buffer.Flush()
+	}
+	if err != nil {
+		log.Println("Recorder write trailer error", element.path, err)
+	}
+	if err = element.file.Close(); err != nil {
+		log.Println("Recorder close error", element.path, err)
+	}
+	duration := element.last - element.first
+	if duration <= 0 {
+		log.Println("Recorder dropping empty segment", element.path)
+		os.Remove(element.path)
+		return
+	}
+	final := filepath.Join(filepath.Dir(element.path), fmt.Sprintf("%d_%d.%s", element.start.UnixMilli(), duration.Milliseconds(), element.format))
+	if err = os.Rename(element.path, final); err != nil {
+		log.Println("Recorder rename error", element.path, err)
+		return
+	}
+	log.Println("Recorded segment", final)
+}
+
+func HTTPAPIServerStreamRecord(c *gin.Context) {
+	uuid := c.Param("uuid")
+	settings, ok := Config.GetRecord(uuid)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":        uuid,
+		"record":    settings,
+		"recording": Recorders.Active(uuid),
+	})
+}
+
+func HTTPAPIUpdateStreamRecord(c *gin.Context) {
+	uuid := c.Param("uuid")
+	var settings RecordST
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		log.Println("Invalid request body:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var audit AuditPendingST
+	defer audit.Flush()
+	Config.mutex.Lock()
+	defer Config.mutex.Unlock()
+
+	stream, exists := Config.Streams[uuid]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	changes := auditDiff(stream.Record, settings)
+	stream.Record = settings
+	Config.Streams[uuid] = stream
+	if err := saveConfig(); err != nil {
+		log.Println("Failed to save config:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save config"})
+		return
+	}
+
+	// Restart so a running recorder picks up the new format and duration
+	if settings.Enabled {
+		Recorders.Restart(uuid)
+	} else {
+		Recorders.Stop(uuid)
+	}
+	audit.Set(c, AuditStreamRecord, uuid, "", changes)
+	log.Println("Updated recording settings for stream:", uuid, settings)
+	c.JSON(http.StatusOK, gin.H{
+		"id":        uuid,
+		"record":    settings,
+		"recording": settings.Enabled,
+	})
+}
+
+// RecordSegmentST describes a finished segment on disk
+type RecordSegmentST struct {
+	Path     string
+	Format   string
+	Start    time.Time
+	Duration time.Duration
+	Size     int64
+}
+
+// End returns the wall clock time of the last packet in the segment
+func (element RecordSegmentST) End() time.Time {
+	return element.Start.Add(element.Duration)
+}
+
+// listRecordSegments returns the finished segments in dir ordered by start
+// time. Files still being written and foreign files are skipped.
+func listRecordSegments(dir string) ([]RecordSegmentST, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []RecordSegmentST
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var start, duration int64
+		var format string
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, ext), "%d_%d", &start, &duration); err != nil {
+			continue
+		}
+		format = strings.TrimPrefix(ext, ".")
+		if format != RecordFormatTS && format != RecordFormatMP4 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, RecordSegmentST{
+			Path:     filepath.Join(dir, name),
+			Format:   format,
+			Start:    time.UnixMilli(start),
+			Duration: time.Duration(duration) * time.Millisecond,
+			Size:     info.Size(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Start.Before(res[j].Start)
+	})
+	return res, nil
+}
+
+// openRecordSegment returns a demuxer for a finished segment; the caller
+// closes the returned file.
+func openRecordSegment(segment RecordSegmentST) (av.Demuxer, *os.File, error) {
+	file, err := os.Open(segment.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if segment.Format == RecordFormatMP4 {
+		return mp4.NewDemuxer(file), file, nil
+	}
+	return ts.NewDemuxer(bufio.NewReader(file)), file, nil
+}
+
+// recordSegmentsInRange lists the finished segments of a stream overlapping
+// [start, end]. A zero end means up to now.
+func recordSegmentsInRange(uuid string, start, end time.Time) ([]RecordSegmentST, error) {
+	segments, err := listRecordSegments(recordDir(Config.GetRecordPath(), uuid))
+	if err != nil {
+		return nil, err
+	}
+	var res []RecordSegmentST
+	for _, segment := range segments {
+		if segment.End().Before(start) || (!end.IsZero() && segment.Start.After(end)) {
+			continue
+		}
+		res = append(res, segment)
+	}
+	return res, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+func TestRecordSegmentNaming(t *testing.T) {
+	root := t.TempDir()
+	codecs := []av.CodecData{testH264Codec(t)}
+	for _, format := range []string{RecordFormatTS, RecordFormatMP4} {
+		dir := filepath.Join(root, format)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		segment, err := newRecordSegment(dir, format, codecs, 10*time.Second, time.Now())
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if want := fmt.Sprintf("%d.%s%s", segment.start.UnixMilli(), format, recordPartSuffix); filepath.Base(segment.path) != want {
+			t.Errorf("%s: writing to %s, want %s", format, filepath.Base(segment.path), want)
+		}
+		for i := 0; i < 50; i++ {
+			if err := segment.WritePacket(testPacket(i%25 == 0, 10*time.Second+time.Duration(i)*40*time.Millisecond)); err != nil {
+				t.Fatal(format, err)
+			}
+		}
+		segment.Close()
+
+		segments, err := listRecordSegments(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 1 {
+			t.Fatalf("%s: %d finished segments, want 1", format, len(segments))
+		}
+		want := fmt.Sprintf("%d_%d.%s", segment.start.UnixMilli(), (49 * 40 * time.Millisecond).Milliseconds(), format)
+		if got := filepath.Base(segments[0].Path); got != want {
+			t.Errorf("%s: finished segment %s, want %s", format, got, want)
+		}
+		if segments[0].Format != format || segments[0].Duration != 1960*time.Millisecond {
+			t.Errorf("%s: parsed %+v", format, segments[0])
+		}
+	}
+}
+
+func TestRecordSegmentDropsEmpty(t *testing.T) {
+	dir := t.TempDir()
+	segment, err := newRecordSegment(dir, RecordFormatTS, []av.CodecData{testH264Codec(t)}, 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = segment.WritePacket(testPacket(true, 0)); err != nil {
+		t.Fatal(err)
+	}
+	segment.Close()
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("segment without duration left %d files", len(entries))
+	}
+}
+
+func TestRecordSegmentListSkipsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"1000_2000.ts", "3000_500.mp4", "4000.ts" + recordPartSuffix, "notes.txt", "5000_100.mkv"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := listRecordSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, segment := range segments {
+		names = append(names, filepath.Base(segment.Path))
+	}
+	if got := strings.Join(names, ","); got != "1000_2000.ts,3000_500.mp4" {
+		t.Errorf("listed %s", got)
+	}
+}
+
+func TestRecordSegmentRotation(t *testing.T) {
+	segment := &recordSegment{first: 10 * time.Second, last: 35 * time.Second}
+	tests := []struct {
+		name string
+		pck  av.Packet
+		want bool
+	}{
+		{"delta after duration", testPacket(false, 41*time.Second), false},
+		{"keyframe before duration", testPacket(true, 36*time.Second), false},
+		{"keyframe at duration", testPacket(true, 40*time.Second), true},
+		{"keyframe after duration", testPacket(true, 45*time.Second), true},
+		{"timeline restarted", testPacket(false, 2*time.Second), true},
+		{"small reorder", testPacket(false, 34500*time.Millisecond), false},
+	}
+	for _, test := range tests {
+		if got := segment.NeedRotate(test.pck, 30*time.Second); got != test.want {
+			t.Errorf("%s: NeedRotate = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// A recorder of a removed stream exits on its own. When Restart already
+// replaced it, the exit must not remove the new recorder.
+func TestRecordWorkerLoopKeepsRestartedRecorder(t *testing.T) {
+	testConfig(t, nil)
+	const uuid = "removed"
+	old := make(chan bool)
+	current := make(chan bool)
+	Recorders.mutex.Lock()
+	Recorders.workers[uuid] = current
+	Recorders.mutex.Unlock()
+	t.Cleanup(func() {
+		Recorders.mutex.Lock()
+		delete(Recorders.workers, uuid)
+		Recorders.mutex.Unlock()
+	})
+
+	RecordWorkerLoop(uuid, old)
+	if !Recorders.Active(uuid) {
+		t.Fatal("exiting recorder removed its replacement")
+	}
+	select {
+	case <-current:
+		t.Fatal("exiting recorder stopped its replacement")
+	default:
+	}
+
+	RecordWorkerLoop(uuid, current)
+	if Recorders.Active(uuid) {
+		t.Error("recorder of a removed stream still listed")
+	}
+}
+
+func TestSegmentStart(t *testing.T) {
+	hub := testHub(t)
+	if now := time.Now(); !segmentStart(hub, testPacket(true, 0), now).Equal(now) {
+		t.Error("without a keyframe the segment does not start now")
+	}
+	hub.cast(testPacket(true, 10*time.Second))
+	keyframe, _ := hub.Keyframe()
+	now := keyframe.Received.Add(time.Second)
+	tests := []struct {
+		name string
+		at   time.Duration
+		want time.Time
+	}{
+		{"the keyframe", 10 * time.Second, keyframe.Received},
+		{"cached before the keyframe", 9 * time.Second, keyframe.Received.Add(-time.Second)},
+		{"after the keyframe", 10*time.Second + 500*time.Millisecond, keyframe.Received.Add(500 * time.Millisecond)},
+		{"ahead of now", 10*time.Second + time.Hour, now},
+		{"another timeline", 10*time.Second - 2*recordClockSkew, now},
+	}
+	for _, test := range tests {
+		if got := segmentStart(hub, testPacket(true, test.at), now); !got.Equal(test.want) {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// A recorder notices its stream going away instead of waiting for packets
+func TestRecordWorkerDisconnected(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": {Ingest: IngestRTMP, Record: RecordST{Enabled: true}}})
+	cfg.Server.RecordPath = t.TempDir()
+	cfg.coAd("cam", []av.CodecData{testH264Codec(t)})
+	hub := cfg.hub("cam")
+	done := make(chan error, 1)
+	go func() {
+		done <- RecordWorker("cam", make(chan bool))
+	}()
+	if !waitFor(t, 2*time.Second, func() bool { return hub.CountKind(SubscriberRecorder) == 1 }) {
+		t.Fatal("recorder did not subscribe")
+	}
+	if !cfg.HasViewer("cam") {
+		t.Error("recorder does not keep the stream running")
+	}
+	hub.Close("stream removed")
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrorRecordDisconnected) {
+			t.Errorf("recorder ended with %v", err)
+		}
+	case <-time.After(recordIdleTimeout / 2):
+		t.Fatal("recorder still waiting for packets")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	configPath = "config.json"
+	// configWatchEvery is how often config.json is checked for changes
+	configWatchEvery = 2 * time.Second
+)
+
+// configWatch remembers the content last loaded or saved, so the watcher
+// neither reloads our own saveConfig writes nor a file touched unchanged
+var configWatch = &configWatchST{}
+
+type configWatchST struct {
+	mutex   sync.Mutex
+	digest  [sha256.Size]byte
+	modTime time.Time
+	// streams are the stream ids in that content. A running stream missing
+	// from it was added at runtime and never saved, a reload keeps it.
+	streams map[string]bool
+	// saves counts saveConfig writes, a reload that read the file before
+	// the latest save would undo it
+	saves uint64
+	// reload serializes reloads from the watcher, SIGHUP and the API
+	reload sync.Mutex
+}
+
+// ReloadST reports what a reload changed
+type ReloadST struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Restarted []string `json:"restarted"`
+	Updated   []string `json:"updated"`
+	// Ignored lists server settings that only apply after a restart
+	Ignored []string `json:"ignored"`
+}
+
+func (element *configWatchST) loaded(data []byte) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.digest = sha256.Sum256(data)
+	if info, err := os.Stat(configPath); err == nil {
+		element.modTime = info.ModTime()
+	}
+	var ids struct {
+		Streams map[string]json.RawMessage `json:"streams"`
+	}
+	json.Unmarshal(data, &ids)
+	element.streams = make(map[string]bool, len(ids.Streams))
+	for uuid := range ids.Streams {
+		element.streams[uuid] = true
+	}
+}
+
+// saved is called by saveConfig with Config.mutex held
+func (element *configWatchST) saved(data []byte) {
+	element.mutex.Lock()
+	element.saves++
+	element.mutex.Unlock()
+	element.loaded(data)
+}
+
+func (element *configWatchST) generation() uint64 {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return element.saves
+}
+
+// persisted returns the stream ids of the content last loaded or saved,
+// ok is false if config.json was saved since generation saves
+func (element *configWatchST) persisted(saves uint64) (map[string]bool, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return element.streams, element.saves == saves
+}
+
+// changed reports whether data differs from what was loaded last
+func (element *configWatchST) changed(data []byte) bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return sha256.Sum256(data) != element.digest
+}
+
+// serveConfigWatch polls the modification time of config.json and reloads
+// it when the content changed
+func serveConfigWatch() {
+	for {
+		time.Sleep(configWatchEvery)
+		if configWatch.modified() {
+			reloadConfigBySystem("file change")
+		}
+	}
+}
+
+// modified reports whether config.json was written since last checked,
+// loaded or saved
+func (element *configWatchST) modified() bool {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return false
+	}
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	modified := !info.ModTime().Equal(element.modTime)
+	element.modTime = info.ModTime()
+	return modified
+}
+
+// reloadConfigBySystem reloads on a file change or SIGHUP and audits the
+// reload when something was applied
+func reloadConfigBySystem(reason string) {
+	if _, applied, err := reloadConfig(reason, false); err == nil && applied {
+		Audit.Add(auditSystemActor, "", AuditConfigReload, configPath, reason, nil)
+	}
+}
+
+// reloadConfig reads config.json and applies it. Unless force is set an
+// unchanged file is left alone and applied is false. Errors keep the
+// running configuration.
+func reloadConfig(reason string, force bool) (res ReloadST, applied bool, err error) {
+	configWatch.reload.Lock()
+	defer configWatch.reload.Unlock()
+	saves := configWatch.generation()
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		log.Println("Config reload failed:", err)
+		return res, false, err
+	}
+	if !force && !configWatch.changed(data) {
+		return res, false, nil
+	}
+	next, err := parseConfig(data)
+	if err != nil {
+		log.Println("Config reload failed, keeping the running configuration:", err)
+		return res, false, err
+	}
+	res, applied = Config.apply(next, saves)
+	if !applied {
+		// The running configuration was saved meanwhile, the file matches it
+		log.Println("Config reload skipped, config.json was saved while reading it")
+		return res, false, nil
+	}
+	configWatch.loaded(data)
+	log.Printf("Config reloaded on %s: added %v, removed %v, restarted %v, updated %v", reason, res.Added, res.Removed, res.Restarted, res.Updated)
+	if len(res.Ignored) > 0 {
+		log.Println("Config reload: restart the server to apply", res.Ignored)
+	}
+	return res, true, nil
+}
+
+// workerOptionsST are the settings a running RTSPWorkerLoop was started
+// with. A new publish key also restarts, which drops the current RTMP
+// publisher. Every field is named after the StreamST field it copies.
+type workerOptionsST struct {
+	URL          string
+	OnDemand     bool
+	DisableAudio bool
+	Debug        bool
+	Transport    string
+	Ingest       string
+	PublishKey   string
+}
+
+func workerOptions(stream StreamST) workerOptionsST {
+	return workerOptionsST{
+		URL:          stream.URL,
+		OnDemand:     stream.OnDemand,
+		DisableAudio: stream.DisableAudio,
+		Debug:        stream.Debug,
+		Transport:    stream.Transport,
+		Ingest:       stream.Ingest,
+		PublishKey:   stream.PublishKey,
+	}
+}
+
+// apply diffs next against the running configuration. Added streams start,
+// removed ones stop, streams whose worker options changed restart and
+// other stream settings are updated in place. Server settings apply to new
+// sessions; the listen addresses and database paths need a restart.
+// Nothing is applied and ok is false if config.json was saved after
+// generation saves, when next was read.
+func (element *ConfigST) apply(next *ConfigST, saves uint64) (res ReloadST, ok bool) {
+	res = ReloadST{Added: []string{}, Removed: []string{}, Restarted: []string{}, Updated: []string{}, Ignored: []string{}}
+	restart := make(map[string]*workerST)
+	var start, record, unrecord []string
+
+	element.mutex.Lock()
+	// saveConfig runs under this lock, so no save can slip in from here on
+	persisted, ok := configWatch.persisted(saves)
+	if !ok {
+		element.mutex.Unlock()
+		return res, false
+	}
+	server := next.Server
+	if server.HTTPPort != element.Server.HTTPPort {
+		res.Ignored = append(res.Ignored, "http_port")
+		server.HTTPPort = element.Server.HTTPPort
+	}
+	if server.UsersPath != element.Server.UsersPath {
+		res.Ignored = append(res.Ignored, "users_path")
+		server.UsersPath = element.Server.UsersPath
+	}
+	if server.AuditPath != element.Server.AuditPath {
+		res.Ignored = append(res.Ignored, "audit_path")
+		server.AuditPath = element.Server.AuditPath
+	}
+	if server.EventsPath != element.Server.EventsPath {
+		res.Ignored = append(res.Ignored, "events_path")
+		server.EventsPath = element.Server.EventsPath
+	}
+	if server.RTMPPort != element.Server.RTMPPort {
+		res.Ignored = append(res.Ignored, "rtmp_port")
+		server.RTMPPort = element.Server.RTMPPort
+	}
+	element.Server = server
+	element.AlertRules = next.AlertRules
+
+	for uuid, stream := range element.Streams {
+		if _, ok := next.Streams[uuid]; ok || !persisted[uuid] {
+			continue
+		}
+		element.removeStream(uuid)
+		res.Removed = append(res.Removed, uuid)
+		log.Println("Config reload removed stream", uuid, stream.Name)
+	}
+	for uuid, stream := range next.Streams {
+		current, ok := element.Streams[uuid]
+		if !ok {
+			stream.Status = false
+			stream.hub = newHub(uuid)
+			element.Streams[uuid] = stream
+			res.Added = append(res.Added, uuid)
+			start = append(start, uuid)
+			if stream.Record.Enabled {
+				record = append(record, uuid)
+			}
+			continue
+		}
+		if len(auditDiff(current, stream, "status")) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(current.Record, stream.Record) {
+			if stream.Record.Enabled {
+				record = append(record, uuid)
+			} else {
+				unrecord = append(unrecord, uuid)
+			}
+		}
+		stream.Status, stream.RunLock, stream.Codecs = current.Status, current.RunLock, current.Codecs
+		stream.hub, stream.worker, stream.retry = current.hub, current.worker, current.retry
+		element.Streams[uuid] = stream
+		if workerOptions(current) != workerOptions(stream) {
+			restart[uuid] = element.stopWorker(uuid)
+			res.Restarted = append(res.Restarted, uuid)
+		} else {
+			res.Updated = append(res.Updated, uuid)
+		}
+	}
+	element.mutex.Unlock()
+
+	for uuid, old := range restart {
+		go element.restartWorker(uuid, old)
+	}
+	for _, uuid := range start {
+		// Like streams added through the API, start for codec discovery
+		go element.RunIFNotRun(uuid)
+	}
+	for _, uuid := range unrecord {
+		Recorders.Stop(uuid)
+	}
+	for _, uuid := range record {
+		Recorders.Restart(uuid)
+	}
+	sort.Strings(res.Added)
+	sort.Strings(res.Removed)
+	sort.Strings(res.Restarted)
+	sort.Strings(res.Updated)
+	return res, true
+}
+
+// HTTPAPIReloadConfig reloads config.json even when it looks unchanged
+func HTTPAPIReloadConfig(c *gin.Context) {
+	res, _, err := reloadConfig("API request", true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auditRequest(c, AuditConfigReload, configPath, "", nil)
+	c.JSON(http.StatusOK, res)
+}
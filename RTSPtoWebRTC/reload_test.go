@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// testIngest is a stream without a worker to dial, reloads can add,
+// restart and remove it freely
+func testIngest(name, key string) StreamST {
+	return StreamST{Name: name, Ingest: IngestRTMP, PublishKey: key}
+}
+
+// testSavedConfig sets up a running configuration and saves it to
+// config.json like the API does
+func testSavedConfig(t *testing.T, streams map[string]StreamST) *ConfigST {
+	t.Helper()
+	cfg := testConfig(t, streams)
+	cfg.Server.HTTPPort = ":8083"
+	configWatch.mutex.Lock()
+	digest, modTime, persisted, saves := configWatch.digest, configWatch.modTime, configWatch.streams, configWatch.saves
+	configWatch.mutex.Unlock()
+	t.Cleanup(func() {
+		configWatch.mutex.Lock()
+		configWatch.digest, configWatch.modTime, configWatch.streams, configWatch.saves = digest, modTime, persisted, saves
+		configWatch.mutex.Unlock()
+	})
+	testSave(t)
+	return cfg
+}
+
+func testSave(t *testing.T) {
+	t.Helper()
+	Config.mutex.Lock()
+	defer Config.mutex.Unlock()
+	if err := saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testWriteConfig edits config.json like an operator would
+func testWriteConfig(t *testing.T, cfg *ConfigST) {
+	t.Helper()
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(configPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Coarse file system clocks could hide the write from the watcher
+	later := time.Now().Add(time.Second)
+	if err = os.Chtimes(configPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigApplyDiff(t *testing.T) {
+	cfg := testSavedConfig(t, map[string]StreamST{
+		"keep":    testIngest("keep", "k1"),
+		"gone":    testIngest("gone", "k2"),
+		"rekey":   testIngest("rekey", "k3"),
+		"renamed": testIngest("renamed", "k4"),
+	})
+	// Opened through /stream and never saved
+	cfg.mutex.Lock()
+	cfg.Streams["runtime"] = StreamST{Name: "runtime", OnDemand: true, hub: newHub("runtime")}
+	cfg.mutex.Unlock()
+	renamed, _ := testStream(cfg, "renamed")
+	hub := renamed.hub
+
+	next := &ConfigST{
+		Server: ServerST{HTTPPort: ":9000", RecordQuotaMB: 100},
+		Streams: map[string]StreamST{
+			"keep":    testIngest("keep", "k1"),
+			"rekey":   testIngest("rekey", "new key"),
+			"renamed": testIngest("Front door", "k4"),
+			"added":   testIngest("added", "k5"),
+		},
+	}
+	res, ok := cfg.apply(next, configWatch.generation())
+	if !ok {
+		t.Fatal("apply skipped without a save")
+	}
+	want := ReloadST{
+		Added:     []string{"added"},
+		Removed:   []string{"gone"},
+		Restarted: []string{"rekey"},
+		Updated:   []string{"renamed"},
+		Ignored:   []string{"http_port"},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("reload %+v, want %+v", res, want)
+	}
+	if _, ok := testStream(cfg, "runtime"); !ok {
+		t.Error("reload removed a stream that was never saved")
+	}
+	if _, ok := testStream(cfg, "gone"); ok {
+		t.Error("stream removed from the file still running")
+	}
+	if renamed, _ = testStream(cfg, "renamed"); renamed.Name != "Front door" || renamed.hub != hub {
+		t.Error("updated stream lost its hub or kept the old name")
+	}
+	if added, _ := testStream(cfg, "added"); added.hub == nil {
+		t.Error("added stream has no hub")
+	}
+	if server := cfg.Server; server.HTTPPort != ":8083" || server.RecordQuotaMB != 100 {
+		t.Errorf("server settings %q %d, the port needs a restart, the quota not", cfg.Server.HTTPPort, cfg.Server.RecordQuotaMB)
+	}
+}
+
+// A reload that read config.json before an API save must not undo it
+func TestConfigApplySkipsAfterSave(t *testing.T) {
+	cfg := testSavedConfig(t, map[string]StreamST{"cam": testIngest("cam", "k1")})
+	saves := configWatch.generation()
+	stale, err := parseConfig([]byte(`{"streams": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.mutex.Lock()
+	cfg.Streams["api"] = testIngest("api", "k2")
+	cfg.mutex.Unlock()
+	testSave(t)
+
+	res, ok := cfg.apply(stale, saves)
+	if ok {
+		t.Errorf("stale config applied: %+v", res)
+	}
+	if _, ok := testStream(cfg, "api"); !ok {
+		t.Error("skipped reload removed the saved stream")
+	}
+}
+
+func TestSaveConfigDoesNotReload(t *testing.T) {
+	cfg := testSavedConfig(t, map[string]StreamST{"cam": testIngest("cam", "k1")})
+	if configWatch.modified() {
+		t.Error("watcher sees our own save as a change")
+	}
+	if _, applied, err := reloadConfig("file change", false); err != nil || applied {
+		t.Errorf("reload after a save: applied %v, err %v", applied, err)
+	}
+
+	edited := &ConfigST{Server: cfg.Server, Streams: map[string]StreamST{
+		"cam":   testIngest("cam", "k1"),
+		"added": testIngest("added", "k2"),
+	}}
+	testWriteConfig(t, edited)
+	if !configWatch.modified() {
+		t.Fatal("watcher missed an edit")
+	}
+	res, applied, err := reloadConfig("file change", false)
+	if err != nil || !applied {
+		t.Fatalf("reload after an edit: applied %v, err %v", applied, err)
+	}
+	if !reflect.DeepEqual(res.Added, []string{"added"}) {
+		t.Errorf("added %v", res.Added)
+	}
+	// The reloaded content is now known, touching it changes nothing
+	if _, applied, _ = reloadConfig("file change", false); applied {
+		t.Error("unchanged file applied twice")
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	cfg := testSavedConfig(t, map[string]StreamST{"cam": testIngest("cam", "k1")})
+	testWriteConfig(t, &ConfigST{Streams: map[string]StreamST{"cam": {Ingest: IngestRTMP}}})
+	if _, applied, err := reloadConfig("file change", false); err == nil || applied {
+		t.Errorf("ingest without key: applied %v, err %v", applied, err)
+	}
+	if cam, _ := testStream(cfg, "cam"); cam.PublishKey != "k1" {
+		t.Error("running configuration changed by a rejected reload")
+	}
+}
+
+// Every worker option is copied from its stream field, a field added to
+// workerOptionsST but not to workerOptions fails here
+func TestWorkerOptionsCoverFields(t *testing.T) {
+	options := reflect.TypeOf(workerOptionsST{})
+	for i := 0; i < options.NumField(); i++ {
+		name := options.Field(i).Name
+		var stream StreamST
+		field := reflect.ValueOf(&stream).Elem().FieldByName(name)
+		if !field.IsValid() || field.Type() != options.Field(i).Type {
+			t.Errorf("%s is not a %s field of StreamST", name, options.Field(i).Type)
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString("changed")
+		case reflect.Bool:
+			field.SetBool(true)
+		default:
+			t.Fatalf("%s: no test value for %s", name, field.Kind())
+		}
+		if workerOptions(stream) == workerOptions(StreamST{}) {
+			t.Errorf("changing %s does not restart the worker", name)
+		}
+	}
+}
+
+func TestConfigApplyRestartOrUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(*StreamST)
+		restart bool
+	}{
+		{"url", func(stream *StreamST) { stream.URL = "rtmp://encoder" }, true},
+		{"on demand", func(stream *StreamST) { stream.OnDemand = true }, true},
+		{"disable audio", func(stream *StreamST) { stream.DisableAudio = true }, true},
+		{"debug", func(stream *StreamST) { stream.Debug = true }, true},
+		{"publish key", func(stream *StreamST) { stream.PublishKey = "k2" }, true},
+		{"name", func(stream *StreamST) { stream.Name = "Front door" }, false},
+		{"slow viewer", func(stream *StreamST) { stream.SlowViewer = &SlowViewerST{Policy: SlowViewerDisconnect} }, false},
+		{"timeouts", func(stream *StreamST) { stream.Timeouts = &TimeoutsST{Dial: 5} }, false},
+		{"record max age", func(stream *StreamST) { stream.Record.MaxAgeHours = 24 }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testSavedConfig(t, map[string]StreamST{"cam": testIngest("cam", "k1")})
+			cam, _ := testStream(cfg, "cam")
+			edited := testIngest("cam", "k1")
+			test.edit(&edited)
+			res, ok := cfg.apply(&ConfigST{Server: cfg.Server, Streams: map[string]StreamST{"cam": edited}}, configWatch.generation())
+			if !ok {
+				t.Fatal("apply skipped without a save")
+			}
+			want := ReloadST{Added: []string{}, Removed: []string{}, Restarted: []string{}, Updated: []string{"cam"}, Ignored: []string{}}
+			if test.restart {
+				want.Restarted, want.Updated = want.Updated, want.Restarted
+			}
+			if !reflect.DeepEqual(res, want) {
+				t.Errorf("reload %+v, want %+v", res, want)
+			}
+			if after, _ := testStream(cfg, "cam"); after.hub != cam.hub {
+				t.Error("stream lost its hub")
+			}
+		})
+	}
+}
+
+func TestConfigApplyIgnoredServerFields(t *testing.T) {
+	tests := []struct {
+		field string
+		edit  func(*ServerST)
+	}{
+		{"http_port", func(server *ServerST) { server.HTTPPort = ":9000" }},
+		{"users_path", func(server *ServerST) { server.UsersPath = "other.json" }},
+		{"audit_path", func(server *ServerST) { server.AuditPath = "other.jsonl" }},
+		{"events_path", func(server *ServerST) { server.EventsPath = "other.db" }},
+		{"rtmp_port", func(server *ServerST) { server.RTMPPort = ":1936" }},
+	}
+	for _, test := range tests {
+		cfg := testSavedConfig(t, nil)
+		before := cfg.Server
+		next := &ConfigST{Server: cfg.Server}
+		test.edit(&next.Server)
+		// Applied at once next to the ignored field
+		next.Server.RecordQuotaMB = 100
+		res, ok := cfg.apply(next, configWatch.generation())
+		if !ok {
+			t.Fatal("apply skipped without a save")
+		}
+		if !reflect.DeepEqual(res.Ignored, []string{test.field}) {
+			t.Errorf("%s: ignored %v", test.field, res.Ignored)
+		}
+		before.RecordQuotaMB = 100
+		if !reflect.DeepEqual(cfg.Server, before) {
+			t.Errorf("%s: server %+v, want %+v", test.field, cfg.Server, before)
+		}
+	}
+}
+
+// testRecorders waits for the recorders of uuid to match recording
+func testRecorders(t *testing.T, cfg *ConfigST, uuid string, recording bool) bool {
+	t.Helper()
+	want := 0
+	if recording {
+		want = 1
+	}
+	hub := cfg.hub(uuid)
+	return waitFor(t, 2*time.Second, func() bool {
+		return Recorders.Active(uuid) == recording && hub.CountKind(SubscriberRecorder) == want
+	})
+}
+
+func TestConfigApplyRecorders(t *testing.T) {
+	cfg := testSavedConfig(t, map[string]StreamST{"cam": testIngest("cam", "k1")})
+	cfg.Server.RecordPath = t.TempDir()
+	// With codecs known the recorder subscribes at once
+	cfg.coAd("cam", []av.CodecData{testH264Codec(t)})
+	t.Cleanup(func() {
+		Recorders.Stop("cam")
+		testRecorders(t, cfg, "cam", false)
+	})
+	apply := func(record RecordST) ReloadST {
+		t.Helper()
+		cam := testIngest("cam", "k1")
+		cam.Record = record
+		res, ok := cfg.apply(&ConfigST{Server: cfg.Server, Streams: map[string]StreamST{"cam": cam}}, configWatch.generation())
+		if !ok {
+			t.Fatal("apply skipped without a save")
+		}
+		return res
+	}
+
+	if res := apply(RecordST{Enabled: true}); !reflect.DeepEqual(res.Updated, []string{"cam"}) {
+		t.Errorf("enabling recording: %+v", res)
+	}
+	if !testRecorders(t, cfg, "cam", true) {
+		t.Fatal("recorder not started")
+	}
+	hub := cfg.hub("cam")
+	// New settings restart the recorder, which subscribes again
+	apply(RecordST{Enabled: true, SegmentDuration: 30})
+	if !testRecorders(t, cfg, "cam", true) || hub.CountKind(SubscriberRecorder) != 1 {
+		t.Error("recorder not restarted with the new settings")
+	}
+	apply(RecordST{})
+	if !testRecorders(t, cfg, "cam", false) {
+		t.Error("recorder still running after recording was disabled")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtmp"
+)
+
+const (
+	// IngestRTMP streams are pushed by an encoder instead of pulled over RTSP
+	IngestRTMP = "rtmp"
+	// rtmpApp is the application encoders publish to, rtmp://host/live/<stream-id>
+	rtmpApp = "live"
+	// publishKeyBytes is the size of generated publish keys before hex encoding
+	publishKeyBytes = 16
+)
+
+var (
+	ErrorIngestUnknown    = errors.New("ingest must be empty or rtmp")
+	ErrorIngestKeyMissing = errors.New("rtmp ingest needs a publish_key")
+	ErrorIngestTransport  = errors.New("rtmp ingest streams have no transport")
+	ErrorIngestNotFound   = errors.New("no rtmp ingest stream with this id")
+	ErrorIngestKey        = errors.New("wrong publish key")
+	ErrorIngestBusy       = errors.New("stream is already being published")
+	ErrorIngestApp        = errors.New("publish to rtmp://host/" + rtmpApp + "/<stream-id>")
+	ErrorIngestNoVideo    = errors.New("publisher sent no keyframe")
+	ErrorIngestDisconnect = errors.New("publisher disconnected")
+	ErrorIngestNoCodecs   = errors.New("publisher sent no codecs")
+)
+
+// validateIngest checks the source settings of a stream. Ingest streams have
+// no URL to pull, a publisher authenticates with the publish key instead.
+func validateIngest(stream StreamST) error {
+	switch stream.Ingest {
+	case "":
+		return nil
+	case IngestRTMP:
+	default:
+		return ErrorIngestUnknown
+	}
+	if stream.PublishKey == "" {
+		return ErrorIngestKeyMissing
+	}
+	if stream.Transport != "" {
+		return ErrorIngestTransport
+	}
+	return nil
+}
+
+func (element *ConfigST) GetRTMPPort() string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Server.RTMPPort
+}
+
+// serveRTMP accepts encoder publishes when rtmp_port is set
+func serveRTMP() {
+	addr := Config.GetRTMPPort()
+	if addr == "" {
+		return
+	}
+	server := &rtmp.Server{Addr: addr, HandlePublish: handleRTMPPublish}
+	log.Println("RTMP ingest listening on", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Println("RTMP ingest stopped:", err)
+	}
+}
+
+// handleRTMPPublish runs one publish like a stream worker. The publisher
+// claims the stream with its key and its packets go to the stream hub.
+func handleRTMPPublish(conn *rtmp.Conn) {
+	defer conn.Close()
+	remote := conn.NetConn().RemoteAddr().String()
+	uuid, err := rtmpStreamID(conn.URL.Path)
+	if err != nil {
+		log.Println("RTMP publish from", remote, "rejected:", err)
+		return
+	}
+	worker, err := Config.startIngest(uuid, conn.URL.Query().Get("key"))
+	if err != nil {
+		log.Println("RTMP publish to", uuid, "from", remote, "rejected:", err)
+		if err != ErrorIngestNotFound {
+			Events.stream(uuid, EventStreamPublishRejected, EventPriorityMedium, "Publish rejected", fmt.Sprintf("%s from %s", err, remote))
+		}
+		return
+	}
+	defer close(worker.done)
+	defer Config.RunUnlock(uuid, worker)
+	go func() {
+		// Deleting or updating the stream cancels the worker, closing the
+		// connection ends the blocked read below
+		<-worker.ctx.Done()
+		conn.Close()
+	}()
+	log.Println("RTMP publish to", uuid, "from", remote)
+	err = RTMPWorker(worker.ctx, uuid, conn)
+	if err == ErrorStreamExitStopped || worker.ctx.Err() != nil {
+		log.Println("Stream", uuid, "publisher stopped")
+		return
+	}
+	log.Println("Stream", uuid, "publisher from", remote, "ended:", err)
+	Metrics.workerError(uuid, err)
+	Webhooks.streamDown(uuid, err)
+}
+
+// rtmpStreamID takes the stream id from /live/<stream-id>. The key comes
+// in the query, in OBS the stream key field is set to <stream-id>?key=<key>.
+func rtmpStreamID(path string) (string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 || parts[0] != rtmpApp || parts[1] == "" {
+		return "", ErrorIngestApp
+	}
+	return parts[1], nil
+}
+
+// startIngest authenticates a publisher and marks the stream running with a
+// new worker, so stopWorker disconnects the publisher like an RTSP worker
+func (element *ConfigST) startIngest(uuid, key string) (*workerST, error) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	tmp, ok := element.Streams[uuid]
+	if !ok || tmp.Ingest != IngestRTMP {
+		return nil, ErrorIngestNotFound
+	}
+	if tmp.PublishKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(tmp.PublishKey)) != 1 {
+		return nil, ErrorIngestKey
+	}
+	if tmp.RunLock {
+		return nil, ErrorIngestBusy
+	}
+	tmp.RunLock = true
+	tmp.Status = false
+	tmp.Codecs = nil
+	tmp.hub.Reset()
+	tmp.worker = newWorker()
+	element.Streams[uuid] = tmp
+	Push.streamStatus(uuid, false, true)
+	return tmp.worker, nil
+}
+
+// RTMPWorker reads a publish until the encoder stops, goes quiet or sends
+// no keyframes. Every read is bounded by the read/write timeout.
+func RTMPWorker(ctx context.Context, name string, conn *rtmp.Conn) (err error) {
+	timeouts := Config.timeouts(name)
+	hub := Config.hub(name)
+	if hub == nil {
+		return ErrorStreamExitNotFound
+	}
+	if err = conn.NetConn().SetReadDeadline(time.Now().Add(timeouts.Keyframe)); err != nil {
+		return err
+	}
+	codecs, err := conn.Streams()
+	if err != nil {
+		return err
+	}
+	if len(codecs) == 0 {
+		return ErrorIngestNoCodecs
+	}
+	hub.connected()
+	defer hub.disconnected()
+	Config.workerConnected(name)
+	Webhooks.streamUp(name)
+	Events.stream(name, EventStreamConnect, EventPriorityLow, "Stream connected", codecsDescription(codecs))
+	defer func() {
+		reason := "closed"
+		if err != nil {
+			reason = err.Error()
+		}
+		Events.stream(name, EventStreamDisconnect, EventPriorityMedium, "Stream disconnected", reason)
+	}()
+	Config.coAd(name, codecs)
+	AudioOnly := len(codecs) == 1 && codecs[0].Type().IsAudio()
+	lastKeyframe := time.Now()
+	for {
+		packetAV, err := rtmpReadPacket(conn, timeouts.ReadWrite)
+		if ctx.Err() != nil {
+			return ErrorStreamExitStopped
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrorIngestDisconnect, err)
+		}
+		if AudioOnly || packetAV.IsKeyFrame {
+			lastKeyframe = time.Now()
+		} else if time.Since(lastKeyframe) > timeouts.Keyframe {
+			return ErrorIngestNoVideo
+		}
+		Config.cast(name, hub, packetAV)
+	}
+}
+
+// rtmpReadPacket reads the next packet of a publish within timeout
+func rtmpReadPacket(conn *rtmp.Conn, timeout time.Duration) (av.Packet, error) {
+	if err := conn.NetConn().SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return av.Packet{}, err
+	}
+	return conn.ReadPacket()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtmp"
+)
+
+func TestRTMPStreamID(t *testing.T) {
+	tests := []struct {
+		path string
+		id   string
+		err  error
+	}{
+		{"/live/cam", "cam", nil},
+		{"live/cam/", "cam", nil},
+		{"/live/front-door", "front-door", nil},
+		{"/live", "", ErrorIngestApp},
+		{"/live/", "", ErrorIngestApp},
+		{"/", "", ErrorIngestApp},
+		{"", "", ErrorIngestApp},
+		{"/app/cam", "", ErrorIngestApp},
+		{"/live/cam/extra", "", ErrorIngestApp},
+		{"/LIVE/cam", "", ErrorIngestApp},
+	}
+	for _, test := range tests {
+		id, err := rtmpStreamID(test.path)
+		if id != test.id || err != test.err {
+			t.Errorf("%q: %q %v, want %q %v", test.path, id, err, test.id, test.err)
+		}
+	}
+}
+
+func TestStartIngest(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{
+		"cam":  testIngest("cam", "k1"),
+		"pull": {URL: "rtsp://127.0.0.1/pull"},
+	})
+	tests := []struct {
+		name string
+		uuid string
+		key  string
+		err  error
+	}{
+		{"unknown stream", "nope", "k1", ErrorIngestNotFound},
+		{"pulled stream", "pull", "k1", ErrorIngestNotFound},
+		{"wrong key", "cam", "k2", ErrorIngestKey},
+		{"no key", "cam", "", ErrorIngestKey},
+		{"key prefix", "cam", "k", ErrorIngestKey},
+	}
+	for _, test := range tests {
+		if worker, err := cfg.startIngest(test.uuid, test.key); err != test.err || worker != nil {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+	if cam, _ := testStream(cfg, "cam"); cam.RunLock || cam.worker != nil {
+		t.Fatal("rejected publish claimed the stream")
+	}
+
+	worker, err := cfg.startIngest("cam", "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cam, _ := testStream(cfg, "cam"); !cam.RunLock || cam.worker != worker {
+		t.Error("publish did not claim the stream")
+	}
+	if _, err = cfg.startIngest("cam", "k1"); err != ErrorIngestBusy {
+		t.Errorf("second publish: %v, want %v", err, ErrorIngestBusy)
+	}
+	cfg.RunUnlock("cam", worker)
+	if _, err = cfg.startIngest("cam", "k1"); err != nil {
+		t.Errorf("publish after the first ended: %v", err)
+	}
+}
+
+// testRTMPServer serves publishes like serveRTMP on a free loopback port
+// and reports the path of every publish it finished handling. rtmp.Server
+// cannot be stopped, the listener lives until the test binary exits.
+func testRTMPServer(t *testing.T) (string, chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	handled := make(chan string, 8)
+	server := &rtmp.Server{Addr: addr, HandlePublish: func(conn *rtmp.Conn) {
+		handleRTMPPublish(conn)
+		handled <- conn.URL.Path
+	}}
+	go server.ListenAndServe()
+	if !waitFor(t, 2*time.Second, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}) {
+		t.Fatal("rtmp server not listening")
+	}
+	return addr, handled
+}
+
+// testHandled waits for the server to finish handling a publish
+func testHandled(t *testing.T, handled chan string) string {
+	t.Helper()
+	select {
+	case path := <-handled:
+		return path
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish still being handled")
+		return ""
+	}
+}
+
+// testPublisher publishes H.264 keyframes to path until the server drops
+// the connection or the test ends
+type testPublisher struct {
+	conn *rtmp.Conn
+	done chan error
+}
+
+func newTestPublisher(t *testing.T, addr, path string) *testPublisher {
+	t.Helper()
+	conn, err := rtmp.DialTimeout("rtmp://"+addr+path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := &testPublisher{conn: conn, done: make(chan error, 1)}
+	t.Cleanup(publisher.Close)
+	if err = conn.WriteHeader([]av.CodecData{testH264Codec(t)}); err != nil {
+		publisher.done <- err
+		return publisher
+	}
+	go func() {
+		for i := 0; ; i++ {
+			err := conn.WritePacket(testPacket(true, time.Duration(i)*40*time.Millisecond))
+			if err == nil {
+				// Flushes the buffered chunks
+				err = conn.WriteTrailer()
+			}
+			if err != nil {
+				publisher.done <- err
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	return publisher
+}
+
+// dropped reports whether the server closed the connection within timeout
+func (element *testPublisher) dropped(timeout time.Duration) bool {
+	select {
+	case <-element.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (element *testPublisher) Close() {
+	element.conn.Close()
+}
+
+func testPublishRejections(t *testing.T, uuid string) []string {
+	t.Helper()
+	events, _, err := Events.Query(EventFilterST{Stream: uuid, Type: EventStreamPublishRejected}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, event := range events {
+		res = append(res, event.Description)
+	}
+	return res
+}
+
+func TestRTMPPublish(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam": testIngest("cam", "k1")})
+	testEvents(t)
+	addr, handled := testRTMPServer(t)
+
+	for _, path := range []string{"/live/cam?key=wrong", "/app/cam?key=k1", "/live/nope?key=k1"} {
+		publisher := newTestPublisher(t, addr, path)
+		testHandled(t, handled)
+		if !publisher.dropped(3 * time.Second) {
+			t.Errorf("publish to %s not dropped", path)
+		}
+	}
+	// Only the wrong key is recorded, the other paths name no stream
+	if rejections := testPublishRejections(t, "cam"); len(rejections) != 1 || !strings.Contains(rejections[0], ErrorIngestKey.Error()) {
+		t.Errorf("rejections %q", rejections)
+	}
+
+	publisher := newTestPublisher(t, addr, "/live/cam?key=k1")
+	hub := cfg.hub("cam")
+	if !waitFor(t, 3*time.Second, func() bool { return hub.Stats().Keyframes > 0 }) {
+		t.Fatal("published keyframes did not reach the hub")
+	}
+	if cam, _ := testStream(cfg, "cam"); !cam.RunLock || !cam.Status || len(cam.Codecs) != 1 {
+		t.Errorf("publishing stream RunLock %v Status %v codecs %d", cam.RunLock, cam.Status, len(cam.Codecs))
+	}
+	second := newTestPublisher(t, addr, "/live/cam?key=k1")
+	testHandled(t, handled)
+	if !second.dropped(3 * time.Second) {
+		t.Error("second publisher not dropped")
+	}
+	if rejections := testPublishRejections(t, "cam"); len(rejections) != 2 || !strings.Contains(rejections[0]+rejections[1], ErrorIngestBusy.Error()) {
+		t.Errorf("rejections %q", rejections)
+	}
+	if publisher.dropped(0) {
+		t.Error("second publisher disconnected the first")
+	}
+
+	publisher.Close()
+	testHandled(t, handled)
+	if cam, _ := testStream(cfg, "cam"); cam.RunLock || cam.Status {
+		t.Error("stream still running after the publisher left")
+	}
+	if health := testHealth(cfg, "cam"); !strings.Contains(health.LastError, ErrorIngestDisconnect.Error()) {
+		t.Errorf("last error %q, want %v", health.LastError, ErrorIngestDisconnect)
+	}
+}
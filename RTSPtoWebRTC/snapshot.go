@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// snapshotMaxAge is how old a cached keyframe may be before a fresh one is awaited
+	snapshotMaxAge       = 30 * time.Second
+	snapshotWaitKeyframe = 20 * time.Second
+	snapshotDecodeTime   = 10 * time.Second
+)
+
+var (
+	ErrorSnapshotNoDecoder  = errors.New("snapshot needs ffmpeg, set ffmpeg_path or install it in PATH")
+	ErrorSnapshotNoKeyframe = errors.New("snapshot no keyframe received")
+	ErrorSnapshotCodec      = errors.New("snapshot codec not supported")
+)
+
+// KeyframeST is a keyframe together with the codec needed to decode it
+type KeyframeST struct {
+	Packet   av.Packet
+	Codec    av.CodecData
+	Received time.Time
+}
+
+func (element *ConfigST) GetFFmpegPath() string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Server.FFmpegPath
+}
+
+// waitKeyframe starts the stream if needed and listens like a viewer until
+// the next video keyframe has been cached
+func waitKeyframe(uuid string, hub *HubST) (KeyframeST, error) {
+	Config.RunIFNotRun(uuid)
+	if Config.coGe(uuid) == nil {
+		return KeyframeST{}, ErrorSnapshotNoKeyframe
+	}
+	sub := Config.clAd(uuid, SubscriberSnapshot)
+	if sub == nil {
+		return KeyframeST{}, ErrorSnapshotNoKeyframe
+	}
+	defer Config.clDe(uuid, sub.ID)
+	started := time.Now()
+	timeout := time.NewTimer(snapshotWaitKeyframe)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-timeout.C:
+			return KeyframeST{}, ErrorSnapshotNoKeyframe
+		case pck := <-sub.C:
+			if !pck.IsKeyFrame {
+				continue
+			}
+			if frame, ok := hub.Keyframe(); ok && frame.Received.After(started) {
+				return frame, nil
+			}
+		}
+	}
+}
+
+// annexB rebuilds a decodable elementary stream from a keyframe and its
+// parameter sets
+func annexB(frame KeyframeST) ([]byte, string, error) {
+	var buf bytes.Buffer
+	startCode := []byte{0, 0, 0, 1}
+	switch codec := frame.Codec.(type) {
+	case h264parser.CodecData:
+		for _, nalu := range [][]byte{codec.SPS(), codec.PPS()} {
+			buf.Write(startCode)
+			buf.Write(nalu)
+		}
+		nalus, _ := h264parser.SplitNALUs(frame.Packet.Data)
+		for _, nalu := range nalus {
+			buf.Write(startCode)
+			buf.Write(nalu)
+		}
+		return buf.Bytes(), "h264", nil
+	case h265parser.CodecData:
+		for _, nalu := range [][]byte{codec.VPS(), codec.SPS(), codec.PPS()} {
+			buf.Write(startCode)
+			buf.Write(nalu)
+		}
+		nalus, _ := h265parser.SplitNALUs(frame.Packet.Data)
+		for _, nalu := range nalus {
+			buf.Write(startCode)
+			buf.Write(nalu)
+		}
+		return buf.Bytes(), "hevc", nil
+	}
+	return nil, "", ErrorSnapshotCodec
+}
+
+// decodeSnapshot turns a keyframe into a JPEG with the local ffmpeg binary
+func decodeSnapshot(frame KeyframeST) ([]byte, error) {
+	ffmpeg := Config.GetFFmpegPath()
+	if ffmpeg == "" {
+		path, err := exec.LookPath("ffmpeg")
+		if err != nil {
+			return nil, ErrorSnapshotNoDecoder
+		}
+		ffmpeg = path
+	}
+	data, format, err := annexB(frame)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotDecodeTime)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-loglevel", "error",
+		"-f", format, "-i", "pipe:0", "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		log.Println("Snapshot ffmpeg error", err, stderr.String())
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// captureSnapshot decodes the cached keyframe of a stream, or the next one
+// when the cached frame is missing or stale
+func captureSnapshot(uuid string, hub *HubST) ([]byte, KeyframeST, error) {
+	frame, ok := hub.Keyframe()
+	if !ok || time.Since(frame.Received) > snapshotMaxAge {
+		log.Println("Waiting for fresh keyframe for snapshot of stream", uuid)
+		var err error
+		if frame, err = waitKeyframe(uuid, hub); err != nil {
+			return nil, frame, err
+		}
+	}
+	image, err := decodeSnapshot(frame)
+	return image, frame, err
+}
+
+// snapshotError answers a failed captureSnapshot
+func snapshotError(c *gin.Context, err error) {
+	switch err {
+	case ErrorSnapshotNoDecoder:
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+	case ErrorSnapshotNoKeyframe:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode keyframe"})
+	}
+}
+
+func HTTPAPIServerStreamSnapshot(c *gin.Context) {
+	uuid := c.Param("uuid")
+	hub := Config.hub(uuid)
+	if hub == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	image, frame, err := captureSnapshot(uuid, hub)
+	if err != nil {
+		snapshotError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, max-age=0, must-revalidate, no-store")
+	c.Header("Last-Modified", frame.Received.UTC().Format(http.TimeFormat))
+	c.Data(http.StatusOK, "image/jpeg", image)
+}
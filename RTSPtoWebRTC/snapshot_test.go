@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+func TestAnnexBH264(t *testing.T) {
+	slice := []byte{0x65, 0x88, 0x84}
+	sei := []byte{0x06, 0x05, 0x01}
+	frame := KeyframeST{Codec: testH264Codec(t), Packet: testAVCC(sei, slice)}
+	data, format, err := annexB(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "h264" {
+		t.Errorf("format %s, want h264", format)
+	}
+	want := testAnnexB(testSPS, testPPS, sei, slice)
+	if !bytes.Equal(data, want) {
+		t.Errorf("stream\n%x\nwant\n%x", data, want)
+	}
+}
+
+func TestAnnexBH265(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0c}
+	sps := []byte{0x42, 0x01, 0x01}
+	pps := []byte{0x44, 0x01, 0xc1}
+	slice := []byte{0x26, 0x01, 0xaf}
+	codec := h265parser.CodecData{RecordInfo: h265parser.AVCDecoderConfRecord{
+		VPS: [][]byte{vps},
+		SPS: [][]byte{sps},
+		PPS: [][]byte{pps},
+	}}
+	data, format, err := annexB(KeyframeST{Codec: codec, Packet: testAVCC(slice)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "hevc" {
+		t.Errorf("format %s, want hevc", format)
+	}
+	want := testAnnexB(vps, sps, pps, slice)
+	if !bytes.Equal(data, want) {
+		t.Errorf("stream\n%x\nwant\n%x", data, want)
+	}
+}
+
+func TestAnnexBRejectsAudio(t *testing.T) {
+	codec, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{ObjectType: aacparser.AOT_AAC_LC, SampleRate: 48000, ChannelLayout: av.CH_MONO, SampleRateIndex: 3, ChannelConfig: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = annexB(KeyframeST{Codec: codec}); err != ErrorSnapshotCodec {
+		t.Errorf("audio codec gave %v, want %v", err, ErrorSnapshotCodec)
+	}
+}
+
+// testAVCC packs NAL units with 4 byte length prefixes like RTSP packets
+func testAVCC(nalus ...[]byte) av.Packet {
+	var data []byte
+	for _, nalu := range nalus {
+		data = append(data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		data = append(data, nalu...)
+	}
+	return av.Packet{IsKeyFrame: true, Data: data}
+}
+
+func testAnnexB(nalus ...[]byte) []byte {
+	var res []byte
+	for _, nalu := range nalus {
+		res = append(res, 0, 0, 0, 1)
+		res = append(res, nalu...)
+	}
+	return res
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	retentionInterval        = 1 * time.Minute
+	defaultRecordWarnPercent = 80
+	bytesPerMB               = 1024 * 1024
+	// recordPartStale is how long a .part file may go unwritten before it
+	// is taken for the leftover of a recorder that died mid segment
+	recordPartStale = 10 * time.Minute
+)
+
+// Storage global
+var Storage = &StorageST{}
+
+// StorageST holds the result of the last retention pass
+type StorageST struct {
+	mutex       sync.RWMutex
+	Updated     time.Time                  `json:"updated"`
+	TotalBytes  int64                      `json:"total_bytes"`
+	QuotaBytes  int64                      `json:"quota_bytes"`
+	UsedPercent float64                    `json:"used_percent"`
+	WarnPercent int                        `json:"warn_percent"`
+	Warning     bool                       `json:"warning"`
+	Streams     map[string]StorageStreamST `json:"streams"`
+}
+
+// StorageStreamST is the disk usage of one stream directory
+type StorageStreamST struct {
+	Bytes    int64     `json:"bytes"`
+	Segments int       `json:"segments"`
+	Oldest   time.Time `json:"oldest"`
+	Newest   time.Time `json:"newest"`
+}
+
+type retentionSegment struct {
+	RecordSegmentST
+	uuid string
+}
+
+// recordPart is a segment file still being written or left unfinished
+type recordPart struct {
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// listRecordParts returns the .part files in dir
+func listRecordParts(dir string) ([]recordPart, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []recordPart
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != recordPartSuffix {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, recordPart{path: filepath.Join(dir, entry.Name()), size: info.Size(), modified: info.ModTime()})
+	}
+	return res, nil
+}
+
+func (element *ConfigST) GetRecordQuota() int64 {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Server.RecordQuotaMB * bytesPerMB
+}
+
+func (element *ConfigST) GetRecordWarnPercent() int {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	if element.Server.RecordWarnPercent <= 0 {
+		return defaultRecordWarnPercent
+	}
+	return element.Server.RecordWarnPercent
+}
+
+// recordDirs maps every directory under the record path to a stream id.
+// Directories of deleted streams keep their escaped name so the quota
+// still accounts for them.
+func (element *ConfigST) recordDirs(root string) (map[string]string, map[string]time.Duration) {
+	element.mutex.RLock()
+	dirs := make(map[string]string, len(element.Streams))
+	maxAge := make(map[string]time.Duration)
+	for uuid, stream := range element.Streams {
+		dirs[recordDir(root, uuid)] = uuid
+		if stream.Record.MaxAgeHours > 0 {
+			maxAge[uuid] = time.Duration(stream.Record.MaxAgeHours) * time.Hour
+		}
+	}
+	element.mutex.RUnlock()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, maxAge
+	}
+	res := make(map[string]string)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		if uuid, ok := dirs[dir]; ok {
+			res[dir] = uuid
+		} else {
+			res[dir] = entry.Name()
+		}
+	}
+	return res, maxAge
+}
+
+func serveRetention() {
+	for {
+		RetentionPass()
+		time.Sleep(retentionInterval)
+	}
+}
+
+// RetentionPass deletes segments past their stream max age, then the oldest
+// segments of any stream until the global quota is met, and refreshes Storage.
+// Segments being written count towards the quota but are never deleted,
+// .part files nobody wrote to for recordPartStale are.
+func RetentionPass() {
+	now := time.Now()
+	dirs, maxAge := Config.recordDirs(Config.GetRecordPath())
+	var all []retentionSegment
+	var writing int64
+	streams := make(map[string]StorageStreamST)
+	for dir, uuid := range dirs {
+		parts, err := listRecordParts(dir)
+		if err != nil {
+			log.Println("Retention list error", dir, err)
+			continue
+		}
+		for _, part := range parts {
+			if now.Sub(part.modified) > recordPartStale {
+				removeSegment(part.path, "unfinished segment of a stopped recorder")
+				continue
+			}
+			writing += part.size
+			tmp := streams[uuid]
+			tmp.Bytes += part.size
+			streams[uuid] = tmp
+		}
+		segments, err := listRecordSegments(dir)
+		if err != nil {
+			log.Println("Retention list error", dir, err)
+			continue
+		}
+		for _, segment := range segments {
+			if age, ok := maxAge[uuid]; ok && now.Sub(segment.End()) > age {
+				removeSegment(segment.Path, "max age exceeded for stream "+uuid)
+				continue
+			}
+			all = append(all, retentionSegment{RecordSegmentST: segment, uuid: uuid})
+		}
+	}
+
+	total := writing
+	for _, segment := range all {
+		total += segment.Size
+	}
+	quota := Config.GetRecordQuota()
+	if quota > 0 && total > quota {
+		sort.Slice(all, func(i, j int) bool {
+			return all[i].Start.Before(all[j].Start)
+		})
+		for len(all) > 0 && total > quota {
+			if removeSegment(all[0].Path, "disk quota exceeded") {
+				total -= all[0].Size
+			}
+			all = all[1:]
+		}
+	}
+
+	for _, segment := range all {
+		tmp := streams[segment.uuid]
+		tmp.Bytes += segment.Size
+		tmp.Segments++
+		if tmp.Oldest.IsZero() || segment.Start.Before(tmp.Oldest) {
+			tmp.Oldest = segment.Start
+		}
+		if segment.End().After(tmp.Newest) {
+			tmp.Newest = segment.End()
+		}
+		streams[segment.uuid] = tmp
+	}
+	Storage.update(now, total, quota, Config.GetRecordWarnPercent(), streams)
+}
+
+func removeSegment(path, reason string) bool {
+	if err := os.Remove(path); err != nil {
+		log.Println("Retention remove error", path, err)
+		return false
+	}
+	log.Println("Retention removed segment", path, "-", reason)
+	return true
+}
+
+// update stores the result of a pass and adds an event when usage crosses
+// the warning threshold in either direction
+func (element *StorageST) update(now time.Time, total, quota int64, warn int, streams map[string]StorageStreamST) {
+	element.mutex.Lock()
+	element.Updated = now
+	element.TotalBytes = total
+	element.QuotaBytes = quota
+	element.WarnPercent = warn
+	element.Streams = streams
+	element.UsedPercent = 0
+	if quota > 0 {
+		element.UsedPercent = float64(total) * 100 / float64(quota)
+	}
+	warning := quota > 0 && element.UsedPercent >= float64(warn)
+	crossed := warning != element.Warning
+	element.Warning = warning
+	used := element.UsedPercent
+	element.mutex.Unlock()
+	if !crossed {
+		return
+	}
+	event := EventST{
+		Type:        EventStorageRecovered,
+		Name:        "Storage usage recovered",
+		Priority:    EventPriorityLow,
+		Description: fmt.Sprintf("Recordings use %.1f%% of the quota, below the %d%% threshold", used, warn),
+		Source:      EventSourceStorage,
+	}
+	if warning {
+		event.Type, event.Name, event.Priority = EventStorageWarning, "Storage almost full", EventPriorityHigh
+		event.Description = fmt.Sprintf("Recordings use %.1f%% of the quota, the threshold is %d%%", used, warn)
+	}
+	log.Println(event.Name+":", event.Description)
+	if _, err := Events.Add(event); err != nil {
+		log.Println("Events add error", err, event.Type)
+	}
+}
+
+func HTTPAPIServerStorage(c *gin.Context) {
+	Storage.mutex.RLock()
+	defer Storage.mutex.RUnlock()
+	c.JSON(http.StatusOK, Storage)
+}
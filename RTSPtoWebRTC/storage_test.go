@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testRecordFile is a file of a stream directory, sized in MB. Segments are
+// named after their start age ago, parts were last written idle ago.
+type testRecordFile struct {
+	stream string
+	age    time.Duration
+	sizeMB int64
+	part   bool
+	idle   time.Duration
+}
+
+func (element testRecordFile) name(now time.Time) string {
+	start := now.Add(-element.age).UnixMilli()
+	if element.part {
+		return fmt.Sprintf("%s/%d.%s%s", element.stream, start, RecordFormatTS, recordPartSuffix)
+	}
+	return fmt.Sprintf("%s/%d_%d.%s", element.stream, start, time.Minute.Milliseconds(), RecordFormatTS)
+}
+
+// testRecordFiles creates sparse files under root and returns their names
+func testRecordFiles(t *testing.T, root string, now time.Time, files []testRecordFile) []string {
+	t.Helper()
+	var res []string
+	for _, file := range files {
+		name := file.name(now)
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, file.sizeMB*bytesPerMB); err != nil {
+			t.Fatal(err)
+		}
+		modified := now.Add(-file.idle)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, name)
+	}
+	return res
+}
+
+// testRecordLeft lists the files left under root
+func testRecordLeft(t *testing.T, root string) []string {
+	t.Helper()
+	var res []string
+	filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			name, _ := filepath.Rel(root, path)
+			res = append(res, filepath.ToSlash(name))
+		}
+		return err
+	})
+	sort.Strings(res)
+	return res
+}
+
+func TestRetentionPass(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams map[string]StreamST
+		quotaMB int64
+		files   []testRecordFile
+		// keep are the indexes of files that survive the pass
+		keep    []int
+		totalMB int64
+	}{
+		{
+			name:    "stream max age",
+			streams: map[string]StreamST{"cam1": {Record: RecordST{MaxAgeHours: 1}}, "cam2": {}},
+			files: []testRecordFile{
+				{stream: "cam1", age: 3 * time.Hour, sizeMB: 1},
+				{stream: "cam1", age: 10 * time.Minute, sizeMB: 1},
+				// Without a max age a stream keeps its segments
+				{stream: "cam2", age: 3 * time.Hour, sizeMB: 1},
+			},
+			keep:    []int{1, 2},
+			totalMB: 2,
+		},
+		{
+			name:    "quota oldest first across streams",
+			streams: map[string]StreamST{"cam1": {}, "cam2": {}},
+			quotaMB: 4,
+			files: []testRecordFile{
+				{stream: "cam1", age: 4 * time.Hour, sizeMB: 2},
+				{stream: "cam2", age: 3 * time.Hour, sizeMB: 2},
+				{stream: "cam1", age: 2 * time.Hour, sizeMB: 2},
+				{stream: "cam2", age: 1 * time.Hour, sizeMB: 2},
+			},
+			keep:    []int{2, 3},
+			totalMB: 4,
+		},
+		{
+			name:    "segment being written",
+			streams: map[string]StreamST{"cam1": {}},
+			quotaMB: 3,
+			files: []testRecordFile{
+				{stream: "cam1", age: 2 * time.Hour, sizeMB: 1},
+				{stream: "cam1", age: time.Hour, sizeMB: 1},
+				// Counted, so both finished segments go, but never deleted
+				{stream: "cam1", age: time.Minute, sizeMB: 3, part: true},
+			},
+			keep:    []int{2},
+			totalMB: 3,
+		},
+		{
+			name:    "stale part",
+			streams: map[string]StreamST{"cam1": {}},
+			files: []testRecordFile{
+				{stream: "cam1", age: 2 * time.Hour, sizeMB: 1, part: true, idle: 2 * recordPartStale},
+				{stream: "cam1", age: time.Hour, sizeMB: 1},
+			},
+			keep:    []int{1},
+			totalMB: 1,
+		},
+		{
+			name:    "removed stream",
+			streams: map[string]StreamST{"cam1": {}},
+			quotaMB: 2,
+			files: []testRecordFile{
+				// The directory of a deleted stream still counts
+				{stream: "gone", age: 2 * time.Hour, sizeMB: 2},
+				{stream: "cam1", age: time.Hour, sizeMB: 2},
+			},
+			keep:    []int{1},
+			totalMB: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, test.streams)
+			cfg.Server.RecordPath = t.TempDir()
+			cfg.Server.RecordQuotaMB = test.quotaMB
+			testStorage(t)
+			names := testRecordFiles(t, cfg.Server.RecordPath, time.Now(), test.files)
+			RetentionPass()
+			var want []string
+			for _, i := range test.keep {
+				want = append(want, names[i])
+			}
+			sort.Strings(want)
+			if got := testRecordLeft(t, cfg.Server.RecordPath); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("left %v, want %v", got, want)
+			}
+			if Storage.TotalBytes != test.totalMB*bytesPerMB {
+				t.Errorf("total %d MB, want %d", Storage.TotalBytes/bytesPerMB, test.totalMB)
+			}
+		})
+	}
+}
+
+// testStorage resets the result of the last retention pass
+func testStorage(t *testing.T) {
+	t.Helper()
+	old := Storage
+	Storage = &StorageST{}
+	t.Cleanup(func() {
+		Storage = old
+	})
+}
+
+func TestRetentionThresholdEvents(t *testing.T) {
+	cfg := testConfig(t, map[string]StreamST{"cam1": {}})
+	cfg.Server.RecordPath = t.TempDir()
+	cfg.Server.RecordQuotaMB = 10
+	cfg.Server.RecordWarnPercent = 50
+	testEvents(t)
+	testStorage(t)
+	events := func() []EventST {
+		t.Helper()
+		res, _, err := Events.Query(EventFilterST{}, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	now := time.Now()
+	testRecordFiles(t, cfg.Server.RecordPath, now, []testRecordFile{{stream: "cam1", age: 3 * time.Hour, sizeMB: 4}})
+	RetentionPass()
+	if n := len(events()); n != 0 || Storage.Warning {
+		t.Fatalf("%d events below the threshold, warning %v", n, Storage.Warning)
+	}
+
+	files := testRecordFiles(t, cfg.Server.RecordPath, now, []testRecordFile{{stream: "cam1", age: 2 * time.Hour, sizeMB: 2}})
+	RetentionPass()
+	RetentionPass()
+	got := events()
+	if len(got) != 1 || got[0].Type != EventStorageWarning || got[0].Priority != EventPriorityHigh || got[0].Source != EventSourceStorage {
+		t.Fatalf("crossing the threshold: %+v", got)
+	}
+
+	if err := os.Remove(filepath.Join(cfg.Server.RecordPath, files[0])); err != nil {
+		t.Fatal(err)
+	}
+	RetentionPass()
+	got = events()
+	if len(got) != 2 || got[0].Type != EventStorageRecovered || got[0].Source != EventSourceStorage || Storage.Warning {
+		t.Errorf("dropping below the threshold: %+v", got)
+	}
+}
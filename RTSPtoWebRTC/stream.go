@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/format/rtspv2"
 )
 
@@ -12,13 +16,16 @@ var (
 	ErrorStreamExitNoVideoOnStream = errors.New("stream exit no video on stream")
 	ErrorStreamExitRtspDisconnect  = errors.New("stream exit rtsp disconnect")
 	ErrorStreamExitNoViewer        = errors.New("stream exit on demand no viewer")
+	ErrorStreamExitNotFound        = errors.New("stream exit not found in config")
+	ErrorStreamExitStopped         = errors.New("stream exit stopped")
 )
 
 func serveStreams() {
 	// Start all non-on-demand streams permanently
+	// RunIFNotRun sets RunLock so recorders and viewers never start a second worker
 	for k, v := range Config.Streams {
 		if !v.OnDemand {
-			go RTSPWorkerLoop(k, v.URL, v.OnDemand, v.DisableAudio, v.Debug)
+			Config.RunIFNotRun(k)
 		}
 	}
 
@@ -28,36 +35,81 @@ func serveStreams() {
 		for k, v := range Config.Streams {
 			if v.OnDemand {
 				log.Println("Initializing on-demand stream for codec discovery:", k)
-				go RTSPWorkerLoop(k, v.URL, v.OnDemand, v.DisableAudio, v.Debug)
+				Config.RunIFNotRun(k)
 			}
 		}
 	}()
 }
-func RTSPWorkerLoop(name, url string, OnDemand, DisableAudio, Debug bool) {
-	defer Config.RunUnlock(name)
-	for {
+func RTSPWorkerLoop(worker *workerST, name, url string, OnDemand, DisableAudio, Debug bool) {
+	defer close(worker.done)
+	defer Config.RunUnlock(name, worker)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			Metrics.reconnect(name)
+		}
 		log.Println("Stream Try Connect", name)
-		err := RTSPWorker(name, url, OnDemand, DisableAudio, Debug)
+		err := RTSPWorker(worker.ctx, name, url, OnDemand, DisableAudio, Debug)
+		if err == ErrorStreamExitStopped || worker.ctx.Err() != nil {
+			log.Println("Stream", name, "worker stopped")
+			return
+		}
 		if err != nil {
 			log.Println(err)
-			Config.LastError = err
+			Metrics.workerError(name, err)
+			Webhooks.streamDown(name, err)
 		}
 		if OnDemand && !Config.HasViewer(name) {
 			log.Println(ErrorStreamExitNoViewer)
 			return
 		}
-		time.Sleep(1 * time.Second)
+		policy := Config.reconnect(name)
+		failures := Config.workerFailed(name)
+		if policy.SuspendAfter > 0 && failures >= policy.SuspendAfter {
+			Config.suspend(name)
+			log.Println("Stream", name, "suspended after", failures, "consecutive failures")
+			Events.stream(name, EventStreamSuspended, EventPriorityHigh, "Stream suspended", fmt.Sprintf("No connection after %d attempts, retry to resume", failures))
+			return
+		}
+		delay := policy.delay(failures)
+		Config.backoff(name, time.Now().Add(delay))
+		log.Println("Stream", name, "reconnecting in", delay.Round(time.Millisecond), "after", failures, "failures")
+		select {
+		case <-worker.ctx.Done():
+			return
+		case <-worker.retry:
+			log.Println("Stream", name, "retrying now")
+		case <-time.After(delay):
+		}
 	}
 }
-func RTSPWorker(name, url string, OnDemand, DisableAudio, Debug bool) error {
-	keyTest := time.NewTimer(20 * time.Second)
-	clientTest := time.NewTimer(20 * time.Second)
-	//add next TimeOut
-	RTSPClient, err := rtspv2.Dial(rtspv2.RTSPClientOptions{URL: url, DisableAudio: DisableAudio, DialTimeout: 3 * time.Second, ReadWriteTimeout: 3 * time.Second, Debug: Debug})
+func RTSPWorker(ctx context.Context, name, url string, OnDemand, DisableAudio, Debug bool) (err error) {
+	timeouts := Config.timeouts(name)
+	keyTest := time.NewTimer(timeouts.Keyframe)
+	clientTest := time.NewTimer(timeouts.ViewerCheck)
+	hub := Config.hub(name)
+	if hub == nil {
+		return ErrorStreamExitNotFound
+	}
+	RTSPClient, bridge, err := dialCamera(url, Config.transport(name), timeouts, DisableAudio, Debug)
 	if err != nil {
 		return err
 	}
+	if bridge != nil {
+		defer bridge.Close()
+	}
 	defer RTSPClient.Close()
+	hub.connected()
+	defer hub.disconnected()
+	Config.workerConnected(name)
+	Webhooks.streamUp(name)
+	Events.stream(name, EventStreamConnect, EventPriorityLow, "Stream connected", codecsDescription(RTSPClient.CodecData))
+	defer func() {
+		reason := "closed"
+		if err != nil {
+			reason = err.Error()
+		}
+		Events.stream(name, EventStreamDisconnect, EventPriorityMedium, "Stream disconnected", reason)
+	}()
 	if RTSPClient.CodecData != nil {
 		Config.coAd(name, RTSPClient.CodecData)
 	}
@@ -67,12 +119,14 @@ func RTSPWorker(name, url string, OnDemand, DisableAudio, Debug bool) error {
 	}
 	for {
 		select {
+		case <-ctx.Done():
+			return ErrorStreamExitStopped
 		case <-clientTest.C:
 			if OnDemand {
 				if !Config.HasViewer(name) {
 					return ErrorStreamExitNoViewer
 				} else {
-					clientTest.Reset(20 * time.Second)
+					clientTest.Reset(timeouts.ViewerCheck)
 				}
 			}
 		case <-keyTest.C:
@@ -81,14 +135,48 @@ func RTSPWorker(name, url string, OnDemand, DisableAudio, Debug bool) error {
 			switch signals {
 			case rtspv2.SignalCodecUpdate:
 				Config.coAd(name, RTSPClient.CodecData)
+				Events.stream(name, EventStreamCodec, EventPriorityLow, "Stream codec changed", codecsDescription(RTSPClient.CodecData))
 			case rtspv2.SignalStreamRTPStop:
 				return ErrorStreamExitRtspDisconnect
 			}
 		case packetAV := <-RTSPClient.OutgoingPacketQueue:
 			if AudioOnly || packetAV.IsKeyFrame {
-				keyTest.Reset(20 * time.Second)
+				keyTest.Reset(timeouts.Keyframe)
 			}
-			Config.cast(name, *packetAV)
+			Config.cast(name, hub, *packetAV)
+		}
+	}
+}
+
+// dialCamera connects the RTSP client the configured way, through a
+// transport bridge for anything but TransportTCP. The client is closed
+// before the bridge, which is nil without one.
+func dialCamera(url, transport string, timeouts streamTimeoutsST, DisableAudio, Debug bool) (*rtspv2.RTSPClient, *transportBridgeST, error) {
+	var bridge *transportBridgeST
+	if transport != "" && transport != TransportTCP {
+		var err error
+		if bridge, url, err = newTransportBridge(url, transport, timeouts); err != nil {
+			return nil, nil, err
+		}
+	}
+	RTSPClient, err := rtspv2.Dial(rtspv2.RTSPClientOptions{URL: url, DisableAudio: DisableAudio, DialTimeout: timeouts.Dial, ReadWriteTimeout: timeouts.ReadWrite, Debug: Debug})
+	if err != nil {
+		if bridge != nil {
+			bridge.Close()
 		}
+		return nil, nil, err
+	}
+	return RTSPClient, bridge, nil
+}
+
+// codecsDescription lists codec types for event descriptions
+func codecsDescription(codecs []av.CodecData) string {
+	if len(codecs) == 0 {
+		return "no codecs"
+	}
+	res := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		res = append(res, codec.Type().String())
 	}
+	return strings.Join(res, ", ")
 }
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	TicketStatusOpen   = "open"
+	TicketStatusClosed = "closed"
+
+	// TicketAttachSnapshot stores a JPEG of the stream taken when attaching,
+	// TicketAttachExport references a clip export job
+	TicketAttachSnapshot = "snapshot"
+	TicketAttachExport   = "export"
+
+	// TicketViewInbox lists tickets assigned to the user, TicketViewSent the
+	// ones the user assigned, TicketViewAll both, or every ticket for admins
+	TicketViewInbox = "inbox"
+	TicketViewSent  = "sent"
+	TicketViewAll   = "all"
+
+	ticketSnapshotDir = "snapshots"
+)
+
+var (
+	ErrorTicketNotFound     = errors.New("ticket not found")
+	ErrorTicketBadStatus    = errors.New("status must be open or closed")
+	ErrorTicketBadAssignee  = errors.New("assignee is not an enabled user")
+	ErrorTicketNoStream     = errors.New("assignee has no access to the stream of this ticket")
+	ErrorTicketNoName       = errors.New("ticket needs an event, an alert or a name")
+	ErrorTicketBadAttach    = errors.New("attachment kind must be snapshot or export")
+	ErrorTicketNoAttachment = errors.New("attachment not found")
+)
+
+var ticketsBucket = []byte("tickets")
+
+// Tickets global
+var Tickets = &TicketsST{}
+
+// TicketsST keeps tickets in the events database next to the events and
+// alerts they were opened from
+type TicketsST struct{}
+
+// TicketST is a follow up of an event or alert assigned from one user to
+// another
+type TicketST struct {
+	ID           string               `json:"id"`
+	EventID      string               `json:"event_id,omitempty"`
+	AlertID      string               `json:"alert_id,omitempty"`
+	Stream       string               `json:"stream,omitempty"`
+	Name         string               `json:"name"`
+	Type         string               `json:"type"`
+	Description  string               `json:"description,omitempty"`
+	MediaURL     string               `json:"media_url,omitempty"`
+	Time         time.Time            `json:"time"`
+	AssignedTo   string               `json:"assigned_to"`
+	AssignedFrom string               `json:"assigned_from"`
+	Status       string               `json:"status"`
+	Created      time.Time            `json:"created"`
+	Updated      time.Time            `json:"updated"`
+	Closed       *time.Time           `json:"closed,omitempty"`
+	ClosedBy     string               `json:"closed_by,omitempty"`
+	Attachments  []TicketAttachmentST `json:"attachments"`
+}
+
+// TicketAttachmentST references recorded media. Snapshots are files under
+// the export path, exports point at the export job. Both are downloaded
+// from the ticket so its participants need no access to the exports.
+type TicketAttachmentST struct {
+	Kind    string    `json:"kind"`
+	Stream  string    `json:"stream"`
+	Ref     string    `json:"ref"`
+	URL     string    `json:"url"`
+	Added   time.Time `json:"added"`
+	AddedBy string    `json:"added_by"`
+}
+
+// participant reports whether the user behind c may work on the ticket. A
+// ticket of a stream is hidden once the user loses the grant for it.
+func (element TicketST) participant(c *gin.Context) bool {
+	username, user := c.GetString(authUserKey), currentUser(c)
+	if user.Role == RoleAdmin {
+		return true
+	}
+	if element.Stream != "" && !user.CanStream(element.Stream) {
+		return false
+	}
+	return element.AssignedTo == username || element.AssignedFrom == username
+}
+
+func (element *TicketsST) Add(ticket TicketST) (TicketST, error) {
+	now := time.Now().UTC()
+	ticket.Status = TicketStatusOpen
+	ticket.Created, ticket.Updated = now, now
+	if ticket.Time.IsZero() {
+		ticket.Time = now
+	}
+	if ticket.Attachments == nil {
+		ticket.Attachments = []TicketAttachmentST{}
+	}
+	err := Events.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ticketsBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		ticket.ID = strconv.FormatUint(id, 10)
+		data, err := json.Marshal(ticket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(eventKey(id), data)
+	})
+	return ticket, err
+}
+
+func (element *TicketsST) Get(id string) (TicketST, error) {
+	var ticket TicketST
+	key, ok := eventKeyFromID(id)
+	if !ok {
+		return ticket, ErrorTicketNotFound
+	}
+	err := Events.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(ticketsBucket).Get(key)
+		if data == nil {
+			return ErrorTicketNotFound
+		}
+		return json.Unmarshal(data, &ticket)
+	})
+	return ticket, err
+}
+
+// List returns the tickets matching fn, newest first
+func (element *TicketsST) List(match func(TicketST) bool) ([]TicketST, error) {
+	res := make([]TicketST, 0)
+	err := Events.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(ticketsBucket).Cursor()
+		for key, data := cursor.Last(); key != nil; key, data = cursor.Prev() {
+			var ticket TicketST
+			if err := json.Unmarshal(data, &ticket); err == nil && match(ticket) {
+				res = append(res, ticket)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Update applies fn to a stored ticket in one transaction, fn may refuse
+// the change with an error
+func (element *TicketsST) Update(id string, fn func(*TicketST) error) (TicketST, error) {
+	var ticket TicketST
+	key, ok := eventKeyFromID(id)
+	if !ok {
+		return ticket, ErrorTicketNotFound
+	}
+	err := Events.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ticketsBucket)
+		data := bucket.Get(key)
+		if data == nil {
+			return ErrorTicketNotFound
+		}
+		if err := json.Unmarshal(data, &ticket); err != nil {
+			return err
+		}
+		if err := fn(&ticket); err != nil {
+			return err
+		}
+		ticket.Updated = time.Now().UTC()
+		data, err := json.Marshal(ticket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	return ticket, err
+}
+
+func (element *TicketsST) Delete(id string) error {
+	key, ok := eventKeyFromID(id)
+	if !ok {
+		return ErrorTicketNotFound
+	}
+	return Events.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ticketsBucket)
+		if bucket.Get(key) == nil {
+			return ErrorTicketNotFound
+		}
+		return bucket.Delete(key)
+	})
+}
+
+func ticketSnapshotPath(id string, n int) string {
+	return filepath.Join(Config.GetExportPath(), ticketSnapshotDir, "ticket-"+id+"-"+strconv.Itoa(n)+".jpg")
+}
+
+func ticketError(c *gin.Context, err error) {
+	switch err {
+	case ErrorTicketNotFound, ErrorTicketNoAttachment, ErrorEventNotFound, ErrorAlertNotFound, ErrorExportNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case ErrorTicketBadStatus, ErrorTicketBadAssignee, ErrorTicketNoStream, ErrorTicketNoName, ErrorTicketBadAttach:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case ErrorUserForbidden:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case ErrorExportNotFinished:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Println("Tickets error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Tickets database error"})
+	}
+}
+
+// ticketAccess loads the ticket of the :id parameter for one of its
+// participants
+func ticketAccess(c *gin.Context) (TicketST, bool) {
+	ticket, err := Tickets.Get(c.Param("id"))
+	if err == nil && !ticket.participant(c) {
+		err = ErrorTicketNotFound
+	}
+	if err != nil {
+		ticketError(c, err)
+		return ticket, false
+	}
+	return ticket, true
+}
+
+// ticketAssignee checks that a ticket can be handed to username
+func ticketAssignee(username, stream string) error {
+	user, ok := Users.get(username)
+	if !ok {
+		return ErrorTicketBadAssignee
+	}
+	if stream != "" && !user.CanStream(stream) {
+		return ErrorTicketNoStream
+	}
+	return nil
+}
+
+// HTTPAPIServerTickets lists the tickets of the current user. view selects
+// the inbox, the sent tickets or all of them; status filters open or closed.
+func HTTPAPIServerTickets(c *gin.Context) {
+	username := c.GetString(authUserKey)
+	view, status := c.DefaultQuery("view", TicketViewAll), c.Query("status")
+	if view != TicketViewInbox && view != TicketViewSent && view != TicketViewAll {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "view must be inbox, sent or all"})
+		return
+	}
+	tickets, err := Tickets.List(func(ticket TicketST) bool {
+		if status != "" && ticket.Status != status || !ticket.participant(c) {
+			return false
+		}
+		switch view {
+		case TicketViewInbox:
+			return ticket.AssignedTo == username
+		case TicketViewSent:
+			return ticket.AssignedFrom == username
+		}
+		return true
+	})
+	if err != nil {
+		ticketError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tickets": tickets})
+}
+
+func HTTPAPIServerTicket(c *gin.Context) {
+	if ticket, ok := ticketAccess(c); ok {
+		c.JSON(http.StatusOK, ticket)
+	}
+}
+
+// HTTPAPIAddTicket opens a ticket from an event or an alert, whose name,
+// stream and media are copied, or from the fields of the request alone.
+// The current user becomes assigned_from.
+func HTTPAPIAddTicket(c *gin.Context) {
+	var request struct {
+		EventID     string `json:"event_id"`
+		AlertID     string `json:"alert_id"`
+		Stream      string `json:"stream"`
+		Name        string `json:"name"`
+		Type        string `json:"type"`
+		Description string `json:"description"`
+		MediaURL    string `json:"media_url"`
+		AssignedTo  string `json:"assigned_to"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	user := currentUser(c)
+	ticket := TicketST{
+		Stream:       request.Stream,
+		Name:         request.Name,
+		Type:         request.Type,
+		Description:  request.Description,
+		MediaURL:     request.MediaURL,
+		AssignedTo:   request.AssignedTo,
+		AssignedFrom: c.GetString(authUserKey),
+	}
+	if request.EventID != "" {
+		event, err := Events.Get(request.EventID)
+		if err == nil && !eventVisible(user, event) {
+			err = ErrorEventNotFound
+		}
+		if err != nil {
+			ticketError(c, err)
+			return
+		}
+		ticket.EventID, ticket.Stream, ticket.Time = event.ID, event.Stream, event.Time
+		ticket.Name, ticket.Type = event.Name, event.Type
+		if ticket.Description == "" {
+			ticket.Description = event.Description
+		}
+		if ticket.MediaURL == "" {
+			ticket.MediaURL = event.MediaURL
+		}
+	} else if request.AlertID != "" {
+		alert, err := Alerts.Get(request.AlertID)
+		if err == nil && !alertVisible(user, alert) {
+			err = ErrorAlertNotFound
+		}
+		if err != nil {
+			ticketError(c, err)
+			return
+		}
+		ticket.AlertID, ticket.Stream, ticket.Time = alert.ID, alert.Stream, alert.Fired
+		ticket.Name, ticket.Type = alert.Title, EventAlert
+		if ticket.Description == "" {
+			ticket.Description = alert.Description
+		}
+	}
+	if ticket.Name == "" {
+		ticketError(c, ErrorTicketNoName)
+		return
+	}
+	if ticket.Stream != "" && !canStream(c, ticket.Stream, RoleOperator) {
+		return
+	}
+	if err := ticketAssignee(ticket.AssignedTo, ticket.Stream); err != nil {
+		ticketError(c, err)
+		return
+	}
+	ticket, err := Tickets.Add(ticket)
+	if err != nil {
+		ticketError(c, err)
+		return
+	}
+	log.Println("User", ticket.AssignedFrom, "assigned ticket", ticket.ID, "to", ticket.AssignedTo)
+	auditRequest(c, AuditTicketAdd, ticket.ID, "", auditDiff(nil, ticket, "created", "updated", "time", "attachments"))
+	c.JSON(http.StatusCreated, ticket)
+}
+
+// HTTPAPIUpdateTicket opens or closes a ticket and reassigns it. Unset
+// fields keep their value.
+func HTTPAPIUpdateTicket(c *gin.Context) {
+	before, ok := ticketAccess(c)
+	if !ok {
+		return
+	}
+	var request struct {
+		Status      string  `json:"status"`
+		AssignedTo  string  `json:"assigned_to"`
+		Description *string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if request.Status != "" && request.Status != TicketStatusOpen && request.Status != TicketStatusClosed {
+		ticketError(c, ErrorTicketBadStatus)
+		return
+	}
+	username := c.GetString(authUserKey)
+	if request.AssignedTo != "" && request.AssignedTo != before.AssignedTo {
+		if !currentUser(c).HasRole(RoleOperator) {
+			ticketError(c, ErrorUserForbidden)
+			return
+		}
+		if err := ticketAssignee(request.AssignedTo, before.Stream); err != nil {
+			ticketError(c, err)
+			return
+		}
+	}
+	ticket, err := Tickets.Update(before.ID, func(ticket *TicketST) error {
+		if request.AssignedTo != "" && request.AssignedTo != ticket.AssignedTo {
+			ticket.AssignedTo, ticket.AssignedFrom = request.AssignedTo, username
+		}
+		if request.Description != nil {
+			ticket.Description = *request.Description
+		}
+		if request.Status != "" && request.Status != ticket.Status {
+			ticket.Status = request.Status
+			if ticket.Status == TicketStatusClosed {
+				now := time.Now().UTC()
+				ticket.Closed, ticket.ClosedBy = &now, username
+			} else {
+				ticket.Closed, ticket.ClosedBy = nil, ""
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ticketError(c, err)
+		return
+	}
+	auditRequest(c, AuditTicketUpdate, ticket.ID, "", auditDiff(before, ticket, "updated", "closed", "closed_by"))
+	c.JSON(http.StatusOK, ticket)
+}
+
+// HTTPAPIDeleteTicket is left to whoever assigned the ticket and to admins
+func HTTPAPIDeleteTicket(c *gin.Context) {
+	ticket, ok := ticketAccess(c)
+	if !ok {
+		return
+	}
+	if currentUser(c).Role != RoleAdmin && ticket.AssignedFrom != c.GetString(authUserKey) {
+		ticketError(c, ErrorUserForbidden)
+		return
+	}
+	if err := Tickets.Delete(ticket.ID); err != nil {
+		ticketError(c, err)
+		return
+	}
+	for i, attachment := range ticket.Attachments {
+		if attachment.Kind != TicketAttachSnapshot {
+			continue
+		}
+		if err := os.Remove(ticketSnapshotPath(ticket.ID, i)); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove ticket snapshot:", err)
+		}
+	}
+	auditRequest(c, AuditTicketDelete, ticket.ID, ticket.Name, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Ticket deleted successfully"})
+}
+
+// HTTPAPIAddTicketAttachment takes a snapshot of a stream, the ticket
+// stream by default, or references an export job
+func HTTPAPIAddTicketAttachment(c *gin.Context) {
+	ticket, ok := ticketAccess(c)
+	if !ok {
+		return
+	}
+	var request struct {
+		Kind   string `json:"kind"`
+		Stream string `json:"stream"`
+		Export string `json:"export_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	attachment := TicketAttachmentST{
+		Kind:    request.Kind,
+		Added:   time.Now().UTC(),
+		AddedBy: c.GetString(authUserKey),
+	}
+	var image []byte
+	switch request.Kind {
+	case TicketAttachSnapshot:
+		attachment.Stream = request.Stream
+		if attachment.Stream == "" {
+			attachment.Stream = ticket.Stream
+		}
+		if !canStream(c, attachment.Stream, RoleViewer) {
+			return
+		}
+		hub := Config.hub(attachment.Stream)
+		if hub == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+			return
+		}
+		var frame KeyframeST
+		var err error
+		if image, frame, err = captureSnapshot(attachment.Stream, hub); err != nil {
+			snapshotError(c, err)
+			return
+		}
+		attachment.Ref = frame.Received.UTC().Format(time.RFC3339Nano)
+	case TicketAttachExport:
+		job, ok := Exports.get(request.Export)
+		if !ok {
+			ticketError(c, ErrorExportNotFound)
+			return
+		}
+		if !canStream(c, job.Stream, RoleOperator) {
+			return
+		}
+		attachment.Stream, attachment.Ref = job.Stream, job.ID
+	default:
+		ticketError(c, ErrorTicketBadAttach)
+		return
+	}
+	var path string
+	ticket, err := Tickets.Update(ticket.ID, func(ticket *TicketST) error {
+		n := len(ticket.Attachments)
+		if image != nil {
+			path = ticketSnapshotPath(ticket.ID, n)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, image, 0644); err != nil {
+				return err
+			}
+		}
+		attachment.URL = "/api/tickets/" + ticket.ID + "/attachments/" + strconv.Itoa(n)
+		ticket.Attachments = append(ticket.Attachments, attachment)
+		return nil
+	})
+	if err != nil {
+		if path != "" {
+			os.Remove(path)
+		}
+		ticketError(c, err)
+		return
+	}
+	auditRequest(c, AuditTicketAttach, ticket.ID, attachment.Kind+" "+attachment.Stream, nil)
+	c.JSON(http.StatusCreated, ticket)
+}
+
+// HTTPAPIServerTicketAttachment serves a stored snapshot or the clip of an
+// export to anyone who may see the ticket
+func HTTPAPIServerTicketAttachment(c *gin.Context) {
+	ticket, ok := ticketAccess(c)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil || n < 0 || n >= len(ticket.Attachments) {
+		ticketError(c, ErrorTicketNoAttachment)
+		return
+	}
+	attachment := ticket.Attachments[n]
+	if attachment.Kind == TicketAttachExport {
+		job, ok := Exports.get(attachment.Ref)
+		if !ok {
+			ticketError(c, ErrorExportNotFound)
+			return
+		}
+		if job.Status != ExportStatusDone {
+			ticketError(c, ErrorExportNotFinished)
+			return
+		}
+		c.FileAttachment(job.path, job.filename())
+		return
+	}
+	c.File(ticketSnapshotPath(ticket.ID, n))
+}
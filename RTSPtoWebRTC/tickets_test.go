@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A viewer working on a ticket downloads its export through the ticket,
+// the export routes stay with operators
+func TestTicketExportAttachment(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testExports(t)
+	job := testExportDone(t, "cam1")
+	ticket, err := Tickets.Add(TicketST{
+		Name:         "Intrusion",
+		Stream:       "cam1",
+		AssignedFrom: "operator",
+		AssignedTo:   "viewer",
+		Attachments:  []TicketAttachmentST{{Kind: TicketAttachExport, Stream: "cam1", Ref: job.ID}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/tickets/" + ticket.ID + "/attachments/0"
+
+	w := testRequest(router, http.MethodGet, path, tokens["viewer"])
+	if w.Code != http.StatusOK || w.Body.String() != "clip" {
+		t.Errorf("assignee: %d %q", w.Code, w.Body.String())
+	}
+	if w := testRequest(router, http.MethodGet, "/api/exports/"+job.ID+"/download", tokens["viewer"]); w.Code != http.StatusForbidden {
+		t.Errorf("viewer downloading the export directly: %d", w.Code)
+	}
+	// Access to the stream is not enough without taking part in the ticket
+	if w := testRequest(router, http.MethodGet, path, tokens["all"]); w.Code != http.StatusNotFound {
+		t.Errorf("outsider: %d", w.Code)
+	}
+
+	Exports.setStatus(job.ID, ExportStatusRunning, nil)
+	if w := testRequest(router, http.MethodGet, path, tokens["viewer"]); w.Code != http.StatusConflict {
+		t.Errorf("unfinished export: %d", w.Code)
+	}
+	Exports.remove(job.ID)
+	if w := testRequest(router, http.MethodGet, path, tokens["viewer"]); w.Code != http.StatusNotFound {
+		t.Errorf("deleted export: %d", w.Code)
+	}
+}
+
+// testTicketPost opens a ticket through the API and decodes it
+func testTicketPost(t *testing.T, router *gin.Engine, token string, request gin.H) (TicketST, int) {
+	t.Helper()
+	var ticket TicketST
+	w := testRequestJSON(router, http.MethodPost, "/api/tickets", token, request)
+	if w.Code == http.StatusCreated {
+		if err := json.Unmarshal(w.Body.Bytes(), &ticket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ticket, w.Code
+}
+
+func testTicketNames(t *testing.T, router *gin.Engine, token, query string) string {
+	t.Helper()
+	w := testRequest(router, http.MethodGet, "/api/tickets?"+query, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: %d", query, w.Code)
+	}
+	var res struct {
+		Tickets []TicketST `json:"tickets"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(res.Tickets))
+	for _, ticket := range res.Tickets {
+		names = append(names, ticket.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// A ticket copies its event or alert and is assigned from the caller,
+// whatever the request says
+func TestTicketCreate(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testEvents(t)
+	event, err := Events.Add(EventST{Stream: "cam1", Type: "motion", Name: "Motion", Description: "yard", MediaURL: "/clip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert, err := Alerts.Add(AlertST{Stream: "cam1", Title: "Offline", Description: "no packets"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hidden, _ := Events.Add(EventST{Stream: "cam2", Name: "Hidden"})
+
+	ticket, code := testTicketPost(t, router, tokens["operator"], gin.H{"event_id": event.ID, "assigned_to": "viewer", "assigned_from": "admin"})
+	if code != http.StatusCreated {
+		t.Fatalf("from event: %d", code)
+	}
+	if ticket.EventID != event.ID || ticket.Stream != "cam1" || ticket.Name != "Motion" || ticket.Type != "motion" ||
+		ticket.Description != "yard" || ticket.MediaURL != "/clip" || !ticket.Time.Equal(event.Time) {
+		t.Errorf("event not copied: %+v", ticket)
+	}
+	if ticket.AssignedFrom != "operator" || ticket.AssignedTo != "viewer" || ticket.Status != TicketStatusOpen {
+		t.Errorf("assignment %+v", ticket)
+	}
+
+	ticket, code = testTicketPost(t, router, tokens["operator"], gin.H{"alert_id": alert.ID, "assigned_to": "viewer"})
+	if code != http.StatusCreated {
+		t.Fatalf("from alert: %d", code)
+	}
+	if ticket.AlertID != alert.ID || ticket.Stream != "cam1" || ticket.Name != "Offline" || ticket.Type != EventAlert || ticket.Description != "no packets" {
+		t.Errorf("alert not copied: %+v", ticket)
+	}
+
+	rejected := []struct {
+		name    string
+		token   string
+		request gin.H
+		want    int
+	}{
+		{"viewer", tokens["viewer"], gin.H{"name": "x", "assigned_to": "operator"}, http.StatusForbidden},
+		{"no name", tokens["operator"], gin.H{"assigned_to": "viewer"}, http.StatusBadRequest},
+		{"unknown assignee", tokens["operator"], gin.H{"name": "x", "assigned_to": "nobody"}, http.StatusBadRequest},
+		{"assignee without the stream", tokens["admin"], gin.H{"name": "x", "stream": "cam2", "assigned_to": "viewer"}, http.StatusBadRequest},
+		{"ungranted stream", tokens["operator"], gin.H{"name": "x", "stream": "cam2", "assigned_to": "admin"}, http.StatusForbidden},
+		{"ungranted event", tokens["operator"], gin.H{"event_id": hidden.ID, "assigned_to": "admin"}, http.StatusNotFound},
+		{"missing alert", tokens["operator"], gin.H{"alert_id": "999", "assigned_to": "admin"}, http.StatusNotFound},
+	}
+	for _, test := range rejected {
+		if _, code := testTicketPost(t, router, test.token, test.request); code != test.want {
+			t.Errorf("%s: %d, want %d", test.name, code, test.want)
+		}
+	}
+}
+
+func TestTicketViews(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testEvents(t)
+	for _, ticket := range []TicketST{
+		{Name: "to viewer", Stream: "cam1", AssignedFrom: "operator", AssignedTo: "viewer"},
+		{Name: "to operator", Stream: "cam1", AssignedFrom: "admin", AssignedTo: "operator"},
+		{Name: "cam2", Stream: "cam2", AssignedFrom: "admin", AssignedTo: "all"},
+	} {
+		if _, err := Tickets.Add(ticket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		user  string
+		query string
+		want  string
+	}{
+		{"operator", "view=inbox", "to operator"},
+		{"operator", "view=sent", "to viewer"},
+		{"operator", "view=all", "to operator,to viewer"},
+		{"viewer", "", "to viewer"},
+		{"all", "view=inbox", "cam2"},
+		{"admin", "view=sent", "cam2,to operator"},
+		{"admin", "view=all", "cam2,to operator,to viewer"},
+		{"admin", "status=closed", ""},
+	}
+	for _, test := range tests {
+		if got := testTicketNames(t, router, tokens[test.user], test.query); got != test.want {
+			t.Errorf("%s %s: %q, want %q", test.user, test.query, got, test.want)
+		}
+	}
+	if w := testRequest(router, http.MethodGet, "/api/tickets?view=other", tokens["admin"]); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown view: %d", w.Code)
+	}
+}
+
+func TestTicketStatusAndAssignment(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testEvents(t)
+	ticket, err := Tickets.Add(TicketST{Name: "Motion", Stream: "cam1", AssignedFrom: "admin", AssignedTo: "viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/tickets/" + ticket.ID
+
+	if w := testRequestJSON(router, http.MethodPut, path, tokens["viewer"], gin.H{"status": TicketStatusClosed}); w.Code != http.StatusOK {
+		t.Fatalf("close: %d", w.Code)
+	}
+	closed, _ := Tickets.Get(ticket.ID)
+	if closed.Status != TicketStatusClosed || closed.Closed == nil || closed.ClosedBy != "viewer" {
+		t.Errorf("closed %+v", closed)
+	}
+	if got := testTicketNames(t, router, tokens["viewer"], "status=open"); got != "" {
+		t.Errorf("closed ticket listed as open: %q", got)
+	}
+	if w := testRequestJSON(router, http.MethodPut, path, tokens["viewer"], gin.H{"status": TicketStatusOpen}); w.Code != http.StatusOK {
+		t.Fatalf("reopen: %d", w.Code)
+	}
+	reopened, _ := Tickets.Get(ticket.ID)
+	if reopened.Status != TicketStatusOpen || reopened.Closed != nil || reopened.ClosedBy != "" {
+		t.Errorf("reopened %+v", reopened)
+	}
+	if w := testRequestJSON(router, http.MethodPut, path, tokens["viewer"], gin.H{"status": "done"}); w.Code != http.StatusBadRequest {
+		t.Errorf("bad status: %d", w.Code)
+	}
+
+	if w := testRequestJSON(router, http.MethodPut, path, tokens["viewer"], gin.H{"assigned_to": "operator"}); w.Code != http.StatusForbidden {
+		t.Errorf("viewer reassigning: %d", w.Code)
+	}
+	if w := testRequestJSON(router, http.MethodPut, path, tokens["admin"], gin.H{"assigned_to": "nobody"}); w.Code != http.StatusBadRequest {
+		t.Errorf("reassigning to an unknown user: %d", w.Code)
+	}
+	if w := testRequestJSON(router, http.MethodPut, path, tokens["admin"], gin.H{"assigned_to": "operator"}); w.Code != http.StatusOK {
+		t.Fatalf("reassign: %d", w.Code)
+	}
+	reassigned, _ := Tickets.Get(ticket.ID)
+	if reassigned.AssignedTo != "operator" || reassigned.AssignedFrom != "admin" {
+		t.Errorf("reassigned %+v", reassigned)
+	}
+	// The previous assignee no longer takes part
+	if w := testRequest(router, http.MethodGet, path, tokens["viewer"]); w.Code != http.StatusNotFound {
+		t.Errorf("previous assignee reading: %d", w.Code)
+	}
+}
+
+// Only whoever assigned a ticket and admins delete it
+func TestTicketDelete(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testEvents(t)
+	tests := []struct {
+		user string
+		want int
+	}{
+		{"viewer", http.StatusForbidden},
+		{"all", http.StatusNotFound},
+		{"operator", http.StatusOK},
+	}
+	ticket, err := Tickets.Add(TicketST{Name: "Motion", Stream: "cam1", AssignedFrom: "operator", AssignedTo: "viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if w := testRequest(router, http.MethodDelete, "/api/tickets/"+ticket.ID, tokens[test.user]); w.Code != test.want {
+			t.Errorf("%s deleting: %d, want %d", test.user, w.Code, test.want)
+		}
+	}
+	ticket, _ = Tickets.Add(TicketST{Name: "Motion", Stream: "cam1", AssignedFrom: "operator", AssignedTo: "viewer"})
+	if w := testRequest(router, http.MethodDelete, "/api/tickets/"+ticket.ID, tokens["admin"]); w.Code != http.StatusOK {
+		t.Errorf("admin deleting: %d", w.Code)
+	}
+	if _, err := Tickets.Get(ticket.ID); err != ErrorTicketNotFound {
+		t.Errorf("deleted ticket: %v", err)
+	}
+}
+
+func TestTicketAttachmentValidation(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testExports(t)
+	job := testExportDone(t, "cam1")
+	ticket, err := Tickets.Add(TicketST{Name: "Motion", Stream: "cam1", AssignedFrom: "admin", AssignedTo: "viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/tickets/" + ticket.ID + "/attachments"
+	tests := []struct {
+		name    string
+		token   string
+		request gin.H
+		want    int
+	}{
+		{"unknown kind", tokens["viewer"], gin.H{"kind": "video"}, http.StatusBadRequest},
+		{"missing export", tokens["admin"], gin.H{"kind": TicketAttachExport, "export_id": "missing"}, http.StatusNotFound},
+		{"viewer attaching an export", tokens["viewer"], gin.H{"kind": TicketAttachExport, "export_id": job.ID}, http.StatusForbidden},
+		{"snapshot of an ungranted stream", tokens["viewer"], gin.H{"kind": TicketAttachSnapshot, "stream": "cam2"}, http.StatusForbidden},
+		{"export", tokens["admin"], gin.H{"kind": TicketAttachExport, "export_id": job.ID}, http.StatusCreated},
+	}
+	for _, test := range tests {
+		if w := testRequestJSON(router, http.MethodPost, path, test.token, test.request); w.Code != test.want {
+			t.Errorf("%s: %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+	attached, _ := Tickets.Get(ticket.ID)
+	if len(attached.Attachments) != 1 {
+		t.Fatalf("%d attachments, want 1", len(attached.Attachments))
+	}
+	if got := attached.Attachments[0]; got.Ref != job.ID || got.Stream != "cam1" || got.AddedBy != "admin" || got.URL != path+"/0" {
+		t.Errorf("attachment %+v", got)
+	}
+	if w := testRequest(router, http.MethodGet, path+"/1", tokens["viewer"]); w.Code != http.StatusNotFound {
+		t.Errorf("missing attachment: %d", w.Code)
+	}
+}
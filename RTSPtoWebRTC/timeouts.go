@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// maxTimeoutSeconds bounds every timeout, longer ones are configuration
+// mistakes that would leave a dead camera looking connected
+const maxTimeoutSeconds = 3600
+
+var ErrorTimeoutRange = errors.New("timeouts must be between 0 and 3600 seconds")
+
+// defaultTimeouts are used where neither the server nor the stream sets one
+var defaultTimeouts = TimeoutsST{
+	Keyframe:    20,
+	ViewerCheck: 20,
+	Dial:        3,
+	ReadWrite:   3,
+	NoVideo:     10,
+	CodecWait:   10,
+}
+
+// TimeoutsST are in seconds. A stream overrides the server settings field
+// by field, 0 keeps the inherited value. Changes apply to the next
+// connection or viewer.
+type TimeoutsST struct {
+	// Keyframe without a video keyframe the worker reconnects
+	Keyframe int `json:"keyframe_seconds,omitempty"`
+	// ViewerCheck is how often an on-demand worker looks for viewers
+	ViewerCheck int `json:"viewer_check_seconds,omitempty"`
+	Dial        int `json:"dial_seconds,omitempty"`
+	ReadWrite   int `json:"read_write_seconds,omitempty"`
+	// NoVideo closes a WebRTC viewer that received no keyframe
+	NoVideo int `json:"no_video_seconds,omitempty"`
+	// CodecWait is how long a request waits for the codecs of a stream
+	CodecWait int `json:"codec_wait_seconds,omitempty"`
+}
+
+// streamTimeoutsST are the resolved timeouts of one stream
+type streamTimeoutsST struct {
+	Keyframe    time.Duration
+	ViewerCheck time.Duration
+	Dial        time.Duration
+	ReadWrite   time.Duration
+	NoVideo     time.Duration
+	CodecWait   time.Duration
+}
+
+func (element TimeoutsST) Validate() error {
+	for _, v := range []int{element.Keyframe, element.ViewerCheck, element.Dial, element.ReadWrite, element.NoVideo, element.CodecWait} {
+		if v < 0 || v > maxTimeoutSeconds {
+			return ErrorTimeoutRange
+		}
+	}
+	return nil
+}
+
+// merge returns element with the non-zero fields of override applied
+func (element TimeoutsST) merge(override TimeoutsST) TimeoutsST {
+	if override.Keyframe > 0 {
+		element.Keyframe = override.Keyframe
+	}
+	if override.ViewerCheck > 0 {
+		element.ViewerCheck = override.ViewerCheck
+	}
+	if override.Dial > 0 {
+		element.Dial = override.Dial
+	}
+	if override.ReadWrite > 0 {
+		element.ReadWrite = override.ReadWrite
+	}
+	if override.NoVideo > 0 {
+		element.NoVideo = override.NoVideo
+	}
+	if override.CodecWait > 0 {
+		element.CodecWait = override.CodecWait
+	}
+	return element
+}
+
+// timeouts resolves the timeouts of a stream from the defaults, the server
+// settings and the stream override
+func (element *ConfigST) timeouts(uuid string) streamTimeoutsST {
+	element.mutex.RLock()
+	res := defaultTimeouts.merge(element.Server.Timeouts)
+	if tmp, ok := element.Streams[uuid]; ok && tmp.Timeouts != nil {
+		res = res.merge(*tmp.Timeouts)
+	}
+	element.mutex.RUnlock()
+	return streamTimeoutsST{
+		Keyframe:    time.Duration(res.Keyframe) * time.Second,
+		ViewerCheck: time.Duration(res.ViewerCheck) * time.Second,
+		Dial:        time.Duration(res.Dial) * time.Second,
+		ReadWrite:   time.Duration(res.ReadWrite) * time.Second,
+		NoVideo:     time.Duration(res.NoVideo) * time.Second,
+		CodecWait:   time.Duration(res.CodecWait) * time.Second,
+	}
+}
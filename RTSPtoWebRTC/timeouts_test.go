@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		server TimeoutsST
+		stream *TimeoutsST
+		want   streamTimeoutsST
+	}{
+		{"defaults", TimeoutsST{}, nil, streamTimeoutsST{
+			Keyframe: 20 * time.Second, ViewerCheck: 20 * time.Second, Dial: 3 * time.Second,
+			ReadWrite: 3 * time.Second, NoVideo: 10 * time.Second, CodecWait: 10 * time.Second,
+		}},
+		{"server", TimeoutsST{Dial: 5, NoVideo: 30}, nil, streamTimeoutsST{
+			Keyframe: 20 * time.Second, ViewerCheck: 20 * time.Second, Dial: 5 * time.Second,
+			ReadWrite: 3 * time.Second, NoVideo: 30 * time.Second, CodecWait: 10 * time.Second,
+		}},
+		// The stream overrides field by field, its zero fields inherit
+		{"stream over server", TimeoutsST{Dial: 5, NoVideo: 30}, &TimeoutsST{Dial: 1, Keyframe: 60}, streamTimeoutsST{
+			Keyframe: 60 * time.Second, ViewerCheck: 20 * time.Second, Dial: 1 * time.Second,
+			ReadWrite: 3 * time.Second, NoVideo: 30 * time.Second, CodecWait: 10 * time.Second,
+		}},
+		{"empty stream override", TimeoutsST{ReadWrite: 8}, &TimeoutsST{}, streamTimeoutsST{
+			Keyframe: 20 * time.Second, ViewerCheck: 20 * time.Second, Dial: 3 * time.Second,
+			ReadWrite: 8 * time.Second, NoVideo: 10 * time.Second, CodecWait: 10 * time.Second,
+		}},
+		{"every field", TimeoutsST{}, &TimeoutsST{Keyframe: 1, ViewerCheck: 2, Dial: 3, ReadWrite: 4, NoVideo: 5, CodecWait: 6}, streamTimeoutsST{
+			Keyframe: 1 * time.Second, ViewerCheck: 2 * time.Second, Dial: 3 * time.Second,
+			ReadWrite: 4 * time.Second, NoVideo: 5 * time.Second, CodecWait: 6 * time.Second,
+		}},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, map[string]StreamST{"cam": {Timeouts: test.stream}})
+		cfg.Server.Timeouts = test.server
+		if got := cfg.timeouts("cam"); got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.name, got, test.want)
+		}
+		// Streams that are gone resolve like streams without an override
+		if got, want := cfg.timeouts("unknown"), cfg.timeouts("none"); got != want {
+			t.Errorf("%s: unknown stream %+v, want %+v", test.name, got, want)
+		}
+	}
+}
+
+func TestParseConfigTimeouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"none", `{"streams": {"cam": {"url": "rtsp://cam"}}}`, true},
+		{"server", `{"server": {"timeouts": {"dial_seconds": 5, "keyframe_seconds": 3600}}}`, true},
+		{"stream", `{"streams": {"cam": {"url": "rtsp://cam", "timeouts": {"no_video_seconds": 30}}}}`, true},
+		{"server negative", `{"server": {"timeouts": {"dial_seconds": -1}}}`, false},
+		{"server too long", `{"server": {"timeouts": {"codec_wait_seconds": 3601}}}`, false},
+		{"stream negative", `{"streams": {"cam": {"url": "rtsp://cam", "timeouts": {"read_write_seconds": -5}}}}`, false},
+		{"stream too long", `{"streams": {"cam": {"url": "rtsp://cam", "timeouts": {"viewer_check_seconds": 86400}}}}`, false},
+		{"not a number", `{"server": {"timeouts": {"dial_seconds": "5s"}}}`, false},
+	}
+	for _, test := range tests {
+		_, err := parseConfig([]byte(test.config))
+		if test.valid && err != nil {
+			t.Errorf("%s: rejected with %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+	if _, err := parseConfig([]byte(`{"streams": {"cam": {"url": "rtsp://cam", "timeouts": {"dial_seconds": 4000}}}}`)); !errors.Is(err, ErrorTimeoutRange) {
+		t.Errorf("stream error %v, want %v", err, ErrorTimeoutRange)
+	}
+}
+
+func TestStreamTimeoutsRequest(t *testing.T) {
+	current := &TimeoutsST{Dial: 5}
+	if res, err := streamTimeouts(nil, current); err != nil || res != current {
+		t.Errorf("left out: %v %v, want the current override", res, err)
+	}
+	if res, err := streamTimeouts(&TimeoutsST{}, current); err != nil || res != nil {
+		t.Errorf("empty object: %v %v, want no override", res, err)
+	}
+	if _, err := streamTimeouts(&TimeoutsST{NoVideo: maxTimeoutSeconds + 1}, current); err != ErrorTimeoutRange {
+		t.Errorf("out of range: %v", err)
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transports of StreamST.Transport. The RTSP client of vdk only receives
+// RTP interleaved in the RTSP connection, so for the other modes it talks
+// to a local bridge that reaches the camera the configured way and hands
+// the RTP packets back interleaved.
+const (
+	// TransportTCP is RTP interleaved in the RTSP connection, the default
+	TransportTCP = "tcp"
+	// TransportUDP receives RTP on a pair of local UDP ports
+	TransportUDP = "udp"
+	// TransportMulticast joins the group the camera announces in SETUP
+	TransportMulticast = "multicast"
+	// TransportHTTP tunnels RTSP through an HTTP GET and POST pair to the
+	// host and port of the stream URL, usually the web port of the camera
+	TransportHTTP = "http"
+)
+
+var (
+	ErrorTransportUnknown   = errors.New("transport must be tcp, udp, multicast or http")
+	ErrorTransportScheme    = errors.New("the udp, multicast and http transports need an rtsp:// url")
+	ErrorTransportSetup     = errors.New("camera answered SETUP without the requested transport")
+	ErrorTransportTunnel    = errors.New("camera refused the HTTP tunnel")
+	ErrorTransportMalformed = errors.New("malformed rtsp message")
+)
+
+// transport returns the transport of a stream, empty is TransportTCP
+func (element *ConfigST) transport(uuid string) string {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return element.Streams[uuid].Transport
+}
+
+// validateTransport checks the transport of a stream against its URL
+func validateTransport(transport, rawURL string) error {
+	switch transport {
+	case "", TransportTCP:
+		return nil
+	case TransportUDP, TransportMulticast, TransportHTTP:
+	default:
+		return ErrorTransportUnknown
+	}
+	target, err := url.Parse(html.UnescapeString(rawURL))
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "rtsp" {
+		return ErrorTransportScheme
+	}
+	return nil
+}
+
+// transportBridgeST accepts the RTSP client on a loopback port and relays
+// it to the camera. RTSP messages are rewritten on the way: request URIs
+// point back at the camera, SETUP asks for the bridge transport and the
+// answer is turned into the interleaved one the client expects.
+type transportBridgeST struct {
+	mode     string
+	target   *url.URL
+	password string
+	timeouts streamTimeoutsST
+	listener net.Listener
+	// localBase and targetBase are the scheme and host of request URIs
+	localBase  string
+	targetBase string
+	upstreamR  *bufio.Reader
+	upstreamW  io.Writer
+	// source is the address of the camera, unicast RTP from elsewhere is
+	// dropped
+	source net.IP
+
+	mutex   sync.Mutex
+	client  net.Conn
+	closers []io.Closer
+	tracks  map[string]*bridgeTrackST
+	closed  bool
+}
+
+// bridgeTrackST is one SETUP, keyed by CSeq until the camera answers
+type bridgeTrackST struct {
+	channel int
+	rtp     *net.UDPConn
+	rtcp    *net.UDPConn
+}
+
+// newTransportBridge connects to the camera and returns the URL the RTSP
+// client has to dial instead of rawURL
+func newTransportBridge(rawURL, mode string, timeouts streamTimeoutsST) (*transportBridgeST, string, error) {
+	target, err := url.Parse(html.UnescapeString(rawURL))
+	if err != nil {
+		return nil, "", err
+	}
+	element := &transportBridgeST{
+		mode:       mode,
+		target:     target,
+		timeouts:   timeouts,
+		targetBase: "rtsp://" + target.Host,
+		tracks:     make(map[string]*bridgeTrackST),
+	}
+	element.password, _ = target.User.Password()
+	host := target.Host
+	if target.Port() == "" {
+		host = net.JoinHostPort(target.Hostname(), "554")
+		if mode == TransportHTTP {
+			host = net.JoinHostPort(target.Hostname(), "80")
+		}
+	}
+	if mode == TransportHTTP {
+		err = element.openTunnel(host)
+	} else {
+		err = element.openControl(host)
+	}
+	if err != nil {
+		element.Close()
+		return nil, "", err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		element.Close()
+		return nil, "", err
+	}
+	element.listener = listener
+	element.localBase = "rtsp://" + listener.Addr().String()
+	local := *target
+	local.Host = listener.Addr().String()
+	go element.serve()
+	return element, local.String(), nil
+}
+
+func (element *transportBridgeST) openControl(host string) error {
+	conn, err := net.DialTimeout("tcp", host, element.timeouts.Dial)
+	if err != nil {
+		return err
+	}
+	element.closers = append(element.closers, conn)
+	element.source = conn.RemoteAddr().(*net.TCPAddr).IP
+	element.upstreamR = bufio.NewReader(conn)
+	element.upstreamW = conn
+	return nil
+}
+
+// openTunnel opens the RTSP over HTTP tunnel: the camera answers on a GET
+// connection and reads base64 encoded requests from a POST connection
+// carrying the same session cookie
+func (element *transportBridgeST) openTunnel(host string) error {
+	cookie := pseudoUUID()
+	path := element.target.RequestURI()
+	headers := "x-sessioncookie: " + cookie + "\r\nPragma: no-cache\r\nCache-Control: no-cache\r\n"
+	if element.target.User != nil {
+		credentials := element.target.User.Username() + ":" + element.password
+		headers += "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+	get, err := net.DialTimeout("tcp", host, element.timeouts.Dial)
+	if err != nil {
+		return err
+	}
+	element.closers = append(element.closers, get)
+	get.SetDeadline(time.Now().Add(element.timeouts.ReadWrite))
+	if _, err = io.WriteString(get, "GET "+path+" HTTP/1.0\r\n"+headers+"Accept: application/x-rtsp-tunnelled\r\n\r\n"); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(get)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrorTransportTunnel, res.Status)
+	}
+	get.SetDeadline(time.Time{})
+	post, err := net.DialTimeout("tcp", host, element.timeouts.Dial)
+	if err != nil {
+		return err
+	}
+	element.closers = append(element.closers, post)
+	if _, err = io.WriteString(post, "POST "+path+" HTTP/1.0\r\n"+headers+"Content-Type: application/x-rtsp-tunnelled\r\nContent-Length: 32767\r\nExpires: Sun, 9 Jan 1972 00:00:00 GMT\r\n\r\n"); err != nil {
+		return err
+	}
+	element.upstreamR = bufio.NewReader(res.Body)
+	element.upstreamW = tunnelWriterST{post}
+	return nil
+}
+
+// tunnelWriterST base64 encodes every write on its own, the camera
+// decodes each request as it arrives
+type tunnelWriterST struct {
+	conn net.Conn
+}
+
+func (element tunnelWriterST) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(element.conn, base64.StdEncoding.EncodeToString(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// serve accepts the RTSP client and relays until either side closes
+func (element *transportBridgeST) serve() {
+	defer element.Close()
+	element.listener.(*net.TCPListener).SetDeadline(time.Now().Add(element.timeouts.Dial + element.timeouts.ReadWrite))
+	client, err := element.listener.Accept()
+	if err != nil {
+		log.Println("Transport bridge to", element.target.Host, "got no client:", err)
+		return
+	}
+	element.mutex.Lock()
+	if element.closed {
+		element.mutex.Unlock()
+		client.Close()
+		return
+	}
+	element.client = client
+	element.mutex.Unlock()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- element.requests(bufio.NewReader(client))
+	}()
+	go func() {
+		if element.mode == TransportHTTP {
+			// The tunnel carries interleaved RTP as is
+			_, err := io.Copy(client, element.upstreamR)
+			errs <- err
+			return
+		}
+		errs <- element.responses()
+	}()
+	if err = <-errs; err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Println("Transport bridge to", element.target.Host, "closed:", err)
+	}
+}
+
+// requests forwards the requests of the client to the camera
+func (element *transportBridgeST) requests(reader *bufio.Reader) error {
+	for {
+		msg, err := readRTSPMessage(reader)
+		if err != nil {
+			return err
+		}
+		if msg.interleaved {
+			// RTCP of the client, the bridge transports keep their own
+			continue
+		}
+		method, uri, proto, ok := msg.requestLine()
+		if !ok {
+			return ErrorTransportMalformed
+		}
+		if strings.HasPrefix(uri, element.localBase) {
+			uri = element.targetBase + strings.TrimPrefix(uri, element.localBase)
+			msg.first = method + " " + uri + " " + proto
+			if auth := msg.get("Authorization"); strings.HasPrefix(auth, "Digest ") {
+				msg.set("Authorization", resignDigest(auth, method, uri, element.password))
+			}
+		}
+		if method == "SETUP" && element.mode != TransportHTTP {
+			if err = element.setup(msg); err != nil {
+				return err
+			}
+		}
+		if _, err = element.upstreamW.Write(msg.bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// setup replaces the interleaved transport of a SETUP with the bridge one
+func (element *transportBridgeST) setup(msg *rtspMessageST) error {
+	channel := 0
+	for _, part := range strings.Split(msg.get("Transport"), ";") {
+		if value := strings.TrimPrefix(strings.TrimSpace(part), "interleaved="); value != strings.TrimSpace(part) {
+			channel, _ = strconv.Atoi(strings.SplitN(value, "-", 2)[0])
+		}
+	}
+	track := &bridgeTrackST{channel: channel}
+	if element.mode == TransportMulticast {
+		msg.set("Transport", "RTP/AVP;multicast")
+	} else {
+		rtp, rtcp, err := listenUDPPair()
+		if err != nil {
+			return err
+		}
+		track.rtp, track.rtcp = rtp, rtcp
+		element.addCloser(rtp, rtcp)
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		msg.set("Transport", fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1))
+	}
+	element.mutex.Lock()
+	element.tracks[msg.get("CSeq")] = track
+	element.mutex.Unlock()
+	return nil
+}
+
+// responses forwards the answers of the camera, turning the transport of
+// a SETUP answer back into the interleaved one the client asked for
+func (element *transportBridgeST) responses() error {
+	for {
+		msg, err := readRTSPMessage(element.upstreamR)
+		if err != nil {
+			return err
+		}
+		if msg.interleaved {
+			continue
+		}
+		element.mutex.Lock()
+		track, ok := element.tracks[msg.get("CSeq")]
+		delete(element.tracks, msg.get("CSeq"))
+		element.mutex.Unlock()
+		if ok && strings.Contains(msg.first, " 200") {
+			if err = element.receive(track, msg.get("Transport")); err != nil {
+				return err
+			}
+			msg.set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", track.channel, track.channel+1))
+		}
+		if err = element.write(msg.bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// receive starts relaying a track once the camera accepted its SETUP
+func (element *transportBridgeST) receive(track *bridgeTrackST, transport string) error {
+	params := make(map[string]string)
+	for _, part := range strings.Split(transport, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		} else {
+			params[kv[0]] = ""
+		}
+	}
+	source := element.source
+	if element.mode == TransportMulticast {
+		// Group members may send from another interface than the RTSP
+		// one, only the source the camera announces is checked
+		source = net.ParseIP(params["source"])
+		if _, ok := params["multicast"]; !ok {
+			return ErrorTransportSetup
+		}
+		group := net.ParseIP(params["destination"])
+		port, err := strconv.Atoi(strings.SplitN(params["port"], "-", 2)[0])
+		if group == nil || err != nil {
+			return ErrorTransportSetup
+		}
+		if track.rtp, err = net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: group, Port: port}); err != nil {
+			return err
+		}
+		element.addCloser(track.rtp)
+		log.Println("Transport bridge joined", group, "port", port, "for", element.target.Host)
+	} else if _, ok := params["client_port"]; !ok {
+		return ErrorTransportSetup
+	}
+	go element.relay(track.rtp, track.channel, source)
+	if track.rtcp != nil {
+		// Sender reports are read and dropped so the port stays open
+		go element.relay(track.rtcp, -1, nil)
+	}
+	return nil
+}
+
+// relay frames the UDP packets of a track from source as interleaved data,
+// channel -1 discards them
+func (element *transportBridgeST) relay(conn *net.UDPConn, channel int, source net.IP) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// The RTP header alone is 12 bytes, the client gives up on less
+		if channel < 0 || n < 12 || (source != nil && !addr.IP.Equal(source)) {
+			continue
+		}
+		frame := make([]byte, 4+n)
+		frame[0] = '$'
+		frame[1] = byte(channel)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+		copy(frame[4:], buf[:n])
+		if err = element.write(frame); err != nil {
+			element.Close()
+			return
+		}
+	}
+}
+
+func (element *transportBridgeST) write(data []byte) error {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.client == nil {
+		return net.ErrClosed
+	}
+	_, err := element.client.Write(data)
+	return err
+}
+
+func (element *transportBridgeST) addCloser(closers ...io.Closer) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	element.closers = append(element.closers, closers...)
+}
+
+// Close ends the bridge and everything it opened
+func (element *transportBridgeST) Close() {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if element.closed {
+		return
+	}
+	element.closed = true
+	if element.listener != nil {
+		element.listener.Close()
+	}
+	if element.client != nil {
+		element.client.Close()
+	}
+	for _, closer := range element.closers {
+		closer.Close()
+	}
+}
+
+// listenUDPPair opens an even RTP port and the RTCP port above it
+func listenUDPPair() (*net.UDPConn, *net.UDPConn, error) {
+	for i := 0; i < 16; i++ {
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err == nil {
+				return rtp, rtcp, nil
+			}
+		}
+		rtp.Close()
+	}
+	return nil, nil, errors.New("no free udp port pair")
+}
+
+// resignDigest computes the digest of a request whose URI the bridge
+// rewrote, the client signed its local URI
+func resignDigest(auth, method, uri, password string) string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "Digest "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	ha1 := fmt.Sprintf("%x", md5.Sum([]byte(params["username"]+":"+params["realm"]+":"+password)))
+	ha2 := fmt.Sprintf("%x", md5.Sum([]byte(method+":"+uri)))
+	response := fmt.Sprintf("%x", md5.Sum([]byte(ha1+":"+params["nonce"]+":"+ha2)))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, params["username"], params["realm"], params["nonce"], uri, response)
+}
+
+// rtspMessageST is an RTSP request or response, or an interleaved frame
+type rtspMessageST struct {
+	interleaved bool
+	first       string
+	headers     [][2]string
+	body        []byte
+}
+
+func readRTSPMessage(reader *bufio.Reader) (*rtspMessageST, error) {
+	peek, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if peek[0] == '$' {
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(reader, header); err != nil {
+			return nil, err
+		}
+		_, err = reader.Discard(int(binary.BigEndian.Uint16(header[2:])))
+		return &rtspMessageST{interleaved: true}, err
+	}
+	msg := &rtspMessageST{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if msg.first == "" {
+				// Stray line breaks between messages
+				continue
+			}
+			break
+		}
+		if msg.first == "" {
+			msg.first = line
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, ErrorTransportMalformed
+		}
+		msg.headers = append(msg.headers, [2]string{strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])})
+	}
+	if length, _ := strconv.Atoi(msg.get("Content-Length")); length > 0 {
+		msg.body = make([]byte, length)
+		if _, err = io.ReadFull(reader, msg.body); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func (element *rtspMessageST) requestLine() (method, uri, proto string, ok bool) {
+	parts := strings.Fields(element.first)
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// get returns a header, names are matched case-insensitively
+func (element *rtspMessageST) get(name string) string {
+	for _, header := range element.headers {
+		if strings.EqualFold(header[0], name) {
+			return header[1]
+		}
+	}
+	return ""
+}
+
+func (element *rtspMessageST) set(name, value string) {
+	for i, header := range element.headers {
+		if strings.EqualFold(header[0], name) {
+			element.headers[i][1] = value
+			return
+		}
+	}
+	element.headers = append(element.headers, [2]string{name, value})
+}
+
+func (element *rtspMessageST) bytes() []byte {
+	var builder strings.Builder
+	builder.WriteString(element.first + "\r\n")
+	for _, header := range element.headers {
+		builder.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+	builder.WriteString("\r\n")
+	builder.Write(element.body)
+	return []byte(builder.String())
+}
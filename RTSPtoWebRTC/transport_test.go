@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/deepch/RTSPtoWebRTC/fixtures/rtspserver"
+	"github.com/deepch/vdk/format/rtspv2"
+)
+
+var testTransportTimeouts = streamTimeoutsST{Keyframe: 5 * time.Second, ViewerCheck: 5 * time.Second, Dial: 2 * time.Second, ReadWrite: 2 * time.Second}
+
+// testFixture starts the fixture camera on loopback ports and returns the
+// stream URL for a transport
+func testFixture(t *testing.T) (*rtspserver.ServerST, func(transport string) string) {
+	t.Helper()
+	// A free port for the group, a fixed one would collect the packets of
+	// another fixture
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	server := rtspserver.New(rtspserver.OptionsST{Multicast: "239.255.42.42:" + strconv.Itoa(port), FPS: 50})
+	t.Cleanup(server.Close)
+	rtspAddr, err := server.ListenRTSP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr, err := server.ListenHTTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, func(transport string) string {
+		if transport == TransportHTTP {
+			return "rtsp://" + httpAddr.String() + "/fixture"
+		}
+		return "rtsp://" + rtspAddr.String() + "/fixture"
+	}
+}
+
+// testKeyframe waits for the first video keyframe of a client
+func testKeyframe(t *testing.T, client *rtspv2.RTSPClient) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case packet := <-client.OutgoingPacketQueue:
+			if packet.IsKeyFrame && len(packet.Data) > 0 {
+				return
+			}
+		case signal := <-client.Signals:
+			if signal == rtspv2.SignalStreamRTPStop {
+				t.Fatal("stream stopped before a keyframe")
+			}
+		case <-timeout:
+			t.Fatal("no keyframe arrived")
+		}
+	}
+}
+
+func TestTransportBridge(t *testing.T) {
+	tests := []struct {
+		transport string
+		// udp ports the bridge opens for the video track
+		ports int
+	}{
+		{TransportTCP, 0},
+		{TransportUDP, 2},
+		{TransportMulticast, 1},
+		{TransportHTTP, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.transport, func(t *testing.T) {
+			server, streamURL := testFixture(t)
+			client, bridge, err := dialCamera(streamURL(test.transport), test.transport, testTransportTimeouts, true, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(client.CodecData) != 1 || !client.CodecData[0].Type().IsVideo() {
+				t.Errorf("codecs %v", client.CodecData)
+			}
+			testKeyframe(t, client)
+			if n := server.Sessions(); n != 1 {
+				t.Fatalf("fixture serves %d sessions", n)
+			}
+			if test.transport == TransportTCP {
+				if bridge != nil {
+					t.Error("tcp dialed through a bridge")
+				}
+				client.Close()
+				if !waitFor(t, 2*time.Second, func() bool { return server.Sessions() == 0 }) {
+					t.Error("fixture session still open")
+				}
+				return
+			}
+			if bridge == nil {
+				t.Fatal("no bridge")
+			}
+
+			bridge.mutex.Lock()
+			closers := append([]io.Closer(nil), bridge.closers...)
+			bridge.mutex.Unlock()
+			ports := 0
+			for _, closer := range closers {
+				if _, ok := closer.(*net.UDPConn); ok {
+					ports++
+				}
+			}
+			if ports != test.ports {
+				t.Errorf("bridge opened %d udp ports, want %d", ports, test.ports)
+			}
+
+			// The worker closes the client and then the bridge when its
+			// context is cancelled
+			client.Close()
+			bridge.Close()
+			if !waitFor(t, 2*time.Second, func() bool { return server.Sessions() == 0 }) {
+				t.Error("fixture session still open after the bridge closed")
+			}
+			if conn, err := net.DialTimeout("tcp", bridge.listener.Addr().String(), time.Second); err == nil {
+				conn.Close()
+				t.Error("bridge still accepts clients")
+			}
+			for _, closer := range closers {
+				if err := closer.(net.Conn).SetDeadline(time.Time{}); err == nil {
+					t.Errorf("%T %v left open", closer, closer.(net.Conn).LocalAddr())
+				}
+			}
+		})
+	}
+}
+
+// Cancelling a worker on a bridged transport ends the session at the camera
+func TestRTSPWorkerBridgeCancel(t *testing.T) {
+	server, streamURL := testFixture(t)
+	cfg := testConfig(t, map[string]StreamST{"cam": {URL: streamURL(TransportUDP), Transport: TransportUDP, DisableAudio: true}})
+	cfg.Server.Timeouts = TimeoutsST{Dial: 2, ReadWrite: 2}
+	testEvents(t)
+	cam, _ := testStream(cfg, "cam")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- RTSPWorker(ctx, "cam", cam.URL, false, true, false)
+	}()
+	if !waitFor(t, 5*time.Second, func() bool { return cam.hub.Stats().Keyframes > 0 }) {
+		cancel()
+		t.Fatalf("no keyframe relayed: %v", <-done)
+	}
+	if n := server.Sessions(); n != 1 {
+		t.Errorf("fixture serves %d sessions", n)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != ErrorStreamExitStopped {
+			t.Errorf("worker ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker ignored the cancel")
+	}
+	if !waitFor(t, 2*time.Second, func() bool { return server.Sessions() == 0 }) {
+		t.Error("fixture session still open after the worker stopped")
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// RoleAdmin manages users and streams and sees every stream
+	RoleAdmin = "admin"
+	// RoleOperator configures, records and exports the streams granted to it
+	RoleOperator = "operator"
+	// RoleViewer only watches live and recorded video of its streams
+	RoleViewer = "viewer"
+
+	// StreamGrantAll in UserST.Streams grants every stream
+	StreamGrantAll = "*"
+)
+
+var (
+	ErrorUserNotFound   = errors.New("user not found")
+	ErrorUserExists     = errors.New("user already exists")
+	ErrorUserBadRole    = errors.New("role must be admin, operator or viewer")
+	ErrorUserBadName    = errors.New("username or email is required")
+	ErrorUserLastAdmin  = errors.New("the last enabled admin cannot be removed, disabled or demoted")
+	ErrorUserForbidden  = errors.New("permission denied")
+	ErrorUserNoPassword = errors.New("password is required")
+)
+
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// normalizeRole accepts the capitalized names the UI uses
+func normalizeRole(role string) (string, error) {
+	role = strings.ToLower(strings.TrimSpace(role))
+	if _, ok := roleRank[role]; !ok {
+		return "", ErrorUserBadRole
+	}
+	return role, nil
+}
+
+// HasRole reports whether the user has at least the given role
+func (element UserST) HasRole(role string) bool {
+	return roleRank[element.Role] >= roleRank[role]
+}
+
+func (element UserST) CanStream(uuid string) bool {
+	if element.Role == RoleAdmin {
+		return true
+	}
+	for _, grant := range element.Streams {
+		if grant == StreamGrantAll || grant == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+func currentUser(c *gin.Context) UserST {
+	if user, ok := c.Get(authAccountKey); ok {
+		return user.(UserST)
+	}
+	return UserST{}
+}
+
+// canStream checks the current user against a stream and answers 403 if
+// the check fails
+func canStream(c *gin.Context, uuid, role string) bool {
+	user := currentUser(c)
+	if user.HasRole(role) && user.CanStream(uuid) {
+		return true
+	}
+	log.Println("User", c.GetString(authUserKey), "denied", role, "access to stream", uuid)
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": ErrorUserForbidden.Error()})
+	return false
+}
+
+// RequireRole rejects users below role
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentUser(c).HasRole(role) {
+			log.Println("User", c.GetString(authUserKey), "denied", c.Request.Method, c.FullPath())
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": ErrorUserForbidden.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// StreamAccess guards routes with a :uuid stream parameter, the user needs
+// role and a grant for that stream
+func StreamAccess(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !canStream(c, c.Param("uuid"), role) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// UserInfoST is the API view of a user, without the password hash
+type UserInfoST struct {
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	Streams  []string  `json:"streams"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+}
+
+func userInfo(username string, user UserST) UserInfoST {
+	streams := user.Streams
+	if streams == nil {
+		streams = []string{}
+	}
+	return UserInfoST{
+		Username: username,
+		Name:     user.Name,
+		Email:    user.Email,
+		Role:     user.Role,
+		Streams:  streams,
+		Disabled: user.Disabled,
+		Created:  user.Created,
+	}
+}
+
+func (element *UsersST) list() []UserInfoST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	res := make([]UserInfoST, 0, len(element.Users))
+	for username, user := range element.Users {
+		res = append(res, userInfo(username, user))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Username < res[j].Username
+	})
+	return res
+}
+
+func (element *UsersST) info(username string) (UserInfoST, bool) {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	user, ok := element.Users[username]
+	if !ok {
+		return UserInfoST{}, false
+	}
+	return userInfo(username, user), true
+}
+
+// adminsLeft counts the enabled admins other than username, the caller
+// holds the mutex
+func (element *UsersST) adminsLeft(username string) int {
+	count := 0
+	for name, user := range element.Users {
+		if name != username && user.Role == RoleAdmin && !user.Disabled {
+			count++
+		}
+	}
+	return count
+}
+
+// put creates or replaces an account. update is applied to the stored user
+// under the lock; an empty password keeps the current one.
+func (element *UsersST) put(username, password string, create bool, update func(*UserST)) (UserInfoST, error) {
+	var hash []byte
+	if password != "" {
+		if len(password) < 8 {
+			return UserInfoST{}, ErrorAuthWeakPassword
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return UserInfoST{}, err
+		}
+	} else if create {
+		return UserInfoST{}, ErrorUserNoPassword
+	}
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	user, ok := element.Users[username]
+	if create && ok {
+		return UserInfoST{}, ErrorUserExists
+	} else if !create && !ok {
+		return UserInfoST{}, ErrorUserNotFound
+	}
+	if create {
+		user.Created = time.Now()
+	}
+	update(&user)
+	if hash != nil {
+		user.PasswordHash = string(hash)
+	}
+	if (user.Role != RoleAdmin || user.Disabled) && ok && element.Users[username].Role == RoleAdmin && element.adminsLeft(username) == 0 {
+		return UserInfoST{}, ErrorUserLastAdmin
+	}
+	element.Users[username] = user
+	if err := element.save(); err != nil {
+		return UserInfoST{}, err
+	}
+	return userInfo(username, user), nil
+}
+
+func (element *UsersST) remove(username string) error {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	user, ok := element.Users[username]
+	if !ok {
+		return ErrorUserNotFound
+	}
+	if user.Role == RoleAdmin && element.adminsLeft(username) == 0 {
+		return ErrorUserLastAdmin
+	}
+	delete(element.Users, username)
+	return element.save()
+}
+
+// UserRequestST is the body of user create and update requests
+type UserRequestST struct {
+	Username string   `json:"username"`
+	Name     string   `json:"name"`
+	Email    string   `json:"email"`
+	Role     string   `json:"role"`
+	Password string   `json:"password"`
+	Streams  []string `json:"streams"`
+	Disabled bool     `json:"disabled"`
+}
+
+func userError(c *gin.Context, err error) {
+	switch err {
+	case ErrorUserNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case ErrorUserExists, ErrorUserLastAdmin:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case ErrorAuthWeakPassword, ErrorUserNoPassword, ErrorUserBadRole, ErrorUserBadName:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Println("Failed to save users file:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
+	}
+}
+
+func HTTPAPIServerUsers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"users": Users.list()})
+}
+
+func HTTPAPIServerUser(c *gin.Context) {
+	user, ok := Users.info(c.Param("username"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrorUserNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// HTTPAPIAddUser creates an account. The username defaults to the email so
+// the CreateUserModal form can be posted as is.
+func HTTPAPIAddUser(c *gin.Context) {
+	var request UserRequestST
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	username := strings.TrimSpace(request.Username)
+	if username == "" {
+		username = strings.TrimSpace(request.Email)
+	}
+	if username == "" {
+		userError(c, ErrorUserBadName)
+		return
+	}
+	role, err := normalizeRole(request.Role)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	user, err := Users.put(username, request.Password, true, func(user *UserST) {
+		user.Name = request.Name
+		user.Email = request.Email
+		user.Role = role
+		user.Streams = request.Streams
+		user.Disabled = request.Disabled
+	})
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	log.Println("User", c.GetString(authUserKey), "created user", username, "with role", role)
+	auditRequest(c, AuditUserAdd, username, "", auditDiff(nil, user))
+	c.JSON(http.StatusCreated, user)
+}
+
+// HTTPAPIUpdateUser replaces name, email, role, grants and status. The
+// password is only changed when one is sent. Sessions of the user end so
+// the new permissions apply at once.
+func HTTPAPIUpdateUser(c *gin.Context) {
+	username := c.Param("username")
+	var request UserRequestST
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	role, err := normalizeRole(request.Role)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	before, _ := Users.info(username)
+	user, err := Users.put(username, request.Password, false, func(user *UserST) {
+		user.Name = request.Name
+		user.Email = request.Email
+		user.Role = role
+		user.Streams = request.Streams
+		user.Disabled = request.Disabled
+	})
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	Sessions.revokeUser(username)
+	log.Println("User", c.GetString(authUserKey), "updated user", username)
+	detail := ""
+	if request.Password != "" {
+		detail = "password reset"
+	}
+	auditRequest(c, AuditUserUpdate, username, detail, auditDiff(before, user))
+	c.JSON(http.StatusOK, user)
+}
+
+func HTTPAPIDeleteUser(c *gin.Context) {
+	username := c.Param("username")
+	before, _ := Users.info(username)
+	if err := Users.remove(username); err != nil {
+		userError(c, err)
+		return
+	}
+	Sessions.revokeUser(username)
+	log.Println("User", c.GetString(authUserKey), "deleted user", username)
+	auditRequest(c, AuditUserDelete, username, "", auditDiff(before, nil))
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+}
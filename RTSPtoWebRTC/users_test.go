@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testRBAC sets up two streams and one user per role, the operator and the
+// viewer are granted cam1 only. It returns the router and a token per user.
+func testRBAC(t *testing.T) (*gin.Engine, map[string]string) {
+	t.Helper()
+	testConfig(t, map[string]StreamST{
+		"cam1": {URL: "rtsp://cam1", OnDemand: true},
+		"cam2": {URL: "rtsp://cam2", OnDemand: true},
+	})
+	users := map[string]UserST{
+		"admin":    {Role: RoleAdmin},
+		"operator": {Role: RoleOperator, Streams: []string{"cam1"}},
+		"viewer":   {Role: RoleViewer, Streams: []string{"cam1"}},
+		"all":      {Role: RoleViewer, Streams: []string{StreamGrantAll}},
+	}
+	testUsers(t, users)
+	tokens := make(map[string]string)
+	for username := range users {
+		tokens[username] = Sessions.create(username).AccessToken
+	}
+	t.Cleanup(func() {
+		for username := range users {
+			Sessions.revokeUser(username)
+		}
+	})
+	return newRouter(), tokens
+}
+
+// testEvents opens a scratch events database for the duration of a test
+func testEvents(t *testing.T) {
+	t.Helper()
+	Config.Server.EventsPath = filepath.Join(t.TempDir(), "events.db")
+	old := Events.db
+	loadEvents()
+	t.Cleanup(func() {
+		Events.db.Close()
+		Events.db = old
+	})
+}
+
+func testRequest(router *gin.Engine, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRBACRoleMatrix(t *testing.T) {
+	router, tokens := testRBAC(t)
+	const ok, forbidden = http.StatusOK, http.StatusForbidden
+	tests := []struct {
+		method string
+		path   string
+		want   map[string]int
+	}{
+		{http.MethodGet, "/api/streams", map[string]int{"admin": ok, "operator": ok, "viewer": ok}},
+		{http.MethodGet, "/api/users", map[string]int{"admin": ok, "operator": forbidden, "viewer": forbidden}},
+		{http.MethodGet, "/metrics", map[string]int{"admin": ok, "operator": forbidden, "viewer": forbidden}},
+		{http.MethodGet, "/api/webhooks", map[string]int{"admin": ok, "operator": forbidden, "viewer": forbidden}},
+		{http.MethodGet, "/api/storage", map[string]int{"admin": ok, "operator": ok, "viewer": forbidden}},
+		{http.MethodGet, "/api/exports", map[string]int{"admin": ok, "operator": ok, "viewer": forbidden}},
+		{http.MethodGet, "/stream/info/cam1", map[string]int{"admin": ok, "operator": ok, "viewer": ok}},
+		{http.MethodGet, "/api/stream/cam1/viewers", map[string]int{"admin": ok, "operator": ok, "viewer": forbidden}},
+		{http.MethodDelete, "/api/stream/cam1", map[string]int{"operator": forbidden, "viewer": forbidden}},
+		{http.MethodPost, "/api/streams", map[string]int{"operator": forbidden, "viewer": forbidden}},
+	}
+	for _, test := range tests {
+		for username, want := range test.want {
+			if w := testRequest(router, test.method, test.path, tokens[username]); w.Code != want {
+				t.Errorf("%s %s as %s: status %d, want %d", test.method, test.path, username, w.Code, want)
+			}
+		}
+		if w := testRequest(router, test.method, test.path, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without token: status %d", test.method, test.path, w.Code)
+		}
+	}
+}
+
+func TestRBACStreamGrants(t *testing.T) {
+	router, tokens := testRBAC(t)
+	tests := []struct {
+		username string
+		path     string
+		want     int
+	}{
+		{"admin", "/stream/info/cam2", http.StatusOK},
+		{"all", "/stream/info/cam2", http.StatusOK},
+		{"viewer", "/stream/info/cam1", http.StatusOK},
+		{"viewer", "/stream/info/cam2", http.StatusForbidden},
+		{"viewer", "/api/playback/cam2/ranges", http.StatusForbidden},
+		{"operator", "/api/stream/cam1/viewers", http.StatusOK},
+		{"operator", "/api/stream/cam2/viewers", http.StatusForbidden},
+		// A grant to every stream does not raise the role
+		{"all", "/api/stream/cam2/viewers", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if w := testRequest(router, http.MethodGet, test.path, tokens[test.username]); w.Code != test.want {
+			t.Errorf("%s as %s: status %d, want %d", test.path, test.username, w.Code, test.want)
+		}
+	}
+
+	for username, want := range map[string]string{"admin": "cam1,cam2", "all": "cam1,cam2", "viewer": "cam1"} {
+		w := testRequest(router, http.MethodGet, "/api/streams", tokens[username])
+		var res struct {
+			Streams map[string]json.RawMessage `json:"streams"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for uuid := range res.Streams {
+			got = append(got, uuid)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != want {
+			t.Errorf("streams of %s: %v, want %s", username, got, want)
+		}
+	}
+}
+
+func TestRBACExportList(t *testing.T) {
+	router, tokens := testRBAC(t)
+	var ids []string
+	for _, stream := range []string{"cam1", "cam2"} {
+		ids = append(ids, Exports.add(stream, time.Now().Add(-time.Minute), time.Now()).ID)
+	}
+	t.Cleanup(func() {
+		Exports.mutex.Lock()
+		for _, id := range ids {
+			delete(Exports.jobs, id)
+		}
+		Exports.mutex.Unlock()
+	})
+	for username, want := range map[string]int{"admin": 2, "operator": 1} {
+		var res struct {
+			Exports []ExportST `json:"exports"`
+		}
+		w := testRequest(router, http.MethodGet, "/api/exports", tokens[username])
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Exports) != want {
+			t.Errorf("%s sees %d exports, want %d", username, len(res.Exports), want)
+		}
+		for _, job := range res.Exports {
+			if username == "operator" && job.Stream != "cam1" {
+				t.Errorf("operator sees the export of %s", job.Stream)
+			}
+		}
+	}
+	if w := testRequest(router, http.MethodGet, "/api/exports/"+ids[1], tokens["operator"]); w.Code != http.StatusForbidden {
+		t.Errorf("operator fetched the export of cam2: status %d", w.Code)
+	}
+}
+
+func TestRBACTicketList(t *testing.T) {
+	router, tokens := testRBAC(t)
+	testEvents(t)
+	// The cam2 ticket was assigned before the operator lost the grant
+	var ids []string
+	for _, stream := range []string{"cam1", "cam2"} {
+		ticket, err := Tickets.Add(TicketST{Stream: stream, Name: "check " + stream, AssignedTo: "operator", AssignedFrom: "admin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, ticket.ID)
+	}
+	tests := []struct {
+		username string
+		view     string
+		want     int
+	}{
+		{"admin", TicketViewAll, 2},
+		{"admin", TicketViewSent, 2},
+		{"operator", TicketViewAll, 1},
+		{"operator", TicketViewInbox, 1},
+		{"viewer", TicketViewAll, 0},
+	}
+	for _, test := range tests {
+		var res struct {
+			Tickets []TicketST `json:"tickets"`
+		}
+		w := testRequest(router, http.MethodGet, "/api/tickets?view="+test.view, tokens[test.username])
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Tickets) != test.want {
+			t.Errorf("%s view %s: %d tickets, want %d", test.username, test.view, len(res.Tickets), test.want)
+		}
+		for _, ticket := range res.Tickets {
+			if test.username != "admin" && ticket.Stream != "cam1" {
+				t.Errorf("%s sees the ticket of %s", test.username, ticket.Stream)
+			}
+		}
+	}
+	if w := testRequest(router, http.MethodGet, "/api/tickets/"+ids[1], tokens["operator"]); w.Code != http.StatusNotFound {
+		t.Errorf("operator fetched the ticket of cam2: status %d", w.Code)
+	}
+}
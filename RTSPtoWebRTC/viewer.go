@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// SlowViewerKeyframe drops packets until the next keyframe
+	SlowViewerKeyframe = "keyframe"
+	// SlowViewerDisconnect closes the viewer after MaxDrops dropped packets
+	SlowViewerDisconnect = "disconnect"
+	// SlowViewerSubstream closes the viewer after MaxDrops dropped packets
+	// and tells it over the push channel to reconnect to the stream's
+	// substream. The WebRTC muxer is bound to the negotiated SPS/PPS, so
+	// switching needs a new session. Without a substream it disconnects.
+	SlowViewerSubstream = "substream"
+
+	defaultSlowViewerMaxDrops = 300
+
+	// ViewerIDHeader carries the viewer id of WebRTC answers sent as text
+	ViewerIDHeader = "X-Viewer-ID"
+)
+
+var (
+	ErrorSlowViewerBadPolicy   = errors.New("slow viewer policy must be keyframe, disconnect or substream")
+	ErrorSlowViewerBadMaxDrops = errors.New("slow viewer max drops must not be negative")
+	ErrorSubstreamUnknown      = errors.New("substream must be the id of another stream")
+)
+
+// SlowViewerST configures what happens when a viewer queue is full
+type SlowViewerST struct {
+	Policy   string `json:"policy"`
+	MaxDrops int    `json:"max_drops"`
+	// Substream is resolved from StreamST.Substream, it is not configured here
+	Substream string `json:"-"`
+}
+
+// ViewerStatsST is the API view of one subscriber
+type ViewerStatsST struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Created  time.Time `json:"created"`
+	Policy   string    `json:"policy"`
+	Sent     uint64    `json:"sent"`
+	Dropped  uint64    `json:"dropped"`
+	Queued   int       `json:"queued"`
+	Skipping bool      `json:"skipping"`
+}
+
+func (element SlowViewerST) Validate() error {
+	switch element.Policy {
+	case "", SlowViewerKeyframe, SlowViewerDisconnect, SlowViewerSubstream:
+	default:
+		return ErrorSlowViewerBadPolicy
+	}
+	if element.MaxDrops < 0 {
+		return ErrorSlowViewerBadMaxDrops
+	}
+	return nil
+}
+
+// validateSubstream checks the substream of stream uuid against streams
+func validateSubstream(uuid, substream string, streams map[string]StreamST) error {
+	if substream == "" {
+		return nil
+	}
+	if _, ok := streams[substream]; !ok || substream == uuid {
+		return ErrorSubstreamUnknown
+	}
+	return nil
+}
+
+// viewerDisconnected is called by a viewer once the hub closed its Done.
+// A viewer dropped for the substream is told where to reconnect.
+func viewerDisconnected(uuid string, sub *SubscriberST) {
+	log.Println("Client", sub.ID, "disconnected from stream", uuid, "reason", sub.Reason)
+	if sub.Reason == SlowViewerSubstream {
+		Push.substream(uuid, sub.ID, sub.Substream)
+	}
+}
+
+func (element SlowViewerST) MaxDropsOrDefault() int {
+	if element.MaxDrops <= 0 {
+		return defaultSlowViewerMaxDrops
+	}
+	return element.MaxDrops
+}
+
+// slowViewer resolves the policy of a stream, falling back to the server default
+func (element *ConfigST) slowViewer(uuid string) SlowViewerST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	policy := element.Server.SlowViewer
+	tmp, ok := element.Streams[uuid]
+	if ok && tmp.SlowViewer != nil {
+		policy = *tmp.SlowViewer
+	}
+	if policy.Policy == "" {
+		policy.Policy = SlowViewerKeyframe
+	}
+	if ok {
+		policy.Substream = tmp.Substream
+	}
+	return policy
+}
+
+func HTTPAPIServerStreamViewers(c *gin.Context) {
+	uuid := c.Param("uuid")
+	hub := Config.hub(uuid)
+	if hub == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	viewers := hub.Viewers()
+	sort.Slice(viewers, func(i, j int) bool {
+		return viewers[i].Created.Before(viewers[j].Created)
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"uuid":    uuid,
+		"policy":  Config.slowViewer(uuid),
+		"viewers": viewers,
+	})
+}
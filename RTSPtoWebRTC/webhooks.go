@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	WebhookStreamDown    = "stream.down"
+	WebhookStreamUp      = "stream.up"
+	WebhookAlertFired    = "alert.fired"
+	WebhookAlertResolved = "alert.resolved"
+	WebhookTest          = "webhook.test"
+
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+
+	// WebhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+	// request body keyed with the webhook secret
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+
+	defaultWebhookAttempts = 5
+	webhookTimeout         = 10 * time.Second
+	webhookBackoffFirst    = time.Second
+	webhookBackoffMax      = 5 * time.Minute
+	// webhookDeliveriesKept bounds the delivery log, older entries are dropped
+	webhookDeliveriesKept = 1000
+)
+
+var (
+	ErrorWebhookNotFound = errors.New("webhook not found")
+	ErrorWebhookNoURL    = errors.New("webhook url must be http or https")
+	ErrorWebhookNoName   = errors.New("webhook name is required and must be unique")
+)
+
+var webhookDeliveriesBucket = []byte("webhook_deliveries")
+
+// Webhooks global
+var Webhooks = &WebhooksST{
+	streams: make(map[string]bool),
+	client:  &http.Client{Timeout: webhookTimeout},
+	backoff: webhookBackoffFirst,
+}
+
+// WebhooksST posts notifications to the targets in ServerST.Webhooks and
+// logs every delivery in the events database
+type WebhooksST struct {
+	mutex sync.Mutex
+	// streams holds the last reported state, up or down, so a camera that
+	// keeps failing to connect is reported once
+	streams map[string]bool
+	client  *http.Client
+	// backoff is the wait after the first failed attempt
+	backoff time.Duration
+}
+
+// WebhookST is one target. Events lists the notification types it wants,
+// "alert.*" matches a prefix and an empty list matches everything.
+type WebhookST struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"`
+	Events      []string `json:"events"`
+	MaxAttempts int      `json:"max_attempts,omitempty"`
+	Disabled    bool     `json:"disabled,omitempty"`
+}
+
+// WebhookPayloadST is the signed JSON body
+type WebhookPayloadST struct {
+	ID     string      `json:"id"`
+	Type   string      `json:"type"`
+	Time   time.Time   `json:"time"`
+	Stream string      `json:"stream,omitempty"`
+	Data   interface{} `json:"data"`
+}
+
+// WebhookDeliveryST is one entry of the delivery log
+type WebhookDeliveryST struct {
+	ID         string     `json:"id"`
+	Webhook    string     `json:"webhook"`
+	Event      string     `json:"event"`
+	Stream     string     `json:"stream,omitempty"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	StatusCode int        `json:"status_code,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Created    time.Time  `json:"created"`
+	Updated    time.Time  `json:"updated"`
+	Delivered  *time.Time `json:"delivered,omitempty"`
+	NextTry    *time.Time `json:"next_try,omitempty"`
+}
+
+func (element WebhookST) Validate() error {
+	if element.Name == "" {
+		return ErrorWebhookNoName
+	}
+	if !strings.HasPrefix(element.URL, "http://") && !strings.HasPrefix(element.URL, "https://") {
+		return ErrorWebhookNoURL
+	}
+	return nil
+}
+
+func (element WebhookST) MaxAttemptsOrDefault() int {
+	if element.MaxAttempts > 0 {
+		return element.MaxAttempts
+	}
+	return defaultWebhookAttempts
+}
+
+func (element WebhookST) wants(kind string) bool {
+	if element.Disabled {
+		return false
+	}
+	if len(element.Events) == 0 {
+		return true
+	}
+	for _, filter := range element.Events {
+		if filter == kind || filter == "*" || (strings.HasSuffix(filter, ".*") && strings.HasPrefix(kind, strings.TrimSuffix(filter, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebhooks checks a webhook list as loaded from config.json
+func validateWebhooks(webhooks []WebhookST) error {
+	names := make(map[string]bool)
+	for _, webhook := range webhooks {
+		if err := webhook.Validate(); err != nil {
+			return fmt.Errorf("webhook %q: %w", webhook.Name, err)
+		}
+		if names[webhook.Name] {
+			return fmt.Errorf("webhook %q: %w", webhook.Name, ErrorWebhookNoName)
+		}
+		names[webhook.Name] = true
+	}
+	return nil
+}
+
+func (element *ConfigST) GetWebhooks() []WebhookST {
+	element.mutex.RLock()
+	defer element.mutex.RUnlock()
+	return append([]WebhookST(nil), element.Server.Webhooks...)
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// streamState reports a stream going up or down once per transition. A
+// stream that never connected is reported down on its first failure.
+func (element *WebhooksST) streamState(uuid string, up bool, reason error) {
+	element.mutex.Lock()
+	last, known := element.streams[uuid]
+	element.streams[uuid] = up
+	element.mutex.Unlock()
+	if known && last == up || !known && up {
+		return
+	}
+	if up {
+		element.Notify(WebhookStreamUp, uuid, gin.H{"name": streamName(uuid)})
+		return
+	}
+	element.Notify(WebhookStreamDown, uuid, gin.H{"name": streamName(uuid), "reason": reason.Error()})
+}
+
+// streamUp is called by RTSPWorker once the camera answered
+func (element *WebhooksST) streamUp(uuid string) {
+	element.streamState(uuid, true, nil)
+}
+
+// streamDown is called by RTSPWorkerLoop for errors that mean the camera
+// is unavailable; an on demand stream stopping for lack of viewers is not
+func (element *WebhooksST) streamDown(uuid string, err error) {
+	if err == ErrorStreamExitNoViewer || err == ErrorStreamExitNotFound {
+		return
+	}
+	element.streamState(uuid, false, err)
+}
+
+func streamName(uuid string) string {
+	Config.mutex.RLock()
+	defer Config.mutex.RUnlock()
+	if tmp, ok := Config.Streams[uuid]; ok {
+		return tmp.Name
+	}
+	return uuid
+}
+
+// Notify queues kind for every webhook that wants it and returns at once
+func (element *WebhooksST) Notify(kind, stream string, data interface{}) {
+	for _, webhook := range Config.GetWebhooks() {
+		if webhook.wants(kind) {
+			element.deliver(webhook, kind, stream, data)
+		}
+	}
+}
+
+// deliver logs a pending delivery and sends it in the background. The
+// returned copy is the delivery as queued.
+func (element *WebhooksST) deliver(webhook WebhookST, kind, stream string, data interface{}) (WebhookDeliveryST, bool) {
+	now := time.Now().UTC()
+	delivery := &WebhookDeliveryST{
+		Webhook: webhook.Name,
+		Event:   kind,
+		Stream:  stream,
+		Status:  WebhookDeliveryPending,
+		Created: now,
+		Updated: now,
+	}
+	if err := element.save(delivery); err != nil {
+		log.Println("Webhook delivery log error", err)
+		return WebhookDeliveryST{}, false
+	}
+	body, err := json.Marshal(WebhookPayloadST{ID: delivery.ID, Type: kind, Time: now, Stream: stream, Data: data})
+	if err != nil {
+		log.Println("Webhook payload error", err)
+		return WebhookDeliveryST{}, false
+	}
+	queued := *delivery
+	go element.send(webhook, delivery, body)
+	return queued, true
+}
+
+// send posts body until a 2xx answer or MaxAttempts, waiting twice as long
+// after every failure
+func (element *WebhooksST) send(webhook WebhookST, delivery *WebhookDeliveryST, body []byte) {
+	backoff := element.backoff
+	for delivery.Attempts < webhook.MaxAttemptsOrDefault() {
+		delivery.Attempts++
+		code, err := element.post(webhook, delivery, body)
+		delivery.StatusCode, delivery.Updated, delivery.NextTry = code, time.Now().UTC(), nil
+		if err == nil {
+			delivery.Status, delivery.Error = WebhookDeliveryDelivered, ""
+			delivery.Delivered = &delivery.Updated
+			element.save(delivery)
+			return
+		}
+		delivery.Error = err.Error()
+		if delivery.Attempts >= webhook.MaxAttemptsOrDefault() {
+			break
+		}
+		next := delivery.Updated.Add(backoff)
+		delivery.NextTry = &next
+		element.save(delivery)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > webhookBackoffMax {
+			backoff = webhookBackoffMax
+		}
+	}
+	delivery.Status = WebhookDeliveryFailed
+	log.Println("Webhook", webhook.Name, "gave up on", delivery.Event, "delivery", delivery.ID, "after", delivery.Attempts, "attempts:", delivery.Error)
+	element.save(delivery)
+}
+
+func (element *WebhooksST) post(webhook WebhookST, delivery *WebhookDeliveryST, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, delivery.Event)
+	request.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	if webhook.Secret != "" {
+		request.Header.Set(WebhookSignatureHeader, webhookSignature(webhook.Secret, body))
+	}
+	response, err := element.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// save stores a delivery, assigning its id the first time, and trims the
+// log to webhookDeliveriesKept entries
+func (element *WebhooksST) save(delivery *WebhookDeliveryST) error {
+	if Events.db == nil {
+		return nil
+	}
+	return Events.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(webhookDeliveriesBucket)
+		var id uint64
+		if delivery.ID == "" {
+			var err error
+			if id, err = bucket.NextSequence(); err != nil {
+				return err
+			}
+			delivery.ID = strconv.FormatUint(id, 10)
+			if id > webhookDeliveriesKept {
+				bucket.Delete(eventKey(id - webhookDeliveriesKept))
+			}
+		} else if id, err := strconv.ParseUint(delivery.ID, 10, 64); err == nil {
+			if bucket.Get(eventKey(id)) == nil {
+				// Trimmed while retrying
+				return nil
+			}
+		}
+		key, _ := eventKeyFromID(delivery.ID)
+		data, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+}
+
+// webhookInfo hides the secret of a webhook from the API
+func webhookInfo(webhook WebhookST) gin.H {
+	events := webhook.Events
+	if events == nil {
+		events = []string{}
+	}
+	return gin.H{
+		"name":         webhook.Name,
+		"url":          webhook.URL,
+		"events":       events,
+		"signed":       webhook.Secret != "",
+		"max_attempts": webhook.MaxAttemptsOrDefault(),
+		"disabled":     webhook.Disabled,
+	}
+}
+
+func HTTPAPIServerWebhooks(c *gin.Context) {
+	webhooks := Config.GetWebhooks()
+	res := make([]gin.H, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		res = append(res, webhookInfo(webhook))
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": res})
+}
+
+// HTTPAPIServerWebhookDeliveries pages the delivery log newest first,
+// filtered by webhook, event and status
+func HTTPAPIServerWebhookDeliveries(c *gin.Context) {
+	webhook, event, status := c.Query("webhook"), c.Query("event"), c.Query("status")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(eventsPageSize)))
+	if err != nil || limit <= 0 || limit > webhookDeliveriesKept {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(webhookDeliveriesKept)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+		return
+	}
+	res := make([]WebhookDeliveryST, 0, limit)
+	total := 0
+	err = Events.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(webhookDeliveriesBucket).Cursor()
+		for key, data := cursor.Last(); key != nil; key, data = cursor.Prev() {
+			var delivery WebhookDeliveryST
+			if err := json.Unmarshal(data, &delivery); err != nil ||
+				(webhook != "" && delivery.Webhook != webhook) ||
+				(event != "" && delivery.Event != event) ||
+				(status != "" && delivery.Status != status) {
+				continue
+			}
+			if total >= offset && len(res) < limit {
+				res = append(res, delivery)
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Webhook delivery log error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read delivery log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":      total,
+		"offset":     offset,
+		"limit":      limit,
+		"deliveries": res,
+	})
+}
+
+// HTTPAPITestWebhook sends a webhook.test notification to one target,
+// whatever its event filter
+func HTTPAPITestWebhook(c *gin.Context) {
+	name := c.Param("name")
+	for _, webhook := range Config.GetWebhooks() {
+		if webhook.Name != name {
+			continue
+		}
+		delivery, ok := Webhooks.deliver(webhook, WebhookTest, "", gin.H{"actor": c.GetString(authUserKey)})
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue delivery"})
+			return
+		}
+		c.JSON(http.StatusAccepted, delivery)
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": ErrorWebhookNotFound.Error()})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testWebhookServer records the requests it gets and answers them with the
+// next of codes, the last code repeats
+type testWebhookServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	codes    []int
+	requests []testWebhookRequest
+}
+
+type testWebhookRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+func newTestWebhookServer(t *testing.T, codes ...int) *testWebhookServer {
+	server := &testWebhookServer{codes: codes}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		server.mutex.Lock()
+		code := http.StatusOK
+		if n := len(server.requests); n < len(server.codes) {
+			code = server.codes[n]
+		} else if len(server.codes) > 0 {
+			code = server.codes[len(server.codes)-1]
+		}
+		server.requests = append(server.requests, testWebhookRequest{path: r.URL.Path, header: r.Header, body: body, at: time.Now()})
+		server.mutex.Unlock()
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (element *testWebhookServer) received() []testWebhookRequest {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	return append([]testWebhookRequest(nil), element.requests...)
+}
+
+func testWebhooks(server *testWebhookServer, backoff time.Duration) *WebhooksST {
+	return &WebhooksST{streams: make(map[string]bool), client: server.Client(), backoff: backoff}
+}
+
+func testWebhookDelivery(t *testing.T, id string) WebhookDeliveryST {
+	t.Helper()
+	var delivery WebhookDeliveryST
+	key, _ := eventKeyFromID(id)
+	err := Events.db.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket(webhookDeliveriesBucket).Get(key), &delivery)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// HMAC-SHA256 test vector
+	got := webhookSignature("key", []byte("The quick brown fox jumps over the lazy dog"))
+	if want := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"; got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+}
+
+func TestWebhookSignedDelivery(t *testing.T) {
+	testConfig(t, nil)
+	testEvents(t)
+	server := newTestWebhookServer(t)
+	webhooks := testWebhooks(server, time.Millisecond)
+	delivery, ok := webhooks.deliver(WebhookST{Name: "signed", URL: server.URL, Secret: "s3cret"}, WebhookStreamDown, "cam", gin.H{"reason": "timeout"})
+	if !ok {
+		t.Fatal("delivery not queued")
+	}
+	waitFor(t, 2*time.Second, func() bool { return len(server.received()) == 1 })
+	requests := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	request := requests[0]
+	if got, want := request.header.Get(WebhookSignatureHeader), webhookSignature("s3cret", request.body); got != want {
+		t.Errorf("signature header %q, want %q", got, want)
+	}
+	if request.header.Get(WebhookEventHeader) != WebhookStreamDown || request.header.Get(WebhookDeliveryHeader) != delivery.ID {
+		t.Errorf("headers %v", request.header)
+	}
+	var payload WebhookPayloadST
+	if err := json.Unmarshal(request.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != delivery.ID || payload.Type != WebhookStreamDown || payload.Stream != "cam" {
+		t.Errorf("payload %+v", payload)
+	}
+
+	// Without a secret nothing is signed
+	webhooks.deliver(WebhookST{Name: "plain", URL: server.URL}, WebhookTest, "", nil)
+	waitFor(t, 2*time.Second, func() bool { return len(server.received()) == 2 })
+	if sig := server.received()[1].header.Get(WebhookSignatureHeader); sig != "" {
+		t.Errorf("unsigned webhook sent signature %q", sig)
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	tests := []struct {
+		webhook WebhookST
+		kind    string
+		want    bool
+	}{
+		{WebhookST{}, WebhookStreamDown, true},
+		{WebhookST{Disabled: true}, WebhookStreamDown, false},
+		{WebhookST{Events: []string{"*"}}, WebhookAlertFired, true},
+		{WebhookST{Events: []string{WebhookStreamDown}}, WebhookStreamDown, true},
+		{WebhookST{Events: []string{WebhookStreamDown}}, WebhookStreamUp, false},
+		{WebhookST{Events: []string{"alert.*"}}, WebhookAlertResolved, true},
+		{WebhookST{Events: []string{"alert.*"}}, WebhookStreamDown, false},
+		// The prefix ends at the dot
+		{WebhookST{Events: []string{"stream.*"}}, "streaming.up", false},
+	}
+	for _, test := range tests {
+		if got := test.webhook.wants(test.kind); got != test.want {
+			t.Errorf("%v disabled %v wants %s = %v, want %v", test.webhook.Events, test.webhook.Disabled, test.kind, got, test.want)
+		}
+	}
+}
+
+func TestWebhookNotifyFilter(t *testing.T) {
+	cfg := testConfig(t, nil)
+	testEvents(t)
+	server := newTestWebhookServer(t)
+	cfg.Server.Webhooks = []WebhookST{
+		{Name: "alerts", URL: server.URL + "/alerts", Events: []string{"alert.*"}},
+		{Name: "down", URL: server.URL + "/down", Events: []string{WebhookStreamDown}},
+		{Name: "off", URL: server.URL + "/off", Disabled: true},
+		{Name: "all", URL: server.URL + "/all"},
+	}
+	webhooks := testWebhooks(server, time.Millisecond)
+	webhooks.Notify(WebhookAlertFired, "cam", nil)
+	waitFor(t, 2*time.Second, func() bool { return len(server.received()) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	paths := make(map[string]bool)
+	for _, request := range server.received() {
+		paths[request.path] = true
+	}
+	if len(paths) != 2 || !paths["/alerts"] || !paths["/all"] {
+		t.Errorf("alert.fired posted to %v, want /alerts and /all", paths)
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	testConfig(t, nil)
+	testEvents(t)
+	const backoff = 30 * time.Millisecond
+	server := newTestWebhookServer(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusNoContent)
+	webhooks := testWebhooks(server, backoff)
+	queued, ok := webhooks.deliver(WebhookST{Name: "flaky", URL: server.URL}, WebhookStreamUp, "cam", nil)
+	if !ok || queued.Status != WebhookDeliveryPending {
+		t.Fatalf("queued %+v", queued)
+	}
+	if !waitFor(t, 2*time.Second, func() bool { return testWebhookDelivery(t, queued.ID).Status == WebhookDeliveryDelivered }) {
+		t.Fatalf("not delivered: %+v", testWebhookDelivery(t, queued.ID))
+	}
+	delivery := testWebhookDelivery(t, queued.ID)
+	if delivery.Attempts != 3 || delivery.StatusCode != http.StatusNoContent || delivery.Error != "" || delivery.Delivered == nil || delivery.NextTry != nil {
+		t.Errorf("delivery %+v", delivery)
+	}
+	requests := server.received()
+	if len(requests) != 3 {
+		t.Fatalf("%d requests, want 3", len(requests))
+	}
+	// The wait doubles after every failure
+	if gap := requests[1].at.Sub(requests[0].at); gap < backoff {
+		t.Errorf("first retry after %v, want %v", gap, backoff)
+	}
+	if gap := requests[2].at.Sub(requests[1].at); gap < 2*backoff {
+		t.Errorf("second retry after %v, want %v", gap, 2*backoff)
+	}
+	for _, request := range requests[1:] {
+		if request.header.Get(WebhookDeliveryHeader) != queued.ID {
+			t.Error("retry sent with another delivery id")
+		}
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	testConfig(t, nil)
+	testEvents(t)
+	server := newTestWebhookServer(t, http.StatusServiceUnavailable)
+	webhooks := testWebhooks(server, time.Millisecond)
+	queued, _ := webhooks.deliver(WebhookST{Name: "down", URL: server.URL, MaxAttempts: 3}, WebhookStreamDown, "cam", nil)
+	if !waitFor(t, 2*time.Second, func() bool { return testWebhookDelivery(t, queued.ID).Status == WebhookDeliveryFailed }) {
+		t.Fatalf("not failed: %+v", testWebhookDelivery(t, queued.ID))
+	}
+	delivery := testWebhookDelivery(t, queued.ID)
+	if delivery.Attempts != 3 || delivery.StatusCode != http.StatusServiceUnavailable || delivery.Error == "" || delivery.Delivered != nil {
+		t.Errorf("delivery %+v", delivery)
+	}
+	if n := len(server.received()); n != 3 {
+		t.Errorf("%d requests, want MaxAttempts 3", n)
+	}
+}
@@ -2,7 +2,7 @@ import React, { useState, useEffect } from 'react';
 import { BrowserRouter, Routes, Route, Navigate } from 'react-router-dom';
 import Login from './components/Login';
 import MainPage from './pages/MainPage';
-import { authenticate } from './api/auth';
+import { restoreSession } from './api/auth';
 import EventLogs from './pages/EventLogs';
 import Sidebar from './components/Sidebar';
 import Navbar from './components/Navbar';
@@ -14,7 +14,7 @@ const App: React.FC = () => {
     console.log('App component mounted');
     const checkAuth = async () => {
       try {
-        const response = await authenticate({ username: '', password: '' });
+        const response = await restoreSession();
         setIsAuthenticated(response.success);
       } catch {
         setIsAuthenticated(false);
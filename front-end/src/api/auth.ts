@@ -1,11 +1,107 @@
+import axios, { AxiosError, InternalAxiosRequestConfig } from 'axios';
+
+const API_BASE_URL = 'http://localhost:8083/api';
+const SESSION_KEY = 'vms_session';
+
+interface Session {
+  username: string;
+  token: string;
+  refresh_token: string;
+}
+
+const loadSession = (): Session | null => {
+  try {
+    const raw = localStorage.getItem(SESSION_KEY);
+    return raw ? JSON.parse(raw) : null;
+  } catch {
+    return null;
+  }
+};
+
+const storeSession = (session: Session | null) => {
+  if (session) {
+    localStorage.setItem(SESSION_KEY, JSON.stringify(session));
+  } else {
+    localStorage.removeItem(SESSION_KEY);
+  }
+};
+
+export const getToken = (): string | null => loadSession()?.token ?? null;
+
+// Attach the access token to every request to the backend
+axios.interceptors.request.use((config) => {
+  const token = getToken();
+  if (token && !config.headers.Authorization) {
+    config.headers.Authorization = `Bearer ${token}`;
+  }
+  return config;
+});
+
+// On 401 trade the refresh token for a new session once, then retry
+let refreshing: Promise<boolean> | null = null;
+
+const refreshSession = async (): Promise<boolean> => {
+  const session = loadSession();
+  if (!session) return false;
+  try {
+    const response = await axios.post(
+      `${API_BASE_URL}/auth/refresh`,
+      { refresh_token: session.refresh_token }
+    );
+    storeSession(response.data);
+    return true;
+  } catch {
+    storeSession(null);
+    return false;
+  }
+};
+
+axios.interceptors.response.use(undefined, async (error: AxiosError) => {
+  const config = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined;
+  if (error.response?.status !== 401 || !config || config._retried || /\/auth\/(login|refresh)$/.test(config.url ?? '')) {
+    throw error;
+  }
+  config._retried = true;
+  refreshing = refreshing || refreshSession().finally(() => (refreshing = null));
+  if (!(await refreshing)) {
+    throw error;
+  }
+  config.headers.Authorization = `Bearer ${getToken()}`;
+  return axios(config);
+});
+
 export const authenticate = async (credentials: {
   username: string;
   password: string;
 }): Promise<{ success: boolean }> => {
-  // Mock API call (replace with actual endpoint)
-  return new Promise((resolve) => {
-    setTimeout(() => {
-      resolve({ success: credentials.username === 'admin' && credentials.password === 'password' });
-    }, 500);
-  });
-};
\ No newline at end of file
+  try {
+    const response = await axios.post(`${API_BASE_URL}/auth/login`, credentials);
+    storeSession(response.data);
+    return { success: true };
+  } catch (error) {
+    if ((error as AxiosError).response?.status === 401) {
+      return { success: false };
+    }
+    throw error;
+  }
+};
+
+// restoreSession checks whether a stored session is still accepted
+export const restoreSession = async (): Promise<{ success: boolean }> => {
+  if (!loadSession()) return { success: false };
+  try {
+    await axios.get(`${API_BASE_URL}/auth/me`);
+    return { success: true };
+  } catch {
+    return { success: false };
+  }
+};
+
+export const logout = async (): Promise<void> => {
+  try {
+    await axios.post(`${API_BASE_URL}/auth/logout`);
+  } catch {
+    // The session is dropped locally either way
+  }
+  storeSession(null);
+};
@@ -25,7 +25,8 @@ export const fetchDevices = async (retryCount = 0): Promise<Camera[]> => {
           status: stream.status ? 'active' : 'inactive',
           audioEnabled: !stream.disable_audio,
           ptzSupported: false,
-          health: Math.floor(Math.random() * 100),
+          health: stream.health?.score ?? 0,
+          healthDetails: stream.health,
           onDemand: stream.on_demand,
           disableAudio: stream.disable_audio,
           debug: stream.debug,
@@ -82,7 +83,7 @@ export const addDevice = async (device: { name: string; url: string; on_demand?:
       status: newStream.status ? 'active' : 'inactive',
       audioEnabled: !newStream.disable_audio,
       ptzSupported: false,
-      health: 100,
+      health: 0,
       onDemand: newStream.on_demand,
       disableAudio: newStream.disable_audio,
       debug: newStream.debug,
@@ -133,7 +134,8 @@ export const updateDevice = async (id: string, updates: Partial<Camera> & { on_d
       status: updatedStream.status ? 'active' : 'inactive',
       audioEnabled: !updatedStream.disable_audio,
       ptzSupported: updates.ptzSupported ?? false,
-      health: updates.health ?? Math.floor(Math.random() * 100),
+      health: updates.health ?? 0,
+      healthDetails: updates.healthDetails,
       onDemand: updatedStream.on_demand,
       disableAudio: updatedStream.disable_audio,
       debug: updatedStream.debug,
@@ -149,6 +151,20 @@ export const updateDevice = async (id: string, updates: Partial<Camera> & { on_d
   }
 };
 
+// retryDevice reconnects a stream now, resuming it when it was suspended
+export const retryDevice = async (id: string): Promise<void> => {
+  try {
+    await axios.post(`${API_BASE_URL}/stream/${encodeURIComponent(id)}/retry`, null, {
+      headers: {
+        'ngrok-skip-browser-warning': 'true',
+      },
+    });
+  } catch (error: any) {
+    console.error('Failed to retry stream:', error);
+    throw new Error(error.response?.data?.error || 'Failed to retry stream');
+  }
+};
+
 export const sendAIPrompt = async (prompt: string): Promise<void> => {
   console.log('Sending AI Prompt:', prompt);
   // Implement AI prompt API call if needed
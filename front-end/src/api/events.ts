@@ -1,69 +1,69 @@
-import { EventLog } from '../types';
+import axios from 'axios';
+import { AlertPriority, EventLog } from '../types';
 
-// Mock data for event logs
-const mockEventLogs: EventLog[] = [
-  {
-    id: '1',
-    eventType: 'screenshot',
-    eventName: 'Movement Detected',
-    timestamp: '2024-03-20T10:30:45.123Z',
-    description: 'Motion detected in camera 1',
-    mediaUrl: 'https://example.com/screenshots/camera1_20240320103045.jpg',
-    priority: 'medium'
-  },
-  {
-    id: '2',
-    eventType: 'recording',
-    eventName: 'Suspicious Activity',
-    timestamp: '2024-03-20T10:25:30.456Z',
-    description: 'Suspicious movement near entrance',
-    mediaUrl: 'https://example.com/recordings/camera2_20240320102530.mp4',
-    priority: 'medium'
-  },
-  {
-    id: '3',
-    eventType: 'screenshot',
-    eventName: 'Line Breach',
-    timestamp: '2024-03-20T10:15:20.789Z',
-    description: 'Perimeter breach detected',
-    mediaUrl: 'https://example.com/screenshots/camera3_20240320101520.jpg',
-    priority: 'high'
-  },
-];
+const API_BASE_URL = 'http://localhost:8083/api';
 
-// Simulate API delay
-const delay = (ms: number) => new Promise(resolve => setTimeout(resolve, ms));
+interface ApiEvent {
+  id: string;
+  stream?: string;
+  type: string;
+  name: string;
+  priority: AlertPriority;
+  time: string;
+  description: string;
+  media_url?: string;
+  source: 'server' | 'user';
+}
 
-export const fetchEventLogs = async (): Promise<EventLog[]> => {
-  await delay(500); // Simulate network delay
-  return mockEventLogs;
+export interface EventQuery {
+  stream?: string;
+  type?: string;
+  priority?: AlertPriority;
+  from?: string;
+  to?: string;
+  limit?: number;
+  offset?: number;
+}
+
+const toEventLog = (event: ApiEvent): EventLog => ({
+  id: event.id,
+  eventType: event.type,
+  eventName: event.name,
+  timestamp: event.time,
+  description: event.description,
+  mediaUrl: event.media_url || '',
+  priority: event.priority,
+  cameraId: event.stream,
+  source: event.source,
+});
+
+const toApiEvent = (event: Partial<EventLog>) => ({
+  stream: event.cameraId,
+  type: event.eventType,
+  name: event.eventName,
+  priority: event.priority,
+  description: event.description,
+  media_url: event.mediaUrl,
+});
+
+export const fetchEventLogs = async (query: EventQuery = {}): Promise<EventLog[]> => {
+  const response = await axios.get(`${API_BASE_URL}/events`, { params: query });
+  return (response.data.events || []).map(toEventLog);
 };
 
 export const addEventLog = async (event: Omit<EventLog, 'id'>): Promise<EventLog> => {
-  await delay(500);
-  const newEvent = {
-    ...event,
-    id: Date.now().toString(),
-  };
-  mockEventLogs.unshift(newEvent);
-  return newEvent;
+  const response = await axios.post(`${API_BASE_URL}/events`, toApiEvent(event));
+  return toEventLog(response.data);
 };
 
+// updateEventLog replaces the editable fields, unset ones keep their value
 export const updateEventLog = async (id: string, updates: Partial<EventLog>): Promise<EventLog> => {
-  await delay(500);
-  const index = mockEventLogs.findIndex(event => event.id === id);
-  if (index === -1) {
-    throw new Error('Event not found');
-  }
-  mockEventLogs[index] = { ...mockEventLogs[index], ...updates };
-  return mockEventLogs[index];
+  const current = await axios.get(`${API_BASE_URL}/events/${encodeURIComponent(id)}`);
+  const merged = { ...toEventLog(current.data), ...updates };
+  const response = await axios.put(`${API_BASE_URL}/events/${encodeURIComponent(id)}`, toApiEvent(merged));
+  return toEventLog(response.data);
 };
 
 export const deleteEventLog = async (id: string): Promise<void> => {
-  await delay(500);
-  const index = mockEventLogs.findIndex(event => event.id === id);
-  if (index === -1) {
-    throw new Error('Event not found');
-  }
-  mockEventLogs.splice(index, 1);
-}; 
\ No newline at end of file
+  await axios.delete(`${API_BASE_URL}/events/${encodeURIComponent(id)}`);
+};
@@ -0,0 +1,50 @@
+import { getToken } from './auth';
+
+const API_BASE_URL = 'http://localhost:8083/api';
+
+export type PushType = 'stream.status' | 'stream.viewers' | 'alert' | 'alert.update' | 'event' | 'viewer.substream';
+
+export interface PushMessage<T = any> {
+  type: PushType;
+  stream?: string;
+  time: string;
+  data: T;
+}
+
+export interface StreamStatusData {
+  status: boolean;
+  running: boolean;
+}
+
+export interface StreamViewersData {
+  viewers: number;
+}
+
+// ViewerSubstreamData tells the viewer session that fell behind on the
+// stream to reconnect to the substream
+export interface ViewerSubstreamData {
+  viewer: string;
+  substream: string;
+}
+
+const pushTypes: PushType[] = ['stream.status', 'stream.viewers', 'alert', 'alert.update', 'event', 'viewer.substream'];
+
+// subscribePush opens the server-sent event channel and returns a function
+// closing it. EventSource cannot send headers, so the token goes in the URL;
+// the browser reconnects on its own when the connection drops.
+export const subscribePush = (onMessage: (message: PushMessage) => void): (() => void) => {
+  const token = getToken();
+  if (!token) {
+    return () => {};
+  }
+  const source = new EventSource(`${API_BASE_URL}/push?token=${encodeURIComponent(token)}`);
+  const listener = (event: MessageEvent) => {
+    try {
+      onMessage(JSON.parse(event.data));
+    } catch (error) {
+      console.error('Invalid push message:', error);
+    }
+  };
+  pushTypes.forEach((type) => source.addEventListener(type, listener as EventListener));
+  return () => source.close();
+};
@@ -1,112 +1,74 @@
+import axios from 'axios';
 import { Ticket } from '../types';
 
-// Mock data
-let mockTickets: Ticket[] = [
-  {
-    id: '1',
-    eventId: 'evt1',
-    eventName: 'Suspicious Activity',
-    eventType: 'recording',
-    mediaUrl: 'recording1.mp4',
-    timestamp: '2024-03-20T10:30:00Z',
-    assignedTo: 'John Doe',
-    status: 'open'
-  },
-  {
-    id: '2',
-    eventId: 'evt2',
-    eventName: 'Motion Detected',
-    eventType: 'screenshot',
-    mediaUrl: 'screenshot1.jpg',
-    timestamp: '2024-03-20T09:15:00Z',
-    assignedTo: 'Jane Smith',
-    status: 'closed'
-  }
-];
+const API_BASE_URL = 'http://localhost:8083/api';
 
-let mockInboxTickets: Ticket[] = [
-  {
-    id: '3',
-    eventId: 'evt3',
-    eventName: 'Line Breach',
-    eventType: 'recording',
-    mediaUrl: 'recording2.mp4',
-    timestamp: '2024-03-20T11:45:00Z',
-    assignedFrom: 'Admin',
-    status: 'open'
-  }
-];
+interface ApiTicket {
+  id: string;
+  event_id?: string;
+  alert_id?: string;
+  stream?: string;
+  name: string;
+  type: string;
+  description?: string;
+  media_url?: string;
+  time: string;
+  assigned_to: string;
+  assigned_from: string;
+  status: 'open' | 'closed';
+}
 
-// Get all tickets (including both assigned and inbox)
-export const getTickets = async (): Promise<Ticket[]> => {
-  await new Promise(resolve => setTimeout(resolve, 500));
-  return [...mockTickets];
-};
+const toTicket = (ticket: ApiTicket): Ticket => ({
+  id: ticket.id,
+  eventId: ticket.event_id || ticket.alert_id || '',
+  eventName: ticket.name,
+  eventType: ticket.type,
+  mediaUrl: ticket.media_url || '',
+  timestamp: ticket.time,
+  assignedTo: ticket.assigned_to,
+  assignedFrom: ticket.assigned_from,
+  status: ticket.status,
+});
 
-// Get only inbox tickets (assigned to current user)
-export const getInboxTickets = async (): Promise<Ticket[]> => {
-  await new Promise(resolve => setTimeout(resolve, 500));
-  return [...mockInboxTickets];
+const fetchTickets = async (view: 'inbox' | 'sent' | 'all'): Promise<Ticket[]> => {
+  const response = await axios.get(`${API_BASE_URL}/tickets`, { params: { view } });
+  return (response.data.tickets || []).map(toTicket);
 };
 
-// Create a new ticket
-export const createTicket = async (ticketData: Omit<Ticket, 'id' | 'status'>): Promise<Ticket> => {
-  await new Promise(resolve => setTimeout(resolve, 500));
-  
-  const newTicket: Ticket = {
-    id: `ticket-${Date.now()}`,
-    ...ticketData,
-    status: 'open'
-  };
+// Tickets the current user assigned to others
+export const getTickets = async (): Promise<Ticket[]> => fetchTickets('sent');
+
+// Tickets assigned to the current user
+export const getInboxTickets = async (): Promise<Ticket[]> => fetchTickets('inbox');
 
-  // Add to main tickets if assignedTo is specified
-  if (ticketData.assignedTo) {
-    mockTickets.push(newTicket);
-    
-    // Also create an inbox ticket for the assigned user
-    const inboxTicket: Ticket = {
-      ...newTicket,
-      id: `ticket-inbox-${Date.now()}`,
-      assignedFrom: 'System', // Or could be the current user's name
-      assignedTo: undefined // Clear assignedTo for inbox ticket
-    };
-    mockInboxTickets.push(inboxTicket);
-  }
-  
-  return newTicket;
+// createTicket opens a ticket for an event, the server fills in the event
+// details and the current user as assignedFrom
+export const createTicket = async (ticketData: Omit<Ticket, 'id' | 'status'>): Promise<Ticket> => {
+  const response = await axios.post(`${API_BASE_URL}/tickets`, {
+    event_id: ticketData.eventId,
+    name: ticketData.eventName,
+    type: ticketData.eventType,
+    media_url: ticketData.mediaUrl,
+    assigned_to: ticketData.assignedTo,
+  });
+  return toTicket(response.data);
 };
 
-// Update ticket status
 export const updateTicketStatus = async (ticketId: string, status: 'open' | 'closed'): Promise<Ticket> => {
-  await new Promise(resolve => setTimeout(resolve, 500));
-  
-  // Check inbox tickets first
-  let ticket = mockInboxTickets.find(t => t.id === ticketId);
-  if (ticket) {
-    ticket.status = status;
-    if (status === 'closed') {
-      // Move from inbox to main tickets when closed
-      mockTickets.push({ ...ticket });
-      mockInboxTickets = mockInboxTickets.filter(t => t.id !== ticketId);
-    }
-    return ticket;
-  }
-  
-  // Check main tickets
-  ticket = mockTickets.find(t => t.id === ticketId);
-  if (!ticket) {
-    throw new Error('Ticket not found');
-  }
-  
-  ticket.status = status;
-  return ticket;
+  const response = await axios.put(`${API_BASE_URL}/tickets/${ticketId}`, { status });
+  return toTicket(response.data);
 };
 
-// Delete a ticket
 export const deleteTicket = async (ticketId: string): Promise<void> => {
-  await new Promise(resolve => setTimeout(resolve, 500));
-  
-  // Try to delete from both arrays
-  mockTickets = mockTickets.filter(t => t.id !== ticketId);
-  mockInboxTickets = mockInboxTickets.filter(t => t.id !== ticketId);
-}; 
\ No newline at end of file
+  await axios.delete(`${API_BASE_URL}/tickets/${ticketId}`);
+};
+
+export const attachSnapshot = async (ticketId: string, stream?: string): Promise<Ticket> => {
+  const response = await axios.post(`${API_BASE_URL}/tickets/${ticketId}/attachments`, { kind: 'snapshot', stream });
+  return toTicket(response.data);
+};
+
+export const attachExport = async (ticketId: string, exportId: string): Promise<Ticket> => {
+  const response = await axios.post(`${API_BASE_URL}/tickets/${ticketId}/attachments`, { kind: 'export', export_id: exportId });
+  return toTicket(response.data);
+};
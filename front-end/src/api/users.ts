@@ -0,0 +1,72 @@
+import axios from 'axios';
+
+const API_BASE_URL = 'http://localhost:8083/api';
+
+export interface ApiUser {
+  username: string;
+  name: string;
+  email: string;
+  role: string;
+  streams: string[];
+  disabled: boolean;
+  created: string;
+}
+
+const errorMessage = (error: unknown, fallback: string): string => {
+  if (axios.isAxiosError(error)) {
+    return error.response?.data?.error || fallback;
+  }
+  return fallback;
+};
+
+export const fetchUsers = async (): Promise<ApiUser[]> => {
+  try {
+    const response = await axios.get(`${API_BASE_URL}/users`);
+    return response.data.users || [];
+  } catch (error: unknown) {
+    console.error('Failed to fetch users:', error);
+    throw new Error(errorMessage(error, 'Failed to fetch users'));
+  }
+};
+
+// createUser posts the CreateUserModal form, the email becomes the username
+export const createUser = async (user: {
+  name: string;
+  email: string;
+  role: string;
+  password: string;
+  streams?: string[];
+}): Promise<ApiUser> => {
+  try {
+    const response = await axios.post(`${API_BASE_URL}/users`, {
+      ...user,
+      streams: user.streams ?? ['*'],
+    });
+    return response.data;
+  } catch (error: unknown) {
+    console.error('Failed to create user:', error);
+    throw new Error(errorMessage(error, 'Failed to create user'));
+  }
+};
+
+export const updateUser = async (
+  username: string,
+  user: Omit<ApiUser, 'username' | 'created'> & { password?: string }
+): Promise<ApiUser> => {
+  try {
+    const response = await axios.put(`${API_BASE_URL}/users/${encodeURIComponent(username)}`, user);
+    return response.data;
+  } catch (error: unknown) {
+    console.error('Failed to update user:', error);
+    throw new Error(errorMessage(error, 'Failed to update user'));
+  }
+};
+
+export const deleteUser = async (username: string): Promise<void> => {
+  try {
+    await axios.delete(`${API_BASE_URL}/users/${encodeURIComponent(username)}`);
+  } catch (error: unknown) {
+    console.error('Failed to delete user:', error);
+    throw new Error(errorMessage(error, 'Failed to delete user'));
+  }
+};
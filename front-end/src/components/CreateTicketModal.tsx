@@ -105,7 +105,7 @@ const CreateTicketModal: React.FC<CreateTicketModalProps> = ({
                 type="text"
                 value={assignedTo}
                 onChange={(e) => setAssignedTo(e.target.value)}
-                placeholder="Enter assignee name"
+                placeholder="Enter assignee username"
                 required
                 className="w-full px-3 py-2 bg-gray-700 text-gray-300 rounded-md border border-gray-600 focus:outline-none focus:ring-2 focus:ring-blue-500"
               />
@@ -1,5 +1,6 @@
 import React, { useState, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
+import { logout } from '../api/auth';
 
 // Font Awesome imports
 import { FontAwesomeIcon } from '@fortawesome/react-fontawesome';
@@ -37,7 +38,8 @@ const Navbar: React.FC<NavbarProps> = ({ setAuthenticated }) => {
     return () => clearInterval(interval); // Cleanup on unmount
   }, []);
 
-  const handleLogout = () => {
+  const handleLogout = async () => {
+    await logout();
     setAuthenticated(false);
     navigate('/login');
   };
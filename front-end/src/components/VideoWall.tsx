@@ -6,6 +6,7 @@ import { FontAwesomeIcon } from '@fortawesome/react-fontawesome';
 import { faTimes, faVolumeUp, faVolumeMute, faArrowsAlt, faCircle, faCamera, faVideo, faExpand, faCompress } from '@fortawesome/free-solid-svg-icons';
 import ConfirmationDialog from './ConfirmationDialog';
 import axios, { AxiosError } from 'axios';
+import { subscribePush, ViewerSubstreamData } from '../api/push';
 
 interface Codec {
   Type: string; // 'video' or 'audio'
@@ -36,6 +37,8 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
   const videoRefs = useRef<{ [key: string]: HTMLVideoElement | null }>({});
   const peerConnections = useRef<{ [key: string]: RTCPeerConnection }>({});
   const processedStreams = useRef<Set<string>>(new Set());
+  // Viewer session of each camera, the server names it when dropping a slow viewer
+  const viewerIds = useRef<{ [key: string]: string }>({});
   const [showCameraSelect, setShowCameraSelect] = useState<number | null>(null);
   const [showScreenshotConfirm, setShowScreenshotConfirm] = useState(false);
   const [showRecordingConfirm, setShowRecordingConfirm] = useState(false);
@@ -200,6 +203,7 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
       delete peerConnections.current[cameraId];
     }
     processedStreams.current.delete(cameraId);
+    delete viewerIds.current[cameraId];
     
     const videoElement = videoRefs.current[cameraId];
     if (videoElement && videoElement.srcObject) {
@@ -220,8 +224,9 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
     };
   }, []);
 
-  // Modify setupWebRTC to include cleanup before setting up new connection
-  const setupWebRTC = async (camera: Camera) => {
+  // Modify setupWebRTC to include cleanup before setting up new connection.
+  // streamId differs from the camera when it plays the substream.
+  const setupWebRTC = async (camera: Camera, streamId: string = camera.id) => {
     if (camera.status !== 'active') {
       console.log(`Skipping WebRTC setup for camera ${camera.id} - status: ${camera.status}`);
       return;
@@ -238,14 +243,14 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
     processedStreams.current.add(camera.id);
 
     try {
-      const streamInfo = await fetchStreamInfo(camera.id);
+      const streamInfo = await fetchStreamInfo(streamId);
       if (!streamInfo || !streamInfo.url) {
-        console.error(`No stream info found for ${camera.id}`);
+        console.error(`No stream info found for ${streamId}`);
         cleanupWebRTCConnection(camera.id);
         return;
       }
 
-      const codecs = await fetchCodecs(camera.id);
+      const codecs = await fetchCodecs(streamId);
       if (codecs.length === 0) {
         console.error(`No codecs found for camera ${camera.id} after retries - stream may be down or restarting`);
         cleanupWebRTCConnection(camera.id);
@@ -332,6 +337,9 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
         cleanupWebRTCConnection(camera.id);
         return;
       }
+      if (response.data.viewer) {
+        viewerIds.current[camera.id] = response.data.viewer;
+      }
       const decodedSDPAnswer = atob(response.data.sdp64);
       await pc.setRemoteDescription(new RTCSessionDescription({ type: 'answer', sdp: decodedSDPAnswer }));
       
@@ -342,6 +350,23 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
     }
   };
 
+  // Re-negotiate on the substream when the server drops a viewer that fell behind
+  useEffect(() => {
+    return subscribePush((message) => {
+      if (message.type !== 'viewer.substream') {
+        return;
+      }
+      const { viewer, substream } = message.data as ViewerSubstreamData;
+      const camera = selectedCameras.find(cam => viewerIds.current[cam.id] === viewer);
+      if (!camera) {
+        return;
+      }
+      console.log(`Camera ${camera.id} fell behind, switching to substream ${substream}`);
+      cleanupWebRTCConnection(camera.id);
+      setupWebRTC(camera, substream);
+    });
+  }, [selectedCameras]);
+
   // Add useEffect for handling camera changes
   useEffect(() => {
     selectedCameras.forEach(camera => {
@@ -475,7 +500,7 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
           ...selectedCamera,
           gridPosition: slotIndex,
           audioEnabled: selectedCamera.audioEnabled ?? false,
-          health: selectedCamera.health ?? Math.floor(Math.random() * 100),
+          health: selectedCamera.health ?? 0,
         });
       }
       return newCameras;
@@ -508,7 +533,7 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
       prevCameras.map((camera) => ({
         ...camera,
         audioEnabled: camera.audioEnabled ?? false,
-        health: camera.health ?? Math.floor(Math.random() * 100),
+        health: camera.health ?? 0,
       }))
     );
   }, []);
@@ -527,6 +552,21 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
     return 'bg-red-500';
   };
 
+  const getHealthTitle = (camera: Camera) => {
+    const details = camera.healthDetails;
+    if (!details) return 'No health data';
+    const lines = [
+      `Uptime: ${Math.round(details.uptime_seconds)}s`,
+      `Bitrate: ${(details.bitrate / 1000).toFixed(0)} kbit/s`,
+      `Packets: ${details.packet_rate.toFixed(1)}/s`,
+      `Keyframe interval: ${details.keyframe_interval_seconds.toFixed(1)}s`,
+      `Reconnects: ${details.reconnects}`,
+    ];
+    if (details.suspended) lines.push('Suspended, retry to reconnect');
+    if (details.last_error) lines.push(`Last error: ${details.last_error}`);
+    return lines.join('\n');
+  };
+
   const toggleFullscreen = (cameraId: string) => {
     const videoElement = videoRefs.current[cameraId];
     if (!videoElement) return;
@@ -628,7 +668,7 @@ const VideoWall: React.FC<VideoWallProps> = ({ allCameras, selectedCameras, setS
                       {camera.name || `Camera ${camera.id}`}
                     </p>
                     <div className="absolute bottom-0 left-0 right-0 flex items-center justify-between bg-black bg-opacity-50 px-2 py-1">
-                      <div className="flex items-end space-x-1 w-12 h-4">
+                      <div className="flex items-end space-x-1 w-12 h-4" title={getHealthTitle(camera)}>
                         {[1, 2, 3, 4].map((bar) => {
                           const filledBars = getFilledBars(camera.health ?? 0);
                           const isFilled = bar <= filledBars;
@@ -4,6 +4,7 @@ import { FontAwesomeIcon } from '@fortawesome/react-fontawesome';
 import { faSync, faPlus, faTrash, faEdit, faVolumeUp, faVolumeMute, faVideo, faCheckCircle } from '@fortawesome/free-solid-svg-icons';
 import { Camera } from '../types';
 import { fetchDevices, addDevice, removeDevice, updateDevice } from '../api/devices';
+import { subscribePush, StreamStatusData } from '../api/push';
 
 const DeviceManager: React.FC = () => {
   const [devices, setDevices] = useState<Camera[]>([]);
@@ -44,6 +45,19 @@ const DeviceManager: React.FC = () => {
     loadDevices();
   }, []);
 
+  // Stream status changes are pushed by the server instead of polled
+  useEffect(() => {
+    return subscribePush((message) => {
+      if (message.type !== 'stream.status' || !message.stream) {
+        return;
+      }
+      const { status } = message.data as StreamStatusData;
+      setDevices((current) => current.map((device) =>
+        device.id === message.stream ? { ...device, status: status ? 'active' : 'inactive' } : device
+      ));
+    });
+  }, []);
+
   const handleAddDevice = async (e: React.FormEvent) => {
     e.preventDefault();
     try {
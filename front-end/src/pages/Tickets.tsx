@@ -1,7 +1,7 @@
 import React, { useState, useEffect } from 'react';
 import { FontAwesomeIcon } from '@fortawesome/react-fontawesome';
 import { faTrash, faTimes, faPlay } from '@fortawesome/free-solid-svg-icons';
-import { getTickets, getInboxTickets, updateTicketStatus } from '../api/tickets';
+import { getTickets, getInboxTickets, updateTicketStatus, deleteTicket } from '../api/tickets';
 import { Ticket } from '../types';
 
 const Tickets: React.FC = () => {
@@ -36,7 +36,7 @@ const Tickets: React.FC = () => {
 
   const handleDeleteTicket = async (ticketId: string, isInbox: boolean) => {
     try {
-      // For now, we'll just update the UI since delete API isn't implemented
+      await deleteTicket(ticketId);
       if (isInbox) {
         setInboxTickets(inboxTickets.filter(ticket => ticket.id !== ticketId));
       } else {
@@ -1,5 +1,6 @@
-import React, { useState } from 'react';
+import React, { useEffect, useState } from 'react';
 import CreateUserModal from '../components/CreateUserModal';
+import { ApiUser, createUser, deleteUser, fetchUsers } from '../api/users';
 import { FontAwesomeIcon } from '@fortawesome/react-fontawesome';
 import { faEdit, faTrash, faPlus } from '@fortawesome/free-solid-svg-icons';
 
@@ -13,21 +14,48 @@ interface User {
 
 const UserAccessManagement: React.FC = () => {
   const [isModalOpen, setIsModalOpen] = useState(false);
-  const [users, setUsers] = useState<User[]>([
-    { id: '1', name: 'John Doe', email: 'john@example.com', role: 'Admin', status: 'active' },
-    { id: '2', name: 'Jane Smith', email: 'jane@example.com', role: 'Operator', status: 'active' },
-    { id: '3', name: 'Bob Johnson', email: 'bob@example.com', role: 'Viewer', status: 'inactive' },
-  ]);
+  const [users, setUsers] = useState<User[]>([]);
+  const [error, setError] = useState<string>('');
 
-  const handleAddUser = (userData: { name: string; email: string; role: string; password: string }) => {
-    const newUser: User = {
-      id: (users.length + 1).toString(),
-      name: userData.name,
-      email: userData.email,
-      role: userData.role,
-      status: 'active',
-    };
-    setUsers([...users, newUser]);
+  const toUser = (user: ApiUser): User => ({
+    id: user.username,
+    name: user.name || user.username,
+    email: user.email,
+    role: user.role.charAt(0).toUpperCase() + user.role.slice(1),
+    status: user.disabled ? 'inactive' : 'active',
+  });
+
+  const loadUsers = async () => {
+    try {
+      setUsers((await fetchUsers()).map(toUser));
+      setError('');
+    } catch (err) {
+      setError((err as Error).message);
+    }
+  };
+
+  useEffect(() => {
+    loadUsers();
+  }, []);
+
+  const handleAddUser = async (userData: { name: string; email: string; role: string; password: string }) => {
+    try {
+      const created = await createUser(userData);
+      setUsers([...users, toUser(created)]);
+      setError('');
+    } catch (err) {
+      setError((err as Error).message);
+    }
+  };
+
+  const handleDeleteUser = async (id: string) => {
+    try {
+      await deleteUser(id);
+      setUsers(users.filter((user) => user.id !== id));
+      setError('');
+    } catch (err) {
+      setError((err as Error).message);
+    }
   };
 
   return (
@@ -43,6 +71,8 @@ const UserAccessManagement: React.FC = () => {
         </button>
       </div>
 
+      {error && <p className="text-red-500 text-sm mb-4">{error}</p>}
+
       <div className="bg-gray-800 rounded-lg shadow-lg overflow-hidden">
         <div className="overflow-x-auto">
           <table className="w-full">
@@ -94,6 +124,7 @@ const UserAccessManagement: React.FC = () => {
                         <FontAwesomeIcon icon={faEdit} />
                       </button>
                       <button 
+                        onClick={() => handleDeleteUser(user.id)}
                         className="text-red-400 hover:text-red-300 transition-colors duration-200"
                         title="Delete User"
                       >
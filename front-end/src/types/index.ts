@@ -8,12 +8,29 @@ export interface Camera {
   audioEnabled: boolean;
   ptzSupported: boolean;
   health?: number;
+  healthDetails?: StreamHealth;
   gridPosition?: number;
   onDemand?: boolean;
   disableAudio?: boolean;
   debug?: boolean;
 }
 
+// StreamHealth is the per-stream health reported by /api/streams
+export interface StreamHealth {
+  score: number;
+  last_error?: string;
+  last_error_time?: string;
+  last_connect?: string;
+  uptime_seconds: number;
+  reconnects: number;
+  packet_rate: number;
+  bitrate: number;
+  keyframe_interval_seconds: number;
+  failures: number;
+  suspended: boolean;
+  next_retry?: string;
+}
+
 export type AlertPriority = 'high' | 'medium' | 'low';
 
 export interface Alert {
@@ -25,4 +42,27 @@ export interface Alert {
   cameraId?: string;
   cameraName?: string;
   isResolved?: boolean;
-}
\ No newline at end of file
+}
+export interface EventLog {
+  id: string;
+  eventType: string;
+  eventName: string;
+  timestamp: string;
+  description: string;
+  mediaUrl: string;
+  priority: AlertPriority;
+  cameraId?: string;
+  source?: 'server' | 'user';
+}
+
+export interface Ticket {
+  id: string;
+  eventId: string;
+  eventName: string;
+  eventType: string;
+  mediaUrl: string;
+  timestamp: string;
+  assignedTo?: string;
+  assignedFrom?: string;
+  status: 'open' | 'closed';
+}